@@ -0,0 +1,98 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// bench 在当前设备上运行本库的基准测试 (转发路径、加密方式、FEC 分片组合、统计序列化) 并输出结果，
+// 用于发现性能回退和比较不同设备。交叉编译后可以直接在手机上运行:
+//
+//	go run -tags bench ./bench
+//	go run -tags bench ./bench -run crypt/
+//	GOOS=android GOARCH=arm64 go build -tags bench -o bench-arm64 ./bench && adb push bench-arm64 /data/local/tmp/
+//
+// -json 输出 RunBenchmarks 返回的原始 JSON，便于保存后对比
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"mobilekcp"
+)
+
+// benchReport 与 RunBenchmarks 返回的 JSON 对应
+type benchReport struct {
+	Version string `json:"version"`
+	Error   string `json:"error"`
+	GOOS    string `json:"goos"`
+	GOARCH  string `json:"goarch"`
+	CPUs    int    `json:"cpus"`
+	Results []struct {
+		Name   string  `json:"name"`
+		N      int     `json:"n"`
+		NsOp   int64   `json:"nsop"`
+		MBps   float64 `json:"mbps"`
+		Allocs int64   `json:"allocs"`
+		Bytes  int64   `json:"bytesop"`
+		Error  string  `json:"error"`
+	} `json:"results"`
+}
+
+func main() {
+	filter := flag.String("run", "", "only run benchmarks whose name contains this string")
+	raw := flag.Bool("json", false, "print raw JSON")
+	flag.Parse()
+
+	// 引擎日志只在失败时有用，避免与表格混在一起
+	log.SetOutput(io.Discard)
+	out := mobilekcp.RunBenchmarks(*filter)
+	if *raw {
+		fmt.Println(out)
+		return
+	}
+
+	var report benchReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if report.Error != "" {
+		fmt.Fprintln(os.Stderr, report.Error)
+		os.Exit(1)
+	}
+	fmt.Printf("%s %s/%s, %d CPUs\n\n", report.Version, report.GOOS, report.GOARCH, report.CPUs)
+	fmt.Printf("%-16s %12s %12s %10s %10s %10s\n", "name", "n", "ns/op", "MB/s", "allocs/op", "B/op")
+	failed := false
+	for _, r := range report.Results {
+		if r.Error != "" {
+			fmt.Printf("%-16s %s\n", r.Name, r.Error)
+			failed = true
+			continue
+		}
+		fmt.Printf("%-16s %12d %12d %10.1f %10d %10d\n", r.Name, r.N, r.NsOp, r.MBps, r.Allocs, r.Bytes)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -22,39 +22,47 @@
 
 package mobilekcp
 
-// Config 客户端配置
-// 通过 JSON 传入，支持与 kcptun 服务端匹配的配置
-type Config struct {
-	// 必填参数
-	LocalAddr  string `json:"localaddr"`  // 本地监听地址 (如 "127.0.0.1:1080")
-	RemoteAddr string `json:"remoteaddr"` // 远程服务器地址 (如 "1.2.3.4:4000")
-
-	// 模式参数
-	Mode string `json:"mode"` // 模式: fast3, fast2, fast, normal (默认 fast)
-
-	// 连接参数
-	Conn int `json:"conn"` // UDP 连接数量 (默认 1)
-
-	// KCP 参数
-	MTU         int  `json:"mtu"`         // MTU 大小 (默认 1350)
-	SndWnd      int  `json:"sndwnd"`      // 发送窗口大小 (默认 128)
-	RcvWnd      int  `json:"rcvwnd"`      // 接收窗口大小 (默认 512)
-	DataShard   int  `json:"datashard"`   // FEC 数据分片 (默认 10)
-	ParityShard int  `json:"parityshard"` // FEC 校验分片 (默认 3)
-	AckNodelay  bool `json:"acknodelay"`  // ACK 无延迟 (默认 false)
-	SockBuf     int  `json:"sockbuf"`     // Socket 缓冲区 (默认 4194304)
-
-	// SMUX 参数
-	SmuxVer   int `json:"smuxver"`   // SMUX 版本 1 或 2 (默认 1)
-	SmuxBuf   int `json:"smuxbuf"`   // SMUX 缓冲区 (默认 4194304)
-	FrameSize int `json:"framesize"` // 帧大小 (默认 4096)
-	StreamBuf int `json:"streambuf"` // 流缓冲区 (默认 2097152)
-	KeepAlive int `json:"keepalive"` // 心跳间隔秒数 (默认 10)
-
-	// 内部参数 (由 Mode 决定)
-	NoDelay      int  `json:"-"`
-	Interval     int  `json:"-"`
-	Resend       int  `json:"-"`
-	NoCongestion int  `json:"-"`
-	NoComp       bool `json:"-"` // 始终为 true，不支持压缩
+import "mobilekcp/internal/engine"
+
+// 配置校验和分享链接接口，不涉及网络，网页端 (js/wasm) 也会编译
+
+// VERSION is injected by buildflags
+var VERSION = "MOBILE-1.0"
+
+func init() {
+	engine.VERSION = VERSION
+}
+
+// GetAPIVersion 返回库支持的 JSON API 版本
+func GetAPIVersion() int {
+	return engine.GetAPIVersion()
+}
+
+// GetVersion 返回版本号
+func GetVersion() string {
+	return engine.GetVersion()
+}
+
+// ExportConfigURI 将配置编码为 kcp:// 分享链接 (配置需通过校验)
+// 返回 JSON: {"uri": "...", "error": "..."}
+func ExportConfigURI(configJson string) string {
+	return engine.ExportConfigURI(configJson)
+}
+
+// ImportConfigURI 解析 kcp:// 分享链接并校验，返回配置 JSON
+// 返回 JSON: {"config": {...}, "error": "..."}
+func ImportConfigURI(uri string) string {
+	return engine.ImportConfigURI(uri)
+}
+
+// ValidateConfigJSON 校验配置但不启动代理
+// 返回 JSON: {"ok": bool, "error": "...", "warnings": ["unknown field: xxx", ...]}
+func ValidateConfigJSON(configJson string) string {
+	return engine.ValidateConfigJSON(configJson)
+}
+
+// MatchRule 用配置中的规则匹配 host (不需要启动代理，GeoIP 规则仅在代理运行时生效)
+// 返回 JSON: {"action": "...", "index": 命中的规则序号 (-1 表示使用默认动作), "error": "..."}
+func MatchRule(configJson string, host string) string {
+	return engine.MatchRule(configJson, host)
 }
@@ -0,0 +1,134 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package mobilekcp
+
+import (
+	"encoding/json"
+	"sync"
+
+	"mobilekcp/internal/engine"
+)
+
+// 类型化接口: gomobile 为导出结构体的基本类型字段生成 getter/setter，
+// 常用场景无需在 App 侧拼装和解析 JSON。gomobile 不支持无符号整数，计数统一为 int64
+
+// Stats 统计快照的常用字段 (完整统计见 GetStats)
+type Stats struct {
+	APIVersion  int    `json:"apiversion"`
+	Instance    string `json:"instance"` // 实例标签
+	Running     bool   `json:"running"`
+	Hibernating bool   `json:"hibernating"`
+	KillSwitch  bool   `json:"killswitch"`  // 断网保护是否生效
+	Uptime      int64  `json:"uptime"`      // 运行秒数
+	Sessions    int    `json:"sessions"`    // 会话池大小
+	Alive       int    `json:"alive"`       // 存活会话数
+	ActiveConns int64  `json:"activeconns"` // 当前连接数
+	TotalConns  int64  `json:"totalconns"`  // 累计连接数
+	BytesUp     int64  `json:"bytesup"`     // 上行字节数
+	BytesDown   int64  `json:"bytesdown"`   // 下行字节数
+	Rejected    int64  `json:"rejected"`    // 来源过滤拒绝数
+	RuleRejects int64  `json:"rulerejects"` // reject 规则拦截数
+	Reconnects  int64  `json:"reconnects"`  // 累计重连次数
+	AvgRTT      int64  `json:"avgrtt"`      // 历史平均 RTT 毫秒
+	QueuedBytes int64  `json:"queuedbytes"` // 待写出字节总数
+	RetransSegs int64  `json:"retranssegs"`
+	LostSegs    int64  `json:"lostsegs"`
+
+	QualityScore int64 `json:"qualityscore"` // 连接质量评分 0~100 (-1 表示暂无)
+}
+
+// GetStatsObject 返回类型化的统计快照
+func GetStatsObject() *Stats {
+	var s Stats
+	json.Unmarshal([]byte(engine.GetStats()), &s)
+	return &s
+}
+
+// ConfigBuilder 以 setter 方式构建配置，setter 返回自身以便链式调用
+// 未提供 setter 的字段通过 SetRaw 设置
+type ConfigBuilder struct {
+	mu     sync.Mutex
+	fields map[string]interface{}
+}
+
+// NewConfigBuilder 创建配置构建器 (apiversion 为当前版本)
+func NewConfigBuilder() *ConfigBuilder {
+	return &ConfigBuilder{fields: map[string]interface{}{"apiversion": engine.GetAPIVersion()}}
+}
+
+func (b *ConfigBuilder) set(name string, value interface{}) *ConfigBuilder {
+	b.mu.Lock()
+	b.fields[name] = value
+	b.mu.Unlock()
+	return b
+}
+
+func (b *ConfigBuilder) SetLabel(label string) *ConfigBuilder     { return b.set("label", label) }
+func (b *ConfigBuilder) SetLocalAddr(addr string) *ConfigBuilder  { return b.set("localaddr", addr) }
+func (b *ConfigBuilder) SetRemoteAddr(addr string) *ConfigBuilder { return b.set("remoteaddr", addr) }
+func (b *ConfigBuilder) SetKey(key string) *ConfigBuilder         { return b.set("key", key) }
+func (b *ConfigBuilder) SetCrypt(crypt string) *ConfigBuilder     { return b.set("crypt", crypt) }
+func (b *ConfigBuilder) SetMode(mode string) *ConfigBuilder       { return b.set("mode", mode) }
+func (b *ConfigBuilder) SetConn(n int) *ConfigBuilder             { return b.set("conn", n) }
+func (b *ConfigBuilder) SetMTU(mtu int) *ConfigBuilder            { return b.set("mtu", mtu) }
+func (b *ConfigBuilder) SetSndWnd(wnd int) *ConfigBuilder         { return b.set("sndwnd", wnd) }
+func (b *ConfigBuilder) SetRcvWnd(wnd int) *ConfigBuilder         { return b.set("rcvwnd", wnd) }
+func (b *ConfigBuilder) SetDataShard(n int) *ConfigBuilder        { return b.set("datashard", n) }
+func (b *ConfigBuilder) SetParityShard(n int) *ConfigBuilder      { return b.set("parityshard", n) }
+func (b *ConfigBuilder) SetNoComp(noComp bool) *ConfigBuilder     { return b.set("nocomp", noComp) }
+func (b *ConfigBuilder) SetQPP(enable bool) *ConfigBuilder        { return b.set("qpp", enable) }
+func (b *ConfigBuilder) SetTransport(t string) *ConfigBuilder     { return b.set("transport", t) }
+func (b *ConfigBuilder) SetAllowLAN(allow bool) *ConfigBuilder    { return b.set("allowlan", allow) }
+func (b *ConfigBuilder) SetNetwork(handle int64) *ConfigBuilder   { return b.set("network", handle) }
+func (b *ConfigBuilder) SetDefaultAction(a string) *ConfigBuilder { return b.set("defaultaction", a) }
+
+// SetRaw 设置任意字段，valueJson 为该字段的 JSON 值 (如 "true"、"[...]")
+// valueJson 无法解析时返回错误信息，否则返回空字符串
+func (b *ConfigBuilder) SetRaw(name string, valueJson string) string {
+	var v json.RawMessage
+	if err := json.Unmarshal([]byte(valueJson), &v); err != nil {
+		return "Config Error: " + name + ": " + err.Error()
+	}
+	b.set(name, v)
+	return ""
+}
+
+// Build 返回配置 JSON，可用于 StartProxy/SelfCheck 等
+func (b *ConfigBuilder) Build() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out, _ := json.Marshal(b.fields)
+	return string(out)
+}
+
+// Validate 校验当前配置，返回值同 ValidateConfigJSON
+func (b *ConfigBuilder) Validate() string {
+	return ValidateConfigJSON(b.Build())
+}
+
+// Start 以当前配置启动代理，返回值同 StartProxy
+func (b *ConfigBuilder) Start() string {
+	return StartProxy(b.Build())
+}
@@ -0,0 +1,143 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// ffi 以 C ABI 导出引擎接口，供 Flutter (dart:ffi)、React Native (JSI) 等不使用 gomobile 的宿主调用
+//
+// 构建:
+//
+//	go build -buildmode=c-shared -o libmobilekcp.so ./ffi     (Android 需配合 NDK 的 CC)
+//	go build -buildmode=c-archive -o libmobilekcp.a ./ffi     (iOS 静态链接)
+//
+// 约定:
+//   - 返回 char* 的函数返回的字符串由调用方通过 mobilekcp_free 释放
+//   - 错误字符串为空表示成功，与 gomobile 接口一致
+//   - 回调在引擎内部线程上调用 (非调用方线程)，json 参数仅在回调期间有效；
+//     Dart 侧应使用 NativeCallable.listener
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+typedef void (*mobilekcp_callback)(const char *json, void *ctx);
+
+static inline void mobilekcp_invoke(mobilekcp_callback cb, const char *json, void *ctx) {
+	cb(json, ctx);
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"mobilekcp"
+)
+
+func main() {}
+
+// callback 保存 C 回调函数指针及其上下文
+type callback struct {
+	fn  C.mobilekcp_callback
+	ctx unsafe.Pointer
+}
+
+func (c *callback) invoke(s string) {
+	cs := C.CString(s)
+	defer C.free(unsafe.Pointer(cs))
+	C.mobilekcp_invoke(c.fn, cs, c.ctx)
+}
+
+// eventCallback 实现 mobilekcp.EventListener
+type eventCallback struct{ callback }
+
+func (c *eventCallback) OnEvent(eventJson string) { c.invoke(eventJson) }
+
+// statsCallback 实现 mobilekcp.StatsListener
+type statsCallback struct{ callback }
+
+func (c *statsCallback) OnStats(statsJson string) { c.invoke(statsJson) }
+
+//export mobilekcp_start
+func mobilekcp_start(config *C.char) *C.char {
+	return C.CString(mobilekcp.StartProxy(C.GoString(config)))
+}
+
+//export mobilekcp_stop
+func mobilekcp_stop() {
+	mobilekcp.StopProxy()
+}
+
+//export mobilekcp_is_running
+func mobilekcp_is_running() C.int {
+	if mobilekcp.IsRunning() {
+		return 1
+	}
+	return 0
+}
+
+//export mobilekcp_stats
+func mobilekcp_stats() *C.char {
+	return C.CString(mobilekcp.GetStats())
+}
+
+//export mobilekcp_validate
+func mobilekcp_validate(config *C.char) *C.char {
+	return C.CString(mobilekcp.ValidateConfigJSON(C.GoString(config)))
+}
+
+//export mobilekcp_version
+func mobilekcp_version() *C.char {
+	return C.CString(mobilekcp.GetVersion())
+}
+
+//export mobilekcp_api_version
+func mobilekcp_api_version() C.int {
+	return C.int(mobilekcp.GetAPIVersion())
+}
+
+//export mobilekcp_network_changed
+func mobilekcp_network_changed(connected C.int) {
+	mobilekcp.NotifyNetworkChanged(connected != 0)
+}
+
+//export mobilekcp_set_event_callback
+func mobilekcp_set_event_callback(fn C.mobilekcp_callback, ctx unsafe.Pointer) {
+	if fn == nil {
+		mobilekcp.SetEventListener(nil)
+		return
+	}
+	mobilekcp.SetEventListener(&eventCallback{callback{fn, ctx}})
+}
+
+//export mobilekcp_set_stats_callback
+func mobilekcp_set_stats_callback(intervalMs C.int, fn C.mobilekcp_callback, ctx unsafe.Pointer) {
+	if fn == nil {
+		mobilekcp.SetStatsListener(0, nil)
+		return
+	}
+	mobilekcp.SetStatsListener(int(intervalMs), &statsCallback{callback{fn, ctx}})
+}
+
+//export mobilekcp_free
+func mobilekcp_free(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
@@ -0,0 +1,147 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// 连接日志: 每条转发连接结束时输出一条结构化记录
+// accesslog 为 "log" 时写入日志输出，"event" 时通过 EventListener 发送 access 事件，
+// 其他值视为文件路径，以 JSON Lines 追加写入
+
+const (
+	accessToLog   = "log"
+	accessToEvent = "event"
+)
+
+// accessRecord 一条连接记录
+type accessRecord struct {
+	Time      int64  `json:"time"` // 结束时间 (毫秒时间戳)
+	ID        uint64 `json:"id,omitempty"`
+	Peer      string `json:"peer"`
+	Target    string `json:"target,omitempty"` // 从代理握手中识别的目标
+	Domain    string `json:"domain,omitempty"` // 目标为 IP 时嗅探出的域名
+	Tag       string `json:"tag,omitempty"`    // App 设置的连接标签
+	Outbound  string `json:"outbound"`         // 出口: proxy, direct, reject
+	Duration  int64  `json:"duration"`         // 毫秒
+	BytesUp   uint64 `json:"bytesup"`
+	BytesDown uint64 `json:"bytesdown"`
+	Reason    string `json:"reason"`
+
+	// 与 kcptun 服务端日志关联 (仅经隧道的连接)
+	Conv    uint32 `json:"conv,omitempty"`    // KCP 会话 ID
+	SID     uint32 `json:"sid,omitempty"`     // SMUX 流 ID
+	Session string `json:"session,omitempty"` // 会话的本地端点
+}
+
+var (
+	accessMu   sync.Mutex
+	accessMode string
+	accessFile *os.File
+)
+
+// openAccessLog 按配置打开连接日志
+func openAccessLog(config *Config) error {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+
+	accessMode = config.AccessLog
+	switch accessMode {
+	case "", accessToLog, accessToEvent:
+		return nil
+	}
+	f, err := os.OpenFile(accessMode, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		accessMode = ""
+		return err
+	}
+	accessFile = f
+	return nil
+}
+
+// closeAccessLog 关闭连接日志
+func closeAccessLog() {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+
+	if accessFile != nil {
+		accessFile.Close()
+		accessFile = nil
+	}
+	accessMode = ""
+}
+
+// logAccess 输出一条连接记录
+func logAccess(rec *accessRecord) {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+
+	if accessMode == "" {
+		return
+	}
+	rec.Time = clk.Now().UnixMilli()
+	b, _ := json.Marshal(rec)
+
+	switch accessMode {
+	case accessToLog:
+		log.Println("Access:", string(b))
+	case accessToEvent:
+		var data map[string]interface{}
+		json.Unmarshal(b, &data)
+		emitEvent("access", data)
+	default:
+		if _, err := accessFile.Write(append(b, '\n')); err != nil {
+			logError("Access log error:", err)
+		}
+	}
+}
+
+// streamRecord 由转发中的连接生成记录
+func streamRecord(s *streamInfo, reason string) *accessRecord {
+	outbound := actionProxy
+	if reason == closePolicy {
+		outbound = actionReject
+	}
+	return &accessRecord{
+		ID:        s.id,
+		Peer:      s.local,
+		Target:    s.getTarget(),
+		Domain:    s.getDomain(),
+		Tag:       s.tag,
+		Outbound:  outbound,
+		Duration:  clk.Since(s.start).Milliseconds(),
+		BytesUp:   atomic.LoadUint64(&s.bytesUp),
+		BytesDown: atomic.LoadUint64(&s.bytesDown),
+		Reason:    reason,
+		Conv:      s.conv,
+		SID:       s.sid,
+		Session:   s.link,
+	}
+}
@@ -0,0 +1,294 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 地址簿: 保存多个服务器配置，按探测到的 RTT/丢包排序
+// autoserver 开启时使用当前最优的服务器启动，连续重连失败后重新排序并切换
+
+const (
+	rankProbes       = 3               // 每个服务器的探测次数
+	rankProbeTimeout = 2 * time.Second // 单次探测超时
+)
+
+// serverProfile 地址簿中的一个服务器
+type serverProfile struct {
+	Name       string          `json:"name"`
+	RemoteAddr string          `json:"remoteaddr"`
+	RTT        int64           `json:"rtt"`  // 毫秒，-1 表示全部探测失败
+	Loss       float64         `json:"loss"` // 探测失败比例
+	Ranked     bool            `json:"ranked"`
+	raw        json.RawMessage // 覆盖到基础配置上的字段
+
+	Weight   int `json:"weight,omitempty"`   // serverselect weighted 时的权重 (0 表示不分配)
+	MaxConns int `json:"maxconns,omitempty"` // 在该服务器上最多建立的会话数 (默认 0 不限制)
+}
+
+var (
+	addrMu     sync.Mutex
+	addrBook   []*serverProfile
+	baseConfig string // 最近一次启动使用的基础配置，用于排序和切换
+
+	autoSwitching int32 // 非 0 表示正在重新排序/切换
+)
+
+const autoSwitchFailures = 3 // 连续重连失败多少次后触发切换
+
+// SetAddrBook 设置地址簿
+// profilesJson: JSON 数组，每项包含 name 和任意配置字段 (至少 remoteaddr)，可选 weight 和 maxconns，
+// 如 [{"name": "hk", "remoteaddr": "1.2.3.4:4000", "crypt": "aes", "weight": 3, "maxconns": 2}]
+// 返回空字符串表示成功，否则返回错误信息
+func SetAddrBook(profilesJson string) string {
+	var raws []json.RawMessage
+	if err := json.Unmarshal([]byte(profilesJson), &raws); err != nil {
+		return "Config Error: " + err.Error()
+	}
+
+	book := make([]*serverProfile, 0, len(raws))
+	for i, raw := range raws {
+		p := &serverProfile{}
+		if err := json.Unmarshal(raw, p); err != nil {
+			return "Config Error: " + err.Error()
+		}
+		if p.Name == "" || p.RemoteAddr == "" {
+			return fmt.Sprintf("Config Error: profile %d requires name and remoteaddr", i)
+		}
+		if p.Weight < 0 || p.MaxConns < 0 {
+			return fmt.Sprintf("Config Error: profile %d has negative weight or maxconns", i)
+		}
+		p.Ranked = false
+
+		// name、weight、maxconns 不是配置字段，合并前移除
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return "Config Error: " + err.Error()
+		}
+		delete(fields, "name")
+		delete(fields, "weight")
+		delete(fields, "maxconns")
+		p.raw, _ = json.Marshal(fields)
+		book = append(book, p)
+	}
+
+	addrMu.Lock()
+	addrBook = book
+	addrMu.Unlock()
+	return ""
+}
+
+// GetAddrBook 返回地址簿及最近一次排序结果 (JSON)
+func GetAddrBook() string {
+	addrMu.Lock()
+	defer addrMu.Unlock()
+
+	b, _ := json.Marshal(addrBook)
+	return string(b)
+}
+
+// RankServers 并发探测地址簿中的所有服务器，按丢包和 RTT 排序
+// 返回排序后的地址簿 (JSON)；耗时最多约 rankProbes * rankProbeTimeout
+func RankServers() string {
+	rankServers()
+	return GetAddrBook()
+}
+
+// rankServers 探测并排序地址簿
+func rankServers() {
+	addrMu.Lock()
+	book := append([]*serverProfile(nil), addrBook...)
+	base := baseConfig
+	addrMu.Unlock()
+
+	type result struct {
+		rtt  int64
+		loss float64
+	}
+	results := make([]result, len(book))
+
+	var wg sync.WaitGroup
+	for i, p := range book {
+		wg.Add(1)
+		go func(i int, p *serverProfile) {
+			defer wg.Done()
+			results[i] = result{rtt: -1, loss: 1}
+
+			config, err := profileConfig(base, p)
+			if err != nil {
+				logErrorf("Rank %s: %v", p.Name, err)
+				return
+			}
+			defer wipeSecrets(config)
+			var best time.Duration = -1
+			failed := 0
+			for j := 0; j < rankProbes; j++ {
+				rtt, err := probeTunnel(config, rankProbeTimeout)
+				if err != nil {
+					failed++
+					continue
+				}
+				if best < 0 || rtt < best {
+					best = rtt
+				}
+			}
+			results[i].loss = float64(failed) / rankProbes
+			if best >= 0 {
+				results[i].rtt = best.Milliseconds()
+			}
+		}(i, p)
+	}
+	wg.Wait()
+
+	addrMu.Lock()
+	for i, p := range book {
+		p.RTT, p.Loss, p.Ranked = results[i].rtt, results[i].loss, true
+	}
+	sort.SliceStable(addrBook, func(i, j int) bool {
+		a, b := addrBook[i], addrBook[j]
+		if a.Loss != b.Loss {
+			return a.Loss < b.Loss
+		}
+		if (a.RTT < 0) != (b.RTT < 0) {
+			return b.RTT < 0
+		}
+		return a.RTT < b.RTT
+	})
+	addrMu.Unlock()
+}
+
+// profileConfig 将服务器配置覆盖到基础配置上并解析
+func profileConfig(base string, p *serverProfile) (*Config, error) {
+	if base == "" {
+		base = "{}"
+	}
+	merged, err := mergeConfigJSON(base, string(p.raw))
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(merged)
+}
+
+// setBaseConfig 记录启动使用的基础配置
+func setBaseConfig(configJson string) {
+	addrMu.Lock()
+	baseConfig = configJson
+	addrMu.Unlock()
+}
+
+// bestServer 返回当前最优的服务器，地址簿未排序时先排序
+func bestServer() (*serverProfile, error) {
+	addrMu.Lock()
+	if len(addrBook) == 0 {
+		addrMu.Unlock()
+		return nil, errors.New("address book is empty")
+	}
+	ranked := addrBook[0].Ranked
+	addrMu.Unlock()
+
+	if !ranked {
+		rankServers()
+	}
+
+	addrMu.Lock()
+	defer addrMu.Unlock()
+	return addrBook[0], nil
+}
+
+// selectAutoServer 为 autoserver 配置选择服务器 (最优或按权重分配)，返回合并后的配置
+// avoid 为当前使用的 remoteaddr，按权重分配时切换到顺序中的下一台
+func selectAutoServer(configJson string, avoid string) (*Config, *serverProfile, error) {
+	var best *serverProfile
+	var err error
+	if opts := parseFleetOptions(configJson); opts.ServerSelect == serverSelectWeighted {
+		best, err = weightedServer(opts.ClientID, avoid)
+	} else {
+		best, err = bestServer()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := profileConfig(configJson, best)
+	if err != nil {
+		return nil, nil, err
+	}
+	applyMaxConns(config, best)
+	return config, best, nil
+}
+
+// autoSwitchServer 连续重连失败后重新排序，最优服务器变化时切换并重启实例
+func autoSwitchServer(current *Config, stop chan struct{}) {
+	if !atomic.CompareAndSwapInt32(&autoSwitching, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&autoSwitching, 0)
+
+	addrMu.Lock()
+	base := baseConfig
+	addrMu.Unlock()
+
+	if parseFleetOptions(base).ServerSelect != serverSelectWeighted {
+		rankServers()
+	}
+	config, best, err := selectAutoServer(base, current.RemoteAddr)
+	if err != nil {
+		logError("Auto server:", err)
+		return
+	}
+	if config.RemoteAddr == current.RemoteAddr {
+		return
+	}
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	select {
+	case <-stop:
+		return
+	default:
+	}
+
+	log.Printf("Auto server: switching to %s (%s)", best.Name, best.RemoteAddr)
+	emitEvent("server-switch", map[string]interface{}{
+		"name":       best.Name,
+		"remoteaddr": best.RemoteAddr,
+		"rtt":        best.RTT,
+		"loss":       best.Loss,
+	})
+	old := proxyConfig
+	stopLocked()
+	wipeSecrets(old)
+	if err := startLocked(config); err != nil {
+		logError("Auto server restart error:", err)
+	}
+}
@@ -0,0 +1,122 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// 打开流错峰: App 启动时常同时发起几十个连接，同一时刻在一个会话上打开的流会一起进入慢启动，
+// 窗口同步增长、ACK 集中到达，短时间内推高 RTT。开启 openspacing 后同一会话上相邻两次打开流
+// 至少间隔该毫秒数，超出的请求依次排队 (只作用于客户端连接的流，控制流和探测流不受影响)
+
+// 当前生效的间隔纳秒数 (0 表示不错峰)，启动时按配置设置
+var openSpacing int64
+
+var (
+	admitDelayed uint64 // 因错峰而等待的打开次数
+	admitWait    uint64 // 累计等待纳秒数
+	admitMaxWait int64  // 最长一次等待纳秒数
+)
+
+// admissionState 会话上的错峰状态
+type admissionState struct {
+	mu   sync.Mutex
+	next time.Time // 下一次允许打开流的时间
+}
+
+// admissionStats 打开流错峰统计
+type admissionStats struct {
+	Spacing int64   `json:"spacing"` // 间隔毫秒数
+	Delayed uint64  `json:"delayed"` // 等待过的打开次数
+	AvgWait float64 `json:"avgwait"` // 等待过的打开的平均等待毫秒数
+	MaxWait float64 `json:"maxwait"` // 最长一次等待毫秒数
+}
+
+// resetAdmission 按配置设置间隔并清零统计
+func resetAdmission(config *Config) {
+	atomic.StoreInt64(&openSpacing, int64(time.Duration(config.OpenSpacing)*time.Millisecond))
+	atomic.StoreUint64(&admitDelayed, 0)
+	atomic.StoreUint64(&admitWait, 0)
+	atomic.StoreInt64(&admitMaxWait, 0)
+}
+
+// admit 等待到该会话上允许打开下一条流的时间
+func (s *poolSession) admit() {
+	spacing := time.Duration(atomic.LoadInt64(&openSpacing))
+	if spacing <= 0 {
+		return
+	}
+	s.admission.mu.Lock()
+	now := clk.Now()
+	slot := s.admission.next
+	if slot.Before(now) {
+		slot = now
+	}
+	s.admission.next = slot.Add(spacing)
+	s.admission.mu.Unlock()
+
+	wait := slot.Sub(now)
+	if wait <= 0 {
+		return
+	}
+	atomic.AddUint64(&admitDelayed, 1)
+	atomic.AddUint64(&admitWait, uint64(wait))
+	for {
+		max := atomic.LoadInt64(&admitMaxWait)
+		if int64(wait) <= max || atomic.CompareAndSwapInt64(&admitMaxWait, max, int64(wait)) {
+			break
+		}
+	}
+	metricObserve("kcp_open_admission_wait_ms", "", float64(wait)/float64(time.Millisecond))
+	clk.Sleep(wait)
+}
+
+// openAdmitted 错峰后打开客户端连接使用的流
+func (s *poolSession) openAdmitted() (*smux.Stream, error) {
+	s.admit()
+	return s.OpenStream()
+}
+
+// snapshotAdmission 返回错峰统计 (未开启时为 nil)
+func snapshotAdmission() *admissionStats {
+	spacing := atomic.LoadInt64(&openSpacing)
+	if spacing <= 0 {
+		return nil
+	}
+	s := &admissionStats{
+		Spacing: time.Duration(spacing).Milliseconds(),
+		Delayed: atomic.LoadUint64(&admitDelayed),
+		MaxWait: float64(atomic.LoadInt64(&admitMaxWait)) / float64(time.Millisecond),
+	}
+	if s.Delayed > 0 {
+		s.AvgWait = float64(atomic.LoadUint64(&admitWait)) / float64(s.Delayed) / float64(time.Millisecond)
+	}
+	return s
+}
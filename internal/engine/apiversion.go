@@ -0,0 +1,50 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+// JSON API 版本: 配置、统计和事件的 JSON 都带 apiversion，App 与库可以各自升级
+// 兼容承诺:
+//   - 同一版本内只新增字段，不删除或改名；改名的字段作为别名保留 (见 configAliases)
+//   - 改变默认行为的调整按配置中的 apiversion 区分，未声明 apiversion 的旧 App 保持原有行为
+//   - 配置声明的版本高于库支持的版本时拒绝启动，而不是静默忽略新字段
+// 版本历史:
+//   1: 初始版本 (未声明 apiversion 的配置按此处理)
+//   2: nocomp 默认值与 kcptun 一致 (false，启用 snappy 压缩)
+
+const (
+	apiVersion       = 2 // 当前版本
+	apiVersionLegacy = 1 // 未声明 apiversion 时采用的版本
+)
+
+// GetAPIVersion 返回库支持的 JSON API 版本
+func GetAPIVersion() int {
+	return apiVersion
+}
+
+// configAPIVersion 返回配置声明的版本，未声明时为旧版本
+func configAPIVersion(config *Config) int {
+	if config.APIVersion <= 0 {
+		return apiVersionLegacy
+	}
+	return config.APIVersion
+}
@@ -0,0 +1,88 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import "log"
+
+// 待命状态: 设备离线时调用 StartProxy 不会失败，而是保存配置进入待命 (armed)，
+// App 通过 NotifyNetworkChanged 报告网络恢复后自动完成启动，无需 App 自行重试
+// 生命周期事件: armed, started (由待命转为运行), start-failed (保持待命，等待下次网络变化), disarmed
+
+var (
+	networkUp   = true  // App 报告的网络状态 (未报告时视为在线)，由 proxyMu 保护
+	armedConfig *Config // 待命中的配置，由 proxyMu 保护
+)
+
+// NotifyNetworkChanged 报告设备网络状态变化
+// connected: 是否有可用网络；待命中且网络恢复时自动启动代理
+func NotifyNetworkChanged(connected bool) {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	networkUp = connected
+	// 网络变化后直连和隧道的延迟对比不再成立
+	resetAutoCache()
+	resetNAT64()
+	if !connected || armedConfig == nil || proxyRunning() {
+		return
+	}
+
+	config := armedConfig
+	if err := launchLocked(config); err != nil {
+		logError("Armed start error:", err)
+		reportStartFailure(config, err.Error())
+		return
+	}
+	clearStartError()
+	armedConfig = nil
+	emitEvent("started", map[string]interface{}{"armed": true})
+}
+
+// IsArmed 是否处于待命状态 (已配置，等待网络恢复)
+func IsArmed() bool {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	return armedConfig != nil
+}
+
+// armLocked 保存配置进入待命 (调用方需持有 proxyMu)
+func armLocked(config *Config) {
+	armedConfig = config
+	log.Println("No network, proxy armed")
+	emitEvent("armed", map[string]interface{}{"remoteaddr": config.RemoteAddr})
+	noteStateLocked()
+}
+
+// disarmLocked 取消待命并清除配置中的密钥 (调用方需持有 proxyMu)
+func disarmLocked() bool {
+	if armedConfig == nil {
+		return false
+	}
+	wipeSecrets(armedConfig)
+	armedConfig = nil
+	emitEvent("disarmed", nil)
+	noteStateLocked()
+	return true
+}
@@ -0,0 +1,240 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// profile 为 auto 时按流量特征在 gaming/download/balanced 之间切换运行中会话的参数
+// (模式计时、窗口、ACK 无延迟、小包复制、平滑发送)，缓冲区等建立时确定的参数不变:
+//   - download: 存在高速流且其流量占绝大部分
+//   - gaming: 有流但都是低速的交互流
+//   - balanced: 其他情况，使用配置本身的参数
+// 同一分类连续 profileStreak 次采样才切换，切换时发送 "profile" 事件
+// LockProfile 可锁定某个档位，锁定期间不再自动切换
+
+const (
+	profileStreak    = 3
+	profileBulkRate  = 64 << 10  // 单条流超过此字节/秒视为大流量流
+	profileBulkShare = 0.8       // 大流量流占总流量的比例
+	profileBulkTotal = 256 << 10 // 总流量低于此字节/秒时不判为 download
+	profileQuietRate = 64 << 10  // gaming: 总流量上限
+)
+
+// autoProfile 自动档位状态
+type autoProfile struct {
+	mu        sync.Mutex
+	active    string  // 当前档位 (空表示未启用)
+	params    *Config // 当前档位生效的参数 (balanced 时为 nil，使用配置本身)
+	locked    bool
+	candidate string
+	streak    int
+	last      map[uint64]uint64 // 流 ID -> 上次采样的字节数
+}
+
+var (
+	autoProf autoProfile
+	autoDup  int64 // 当前档位的小包复制阈值
+)
+
+// autoParams 当前档位覆盖的参数 (未启用或 balanced 时为 nil)
+func autoParams() *Config {
+	autoProf.mu.Lock()
+	defer autoProf.mu.Unlock()
+	return autoProf.params
+}
+
+// pacingOn 平滑发送是否生效 (auto 档位覆盖配置)
+func pacingOn(config *Config) bool {
+	if p := autoParams(); p != nil {
+		return p.Pacing
+	}
+	return config.Pacing
+}
+
+// resetAutoProfile 启动时回到 balanced
+func resetAutoProfile(config *Config) {
+	autoProf.mu.Lock()
+	autoProf.active, autoProf.params, autoProf.locked = "", nil, false
+	autoProf.candidate, autoProf.streak, autoProf.last = "", 0, nil
+	if config.Profile == profileAuto {
+		autoProf.active = "balanced"
+	}
+	autoProf.mu.Unlock()
+	atomic.StoreInt64(&autoDup, int64(config.Duplicate))
+}
+
+// classifyTraffic 按各流自上次采样以来的速率分类
+func classifyTraffic(secs float64) string {
+	streamsMu.Lock()
+	list := make([]*streamInfo, 0, len(activeStreams))
+	for _, s := range activeStreams {
+		list = append(list, s)
+	}
+	streamsMu.Unlock()
+
+	last := make(map[uint64]uint64, len(list))
+	var total, bulk float64
+	for _, s := range list {
+		n := atomic.LoadUint64(&s.bytesUp) + atomic.LoadUint64(&s.bytesDown)
+		last[s.id] = n
+		rate := float64(n-autoProf.last[s.id]) / secs
+		total += rate
+		if rate >= profileBulkRate {
+			bulk += rate
+		}
+	}
+	autoProf.last = last
+
+	switch {
+	case len(list) == 0:
+		return "balanced"
+	case total >= profileBulkTotal && bulk >= total*profileBulkShare:
+		return "download"
+	case bulk == 0 && total < profileQuietRate:
+		return "gaming"
+	}
+	return "balanced"
+}
+
+// sampleProfile 采样并在分类稳定后切换档位
+func sampleProfile(config *Config) {
+	if config.Profile != profileAuto {
+		return
+	}
+	autoProf.mu.Lock()
+	if autoProf.locked {
+		autoProf.mu.Unlock()
+		return
+	}
+	class := classifyTraffic(wireSampleInterval.Seconds())
+	if class == autoProf.active {
+		autoProf.candidate, autoProf.streak = "", 0
+		autoProf.mu.Unlock()
+		return
+	}
+	if class != autoProf.candidate {
+		autoProf.candidate, autoProf.streak = class, 0
+	}
+	autoProf.streak++
+	if autoProf.streak < profileStreak {
+		autoProf.mu.Unlock()
+		return
+	}
+	autoProf.candidate, autoProf.streak = "", 0
+	autoProf.mu.Unlock()
+
+	switchProfile(config, class, "auto")
+}
+
+// switchProfile 切换到指定档位并应用到所有存活会话
+func switchProfile(config *Config, name, reason string) {
+	var params *Config
+	dup := config.Duplicate
+	if name != "balanced" {
+		c := *config
+		profiles[name](&c)
+		applyMode(&c)
+		params, dup = &c, c.Duplicate
+	}
+
+	autoProf.mu.Lock()
+	from := autoProf.active
+	autoProf.active, autoProf.params = name, params
+	locked := autoProf.locked
+	autoProf.mu.Unlock()
+	atomic.StoreInt64(&autoDup, int64(dup))
+
+	ack := config.AckNodelay
+	if params != nil {
+		ack = params.AckNodelay
+	}
+	p := effectiveParams(config)
+	interval := kcpInterval(config, p)
+	proxyMu.Lock()
+	for _, s := range proxySessions {
+		if s.alive() && s.conn != nil {
+			s.conn.SetNoDelay(p.NoDelay, interval, p.Resend, p.NoCongestion)
+			s.conn.SetWindowSize(p.SndWnd, p.RcvWnd)
+			s.conn.SetACKNoDelay(ack)
+			if !pacingOn(config) {
+				s.conn.SetRateLimit(uint32(config.RateLimit))
+			}
+		}
+	}
+	proxyMu.Unlock()
+
+	log.Printf("Profile %s -> %s (%s)", from, name, reason)
+	emitEvent("profile", map[string]interface{}{"from": from, "to": name, "reason": reason, "locked": locked})
+}
+
+// LockProfile 锁定 auto 模式下的档位: "gaming", "download" 或 "balanced"，空字符串解除锁定恢复自动切换
+// 返回空字符串表示成功，否则返回错误信息
+func LockProfile(name string) string {
+	proxyMu.Lock()
+	running, config := proxyRunning(), proxyConfig
+	proxyMu.Unlock()
+	if !running {
+		return "Proxy not running"
+	}
+	if config.Profile != profileAuto {
+		return "Profile is not auto"
+	}
+
+	if name == "" {
+		autoProf.mu.Lock()
+		autoProf.locked = false
+		autoProf.mu.Unlock()
+		log.Println("Profile unlocked")
+		return ""
+	}
+	if _, ok := profiles[name]; (!ok && name != "balanced") || name == profileAuto {
+		return "Unknown profile: " + name
+	}
+	autoProf.mu.Lock()
+	autoProf.locked = true
+	autoProf.candidate, autoProf.streak = "", 0
+	autoProf.mu.Unlock()
+	switchProfile(config, name, "lock")
+	return ""
+}
+
+// profileState 统计中的档位状态 (未启用 auto 时为 nil)
+type profileState struct {
+	Active string `json:"active"`
+	Locked bool   `json:"locked"`
+}
+
+func snapshotProfile() *profileState {
+	autoProf.mu.Lock()
+	defer autoProf.mu.Unlock()
+	if autoProf.active == "" {
+		return nil
+	}
+	return &profileState{Active: autoProf.active, Locked: autoProf.locked}
+}
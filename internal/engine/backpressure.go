@@ -0,0 +1,111 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"sync"
+)
+
+// queueMark 会话发送队列的高/低水位
+// 超过高水位时发送 "queue" 事件，开启 backpressure 时暂停读取本地客户端，
+// 回落到低水位以下时恢复
+type queueMark struct {
+	high, low int64
+	block     bool
+
+	mu      sync.Mutex
+	over    bool
+	drained chan struct{} // 回落到低水位时关闭
+}
+
+func newQueueMark(config *Config) *queueMark {
+	if config.QueueHigh <= 0 {
+		return nil
+	}
+	return &queueMark{
+		high:  int64(config.QueueHigh),
+		low:   int64(config.QueueLow),
+		block: config.Backpressure,
+	}
+}
+
+// check 按当前队列深度切换水位状态
+func (m *queueMark) check(s *poolSession, queued int64) {
+	m.mu.Lock()
+	state := ""
+	if !m.over && queued >= m.high {
+		m.over = true
+		m.drained = make(chan struct{})
+		state = "high"
+	} else if m.over && queued <= m.low {
+		m.over = false
+		close(m.drained)
+		state = "low"
+	}
+	m.mu.Unlock()
+
+	if state == "" {
+		return
+	}
+	if state == "high" {
+		metricCount("kcp_queue_high_total", "", 1)
+	}
+	emitEvent("queue", map[string]interface{}{
+		"index":        sessionIndex(s),
+		"state":        state,
+		"queued":       queued,
+		"backpressure": m.block,
+	})
+}
+
+// wait 开启 backpressure 且超过高水位时阻塞，直到回落到低水位或会话关闭
+func (m *queueMark) wait(s *poolSession) {
+	if !m.block {
+		return
+	}
+	m.mu.Lock()
+	drained := m.drained
+	over := m.over
+	m.mu.Unlock()
+
+	if over {
+		select {
+		case <-drained:
+		case <-s.CloseChan():
+		}
+	}
+}
+
+// sessionIndex 会话在会话池中的序号 (已被替换时为 -1)
+func sessionIndex(s *poolSession) int {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	for i, p := range proxySessions {
+		if p == s {
+			return i
+		}
+	}
+	return -1
+}
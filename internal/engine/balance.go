@@ -0,0 +1,101 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// 按有效吞吐加权分配新连接: 每个 wireSampleInterval 统计各会话的平滑吞吐，
+// 以每条流的吞吐相对最好会话的比例作为权重，被劣质 NAT 路径拖慢的会话分到更少的新流
+// 选择使用平滑加权轮询，权重相同时退化为普通轮询
+
+const (
+	balanceAlpha      = 0.3      // 吞吐平滑系数
+	balanceMinWeight  = 0.1      // 最低权重，保证慢会话仍有机会恢复
+	balanceMinGoodput = 16 << 10 // 最好会话每条流吞吐低于此字节/秒时不加权 (流量太少不足以判断)
+)
+
+// balanceState 会话的加权状态 (由 proxyMu 保护)
+type balanceState struct {
+	goodput   float64 // 平滑吞吐 字节/秒
+	weight    float64 // 0 表示尚未测量，按 1 处理
+	credit    float64 // 平滑加权轮询的当前值
+	lastBytes uint64
+	lastAt    time.Time
+}
+
+// balanceWeight 会话的当前权重
+func (s *poolSession) balanceWeight() float64 {
+	if s.balance.weight <= 0 {
+		return 1
+	}
+	return s.balance.weight
+}
+
+// sampleBalance 更新各会话的吞吐和权重
+func sampleBalance() {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	now := clk.Now()
+	perStream := make([]float64, len(proxySessions))
+	var best float64
+	for i, s := range proxySessions {
+		if !s.alive() {
+			continue
+		}
+		b := &s.balance
+		bytes := atomic.LoadUint64(&s.bytesUp) + atomic.LoadUint64(&s.bytesDown)
+		if !b.lastAt.IsZero() {
+			if secs := now.Sub(b.lastAt).Seconds(); secs > 0 {
+				rate := float64(bytes-b.lastBytes) / secs
+				b.goodput += balanceAlpha * (rate - b.goodput)
+			}
+		}
+		b.lastBytes, b.lastAt = bytes, now
+
+		// 没有流的会话无从判断，保持默认权重
+		if n := s.NumStreams(); n > 0 {
+			perStream[i] = b.goodput / float64(n)
+			best = math.Max(best, perStream[i])
+		} else {
+			perStream[i] = -1
+		}
+	}
+
+	for i, s := range proxySessions {
+		if !s.alive() {
+			continue
+		}
+		w := 1.0
+		if best >= balanceMinGoodput && perStream[i] >= 0 {
+			w = math.Max(balanceMinWeight, perStream[i]/best)
+		}
+		s.balance.weight = w
+	}
+}
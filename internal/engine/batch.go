@@ -0,0 +1,153 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 写入合并: 浏览网页等大量并发小流的场景下，SMUX 帧一个个写入 KCP，
+// 每次写入都会立即 flush 成一个小包。batchConn 在 writebatch 毫秒内把连续的小帧
+// 合并为一次写入，KCP 流模式下即合并进同一个段。
+// 距上次写入已超过延迟的写入直接发出，单个流的请求不会因此增加延迟
+
+var (
+	statBatchWrites  uint64 // 进入合并缓冲的写入次数
+	statBatchFlushes uint64 // 合并后的实际写入次数
+)
+
+// batchStats 写入合并统计
+type batchStats struct {
+	Writes  uint64 `json:"writes"`
+	Flushes uint64 `json:"flushes"`
+}
+
+func snapshotBatch() *batchStats {
+	return &batchStats{
+		Writes:  atomic.LoadUint64(&statBatchWrites),
+		Flushes: atomic.LoadUint64(&statBatchFlushes),
+	}
+}
+
+// resetBatch 清零写入合并统计
+func resetBatch() {
+	atomic.StoreUint64(&statBatchWrites, 0)
+	atomic.StoreUint64(&statBatchFlushes, 0)
+}
+
+// batchConn 在短延迟内合并小写入
+type batchConn struct {
+	net.Conn
+	delay time.Duration
+	limit int // 缓冲达到该大小 (约一个段) 时立即写出
+
+	mu        sync.Mutex
+	buf       []byte
+	timer     clockTimer
+	lastWrite time.Time
+	err       error // 定时写出时的错误，由下一次 Write 返回
+}
+
+func newBatchConn(conn net.Conn, delay time.Duration, limit int) *batchConn {
+	return &batchConn{Conn: conn, delay: delay, limit: limit}
+}
+
+func (c *batchConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	// 空闲后的第一次写入或大块写入不等待
+	if len(c.buf) == 0 && (clk.Since(c.lastWrite) >= c.delay || len(b) >= c.limit) {
+		c.lastWrite = clk.Now()
+		return c.Conn.Write(b)
+	}
+
+	atomic.AddUint64(&statBatchWrites, 1)
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= c.limit {
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if c.timer == nil {
+		c.timer = clk.AfterFunc(c.delay, c.flushTimer)
+	}
+	return len(b), nil
+}
+
+// flushLocked 写出缓冲 (调用方持有 c.mu)
+func (c *batchConn) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	atomic.AddUint64(&statBatchFlushes, 1)
+	_, err := c.Conn.Write(c.buf)
+	c.buf = c.buf[:0]
+	c.lastWrite = clk.Now()
+	if err != nil {
+		c.err = err
+	}
+	return err
+}
+
+// Flush 立即写出缓冲
+func (c *batchConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+// buffered 缓冲中尚未写出的字节数
+func (c *batchConn) buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.buf)
+}
+
+func (c *batchConn) flushTimer() {
+	c.mu.Lock()
+	c.timer = nil
+	c.flushLocked()
+	c.mu.Unlock()
+}
+
+func (c *batchConn) Close() error {
+	c.mu.Lock()
+	c.flushLocked()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
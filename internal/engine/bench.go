@@ -0,0 +1,264 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build bench && !js
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// 基准测试: RunBenchmarks 在设备上运行转发路径、各加密方式、FEC 分片组合和统计序列化的基准，
+// 便于发现性能回退、在不同设备之间客观比较。使用 testing.Benchmark，不依赖 go test，
+// 可以由 App 调用或通过 bench 命令行工具运行 (go run -tags bench ./bench)。
+// 每项约运行 1 秒，全部运行约 20 秒，filter 按名称子串只运行部分项目 (如 "crypt/" 或 "fec/")
+// testing 包会带入其命令行参数注册并增大二进制，只在使用 bench 构建标签时编译 (默认见 bench_off.go)；
+// go test -tags bench -bench . 以 BenchmarkEngine 运行同样的项目
+
+const (
+	benchChunk  = 32 << 10 // 转发基准每次操作的字节数
+	benchPacket = 1400     // 加密和 FEC 基准的包/分片长度
+)
+
+// benchCrypts 参与基准的加密方式
+var benchCrypts = []string{"aes", "aes-128", "aes-192", "salsa20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor", "sm4", "none"}
+
+// benchFECs 参与基准的 datashard/parityshard 组合
+var benchFECs = [][2]int{{10, 3}, {5, 2}, {20, 10}}
+
+// benchCase 一项基准
+type benchCase struct {
+	name string
+	fn   func(b *testing.B)
+}
+
+// benchResult 一项基准的结果
+type benchResult struct {
+	Name        string  `json:"name"`
+	N           int     `json:"n"`    // 迭代次数
+	NsPerOp     int64   `json:"nsop"` // 每次操作纳秒
+	MBps        float64 `json:"mbps"` // 吞吐 MB/s (有字节数的项目)
+	AllocsPerOp int64   `json:"allocs"`
+	BytesPerOp  int64   `json:"bytesop"` // 每次操作分配的字节
+	Error       string  `json:"error,omitempty"`
+}
+
+// benchReport 基准测试报告
+type benchReport struct {
+	Version string        `json:"version"`
+	GOOS    string        `json:"goos"`
+	GOARCH  string        `json:"goarch"`
+	CPUs    int           `json:"cpus"`
+	Results []benchResult `json:"results"`
+}
+
+// benchCases 全部基准
+func benchCases() []benchCase {
+	cases := []benchCase{
+		{"relay/buffer", benchRelayBuffer},
+		{"relay/tcp", benchRelayTCP},
+	}
+	for _, crypt := range benchCrypts {
+		crypt := crypt
+		cases = append(cases, benchCase{"crypt/" + crypt, func(b *testing.B) { benchCrypt(b, crypt) }})
+	}
+	for _, fec := range benchFECs {
+		data, parity := fec[0], fec[1]
+		cases = append(cases, benchCase{fmt.Sprintf("fec/%d-%d", data, parity), func(b *testing.B) { benchFEC(b, data, parity) }})
+	}
+	cases = append(cases, benchCase{"stats/json", benchStatsJSON})
+	return cases
+}
+
+// RunBenchmarks 运行名称包含 filter 的基准 (filter 为空时全部运行，阻塞调用)
+// 仅在使用 bench 构建标签时可用，默认构建返回 {"version", "error"}
+// 返回 JSON: {"version", "goos", "goarch", "cpus", "results": [{"name", "n", "nsop", "mbps", "allocs", "bytesop", "error"}]}
+func RunBenchmarks(filter string) string {
+	report := benchReport{
+		Version: VERSION,
+		GOOS:    runtime.GOOS,
+		GOARCH:  runtime.GOARCH,
+		CPUs:    runtime.NumCPU(),
+		Results: []benchResult{},
+	}
+	for _, c := range benchCases() {
+		if filter != "" && !strings.Contains(c.name, filter) {
+			continue
+		}
+		r := testing.Benchmark(c.fn)
+		res := benchResult{Name: c.name, N: r.N}
+		if r.N == 0 {
+			res.Error = "failed"
+		} else {
+			res.NsPerOp = r.NsPerOp()
+			res.AllocsPerOp = r.AllocsPerOp()
+			res.BytesPerOp = r.AllocedBytesPerOp()
+			if r.Bytes > 0 && r.T > 0 {
+				res.MBps = float64(r.Bytes) * float64(r.N) / 1e6 / r.T.Seconds()
+			}
+		}
+		log.Printf("Benchmark %s: %d ns/op, %.1f MB/s", c.name, res.NsPerOp, res.MBps)
+		report.Results = append(report.Results, res)
+	}
+	b, _ := json.Marshal(report)
+	return string(b)
+}
+
+// benchRelayBuffer 通用缓冲路径 (内存到内存)
+func benchRelayBuffer(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(benchChunk)
+	src := io.LimitReader(zeroReader{}, int64(b.N)*benchChunk)
+	if _, err := relay(io.Discard, src); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// benchRelayTCP 回环 TCP 之间的转发 (Linux/Android 上走 splice)
+func benchRelayTCP(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(benchChunk)
+
+	// feeder -> in ==relay==> out -> sink
+	feeder, in, err := loopbackPair()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer in.Close()
+	out, sink, err := loopbackPair()
+	if err != nil {
+		feeder.Close()
+		b.Fatal(err)
+	}
+	defer out.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, sink)
+		sink.Close()
+		close(done)
+	}()
+	go func() {
+		buf := make([]byte, benchChunk)
+		for i := 0; i < b.N; i++ {
+			if _, err := feeder.Write(buf); err != nil {
+				break
+			}
+		}
+		feeder.Close()
+	}()
+
+	b.ResetTimer()
+	if _, err := relay(out, in); err != nil {
+		b.Fatal(err)
+	}
+	out.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+// loopbackPair 建立一对相连的回环 TCP 连接
+func loopbackPair() (net.Conn, net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := l.Accept()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// zeroReader 无限的全零数据
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// benchCrypt 单个包的加密
+func benchCrypt(b *testing.B, crypt string) {
+	pass := make([]byte, 32)
+	for i := range pass {
+		pass[i] = byte(i)
+	}
+	block, err := newBlockCrypt(crypt, pass)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(benchPacket)
+	packet := make([]byte, benchPacket)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		block.Encrypt(packet, packet)
+	}
+}
+
+// benchFEC 一组分片的 Reed-Solomon 编码
+func benchFEC(b *testing.B, data, parity int) {
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		b.Fatal(err)
+	}
+	shards := make([][]byte, data+parity)
+	for i := range shards {
+		shards[i] = make([]byte, benchPacket)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(data * benchPacket))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(shards); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchStatsJSON 统计快照及序列化 (GetStats 的开销)
+func benchStatsJSON(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(snapshotStats()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
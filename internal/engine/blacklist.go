@@ -0,0 +1,173 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 服务器 IP 黑名单: remoteaddr 为解析到多个地址的域名时，
+// 会话建立后很快断开的 IP 在 blacklistttl 内排到其他 IP 之后，重连时优先尝试其余地址。
+// 黑名单只在本次运行内有效，每次启动清空
+
+// 会话存活不足该时间即断开视为其服务器 IP 失败
+const blacklistMinLife = time.Minute
+
+// blacklistEntry 一个失败的服务器 IP
+type blacklistEntry struct {
+	failures int
+	until    time.Time
+}
+
+// blacklistInfo 黑名单诊断信息
+type blacklistInfo struct {
+	IP        string `json:"ip"`
+	Failures  int    `json:"failures"`  // 累计失败次数
+	Remaining int64  `json:"remaining"` // 剩余冷却秒数
+}
+
+var (
+	blacklistMu sync.Mutex
+	blacklist   map[string]*blacklistEntry
+)
+
+// resetBlacklist 清空黑名单 (每次启动)
+func resetBlacklist() {
+	blacklistMu.Lock()
+	blacklist = nil
+	blacklistMu.Unlock()
+}
+
+// blameSession 会话在 blacklistMinLife 内断开时将其服务器 IP 加入黑名单 (每个会话只计一次)
+func blameSession(config *Config, s *poolSession) {
+	if s == nil || config.BlacklistTTL < 0 || atomic.LoadInt32(&s.shutdown) != 0 {
+		return
+	}
+	if clk.Since(s.created) >= blacklistMinLife || !atomic.CompareAndSwapInt32(&s.blamed, 0, 1) {
+		return
+	}
+	host, _, err := net.SplitHostPort(s.link.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+
+	blacklistMu.Lock()
+	if blacklist == nil {
+		blacklist = make(map[string]*blacklistEntry)
+	}
+	e := blacklist[host]
+	if e == nil {
+		e = &blacklistEntry{}
+		blacklist[host] = e
+	}
+	e.failures++
+	e.until = clk.Now().Add(time.Duration(config.BlacklistTTL) * time.Second)
+	failures := e.failures
+	blacklistMu.Unlock()
+
+	log.Printf("Server %s blacklisted for %ds (failures: %d)", host, config.BlacklistTTL, failures)
+}
+
+// pickRemoteIP 选择第一个不在冷却中的 IP，全部在冷却中时选择最早结束冷却的
+func pickRemoteIP(ips []net.IP) net.IP {
+	blacklistMu.Lock()
+	defer blacklistMu.Unlock()
+
+	now := clk.Now()
+	var best net.IP
+	var bestUntil time.Time
+	for _, ip := range ips {
+		e := blacklist[ip.String()]
+		if e == nil || !now.Before(e.until) {
+			return ip
+		}
+		if best == nil || e.until.Before(bestUntil) {
+			best, bestUntil = ip, e.until
+		}
+	}
+	return best
+}
+
+// resolveRemote 解析 remoteaddr 并按黑名单选择服务器 IP
+func resolveRemote(config *Config, resolver *net.Resolver) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(config.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return net.ResolveUDPAddr("udp", net.JoinHostPort(synthesizeNAT64(config, resolver, ip).String(), port))
+	}
+
+	// 开启 dnsprefetch 时优先使用有效期内的预解析结果，实时解析失败时使用过期的结果
+	ips := prefetched(config, host, false)
+	if ips == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), tlsDialTimeout)
+		defer cancel()
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			if ips = prefetched(config, host, true); ips == nil {
+				return nil, err
+			}
+			log.Printf("Resolve %s failed, using prefetched addresses: %v", host, err)
+		} else {
+			ips = make([]net.IP, len(addrs))
+			for i, a := range addrs {
+				ips[i] = a.IP
+			}
+			if config.DNSPrefetch > 0 {
+				storePrefetch(host, ips)
+			}
+		}
+	}
+	ip := ips[0]
+	if config.BlacklistTTL >= 0 {
+		ip = pickRemoteIP(ips)
+	}
+	// 没有 DNS64 的纯 IPv6 网络上域名只解析出 IPv4 地址
+	ip = synthesizeNAT64(config, resolver, ip)
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(ip.String(), port))
+}
+
+// snapshotBlacklist 仍在冷却中的 IP，按剩余时间排序
+func snapshotBlacklist() []blacklistInfo {
+	blacklistMu.Lock()
+	defer blacklistMu.Unlock()
+
+	now := clk.Now()
+	var list []blacklistInfo
+	for ip, e := range blacklist {
+		if remain := e.until.Sub(now); remain > 0 {
+			list = append(list, blacklistInfo{IP: ip, Failures: e.failures, Remaining: int64(remain.Seconds())})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Remaining > list[j].Remaining })
+	return list
+}
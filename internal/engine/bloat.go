@@ -0,0 +1,180 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// 下行缓冲膨胀 (bufferbloat) 检测: 下行负载较高时 RTT 相对空闲基线的膨胀即为瓶颈缓冲区中的排队时延。
+// 每个 wireSampleInterval 采样一次，负载期间的膨胀换算为 0~100 的分数并平滑，计入统计和质量评分。
+// 控制流有单向时延样本时改用下行排队时延，避免把上行排队算到下行。
+// 开启 antibloat 后分数超过 bloatMitigateAt 时把接收窗口收缩到基线 RTT 对应的 BDP 附近，
+// 减少对端在途数据从而缩短排队，分数回落到 bloatRestoreAt 以下时恢复
+
+const (
+	bloatWindow     = 120  // 基线 RTT 取最小值的样本数 (约 10 分钟)
+	bloatMinRate    = 64e3 // 下行速率低于此字节/秒时不算负载
+	bloatLoadShare  = 0.5  // 下行速率达到峰值的此比例时算负载
+	bloatPeakDecay  = 0.98 // 峰值速率每次采样的衰减
+	bloatFull       = 400  // 膨胀达到此毫秒数时分数为 100
+	bloatAlpha      = 0.3  // 分数平滑系数
+	bloatMitigateAt = 50
+	bloatRestoreAt  = 20
+	bloatWndGain    = 2  // 收缩后的接收窗口为基线 BDP 的倍数
+	bloatMinWnd     = 32 // 收缩后的接收窗口下限 (包)
+)
+
+var (
+	bloatMu        sync.Mutex
+	bloatRTTs      []int64 // 各采样周期的平均 RTT 毫秒
+	bloatPeak      float64 // 衰减的峰值下行速率
+	bloatLastBytes uint64
+	bloatScore     float64
+	bloatInflation float64 // 最近一次负载期间的膨胀毫秒
+	bloatLoaded    bool
+	bloatValid     bool
+	bloatLimited   bool // 已收缩接收窗口
+	bloatRcv       int  // 收缩后的接收窗口 (开始缓解时按峰值速率和基线 RTT 计算，之后不变，避免随速率下降越缩越小)
+)
+
+// resetBloat 启动时清空
+func resetBloat() {
+	bloatMu.Lock()
+	bloatRTTs, bloatPeak, bloatScore, bloatInflation = nil, 0, 0, 0
+	bloatLoaded, bloatValid, bloatLimited, bloatRcv = false, false, false, 0
+	bloatLastBytes = atomic.LoadUint64(&statBytesDown)
+	bloatMu.Unlock()
+}
+
+// sampleBloat 采样一次下行负载和 RTT
+func sampleBloat(config *Config) {
+	quality.mu.Lock()
+	rtt, ok := quality.rtt, quality.valid
+	quality.mu.Unlock()
+	if !ok || rtt <= 0 {
+		return
+	}
+	down := atomic.LoadUint64(&statBytesDown)
+	oneWay := snapshotOneWay()
+
+	bloatMu.Lock()
+	rate := float64(down-bloatLastBytes) / wireSampleInterval.Seconds()
+	bloatLastBytes = down
+	bloatPeak = math.Max(rate, bloatPeak*bloatPeakDecay)
+	bloatRTTs = pushWindow(bloatRTTs, int64(rtt), bloatWindow)
+	base := float64(minOf(bloatRTTs))
+
+	bloatLoaded = rate >= bloatMinRate && rate >= bloatLoadShare*bloatPeak
+	if bloatLoaded {
+		inflation := rtt - base
+		if oneWay != nil && oneWay.Samples >= owdFilterSize {
+			inflation = oneWay.DownQueue
+		}
+		bloatInflation = math.Max(0, inflation)
+		score := 100 * clamp01(bloatInflation/bloatFull)
+		if !bloatValid {
+			bloatScore, bloatValid = score, true
+		} else {
+			bloatScore += bloatAlpha * (score - bloatScore)
+		}
+	} else if bloatValid {
+		// 空闲时逐渐回落
+		bloatScore -= bloatAlpha * bloatScore
+	}
+	score := bloatScore
+	mitigate := config.AntiBloat && !bloatLimited && score >= bloatMitigateAt
+	restore := bloatLimited && score < bloatRestoreAt
+	if mitigate {
+		bloatLimited = true
+		bloatRcv = maxInt(int(bloatPeak*base/1000/float64(currentMTU(config)))*bloatWndGain, bloatMinWnd)
+	} else if restore {
+		bloatLimited = false
+	}
+	limited, rcv := bloatLimited, bloatRcv
+	bloatMu.Unlock()
+
+	metricGauge("kcp_bufferbloat_score", "", score)
+	if mitigate {
+		log.Printf("Downstream bufferbloat: score %.0f, inflation %.0fms over %.0fms base, shrinking receive window", score, bloatInflation, base)
+		emitEvent("bufferbloat", map[string]interface{}{"score": int(score), "inflation": int(bloatInflation), "base": int(base), "mitigating": true})
+	} else if restore {
+		log.Printf("Downstream bufferbloat cleared: score %.0f, restoring receive window", score)
+		emitEvent("bufferbloat", map[string]interface{}{"score": int(score), "mitigating": false})
+	}
+	if limited || restore {
+		applyBloatWindow(config, rcv, limited)
+	}
+}
+
+// applyBloatWindow 收缩 (limited) 或恢复各会话的接收窗口
+func applyBloatWindow(config *Config, rcv int, limited bool) {
+	p := effectiveParams(config)
+	if !limited || rcv > p.RcvWnd {
+		rcv = p.RcvWnd
+	}
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	for _, s := range proxySessions {
+		if s.alive() && s.conn != nil {
+			s.conn.SetWindowSize(p.SndWnd, rcv)
+		}
+	}
+}
+
+// currentBloat 平滑后的分数 (尚无负载样本时为 0)
+func currentBloat() float64 {
+	bloatMu.Lock()
+	defer bloatMu.Unlock()
+	return bloatScore
+}
+
+// bloatStats 下行缓冲膨胀统计
+type bloatStats struct {
+	Score      int     `json:"score"`      // 0~100
+	Inflation  float64 `json:"inflation"`  // 最近一次负载期间的排队时延毫秒
+	BaseRTT    float64 `json:"basertt"`    // 空闲基线 RTT 毫秒
+	Loaded     bool    `json:"loaded"`     // 最近采样周期下行处于负载状态
+	Mitigating bool    `json:"mitigating"` // 已收缩接收窗口 (antibloat)
+}
+
+// snapshotBloat 返回缓冲膨胀统计 (尚无负载样本时为 nil)
+func snapshotBloat() *bloatStats {
+	bloatMu.Lock()
+	defer bloatMu.Unlock()
+	if !bloatValid {
+		return nil
+	}
+	return &bloatStats{
+		Score:      int(math.Round(bloatScore)),
+		Inflation:  bloatInflation,
+		BaseRTT:    float64(minOf(bloatRTTs)),
+		Loaded:     bloatLoaded,
+		Mitigating: bloatLimited,
+	}
+}
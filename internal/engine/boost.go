@@ -0,0 +1,111 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// 握手加速: 每个新连接最初的 boostBytes 字节 (TLS ClientHello、HTTP 请求、DNS 查询等)
+// 视为交互流量；同一会话上有交互数据正在写入时，批量流量的写入稍作等待，
+// 让交互数据先进入 KCP 发送队列，避免排在大量下载/上传数据之后
+// 只能调度本端上行方向，下行顺序由服务端决定
+
+const (
+	boostBytes   = 4096                  // 每个新连接视为交互流量的字节数
+	boostMaxWait = 20 * time.Millisecond // 批量写入最长等待时间，避免饿死
+)
+
+// priorityGate 会话级的交互优先门
+type priorityGate struct {
+	mu     sync.Mutex
+	active int
+	idle   chan struct{} // active 为 0 时处于关闭状态
+}
+
+func newPriorityGate() *priorityGate {
+	idle := make(chan struct{})
+	close(idle)
+	return &priorityGate{idle: idle}
+}
+
+// enter 开始一次交互写入
+func (g *priorityGate) enter() {
+	g.mu.Lock()
+	if g.active == 0 {
+		g.idle = make(chan struct{})
+	}
+	g.active++
+	g.mu.Unlock()
+}
+
+// leave 结束一次交互写入
+func (g *priorityGate) leave() {
+	g.mu.Lock()
+	g.active--
+	if g.active == 0 {
+		close(g.idle)
+	}
+	g.mu.Unlock()
+}
+
+// wait 批量写入前等待交互写入完成 (最多 maxWait)
+func (g *priorityGate) wait(maxWait time.Duration) {
+	g.mu.Lock()
+	idle := g.idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+		return
+	default:
+	}
+	select {
+	case <-idle:
+	case <-clk.After(maxWait):
+	}
+}
+
+// boostWriter 上行写入: 前 boostBytes 字节按交互流量写入，之后按批量流量写入
+type boostWriter struct {
+	w       io.Writer
+	gate    *priorityGate
+	written int
+}
+
+func (b *boostWriter) Write(p []byte) (int, error) {
+	if b.written >= boostBytes {
+		b.gate.wait(boostMaxWait)
+		return b.w.Write(p)
+	}
+
+	b.gate.enter()
+	n, err := b.w.Write(p)
+	b.gate.leave()
+	b.written += n
+	return n, err
+}
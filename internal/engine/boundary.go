@@ -0,0 +1,144 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// 跨语言边界开销: 每次回调 (OnEvent/OnStats) 都要经过 gomobile 的 JNI/ObjC 桥接，
+// 这里记录回调耗时 (包括桥接和 App 处理) 以及统计快照的序列化耗时，
+// 并可把短时间内的多个事件合并为一次回调，减少频繁事件的跨边界调用
+
+const eventBatchMax = 64 // 一次回调最多合并的事件数
+
+// callStat 一类回调的耗时统计
+type callStat struct {
+	mu    sync.Mutex
+	calls uint64
+	items uint64 // 回调携带的事件数 (统计快照为 1)
+	total time.Duration
+	max   time.Duration
+}
+
+func (c *callStat) observe(d time.Duration, items int) {
+	c.mu.Lock()
+	c.calls++
+	c.items += uint64(items)
+	c.total += d
+	if d > c.max {
+		c.max = d
+	}
+	c.mu.Unlock()
+}
+
+// boundaryCall 一类回调的统计快照 (微秒)
+type boundaryCall struct {
+	Calls uint64 `json:"calls"`
+	Items uint64 `json:"items"`
+	AvgUs int64  `json:"avgus"`
+	MaxUs int64  `json:"maxus"`
+}
+
+func (c *callStat) snapshot() boundaryCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := boundaryCall{Calls: c.calls, Items: c.items, MaxUs: c.max.Microseconds()}
+	if c.calls > 0 {
+		b.AvgUs = (c.total / time.Duration(c.calls)).Microseconds()
+	}
+	return b
+}
+
+var (
+	eventCalls    callStat // OnEvent 回调
+	statsCalls    callStat // OnStats 回调
+	statsMarshals callStat // 统计快照生成和序列化
+
+	eventFlush time.Duration // 事件合并间隔 (0 表示逐条回调)，由 eventMu 保护
+)
+
+// boundaryStats 跨语言边界开销统计
+type boundaryStats struct {
+	Events       boundaryCall `json:"events"`
+	Stats        boundaryCall `json:"stats"`
+	StatsMarshal boundaryCall `json:"statsmarshal"`
+	FlushMs      int64        `json:"flushms"` // 事件合并间隔
+}
+
+func snapshotBoundary() *boundaryStats {
+	eventMu.Lock()
+	flush := eventFlush
+	eventMu.Unlock()
+	return &boundaryStats{
+		Events:       eventCalls.snapshot(),
+		Stats:        statsCalls.snapshot(),
+		StatsMarshal: statsMarshals.snapshot(),
+		FlushMs:      flush.Milliseconds(),
+	}
+}
+
+// SetEventBatching 设置事件合并间隔毫秒数
+// flushMs > 0 时第一个事件到达后最多等待 flushMs，把期间的事件 (最多 64 个) 合并为一次回调，
+// OnEvent 收到的是事件的 JSON 数组 "[{...}, {...}]"；flushMs <= 0 恢复逐条回调 (默认)
+func SetEventBatching(flushMs int) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	if flushMs < 0 {
+		flushMs = 0
+	}
+	eventFlush = time.Duration(flushMs) * time.Millisecond
+}
+
+// nextEvents 取出下一次回调的内容和事件数
+func nextEvents(queue chan string, first string) (string, int) {
+	eventMu.Lock()
+	flush := eventFlush
+	eventMu.Unlock()
+	if flush <= 0 {
+		return first, 1
+	}
+
+	batch := []string{first}
+	timer := clk.After(flush)
+collect:
+	for len(batch) < eventBatchMax {
+		select {
+		case ev := <-queue:
+			batch = append(batch, ev)
+		case <-timer:
+			break collect
+		}
+	}
+	return "[" + strings.Join(batch, ",") + "]", len(batch)
+}
+
+// observeCallback 记录一次回调耗时
+func observeCallback(c *callStat, kind string, d time.Duration, items int) {
+	c.observe(d, items)
+	metricObserve("kcp_callback_ms", "kind="+kind, float64(d)/float64(time.Millisecond))
+}
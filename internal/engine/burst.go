@@ -0,0 +1,208 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 突发预算: 蜂窝网络的无线模块空闲一段时间后会降到低功耗状态，再次发送时需要重新唤醒，
+// 唤醒后的活跃期内尽快发完数据比平滑地拉长发送更省电、单次唤醒的吞吐也更高。
+// 配置 burstbudget 后，会话上行空闲 burstRefill 以上即补满预算，下一次发送先以线速 (不超过服务端通告的上限) 突发，
+// 预算用完再恢复 samplePacing 计算的平滑速率，保持长时间传输的平均平滑。
+// 仅在平滑发送生效 (开启 pacing 且未配置 ratelimit) 时工作，完整性测试结果中给出突发统计
+
+const (
+	burstTick   = 25 * time.Millisecond // 检测上行流量的间隔
+	burstRefill = time.Second           // 上行空闲多久后视为无线已休眠、补满预算
+)
+
+// burstState 单个会话的突发状态 (由 burstMu 保护)
+type burstState struct {
+	last     uint64    // 上次检测时的上行字节数
+	active   time.Time // 最近一次有上行流量的时间
+	left     int64     // 剩余预算字节
+	bursting bool      // 已解除速率限制
+	pace     uint32    // samplePacing 给出的平滑速率 (尚未计算时为 0)
+}
+
+var (
+	burstMu     sync.Mutex
+	burstStates = make(map[*poolSession]*burstState)
+
+	burstOn    int32 // 非 0 表示突发预算生效
+	burstWakes uint64
+	burstBytes uint64 // 以线速突发的上行字节
+	burstPaced uint64 // 预算用完后平滑发送的上行字节
+)
+
+// burstMeasure 突发统计
+type burstMeasure struct {
+	Wakes      uint64 `json:"wakes"`      // 空闲后开始突发的次数
+	BurstBytes uint64 `json:"burstbytes"` // 以线速发送的字节
+	PacedBytes uint64 `json:"pacedbytes"` // 平滑发送的字节
+	PerWake    uint64 `json:"perwake"`    // 平均每次唤醒发送的字节
+}
+
+// snapshotBurst 返回累计的突发统计 (未开启突发预算时为 nil)
+func snapshotBurst() *burstMeasure {
+	if atomic.LoadInt32(&burstOn) == 0 {
+		return nil
+	}
+	m := &burstMeasure{
+		Wakes:      atomic.LoadUint64(&burstWakes),
+		BurstBytes: atomic.LoadUint64(&burstBytes),
+		PacedBytes: atomic.LoadUint64(&burstPaced),
+	}
+	m.fillPerWake()
+	return m
+}
+
+// since 返回自 prev 以来的增量
+func (m *burstMeasure) since(prev *burstMeasure) *burstMeasure {
+	if m == nil || prev == nil {
+		return nil
+	}
+	d := &burstMeasure{
+		Wakes:      m.Wakes - prev.Wakes,
+		BurstBytes: m.BurstBytes - prev.BurstBytes,
+		PacedBytes: m.PacedBytes - prev.PacedBytes,
+	}
+	d.fillPerWake()
+	return d
+}
+
+func (m *burstMeasure) fillPerWake() {
+	if m.Wakes > 0 {
+		m.PerWake = (m.BurstBytes + m.PacedBytes) / m.Wakes
+	}
+}
+
+// setPaceRate 记录并应用平滑速率，会话正在突发时只记录，预算用完后再应用
+func setPaceRate(s *poolSession, rate uint32) {
+	burstMu.Lock()
+	defer burstMu.Unlock()
+	if st := burstStates[s]; st != nil {
+		st.pace = rate
+		if st.bursting {
+			return
+		}
+	}
+	s.conn.SetRateLimit(rate)
+}
+
+// burstLoop 按上行流量切换各会话的突发和平滑发送
+func burstLoop(config *Config, stop chan struct{}) {
+	atomic.StoreInt32(&burstOn, 1)
+	defer func() {
+		atomic.StoreInt32(&burstOn, 0)
+		burstMu.Lock()
+		burstStates = make(map[*poolSession]*burstState)
+		burstMu.Unlock()
+	}()
+
+	ticker := clk.NewTicker(burstTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.Chan():
+		}
+		if !pacingOn(config) {
+			continue
+		}
+		sampleBurst(int64(config.BurstBudget))
+	}
+}
+
+// sampleBurst 检测一次各会话的上行流量
+func sampleBurst(budget int64) {
+	proxyMu.Lock()
+	sessions := make([]*poolSession, 0, len(proxySessions))
+	for _, s := range proxySessions {
+		if s.alive() && s.conn != nil {
+			sessions = append(sessions, s)
+		}
+	}
+	proxyMu.Unlock()
+
+	// 突发时解除平滑限制，但不超过服务端通告的单会话上限
+	lift := uint32(sessionRateCap())
+	now := clk.Now()
+	burstMu.Lock()
+	defer burstMu.Unlock()
+
+	seen := make(map[*poolSession]bool, len(sessions))
+	for _, s := range sessions {
+		seen[s] = true
+		up := atomic.LoadUint64(&s.bytesUp)
+		st := burstStates[s]
+		if st == nil {
+			st = &burstState{last: up, active: now, left: budget}
+			burstStates[s] = st
+			continue
+		}
+		delta := int64(up - st.last)
+		st.last = up
+		if delta == 0 {
+			if !st.bursting && st.left < budget && now.Sub(st.active) >= burstRefill {
+				st.left = budget
+			}
+			continue
+		}
+		st.active = now
+
+		if st.left <= 0 {
+			atomic.AddUint64(&burstPaced, uint64(delta))
+			continue
+		}
+		if !st.bursting {
+			st.bursting = true
+			s.conn.SetRateLimit(lift)
+			atomic.AddUint64(&burstWakes, 1)
+		}
+		used := delta
+		if used > st.left {
+			used = st.left
+		}
+		st.left -= used
+		atomic.AddUint64(&burstBytes, uint64(used))
+		atomic.AddUint64(&burstPaced, uint64(delta-used))
+		if st.left <= 0 {
+			st.bursting = false
+			if st.pace > 0 {
+				s.conn.SetRateLimit(st.pace)
+			}
+		}
+	}
+	for s := range burstStates {
+		if !seen[s] {
+			delete(burstStates, s)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"strings"
+)
+
+// 能力协商: 客户端在控制流的第一个 ping 中声明需要服务端配合的可选功能 (caps)，
+// 服务端回复 {"type":"caps","caps":[...]}，列出其中它也支持的部分。
+// 这些功能只在协商成功后启用，控制流重连时重新协商
+
+const capBind = "bind" // SOCKS5 BIND: 服务端代理在其公网地址上监听入站连接
+
+// clientCaps 按配置列出客户端声明的能力
+func clientCaps(config *Config) []string {
+	var caps []string
+	if config.SocksBind {
+		caps = append(caps, capBind)
+	}
+	if config.ICMPRelay {
+		caps = append(caps, capICMP)
+	}
+	if config.AcceptServerRate {
+		caps = append(caps, capRate)
+	}
+	if fecDirEnabled(config) {
+		caps = append(caps, capFECDir)
+	}
+	if config.MappedAddr != "" {
+		caps = append(caps, capMapped)
+	}
+	return caps
+}
+
+// handleServerCaps 记录服务端确认的能力
+func handleServerCaps(config *Config, msg *ctrlMessage) {
+	ctrlMu.Lock()
+	ctrlState.Caps = msg.Caps
+	ctrlMu.Unlock()
+	log.Printf("Server capabilities: [%s]", strings.Join(msg.Caps, ", "))
+	handleServerRate(config, msg)
+}
+
+// serverSupports 服务端是否已在控制流中确认支持 cap
+func serverSupports(cap string) bool {
+	ctrlMu.Lock()
+	defer ctrlMu.Unlock()
+	for _, c := range ctrlState.Caps {
+		if c == cap {
+			return true
+		}
+	}
+	return false
+}
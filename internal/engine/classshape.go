@@ -0,0 +1,237 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 按类别整形: 连接按路由规则的 class 字段或 classports 的目标端口归入类别，
+// classshares 为类别设置占估计容量的百分比 (如 {"bulk": 80})，同类别的所有流共享一个上行和一个下行令牌桶，
+// 使大流量类别跑满时交互流量仍有余量。
+// 容量按各方向的衰减峰值吞吐估计，服务端通告了带宽上限时不超过上限；
+// 有类别正被限速 (达到限额的 classBindingShare) 时峰值不衰减，避免限速后的吞吐把估计越拉越低。
+// 容量尚未估计出来之前不限速
+
+const (
+	classPeakDecay    = 0.98     // 峰值吞吐每次采样的衰减
+	classBindingShare = 0.9      // 类别速率达到限额的此比例时视为正在限速
+	classMinRate      = 32 << 10 // 限额下限字节/秒
+)
+
+const (
+	classUp = iota
+	classDown
+)
+
+// classShaper 一个类别的限速器和计数
+type classShaper struct {
+	share   int
+	limits  [2]*rateLimiter // 尚未估计出容量时为 nil
+	bytes   [2]uint64
+	last    [2]uint64
+	rates   [2]float64 // 最近一次采样的速率
+	binding bool       // 最近一次采样时正在限速
+}
+
+var (
+	classMu      sync.Mutex
+	classShapers map[string]*classShaper
+	classPeak    [2]float64 // 各方向的峰值吞吐估计
+	classLast    [2]uint64
+	classAt      time.Time
+)
+
+// resetClasses 启动时按配置创建各类别
+func resetClasses(config *Config) {
+	classMu.Lock()
+	defer classMu.Unlock()
+	classShapers = make(map[string]*classShaper, len(config.ClassShares))
+	for class, share := range config.ClassShares {
+		classShapers[class] = &classShaper{share: share}
+	}
+	classPeak = [2]float64{}
+	classLast = [2]uint64{atomic.LoadUint64(&statBytesUp), atomic.LoadUint64(&statBytesDown)}
+	classAt = clk.Now()
+}
+
+// streamClass 连接的类别: 先看命中规则的 class，再看目标端口
+func streamClass(config *Config, host, target string) string {
+	if rs := currentRules(config); rs != nil {
+		if idx := rs.match(host); idx >= 0 && rs.rules[idx].Class != "" {
+			return rs.rules[idx].Class
+		}
+	}
+	if len(config.ClassPorts) == 0 {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return ""
+	}
+	p, _ := strconv.Atoi(port)
+	names := make([]string, 0, len(config.ClassPorts))
+	for class := range config.ClassPorts {
+		names = append(names, class)
+	}
+	// 端口出现在多个类别时结果固定
+	sort.Strings(names)
+	for _, class := range names {
+		for _, cp := range config.ClassPorts[class] {
+			if cp == p {
+				return class
+			}
+		}
+	}
+	return ""
+}
+
+// wrapClass 为配置了份额的类别加上共享限速
+func wrapClass(class string, up, down io.Writer) (io.Writer, io.Writer) {
+	classMu.Lock()
+	c := classShapers[class]
+	classMu.Unlock()
+	if c == nil {
+		return up, down
+	}
+	return &classWriter{up, c, classUp}, &classWriter{down, c, classDown}
+}
+
+// classWriter 按类别限速并计数的写入
+type classWriter struct {
+	w   io.Writer
+	c   *classShaper
+	dir int
+}
+
+func (w *classWriter) Write(p []byte) (int, error) {
+	classMu.Lock()
+	limit := w.c.limits[w.dir]
+	classMu.Unlock()
+	if limit != nil {
+		limit.wait(len(p))
+	}
+	n, err := w.w.Write(p)
+	atomic.AddUint64(&w.c.bytes[w.dir], uint64(n))
+	return n, err
+}
+
+// sampleClasses 更新容量估计和各类别的限额
+func sampleClasses(config *Config) {
+	if len(config.ClassShares) == 0 {
+		return
+	}
+	capped := float64(serverRate())
+
+	classMu.Lock()
+	defer classMu.Unlock()
+	now := clk.Now()
+	secs := now.Sub(classAt).Seconds()
+	if secs <= 0 {
+		return
+	}
+	classAt = now
+
+	binding := false
+	for _, c := range classShapers {
+		c.binding = false
+		for dir := range c.bytes {
+			b := atomic.LoadUint64(&c.bytes[dir])
+			c.rates[dir] = float64(b-c.last[dir]) / secs
+			c.last[dir] = b
+			if l := c.limits[dir]; l != nil && c.rates[dir] >= l.currentRate()*classBindingShare {
+				c.binding = true
+			}
+		}
+		binding = binding || c.binding
+	}
+
+	total := [2]uint64{atomic.LoadUint64(&statBytesUp), atomic.LoadUint64(&statBytesDown)}
+	for dir := range total {
+		rate := float64(total[dir]-classLast[dir]) / secs
+		classLast[dir] = total[dir]
+		if !binding {
+			classPeak[dir] *= classPeakDecay
+		}
+		classPeak[dir] = math.Max(classPeak[dir], rate)
+		if capped > 0 && classPeak[dir] > capped {
+			classPeak[dir] = capped
+		}
+	}
+
+	for _, c := range classShapers {
+		for dir := range c.limits {
+			if classPeak[dir] < classMinRate {
+				continue
+			}
+			limit := math.Max(classPeak[dir]*float64(c.share)/100, classMinRate)
+			if c.limits[dir] == nil {
+				c.limits[dir] = newRateLimiter(int(limit))
+			} else {
+				c.limits[dir].setRate(limit)
+			}
+		}
+	}
+}
+
+// classStats 单个类别的整形统计
+type classStats struct {
+	Class     string  `json:"class"`
+	Share     int     `json:"share"`     // 占估计容量的百分比
+	LimitUp   float64 `json:"limitup"`   // 上行限额字节/秒 (0 表示尚未限速)
+	LimitDown float64 `json:"limitdown"` // 下行限额字节/秒
+	RateUp    float64 `json:"rateup"`
+	RateDown  float64 `json:"ratedown"`
+	Binding   bool    `json:"binding"` // 正在限速
+}
+
+// snapshotClasses 返回各类别的整形统计 (未配置 classshares 时为 nil)
+func snapshotClasses() []classStats {
+	classMu.Lock()
+	defer classMu.Unlock()
+	if len(classShapers) == 0 {
+		return nil
+	}
+	list := make([]classStats, 0, len(classShapers))
+	for class, c := range classShapers {
+		s := classStats{Class: class, Share: c.share, RateUp: c.rates[classUp], RateDown: c.rates[classDown], Binding: c.binding}
+		if l := c.limits[classUp]; l != nil {
+			s.LimitUp = l.currentRate()
+		}
+		if l := c.limits[classDown]; l != nil {
+			s.LimitDown = l.currentRate()
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Class < list[j].Class })
+	return list
+}
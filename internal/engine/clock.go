@@ -0,0 +1,196 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// clock 时间抽象，所有定时逻辑 (看门狗、统计推送、限速等) 都通过它获取时间，
+// 测试时可替换为 manualClock 以确定性地推进时间
+type clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) clockTimer
+	NewTicker(d time.Duration) clockTicker
+	Sleep(d time.Duration)
+}
+
+// clockTimer 可停止的定时器
+type clockTimer interface {
+	Stop() bool
+}
+
+// clockTicker 周期定时器
+type clockTicker interface {
+	Chan() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// clk 全局时钟
+var clk clock = realClock{}
+
+// realClock 系统时钟
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return time.AfterFunc(d, f)
+}
+
+func (realClock) NewTicker(d time.Duration) clockTicker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) Chan() <-chan time.Time { return t.C }
+
+// manualClock 手动推进的时钟 (测试用)
+// 只有调用 Advance 时时间才会前进，到期的定时器按时间顺序触发
+type manualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*manualWaiter
+}
+
+// manualWaiter 等待到期的定时器/周期定时器/Sleep
+type manualWaiter struct {
+	when   time.Time
+	period time.Duration // > 0 表示周期定时器
+	ch     chan time.Time
+	fn     func()
+	clock  *manualClock
+}
+
+func newManualClock(now time.Time) *manualClock {
+	return &manualClock{now: now}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	w := c.add(d, 0, nil)
+	return w.ch
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return c.add(d, 0, f)
+}
+
+func (c *manualClock) NewTicker(d time.Duration) clockTicker {
+	return manualTicker{c.add(d, d, nil)}
+}
+
+func (c *manualClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Advance 推进时间并触发所有到期的定时器
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.waiters, func(i, j int) bool { return c.waiters[i].when.Before(c.waiters[j].when) })
+		if len(c.waiters) == 0 || c.waiters[0].when.After(end) {
+			break
+		}
+		w := c.waiters[0]
+		c.now = w.when
+		if w.period > 0 {
+			w.when = w.when.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+
+		c.mu.Unlock()
+		if w.fn != nil {
+			w.fn()
+		} else {
+			select {
+			case w.ch <- c.now:
+			default:
+			}
+		}
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+func (c *manualClock) add(d, period time.Duration, f func()) *manualWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &manualWaiter{when: c.now.Add(d), period: period, ch: make(chan time.Time, 1), fn: f, clock: c}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+func (w *manualWaiter) Stop() bool {
+	c := w.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, x := range c.waiters {
+		if x == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// manualTicker 手动时钟的周期定时器
+type manualTicker struct{ w *manualWaiter }
+
+func (t manualTicker) Chan() <-chan time.Time { return t.w.ch }
+func (t manualTicker) Stop()                  { t.w.Stop() }
+
+func (t manualTicker) Reset(d time.Duration) {
+	t.w.Stop()
+	c := t.w.clock
+	c.mu.Lock()
+	t.w.when = c.now.Add(d)
+	t.w.period = d
+	c.waiters = append(c.waiters, t.w)
+	c.mu.Unlock()
+}
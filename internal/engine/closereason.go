@@ -0,0 +1,113 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// 连接关闭原因: 每条连接结束时归入一类，按类计数并写入连接日志
+const (
+	closeClientEOF   = "client-eof"   // 本地客户端正常关闭
+	closeRemoteEOF   = "remote-eof"   // 远端正常关闭流
+	closeClientError = "client-error" // 本地连接读写出错
+	closeRemoteError = "remote-error" // 流读写出错
+	closeTimeout     = "timeout"      // 读写超时
+	closeSessionLost = "session-lost" // 所属会话断开，或等待可用会话超时
+	closeOpenFailed  = "open-failed"  // OpenStream 或直连拨号失败
+	closePolicy      = "policy"       // 来源过滤或 reject 规则拒绝
+	closeOverload    = "overload"     // 停车场已满
+	closeShutdown    = "shutdown"     // 代理停止或重启
+	closeTrimmed     = "trimmed"      // 内存压力下被回收
+	closeKillSwitch  = "killswitch"   // 隧道断开期间被断网保护拒绝
+	closeDraining    = "draining"     // 排空期间拒绝的新连接
+)
+
+var closeReasons = [...]string{
+	closeClientEOF, closeRemoteEOF, closeClientError, closeRemoteError, closeTimeout,
+	closeSessionLost, closeOpenFailed, closePolicy, closeOverload, closeShutdown, closeTrimmed, closeKillSwitch,
+	closeDraining,
+}
+
+var closeReasonCount [len(closeReasons)]uint64
+
+// countClose 按原因计数
+func countClose(reason string) {
+	metricCount("kcp_conns_closed_total", "reason="+reason, 1)
+	for i, r := range closeReasons {
+		if r == reason {
+			atomic.AddUint64(&closeReasonCount[i], 1)
+			return
+		}
+	}
+}
+
+// closeReasonStats 返回各关闭原因的计数
+func closeReasonStats() map[string]uint64 {
+	m := make(map[string]uint64, len(closeReasons))
+	for i, r := range closeReasons {
+		m[r] = atomic.LoadUint64(&closeReasonCount[i])
+	}
+	return m
+}
+
+// classifyClose 根据先结束的方向及其错误判断关闭原因
+// fromClient 为 true 表示客户端 -> 流方向先结束
+// session 为 nil 表示直连
+func classifyClose(session *poolSession, fromClient bool, err error) string {
+	if session != nil && session.IsClosed() {
+		if atomic.LoadInt32(&session.shutdown) != 0 {
+			return closeShutdown
+		}
+		return closeSessionLost
+	}
+
+	if errors.Is(err, errRuleRejected) {
+		return closePolicy
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return closeTimeout
+	}
+	switch {
+	case fromClient && err == nil:
+		return closeClientEOF
+	case fromClient:
+		return closeClientError
+	case err == nil:
+		return closeRemoteEOF
+	default:
+		return closeRemoteError
+	}
+}
+
+// closeSessionForShutdown 代理停止时关闭会话，其上的连接归为 shutdown
+func closeSessionForShutdown(s *poolSession) {
+	atomic.StoreInt32(&s.shutdown, 1)
+	s.Close()
+}
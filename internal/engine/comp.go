@@ -0,0 +1,233 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// snappy 压缩: 与 kcptun 的 --nocomp=false 一致，直接包装在 KCP 连接上 (QPP 在其外层)，
+// 服务端必须使用相同的设置
+//
+// zstd 压缩 (comp=zstd，需要服务端支持): 可使用 App 提供的预训练字典 (zstd --train 生成)，
+// 对 JSON API 等高度重复的协议压缩率明显更高。每个会话建立时在 KCP 连接上交换
+// "ZSTD" + 字典 ID (字典内容 SHA-256 的前 4 字节，无字典为 0)，服务端原样回复表示接受
+
+const (
+	zstdMagic            = "ZSTD"
+	compNegotiateTimeout = 5 * time.Second
+)
+
+var (
+	statCompPlainOut uint64 // 压缩前发送的字节数
+	statCompWireOut  uint64 // 压缩后发送的字节数
+	statCompPlainIn  uint64 // 解压后接收的字节数
+	statCompWireIn   uint64 // 解压前接收的字节数
+	statCompEncode   uint64 // 压缩耗时 (纳秒)
+	statCompDecode   uint64 // 解压耗时 (纳秒，不含等待网络数据的时间)
+)
+
+// compStats 压缩统计 (评估压缩率和 CPU 开销)
+type compStats struct {
+	Algo     string  `json:"algo"`
+	PlainOut uint64  `json:"plainout"`
+	WireOut  uint64  `json:"wireout"`
+	PlainIn  uint64  `json:"plainin"`
+	WireIn   uint64  `json:"wirein"`
+	Ratio    float64 `json:"ratio"`    // 压缩后 / 压缩前 (双向合计)
+	EncodeMs int64   `json:"encodems"` // 累计压缩耗时
+	DecodeMs int64   `json:"decodems"` // 累计解压耗时
+}
+
+func snapshotComp(algo string) *compStats {
+	c := &compStats{
+		Algo:     algo,
+		PlainOut: atomic.LoadUint64(&statCompPlainOut),
+		WireOut:  atomic.LoadUint64(&statCompWireOut),
+		PlainIn:  atomic.LoadUint64(&statCompPlainIn),
+		WireIn:   atomic.LoadUint64(&statCompWireIn),
+		EncodeMs: time.Duration(atomic.LoadUint64(&statCompEncode)).Milliseconds(),
+		DecodeMs: time.Duration(atomic.LoadUint64(&statCompDecode)).Milliseconds(),
+	}
+	if plain := c.PlainOut + c.PlainIn; plain > 0 {
+		c.Ratio = float64(c.WireOut+c.WireIn) / float64(plain)
+	}
+	return c
+}
+
+// resetComp 清零压缩统计
+func resetComp() {
+	for _, c := range []*uint64{&statCompPlainOut, &statCompWireOut, &statCompPlainIn, &statCompWireIn, &statCompEncode, &statCompDecode} {
+		atomic.StoreUint64(c, 0)
+	}
+}
+
+// wireReader 统计压缩数据的字节数和等待时间 (用于从解压耗时中扣除)
+type wireReader struct {
+	r    io.Reader
+	wait time.Duration // 仅读取协程访问
+}
+
+func (w *wireReader) Read(b []byte) (int, error) {
+	start := clk.Now()
+	n, err := w.r.Read(b)
+	w.wait += clk.Since(start)
+	atomic.AddUint64(&statCompWireIn, uint64(n))
+	return n, err
+}
+
+// flushWriter 带 Flush 的压缩写入器 (snappy.Writer, zstd.Encoder)
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// compConn 与 kcptun 的 CompStream 相同: 每次写入后立即 Flush
+type compConn struct {
+	net.Conn
+	w       flushWriter
+	r       io.Reader
+	wire    *wireReader
+	release func() // 释放解压器资源 (可为 nil)
+}
+
+func newCompConn(conn net.Conn) *compConn {
+	wire := &wireReader{r: conn}
+	return &compConn{
+		Conn: conn,
+		w:    snappy.NewBufferedWriter(&countWriter{conn, &statCompWireOut}),
+		r:    snappy.NewReader(wire),
+		wire: wire,
+	}
+}
+
+// newZstdConn 创建 zstd 压缩连接，dict 为空表示不使用字典
+func newZstdConn(conn net.Conn, dict []byte) (*compConn, error) {
+	eopts := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1)}
+	dopts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true)}
+	if len(dict) > 0 {
+		eopts = append(eopts, zstd.WithEncoderDict(dict))
+		dopts = append(dopts, zstd.WithDecoderDicts(dict))
+	}
+
+	wire := &wireReader{r: conn}
+	enc, err := zstd.NewWriter(&countWriter{conn, &statCompWireOut}, eopts...)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(wire, dopts...)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	return &compConn{Conn: conn, w: enc, r: dec, wire: wire, release: dec.Close}, nil
+}
+
+func (c *compConn) Read(b []byte) (int, error) {
+	start := clk.Now()
+	c.wire.wait = 0
+	n, err := c.r.Read(b)
+	if d := clk.Since(start) - c.wire.wait; d > 0 {
+		atomic.AddUint64(&statCompDecode, uint64(d))
+	}
+	atomic.AddUint64(&statCompPlainIn, uint64(n))
+	return n, err
+}
+
+func (c *compConn) Write(b []byte) (int, error) {
+	start := clk.Now()
+	defer func() { atomic.AddUint64(&statCompEncode, uint64(clk.Since(start))) }()
+
+	if _, err := c.w.Write(b); err != nil {
+		return 0, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	atomic.AddUint64(&statCompPlainOut, uint64(len(b)))
+	return len(b), nil
+}
+
+func (c *compConn) Close() error {
+	if c.release != nil {
+		c.release()
+	}
+	return c.Conn.Close()
+}
+
+// loadCompDict 加载 zstd 字典
+func loadCompDict(config *Config) error {
+	config.compDict = nil
+	if config.CompDict == "" {
+		return nil
+	}
+	b, err := os.ReadFile(config.CompDict)
+	if err != nil {
+		return err
+	}
+	config.compDict = b
+	return nil
+}
+
+// compDictID 字典 ID: 内容 SHA-256 的前 4 字节，无字典为 0
+func compDictID(dict []byte) uint32 {
+	if len(dict) == 0 {
+		return 0
+	}
+	sum := sha256.Sum256(dict)
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// negotiateZstd 与服务端协商 zstd 压缩和字典
+func negotiateZstd(conn net.Conn, dict []byte) error {
+	hello := make([]byte, 8)
+	copy(hello, zstdMagic)
+	binary.BigEndian.PutUint32(hello[4:], compDictID(dict))
+
+	conn.SetDeadline(clk.Now().Add(compNegotiateTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(hello); err != nil {
+		return err
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("zstd negotiation: %v (server may not support comp=zstd)", err)
+	}
+	if !bytes.Equal(reply, hello) {
+		return fmt.Errorf("zstd negotiation: server rejected dictionary %08x", compDictID(dict))
+	}
+	return nil
+}
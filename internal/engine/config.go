@@ -0,0 +1,358 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Config 客户端配置
+// 通过 JSON 传入，支持与 kcptun 服务端匹配的配置
+type Config struct {
+	APIVersion int `json:"apiversion"` // 配置所针对的 JSON API 版本 (见 GetAPIVersion，默认 1)
+
+	// 必填参数
+	LocalAddr  string `json:"localaddr"`  // 本地监听地址 (如 "127.0.0.1:1080"，可写成数组同时监听多个地址)
+	RemoteAddr string `json:"remoteaddr"` // 远程服务器地址 (如 "1.2.3.4:4000")
+	Label      string `json:"label"`      // 实例标签，统计、事件和日志按标签区分 (1-32 个字母、数字或 '_'、'.'、'-'，默认 "default")
+
+	// 本地监听 TLS 参数 (HTTPS 代理端点)
+	LocalTLSCert string `json:"localtlscert"` // 本地监听使用的证书链 (PEM，配置后本地监听只接受 TLS 连接，默认空)
+	LocalTLSKey  string `json:"localtlskey"`  // 证书私钥 (PEM，与 localtlscert 同时配置)
+	LocalTLSALPN string `json:"localtlsalpn"` // 本地 TLS 的 ALPN 列表，逗号分隔；"passthrough" 表示选择客户端首选的协议，需服务端代理支持该协议 (默认 "http/1.1")
+
+	// 加密参数 (与 kcptun 的 --key/--crypt 一致)
+	Key   string `json:"key"`   // 预共享密钥 (默认 "it's a secrect")
+	Crypt string `json:"crypt"` // 加密方式: aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none, null (默认 none)
+
+	// QPP 参数 (与 kcptun 的 --QPP/--QPPCount 一致)
+	QPP      bool `json:"qpp"`      // 启用 Quantum Permutation Pad 混淆 (默认 false)
+	QPPCount int  `json:"qppcount"` // 置换表数量，建议使用质数 (默认 61)
+
+	// 模式参数
+	Mode    string `json:"mode"`    // 模式: fast3, fast2, fast, normal, manual (默认 fast)
+	Profile string `json:"profile"` // 预设档位: gaming (交互低延迟), download (大流量), auto (按流量在 gaming/download/balanced 间自动切换)；档位参数作为基础，显式配置的字段优先 (默认空不使用)
+
+	// 连接参数
+	Conn        int   `json:"conn"`        // UDP 连接数量，显式配置为 0 时按需建立会话 (默认 1)
+	MaxConn     int   `json:"maxconn"`     // conn 为 0 时按需建立的会话数上限 (默认 4)
+	MinReady    int   `json:"minready"`    // 启动时至少建立多少个会话即返回成功，其余在后台继续建立并发送 "pool-progress" 事件 (默认 1)
+	AutoExpire  int   `json:"autoexpire"`  // 会话建立多少秒后替换为新会话 (默认 0 不过期)
+	ScavengeTTL int   `json:"scavengettl"` // 过期会话上的现有连接最多继续保留的秒数 (默认 600)
+	PinnedPorts []int `json:"pinnedports"` // 这些目标端口的连接使用会话池中最后一个专用会话，其余连接不使用该会话 (如 [3478]，需要 conn >= 2，默认空)
+
+	UpdateTimeout  int `json:"updatetimeout"`  // UpdateConfig 建立新会话池的最长秒数，超时则继续使用旧配置 (默认 15)
+	StartupTimeout int `json:"startuptimeout"` // StartProxy 整体的最长秒数 (含自动选择服务器、监听和建立会话池)，超时返回错误并清理 (默认 0 不限制)
+
+	ReplayPorts []int `json:"replayports"` // 这些目标端口的连接在收到响应前会话断开时，在新会话上重发请求 (仅用于幂等协议，如 [80]，默认空)
+
+	ClassShares map[string]int   `json:"classshares"` // 各连接类别占估计容量的百分比上限，同类别的流共享限额 (如 {"bulk": 80}，默认空不整形)
+	ClassPorts  map[string][]int `json:"classports"`  // 按目标端口归入类别 (如 {"bulk": [22, 873]})，规则的 class 字段优先 (默认空)
+
+	StreamIdle        int      `json:"streamidle"`        // 双向都没有数据超过多少秒的流被关闭 (默认 0 不回收)
+	IdleExemptPorts   []int    `json:"idleexemptports"`   // 不受 streamidle 限制的目标端口，用于推送/长轮询 (如 [5228, 5223]，默认空)
+	IdleExemptDomains []string `json:"idleexemptdomains"` // 不受 streamidle 限制的目标域名，匹配该域名及其子域名 (如 ["push.apple.com"]，默认空)
+
+	// 传输参数
+	Network        int64  `json:"network"`        // Android Network 句柄 (Network.getNetworkHandle())，非 0 时通过 NetworkProtector 绑定 socket (默认 0 使用默认路由)
+	Transport      string `json:"transport"`      // 传输方式: kcp, tls (默认 kcp，tls 需要服务端支持 SMUX over TLS)
+	TLSSNI         string `json:"tlssni"`         // TLS 握手使用的 SNI (默认 remoteaddr 的主机名)
+	TLSALPN        string `json:"tlsalpn"`        // TLS ALPN 列表，逗号分隔 (默认 "h2,http/1.1")
+	TLSFingerprint string `json:"tlsfingerprint"` // TLS ClientHello 指纹: go (crypto/tls), chrome, firefox, safari, ios, edge, random (每次随机生成)，需 transport 为 tls (默认 go)
+	PinSHA256      string `json:"pinsha256"`      // 证书公钥 SHA-256 指纹，逗号分隔 (base64 或 hex，默认空不固定)
+	CAFile         string `json:"cafile"`         // 自定义 CA 证书文件路径 (PEM，默认使用系统 CA)
+	CAPEM          string `json:"capem"`          // 内联自定义 CA 证书 (PEM，可与 cafile 同时使用)
+
+	TCP         bool `json:"tcp"`         // TCP 模拟，与 kcptun 的 --tcp 一致 (需要 root/CAP_NET_RAW，仅 Linux/Android，默认 false)
+	TCPFallback bool `json:"tcpfallback"` // 无法使用 TCP 模拟时回退到 UDP，服务端需同时监听 UDP (默认 false)
+
+	LocalPort  int    `json:"kcplocalport"` // KCP UDP socket 绑定的本地端口，多个会话依次使用后续端口，用于路由器端口转发 (默认 0 随机端口；"localport" 是旧版的本地监听端口)
+	MappedAddr string `json:"mappedaddr"`   // kcplocalport 在外部映射的地址 (如 "203.0.113.5:40000")，在能力协商中通告给服务端，需要 controlstream (默认空)
+
+	// 点对点参数 (两台设备经会合中介打洞后直连)
+	Rendezvous string `json:"rendezvous"` // 会合中介的 UDP 地址 (如 "broker.example.com:3478"，默认空不启用)
+	PeerID     string `json:"peerid"`     // 本机在中介上登记的 ID
+	PeerDial   string `json:"peerdial"`   // 新建会话时直连的对端 ID，打洞失败时经 remoteaddr 服务端中转 (与 peerserve 二选一)
+	PeerServe  string `json:"peerserve"`  // 接受对端直连，把每条流转发到该地址 (如本机 SOCKS 服务 "127.0.0.1:1081"，与 peerdial 二选一)
+
+	// KCP 参数
+	MTU             int    `json:"mtu"`             // MTU 大小 (默认 1350)
+	MTUClamp        bool   `json:"mtuclamp"`        // 检测到 MTU 黑洞 (大包持续重传而小包正常) 时自动逐级降低 MTU (默认 false)
+	SndWnd          int    `json:"sndwnd"`          // 发送窗口大小 (默认 128)
+	RcvWnd          int    `json:"rcvwnd"`          // 接收窗口大小 (默认 512)
+	DataShard       int    `json:"datashard"`       // FEC 数据分片 (默认 10)
+	ParityShard     int    `json:"parityshard"`     // FEC 校验分片 (默认 3)
+	AckNodelay      bool   `json:"acknodelay"`      // ACK 无延迟 (默认 false)
+	DSCP            int    `json:"dscp"`            // IP 包的 DSCP 值 0-63 (默认 0)
+	RateLimit       int    `json:"ratelimit"`       // 每个会话的发送速率上限字节/秒 (默认 0 不限制)
+	Pacing          bool   `json:"pacing"`          // 按 RTT 把发送速率平滑到每 RTT 一个窗口，配置 ratelimit 时不生效 (默认 false)
+	BurstBudget     int    `json:"burstbudget"`     // 平滑发送时会话上行空闲 1 秒后允许以线速突发的字节数，配合蜂窝无线的唤醒周期，用完后恢复平滑 (默认 0 不突发)
+	Duplicate       int    `json:"duplicate"`       // 不超过此字节数的 UDP 包发送两份，降低交互流量的丢包延迟 (默认 0 不复制)
+	BDPBuffers      bool   `json:"bdpbuffers"`      // 按 rcvwnd×mtu 设置未配置的 sockbuf/smuxbuf/streambuf (默认 false)
+	AutoStreamBuf   bool   `json:"autostreambuf"`   // 新建会话时按测得的 BDP 放大流窗口，不超过 smuxbuf (默认 false)
+	AutoFEC         bool   `json:"autofec"`         // 按测得的重传率建议 FEC 分片，通过 "fec-advice" 事件和统计给出 (需与服务端一致，不自动修改，默认 false)
+	AntiBloat       bool   `json:"antibloat"`       // 检测到下行缓冲膨胀时收缩接收窗口以减少排队，缓解后恢复 (默认 false)
+	NoComp          *bool  `json:"nocomp"`          // 关闭 snappy 压缩，需与服务端一致 (apiversion 1 默认 true，2 起默认 false 与 kcptun 一致)
+	Comp            string `json:"comp"`            // 压缩算法: snappy (受 nocomp 控制，与 kcptun 一致), zstd (需要服务端支持，按会话协商) (默认 snappy)
+	CompDict        string `json:"compdict"`        // zstd 预训练字典文件路径 (zstd --train 生成，需与服务端一致，默认空不使用字典)
+	SockBuf         int    `json:"sockbuf"`         // Socket 缓冲区 (默认 4194304)
+	TimerResolution int    `json:"timerresolution"` // 没有连接时把 KCP interval 放宽到的毫秒数，减少空闲唤醒 (默认 0 不放宽，建议 100-500)
+	WriteBatch      int    `json:"writebatch"`      // 把多个流的小帧合并写入 KCP 的最长延迟毫秒数，空闲后的首次写入不等待 (默认 0 不合并，建议 1-5)
+	WriteGrace      int    `json:"writegrace"`      // UDP 瞬时写错误 (如切换网络时的 ENETUNREACH) 缓存重试的毫秒数，超时才断开会话 (默认 3000，负数禁用)
+	BlacklistTTL    int    `json:"blacklistttl"`    // remoteaddr 解析到多个 IP 时，会话一分钟内断开的 IP 在重连时排到最后的秒数 (默认 300，负数禁用)
+	NoNAT64         bool   `json:"nonat64"`         // 关闭纯 IPv6 网络上为 IPv4 remoteaddr 合成 NAT64 地址 (RFC 7050/6052，默认 false)
+	DNSPrefetch     int    `json:"dnsprefetch"`     // 在后台每隔多少秒预解析 remoteaddr 和地址簿中的服务器域名，重连时直接使用结果，解析失败时发送 "dns-prefetch-failed" 事件 (默认 0 不预解析)
+	ZombieTTFB      int    `json:"zombiettfb"`      // 已发送数据的流超过此秒数未收到首字节记为一次超时 (默认 15，负数禁用僵尸会话检测)
+	ZombieCount     int    `json:"zombiecount"`     // 同一会话连续超时多少次后视为僵尸会话并重建 (默认 3)
+	PredictLoss     int    `json:"predictloss"`     // 稳定的会话连续多少个服务端心跳间隔没有收到数据时提前建立替换会话 (默认 0 不预测，建议 2，SMUX 在 3 个间隔后判定断线)
+
+	// SMUX 参数
+	SmuxVer   int `json:"smuxver"`   // SMUX 版本 1 或 2 (默认 1)
+	SmuxBuf   int `json:"smuxbuf"`   // SMUX 缓冲区 (默认 4194304)
+	FrameSize int `json:"framesize"` // 帧大小 (默认 4096)
+	StreamBuf int `json:"streambuf"` // 流缓冲区 (默认 2097152)
+	KeepAlive int `json:"keepalive"` // 心跳间隔秒数 (默认 10)
+
+	AdaptiveKeepAlive bool `json:"adaptivekeepalive"` // 按 RTT 和重传率调整心跳间隔: 不稳定时缩短 (最短 2 秒)，稳定时延长 (最长 2 倍，不超过 25 秒或 keepalive) (默认 false)
+	KeepAliveWindow   int  `json:"keepalivewindow"`   // Conn > 1 时合并各会话心跳的时间窗口毫秒数 (默认 200，负数禁用)
+	HibernateAfter    int  `json:"hibernateafter"`    // 连续多少分钟没有客户端连接后关闭全部会话，有新连接时再重建 (默认 0 不休眠)
+	ExitOnIdle        int  `json:"exitonidle"`        // 处理过连接后全部连接结束并空闲多少秒时自动停止实例，用于一次性任务 (默认 0 不退出)
+	OwnerTimeout      int  `json:"ownertimeout"`      // 超过多少秒没有调用 OwnerHeartbeat 时自动停止实例，用于 UI 进程崩溃后回收代理 (默认 0 不检查)
+
+	// 内存参数
+	MemoryBudget int    `json:"memorybudget"` // 堆内存预算 MB，超出时按 trimpolicy 关闭部分流 (默认 0 不限制)
+	TrimPolicy   string `json:"trimpolicy"`   // 内存压力下选择关闭流的策略: bulk, idle, oldest (默认 bulk)
+	QueueHigh    int    `json:"queuehigh"`    // 会话待写出字节数超过该值时发送 "queue" 事件 (默认 0 不检测)
+	QueueLow     int    `json:"queuelow"`     // 待写出字节数回落到该值以下时发送恢复事件 (默认 queuehigh 的一半)
+	Backpressure bool   `json:"backpressure"` // 超过 queuehigh 时暂停读取本地客户端，回落到 queuelow 后恢复 (默认 false)
+	StreamCap    int    `json:"streamcap"`    // 单条流积压的接收数据上限 KB，超出时暂停读取会话，持续超出 10 秒则关闭该流 (默认 0 不限制)
+
+	// 调度参数
+	BoostHandshakes bool `json:"boosthandshakes"` // 每个新连接最初约 4KB 的上行数据优先于批量数据发送 (默认 false)
+	WarmStream      bool `json:"warmstream"`      // 每个会话预先打开一条空闲流供下一个连接接管，省去服务端拨号目标的时间 (默认 false)
+	OpenSpacing     int  `json:"openspacing"`     // 同一会话上相邻两次为客户端连接打开流的最小间隔毫秒数，避免大量连接同时进入慢启动推高 RTT (默认 0 不错峰，建议 2)
+
+	// 接入控制参数
+	AllowLAN     bool     `json:"allowlan"`     // 允许非回环地址接入 (默认 false，仅允许本机)
+	AllowSources []string `json:"allowsources"` // allowlan 开启时的来源白名单 (CIDR 或 IP，空表示不限制)
+
+	// 热点共享参数
+	Hotspot      bool   `json:"hotspot"`      // 热点模式: 监听热点网卡，允许热点网段内的客户端接入 (默认 false)
+	HotspotIface string `json:"hotspotiface"` // 热点网卡名 (默认自动探测 ap0/swlan0/softap0/wlan1/bridge100)
+	HotspotDNS   int    `json:"hotspotdns"`   // 在热点网卡上提供 DNS 转发的端口，查询经隧道转发 (默认 0 不启用)
+	DNSUpstream  string `json:"dnsupstream"`  // DNS 上游服务器，由服务端经 TCP 连接 (默认 "8.8.8.8:53")
+	DNSRate      int    `json:"dnsrate"`      // 每个热点客户端每秒最多转发的 DNS 查询数 (默认 20，负数不限制)
+	DNSNo0x20    bool   `json:"dnsno0x20"`    // 关闭上游查询的 0x20 大小写随机化 (上游不保留大小写时使用，默认 false)
+	ClientRate   int    `json:"clientrate"`   // 每个热点客户端单向限速，字节/秒 (默认 0 不限速)
+
+	// DNS 存根参数
+	DNSStub string `json:"dnsstub"` // 本地 DNS 存根地址 (如 "127.0.0.1:5353")，A/AAAA 查询经隧道转发到 dnsupstream (默认空不启用)
+
+	// 断网保护参数
+	KillSwitch bool `json:"killswitch"` // 全部会话断开期间拒绝所有连接 (包括 direct/auto 规则)，不排队也不直连 (默认 false)
+
+	// mDNS 广播参数
+	Advertise     bool   `json:"advertise"`     // 在局域网通过 mDNS/DNS-SD 广播本地代理 (默认 false)
+	AdvertiseName string `json:"advertisename"` // 广播的实例名 (默认 "kcp-mobile")
+	AdvertiseType string `json:"advertisetype"` // 广播的服务类型 (默认 "_socks._tcp")
+
+	// 路由规则参数 (用于生成 PAC；存在 direct 动作时本地直连)
+	Rules         []Rule `json:"rules"`         // 路由规则，按顺序匹配
+	DefaultAction string `json:"defaultaction"` // 未命中规则时的动作: proxy, direct, auto (默认 proxy)
+	SocksResolve  string `json:"socksresolve"`  // SOCKS5 域名目标的解析方: remote (经隧道发送域名), local (本机解析后发送 IP), rules (按规则的 resolve 字段) (默认 remote)
+	PACType       string `json:"pactype"`       // PAC 中的代理类型: SOCKS5, PROXY (默认 SOCKS5)
+	GeoIPDB       string `json:"geoipdb"`       // GeoIP 数据库 (MMDB) 文件路径，geoip 规则需要 (默认空)
+	RulesURL      string `json:"rulesurl"`      // 规则订阅地址，通过隧道定期拉取 JSON 规则数组，排在本地规则之后 (默认空)
+	RulesInterval int    `json:"rulesinterval"` // 规则订阅刷新间隔秒数 (默认 86400)
+	AutoTTL       int    `json:"autottl"`       // auto 动作缓存竞速结果的秒数 (默认 600)
+	SniffSNI      bool   `json:"sniffsni"`      // 目标为 IP 时从 TLS ClientHello 中识别 SNI 域名，用于规则匹配和连接日志 (默认 false)
+	SniffHost     bool   `json:"sniffhost"`     // 目标为 IP 时从明文 HTTP 请求的 Host 头识别域名，用于规则匹配、连接日志和目的地统计 (默认 false)
+
+	// 控制端点参数
+	ControlAddr string `json:"controladdr"` // 控制/状态 HTTP 端点地址，提供 /proxy.pac 和 /stats (默认空不启用)
+
+	// 控制流参数 (需要服务端支持)
+	ControlStream bool `json:"controlstream"` // 维持一条带签名心跳的控制流，用于存活检测和时钟同步 (默认 false)
+	Heartbeat     int  `json:"heartbeat"`     // 控制流心跳间隔秒数 (默认 5，最大 3600)
+
+	AcceptServerHints bool `json:"acceptserverhints"` // 接受服务端通过控制流下发的窗口/FEC/模式建议 (默认 false)
+	AcceptServerRate  bool `json:"acceptserverrate"`  // 在能力协商中接受服务端通告的带宽上限，发送速率和窗口不超过该上限 (默认 false)
+	SocksBind         bool `json:"socksbind"`         // 经隧道转发 SOCKS5 BIND (FTP 主动模式等)，服务端未在控制流中确认支持时本地回复不支持 (默认 false)
+	ICMPRelay         bool `json:"icmprelay"`         // 通过 RelayEcho 经隧道中继 TUN 捕获的 ping，服务端未在控制流中确认支持时丢弃 (默认 false)
+
+	FECUp   string `json:"fecup"`   // 上行是否发送 FEC 校验分片: on, off, auto (按上行重传率开关)，服务端在控制流中确认后生效 (默认 on)
+	FECDown string `json:"fecdown"` // 请求服务端下行是否发送 FEC 校验分片: on, off, auto (按下行 FEC 恢复率开关) (默认 on)
+
+	// 地址簿参数
+	AutoServer bool `json:"autoserver"` // 启动时使用地址簿中最优的服务器，连续重连失败后重新排序切换 (默认 false)
+
+	ServerSelect string `json:"serverselect"` // autoserver 的选择方式: rank (探测排序选最优), weighted (按地址簿的 weight 和 clientid 确定性分配) (默认 rank)
+	ClientID     string `json:"clientid"`     // 客户端的稳定标识 (如安装 ID)，weighted 分配时用于哈希 (默认空)
+
+	// 连接日志参数
+	AccessLog string `json:"accesslog"` // 每条连接结束时输出记录: "log" 写日志, "event" 发送 access 事件, 其他为文件路径 (默认空不记录)
+
+	// 统计参数
+	MetricsFile string `json:"metricsfile"` // 累计统计持久化文件路径，启动时加载、停止时保存 (默认空不持久化)
+
+	// 诊断参数 (与 kcptun 一致)
+	Log        string `json:"log"`        // 日志文件路径 (默认空，输出到标准错误)
+	SnmpLog    string `json:"snmplog"`    // KCP SNMP 计数 CSV 文件路径，支持 Go 时间格式 (如 "snmp-20060102.log"，默认空)
+	SnmpPeriod int    `json:"snmpperiod"` // SNMP 记录间隔秒数 (默认 60)
+	PProf      bool   `json:"pprof"`      // 在 127.0.0.1:6060 启动 pprof (默认 false)
+	Quiet      bool   `json:"quiet"`      // 与 kcptun 相同: 只输出错误日志，不输出单条连接的日志 (默认 false)
+	RedactLogs *bool  `json:"redactlogs"` // 日志、事件和 DumpState 中的 IP、主机名和密钥脱敏后输出 (默认 true，debug 时默认 false)
+
+	// 调试参数
+	Debug    bool `json:"debug"`    // 开启调试功能 (如 MirrorStream 流量镜像，默认 false)
+	FrameCRC bool `json:"framecrc"` // 每个 SMUX 帧附加 CRC32 端到端校验，需要 debug 且服务端支持 (默认 false)
+
+	TraceFile   string `json:"tracefile"`   // 每秒记录会话 RTT、重传率和断开/重建的轨迹文件路径，用于在开发机上重放，需要 debug (默认空)
+	TraceReplay string `json:"tracereplay"` // 按轨迹文件在 UDP 收发路径上模拟延迟、丢包和断网，需要 debug (默认空)
+
+	// 看门狗参数
+	Watchdog int `json:"watchdog"` // 卡死判定阈值秒数，超过后自动重启，新会话无法建立时不重启 (默认 30，负数禁用，最大 3600)
+
+	// KCP 内部参数 (由 Mode 决定，仅 manual 模式下使用配置值)
+	NoDelay      int `json:"nodelay"`
+	Interval     int `json:"interval"`
+	Resend       int `json:"resend"`
+	NoCongestion int `json:"nc"`
+
+	allowNets  []*net.IPNet // 由 AllowSources 解析
+	ruleSet    *ruleSet     // 由 Rules + subRules 预编译
+	subRules   []Rule       // 订阅拉取的规则
+	hotspotNet *net.IPNet   // 热点网段 (启动时探测)
+	compDict   []byte       // 由 CompDict 加载 (启动时)
+
+	unknownFields []string // 无法识别的字段 (解析时收集)
+	listenExtra   []string // localaddr 数组中主地址之后的附加地址
+	onDemand      bool     // conn 显式配置为 0 (按需建立会话)
+
+	start *startGuard // 带时长上限的启动 (仅启动期间)
+	trace *netTrace   // 由 TraceReplay 加载 (启动时)
+
+	secrets *configSecrets // 由 Key 派生的密钥 (启动时派生，原始 Key 随即清除)
+}
+
+// configAliases 字段别名 -> 规范名，兼容旧版 App 和 kcptun 的配置写法
+var configAliases = map[string]string{
+	"nocongestion": "nc",
+	"local":        "localaddr",
+	"remote":       "remoteaddr",
+	"datashards":   "datashard",
+	"parityshards": "parityshard",
+	"ds":           "datashard",
+	"ps":           "parityshard",
+	"qpp-count":    "qppcount",
+}
+
+var (
+	configFieldsOnce sync.Once
+	configFields     map[string]bool
+)
+
+// knownConfigFields 返回 Config 的所有 JSON 字段名
+func knownConfigFields() map[string]bool {
+	configFieldsOnce.Do(func() {
+		configFields = make(map[string]bool)
+		t := reflect.TypeOf(Config{})
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if tag != "" && tag != "-" {
+				configFields[tag] = true
+			}
+		}
+	})
+	return configFields
+}
+
+// UnmarshalJSON 解析配置，支持字段别名并记录无法识别的字段
+func (c *Config) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	known := knownConfigFields()
+	fields := make(map[string]json.RawMessage, len(raw))
+	var localPort json.RawMessage
+	for key, value := range raw {
+		name := strings.ToLower(key)
+		if canon, ok := configAliases[name]; ok {
+			name = canon
+		}
+		switch {
+		case name == "localport":
+			localPort = value
+		case known[name]:
+			fields[name] = value
+		default:
+			c.unknownFields = append(c.unknownFields, key)
+		}
+	}
+	sort.Strings(c.unknownFields)
+
+	// localport: 旧版配置只给端口，监听在本机回环地址
+	if localPort != nil && fields["localaddr"] == nil {
+		var port json.Number
+		if err := json.Unmarshal(bytes.Trim(localPort, `"`), &port); err != nil {
+			return fmt.Errorf("invalid localport: %s", localPort)
+		}
+		addr, _ := json.Marshal("127.0.0.1:" + port.String())
+		fields["localaddr"] = addr
+	}
+
+	// conn 显式为 0: 按需建立会话
+	if v, ok := fields["conn"]; ok {
+		var n json.Number
+		if json.Unmarshal(bytes.Trim(v, `"`), &n) == nil && n.String() == "0" {
+			c.onDemand = true
+		}
+	}
+
+	// localaddr 数组: 第一个为主监听，其余为附加监听
+	if v := bytes.TrimSpace(fields["localaddr"]); len(v) > 0 && v[0] == '[' {
+		var addrs []string
+		if err := json.Unmarshal(v, &addrs); err != nil || len(addrs) == 0 {
+			return fmt.Errorf("invalid localaddr: %s", v)
+		}
+		first, _ := json.Marshal(addrs[0])
+		fields["localaddr"] = first
+		c.listenExtra = addrs[1:]
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	type plain Config
+	return json.Unmarshal(b, (*plain)(c))
+}
@@ -0,0 +1,113 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import "testing"
+
+// FuzzParseConfig 任意输入都不能让 parseConfig 崩溃；校验通过的配置再次校验也必须通过，
+// 且各数值字段都在 validateConfig 的范围内
+func FuzzParseConfig(f *testing.F) {
+	seeds := []string{
+		`{}`,
+		`{"remoteaddr":"vps.example.com:29900","label":"vps","key":"secret","crypt":"aes","mode":"fast3"}`,
+		`{"remoteaddr":"1.2.3.4:29900","label":"t","conn":4,"minready":2,"datashard":-100,"parityshard":300}`,
+		`{"remoteaddr":"1.2.3.4:29900","label":"t","datashard":0,"parityshard":0,"mtu":64}`,
+		`{"remoteaddr":"1.2.3.4:29900","label":"t","profile":"mobile","rules":[{"type":"domain","value":"example.com","action":"direct"}]}`,
+		`{"remoteaddr":"[::1]:29900","label":"t","transport":"tls","sni":"cdn.example.com"}`,
+		`{"remoteaddr":"1.2.3.4:29900","label":"t","conn":0,"maxconn":8}`,
+		`{"label":" ","remoteaddr":"1.2.3.4:29900"}`,
+		`{"label":"","remoteaddr":"1.2.3.4:29900"}`,
+		`[1,2,3]`,
+		`{"conn":1e100}`,
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, configJson string) {
+		config, err := parseConfig(configJson)
+		if err != nil {
+			return
+		}
+		if err := validateConfig(config); err != nil {
+			t.Fatalf("validated config fails revalidation: %v", err)
+		}
+		if config.DataShard < 0 || config.ParityShard < 0 || config.DataShard+config.ParityShard > 256 {
+			t.Fatalf("shards out of range: %d+%d", config.DataShard, config.ParityShard)
+		}
+		if config.Conn < 1 || config.Conn > maxConn || config.MinReady < 1 || config.MinReady > config.Conn {
+			t.Fatalf("conn/minready out of range: %d/%d", config.Conn, config.MinReady)
+		}
+		if validateLabel(config.Label) != nil {
+			t.Fatalf("invalid label accepted: %q", config.Label)
+		}
+		if config.MTU < 64 || config.MTU > 1500 {
+			t.Fatalf("mtu out of range: %d", config.MTU)
+		}
+	})
+}
+
+// FuzzDecodeConfigURI 任意分享链接都不能让导入崩溃；解码成功的配置若通过校验，
+// 重新导出再导入后必须得到等价的配置
+func FuzzDecodeConfigURI(f *testing.F) {
+	seeds := []string{
+		"kcp://203.0.113.1:4000?key=secret#home",
+		"kcp://[2001:db8::1]:29900?crypt=aes-128&ds=5&ps=2&key=p%26ss%3Dw%23rd%3F#office.1",
+		"kcp://example.com:4000?nocomp=true&mode=fast3&mtu=1200&rules=%5B%7B%22type%22%3A%22suffix%22%2C%22value%22%3A%22example.org%22%2C%22action%22%3A%22direct%22%7D%5D#x",
+		"kcp://1.2.3.4:29900?conn=1e100#t",
+		"kcp://1.2.3.4:29900?mtu=%7B&mtu=1200",
+		"kcp://1.2.3.4:29900?label=a#b",
+		"kcp://?%zz",
+		"http://1.2.3.4:29900",
+		"",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, uri string) {
+		configJson, err := decodeConfigURI(uri)
+		if err != nil {
+			return
+		}
+		config, err := parseConfig(configJson)
+		if err != nil {
+			return
+		}
+		if err := validateConfig(config); err != nil {
+			t.Fatalf("imported config fails revalidation: %v", err)
+		}
+
+		again, err := encodeConfigURI(configJson)
+		if err != nil {
+			t.Fatalf("re-export %s: %v", configJson, err)
+		}
+		decoded, err := decodeConfigURI(again)
+		if err != nil {
+			t.Fatalf("re-import %q: %v", again, err)
+		}
+		if got, want := effectiveConfig(t, decoded), effectiveConfig(t, configJson); got != want {
+			t.Fatalf("round trip changed config:\n got %s\nwant %s", got, want)
+		}
+	})
+}
@@ -0,0 +1,499 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// SALT is used for pbkdf2 key expansion (same as kcptun)
+	SALT = "kcp-go"
+	// maximum supported smux version
+	maxSmuxVer = 2
+	// default key (same as kcptun default)
+	defaultKey = "it's a secrect"
+	// maximum accepted config JSON size
+	maxConfigLen = 1 << 20
+	// maximum number of UDP connections
+	maxConn = 64
+	// maximum buffer size for sockbuf/smuxbuf/streambuf
+	maxBufSize = 64 << 20
+	// 启动时等待 minready 个会话建立的最长时间 (也是 updatetimeout 的默认值)
+	sessionDialTimeout = 15 * time.Second
+)
+
+// VERSION 由门面包 (mobilekcp.VERSION，构建时注入) 在 init 中设置
+var VERSION = "MOBILE-1.0"
+
+// GetVersion 返回版本号
+func GetVersion() string {
+	return VERSION
+}
+
+// ValidateConfigJSON 校验配置但不启动代理
+// 返回 JSON: {"ok": bool, "error": "...", "warnings": ["unknown field: xxx", ...]}
+func ValidateConfigJSON(configJson string) string {
+	result := struct {
+		OK       bool     `json:"ok"`
+		Error    string   `json:"error,omitempty"`
+		Warnings []string `json:"warnings"`
+	}{Warnings: []string{}}
+
+	config, err := parseConfig(configJson)
+	if config != nil {
+		for _, field := range config.unknownFields {
+			result.Warnings = append(result.Warnings, "unknown field: "+field)
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.OK = true
+	}
+
+	b, _ := json.Marshal(result)
+	return string(b)
+}
+
+// parseConfig 解析 JSON 配置，应用默认值和模式参数并校验
+// 配置可能来自用户导入等不可信来源，解析失败只返回错误，不会 panic
+// JSON 解析成功但校验失败时仍返回 config，便于调用方读取警告
+func parseConfig(configJson string) (*Config, error) {
+	if len(configJson) > maxConfigLen {
+		return nil, fmt.Errorf("Config Error: config too large (%d bytes)", len(configJson))
+	}
+
+	var parsed Config
+	if err := json.Unmarshal([]byte(configJson), &parsed); err != nil {
+		return nil, fmt.Errorf("Config Error: %v", err)
+	}
+	// 预设档位作为基础，显式字段优先
+	config, err := applyProfile(configJson, &parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	// 应用默认值
+	applyDefaults(config)
+
+	// 根据模式设置 KCP 参数
+	applyMode(config)
+
+	// 验证配置
+	if err := validateConfig(config); err != nil {
+		return config, fmt.Errorf("Validate Error: %v", err)
+	}
+	return config, nil
+}
+
+// applyDefaults 设置配置默认值
+func applyDefaults(config *Config) {
+	if config.LocalAddr == "" {
+		config.LocalAddr = "127.0.0.1:1080"
+	}
+	if config.Conn <= 0 {
+		config.Conn = 1
+		if config.onDemand {
+			config.Conn = onDemandSlots(config)
+		}
+	}
+	if config.MinReady <= 0 {
+		config.MinReady = 1
+	}
+	if config.MTU <= 0 {
+		config.MTU = 1350
+	}
+	if config.SndWnd <= 0 {
+		config.SndWnd = 128
+	}
+	if config.RcvWnd <= 0 {
+		config.RcvWnd = 512
+	}
+	if config.DataShard <= 0 {
+		config.DataShard = 10
+	}
+	if config.ParityShard <= 0 {
+		config.ParityShard = 3
+	}
+	if config.SmuxVer <= 0 {
+		config.SmuxVer = 1
+	}
+	applyBDPBuffers(config)
+	if config.SmuxBuf <= 0 {
+		config.SmuxBuf = 4194304
+	}
+	if config.StreamBuf <= 0 {
+		config.StreamBuf = 2097152
+	}
+	if config.FrameSize <= 0 {
+		config.FrameSize = 4096
+	}
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = 10
+	}
+	if config.SockBuf <= 0 {
+		config.SockBuf = 4194304
+	}
+	if config.Mode == "" {
+		config.Mode = "fast"
+	}
+	if config.Key == "" {
+		config.Key = defaultKey
+	}
+	if config.Crypt == "" {
+		config.Crypt = "none"
+	}
+	if config.Transport == "" {
+		config.Transport = transportKCP
+	}
+	if config.TLSFingerprint == "" {
+		config.TLSFingerprint = tlsFingerprintGo
+	}
+	if config.TLSALPN == "" {
+		config.TLSALPN = "h2,http/1.1"
+	}
+	if config.DNSUpstream == "" {
+		config.DNSUpstream = "8.8.8.8:53"
+	}
+	if config.DNSRate == 0 {
+		config.DNSRate = 20
+	}
+	if config.AdvertiseName == "" {
+		config.AdvertiseName = "kcp-mobile"
+	}
+	if config.AdvertiseType == "" {
+		config.AdvertiseType = "_socks._tcp"
+	}
+	if config.DefaultAction == "" {
+		config.DefaultAction = actionProxy
+	}
+	if config.SocksResolve == "" {
+		config.SocksResolve = socksResolveRemote
+	}
+	if config.PACType == "" {
+		config.PACType = "SOCKS5"
+	}
+	if config.LocalTLSCert != "" && config.LocalTLSALPN == "" {
+		config.LocalTLSALPN = "http/1.1"
+	}
+	if config.KeepAliveWindow == 0 {
+		config.KeepAliveWindow = 200
+	}
+	if config.WriteGrace == 0 {
+		config.WriteGrace = 3000
+	}
+	if config.QPPCount <= 0 {
+		config.QPPCount = 61
+	}
+	if config.RulesInterval <= 0 {
+		config.RulesInterval = 86400
+	}
+	if config.TrimPolicy == "" {
+		config.TrimPolicy = "bulk"
+	}
+	if config.QueueHigh > 0 && config.QueueLow == 0 {
+		config.QueueLow = config.QueueHigh / 2
+	}
+	if strings.TrimSpace(config.Label) == "" {
+		config.Label = defaultLabel
+	}
+	if config.AutoTTL <= 0 {
+		config.AutoTTL = 600
+	}
+	if config.BlacklistTTL == 0 {
+		config.BlacklistTTL = 300
+	}
+	if config.ZombieTTFB == 0 {
+		config.ZombieTTFB = 15
+	}
+	if config.ZombieCount <= 0 {
+		config.ZombieCount = 3
+	}
+	if config.Heartbeat <= 0 {
+		config.Heartbeat = 5
+	}
+	if config.Watchdog == 0 {
+		config.Watchdog = 30
+	} else if config.Watchdog < 0 {
+		config.Watchdog = -1
+	}
+	// 日志脱敏默认开启，debug 时默认关闭
+	if config.RedactLogs == nil {
+		redact := !config.Debug
+		config.RedactLogs = &redact
+	}
+	// 压缩默认值: apiversion 2 起与 kcptun 一致启用压缩，旧版本配置保持禁用
+	if config.NoComp == nil {
+		noComp := configAPIVersion(config) < 2
+		config.NoComp = &noComp
+	}
+	if config.Comp == "" {
+		config.Comp = compSnappy
+	}
+	if config.ServerSelect == "" {
+		config.ServerSelect = serverSelectRank
+	}
+	if config.FECUp == "" {
+		config.FECUp = fecDirOn
+	}
+	if config.FECDown == "" {
+		config.FECDown = fecDirOn
+	}
+	if config.ScavengeTTL <= 0 {
+		config.ScavengeTTL = 600
+	}
+	if config.UpdateTimeout <= 0 {
+		config.UpdateTimeout = int(sessionDialTimeout / time.Second)
+	}
+	if config.SnmpPeriod <= 0 {
+		config.SnmpPeriod = 60
+	}
+}
+
+// applyMode 根据模式设置 KCP 参数
+func applyMode(config *Config) {
+	switch config.Mode {
+	case "normal":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
+	case "fast":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
+	case "fast2":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
+	case "fast3":
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
+	case "manual":
+		// 使用配置中的 nodelay/interval/resend/nc
+	default:
+		// 如果模式未知，使用 fast 模式
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
+	}
+}
+
+// validateConfig 验证配置
+func validateConfig(config *Config) error {
+	if config.APIVersion > apiVersion {
+		return fmt.Errorf("apiversion %d not supported (library supports up to %d)", config.APIVersion, apiVersion)
+	}
+	if config.RemoteAddr == "" {
+		return fmt.Errorf("remoteaddr is required")
+	}
+	if config.Conn <= 0 {
+		return fmt.Errorf("conn must be greater than 0")
+	}
+	if config.SmuxVer > maxSmuxVer {
+		return fmt.Errorf("unsupported smux version: %d", config.SmuxVer)
+	}
+	if _, _, err := net.SplitHostPort(config.RemoteAddr); err != nil {
+		return fmt.Errorf("invalid remoteaddr: %v", err)
+	}
+	if _, _, err := net.SplitHostPort(config.LocalAddr); err != nil {
+		return fmt.Errorf("invalid localaddr: %v", err)
+	}
+
+	// 限制数值范围，避免异常配置导致超大内存分配
+	bounds := []struct {
+		name     string
+		value    int
+		min, max int
+	}{
+		{"conn", config.Conn, 1, maxConn},
+		{"minready", config.MinReady, 1, config.Conn},
+		{"maxconn", config.MaxConn, 0, maxConn},
+		{"mtu", config.MTU, 64, 1500},
+		{"sndwnd", config.SndWnd, 1, 65535},
+		{"rcvwnd", config.RcvWnd, 1, 65535},
+		{"datashard", config.DataShard, 0, 256},
+		{"parityshard", config.ParityShard, 0, 256},
+		{"datashard+parityshard", config.DataShard + config.ParityShard, 0, 256},
+		{"sockbuf", config.SockBuf, 1, maxBufSize},
+		{"writegrace", config.WriteGrace, -1, 60000},
+		{"timerresolution", config.TimerResolution, 0, 5000},
+		{"writebatch", config.WriteBatch, 0, 50},
+		{"openspacing", config.OpenSpacing, 0, 100},
+		{"kcplocalport", config.LocalPort, 0, 65535},
+		{"streamidle", config.StreamIdle, 0, 86400},
+		{"blacklistttl", config.BlacklistTTL, -1, 86400},
+		{"dnsprefetch", config.DNSPrefetch, 0, 86400},
+		{"dnsrate", config.DNSRate, -1, 10000},
+		{"duplicate", config.Duplicate, 0, 1500},
+		{"burstbudget", config.BurstBudget, 0, 64 << 20},
+		{"zombiettfb", config.ZombieTTFB, -1, 600},
+		{"zombiecount", config.ZombieCount, 1, 100},
+		{"predictloss", config.PredictLoss, 0, 10},
+		{"smuxbuf", config.SmuxBuf, 1, maxBufSize},
+		{"streambuf", config.StreamBuf, 1, maxBufSize},
+		{"framesize", config.FrameSize, 1, 65535},
+		{"keepalive", config.KeepAlive, 1, 3600},
+		{"watchdog", config.Watchdog, -1, 3600},
+		{"heartbeat", config.Heartbeat, 1, 3600},
+		{"hibernateafter", config.HibernateAfter, 0, 1440},
+		{"exitonidle", config.ExitOnIdle, 0, 86400},
+		{"ownertimeout", config.OwnerTimeout, 0, 86400},
+		{"memorybudget", config.MemoryBudget, 0, 4096},
+		{"streamcap", config.StreamCap, 0, 1 << 20},
+		{"queuehigh", config.QueueHigh, 0, maxBufSize},
+		{"queuelow", config.QueueLow, 0, maxBufSize},
+		{"dscp", config.DSCP, 0, 63},
+		{"autoexpire", config.AutoExpire, 0, 30 * 86400},
+		{"scavengettl", config.ScavengeTTL, 1, 86400},
+		{"updatetimeout", config.UpdateTimeout, 1, 600},
+		{"startuptimeout", config.StartupTimeout, 0, 600},
+		{"snmpperiod", config.SnmpPeriod, 1, 86400},
+		{"qppcount", config.QPPCount, 1, 65535},
+		{"rulesinterval", config.RulesInterval, 60, 30 * 86400},
+		{"autottl", config.AutoTTL, 10, 86400},
+	}
+	for _, b := range bounds {
+		if b.value < b.min || b.value > b.max {
+			return fmt.Errorf("%s out of range [%d, %d]: %d", b.name, b.min, b.max, b.value)
+		}
+	}
+
+	if !blockCrypts[config.Crypt] {
+		return fmt.Errorf("unsupported crypt: %s", config.Crypt)
+	}
+
+	switch config.Transport {
+	case transportKCP, transportTLS:
+	default:
+		return fmt.Errorf("unknown transport: %s", config.Transport)
+	}
+	if err := validateTLS(config); err != nil {
+		return err
+	}
+	if config.FrameCRC && !config.Debug {
+		return fmt.Errorf("framecrc requires debug")
+	}
+	if err := validateTrace(config); err != nil {
+		return err
+	}
+	if _, err := localTLSConfig(config); err != nil {
+		return err
+	}
+	if err := validateServerSelect(config); err != nil {
+		return err
+	}
+	if err := validateDNSStub(config); err != nil {
+		return err
+	}
+	if err := validateFECDirs(config); err != nil {
+		return err
+	}
+	if err := validateClasses(config); err != nil {
+		return err
+	}
+	if err := validateOnDemand(config); err != nil {
+		return err
+	}
+	if err := validateListenExtra(config); err != nil {
+		return err
+	}
+	if err := validatePeer(config); err != nil {
+		return err
+	}
+	if err := validateMapping(config); err != nil {
+		return err
+	}
+	if err := validateIdleExempt(config); err != nil {
+		return err
+	}
+	if err := validateReplayPorts(config); err != nil {
+		return err
+	}
+	if err := validatePinnedPorts(config); err != nil {
+		return err
+	}
+
+	nets, err := parseSources(config.AllowSources)
+	if err != nil {
+		return err
+	}
+	config.allowNets = nets
+	rs, err := compileRules(append(append([]Rule(nil), config.Rules...), config.subRules...))
+	if err != nil {
+		return err
+	}
+	config.ruleSet = rs
+	if rs.geoip && config.GeoIPDB == "" {
+		return fmt.Errorf("geoip rules require geoipdb")
+	}
+	if config.GeoIPDB != "" && !geoipBuilt {
+		return fmt.Errorf("geoipdb is not supported in this build (nogeoip)")
+	}
+	if config.RulesURL != "" {
+		if u, err := url.Parse(config.RulesURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid rulesurl: %s", config.RulesURL)
+		}
+	}
+	if err := validateLabel(config.Label); err != nil {
+		return err
+	}
+	switch config.Comp {
+	case compSnappy:
+		if config.CompDict != "" {
+			return fmt.Errorf("compdict requires comp=zstd")
+		}
+	case compZstd:
+	default:
+		return fmt.Errorf("unknown comp: %s", config.Comp)
+	}
+	if config.QueueHigh > 0 && config.QueueLow >= config.QueueHigh {
+		return fmt.Errorf("queuelow must be less than queuehigh")
+	}
+	if config.SocksBind && !config.ControlStream {
+		return fmt.Errorf("socksbind requires controlstream")
+	}
+	if config.ICMPRelay && !config.ControlStream {
+		return fmt.Errorf("icmprelay requires controlstream")
+	}
+	if config.Backpressure && config.QueueHigh == 0 {
+		return fmt.Errorf("backpressure requires queuehigh")
+	}
+	switch config.TrimPolicy {
+	case "bulk", "idle", "oldest":
+	default:
+		return fmt.Errorf("unknown trimpolicy: %s", config.TrimPolicy)
+	}
+	switch config.DefaultAction {
+	case actionProxy, actionDirect, actionAuto:
+	default:
+		return fmt.Errorf("unknown defaultaction: %s", config.DefaultAction)
+	}
+	switch config.SocksResolve {
+	case socksResolveRemote, socksResolveLocal, socksResolveRules:
+	default:
+		return fmt.Errorf("unknown socksresolve: %s", config.SocksResolve)
+	}
+	switch config.PACType {
+	case "SOCKS5", "SOCKS", "PROXY", "HTTPS":
+	default:
+		return fmt.Errorf("unknown pactype: %s", config.PACType)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 配置分享链接: kcp://<remoteaddr>?<字段>=<值>&...#<label>
+// 查询参数使用配置的 JSON 字段名 (别名转换为规范名)，字符串字段直接取值，
+// 其他字段 (数字、布尔、rules 等) 为紧凑的 JSON 文本；remoteaddr 不是单个 host:port 时放在查询参数中。
+// 链接包含 key 等密钥，与配置 JSON 同等敏感
+
+const configURIScheme = "kcp"
+
+var (
+	configStringsOnce sync.Once
+	configStrings     map[string]bool
+)
+
+// stringConfigField 字段是否为字符串类型 (分享链接中不加 JSON 引号)
+func stringConfigField(name string) bool {
+	configStringsOnce.Do(func() {
+		configStrings = make(map[string]bool)
+		t := reflect.TypeOf(Config{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("json"), ",")[0]
+			typ := f.Type
+			if typ.Kind() == reflect.Ptr {
+				typ = typ.Elem()
+			}
+			if tag != "" && tag != "-" && typ.Kind() == reflect.String {
+				configStrings[tag] = true
+			}
+		}
+	})
+	return configStrings[name]
+}
+
+// canonicalField 返回字段的规范名
+func canonicalField(key string) string {
+	name := strings.ToLower(key)
+	if canon, ok := configAliases[name]; ok {
+		return canon
+	}
+	return name
+}
+
+// plainAddr 是否为可以放在链接主机部分的单个 host:port
+func plainAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	return err == nil
+}
+
+// encodeConfigURI 将配置 JSON 编码为分享链接 (配置需通过校验，无法识别的字段被丢弃)
+func encodeConfigURI(configJson string) (string, error) {
+	if _, err := parseConfig(configJson); err != nil {
+		return "", err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(configJson), &raw); err != nil {
+		return "", err
+	}
+
+	u := &url.URL{Scheme: configURIScheme}
+	query := url.Values{}
+	known := knownConfigFields()
+	for key, value := range raw {
+		name := canonicalField(key)
+		if !known[name] && name != "localport" {
+			continue
+		}
+		var s string
+		if stringConfigField(name) && json.Unmarshal(value, &s) == nil {
+			switch {
+			case name == "label":
+				u.Fragment = s
+				continue
+			case name == "remoteaddr" && plainAddr(s):
+				u.Host = s
+				continue
+			}
+		} else {
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, value); err != nil {
+				return "", err
+			}
+			s = buf.String()
+		}
+		query.Set(name, s)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// decodeConfigURI 将分享链接解码为配置 JSON
+func decodeConfigURI(uri string) (string, error) {
+	if len(uri) > maxConfigLen {
+		return "", fmt.Errorf("uri too large (%d bytes)", len(uri))
+	}
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != configURIScheme {
+		return "", errors.New("not a kcp:// uri")
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if u.Host != "" {
+		fields["remoteaddr"], _ = json.Marshal(u.Host)
+	}
+	if u.Fragment != "" {
+		fields["label"], _ = json.Marshal(u.Fragment)
+	}
+	for key, values := range query {
+		name, value := canonicalField(key), values[len(values)-1]
+		if stringConfigField(name) {
+			fields[name], _ = json.Marshal(value)
+			continue
+		}
+		if !json.Valid([]byte(value)) {
+			return "", fmt.Errorf("invalid value for %s: %q", name, value)
+		}
+		fields[name] = json.RawMessage(value)
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ExportConfigURI 将配置编码为 kcp:// 分享链接 (配置需通过校验)
+// 返回 JSON: {"uri": "...", "error": "..."}
+func ExportConfigURI(configJson string) string {
+	result := struct {
+		URI   string `json:"uri,omitempty"`
+		Error string `json:"error,omitempty"`
+	}{}
+	uri, err := encodeConfigURI(configJson)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.URI = uri
+	}
+	b, _ := json.Marshal(result)
+	return string(b)
+}
+
+// ImportConfigURI 解析 kcp:// 分享链接并校验，返回配置 JSON
+// 返回 JSON: {"config": {...}, "error": "..."}
+func ImportConfigURI(uri string) string {
+	result := struct {
+		Config json.RawMessage `json:"config,omitempty"`
+		Error  string          `json:"error,omitempty"`
+	}{}
+	configJson, err := decodeConfigURI(uri)
+	if err == nil {
+		_, err = parseConfig(configJson)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Config = json.RawMessage(configJson)
+	}
+	b, _ := json.Marshal(result)
+	return string(b)
+}
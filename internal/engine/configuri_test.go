@@ -0,0 +1,99 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// effectiveConfig 解析后的配置 (含默认值) 的 JSON，用于比较两份配置是否等价
+func effectiveConfig(t *testing.T, configJson string) string {
+	config, err := parseConfig(configJson)
+	if err != nil {
+		t.Fatalf("parseConfig(%s): %v", configJson, err)
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestConfigURIRoundTrip(t *testing.T) {
+	for _, configJson := range []string{
+		`{"remoteaddr": "203.0.113.1:4000", "key": "secret", "label": "home"}`,
+		`{"remote": "[2001:db8::1]:29900", "key": "p&ss=w#rd?", "crypt": "aes-128", "ds": 5, "ps": 2, "label": "office.1"}`,
+		`{"remoteaddr": "example.com:4000", "key": "123", "label": "x", "nocomp": true, "mode": "fast3", "mtu": 1200,
+		  "rules": [{"type": "suffix", "value": "example.org", "action": "direct"}], "defaultaction": "proxy"}`,
+	} {
+		uri, err := encodeConfigURI(configJson)
+		if err != nil {
+			t.Fatalf("encode %s: %v", configJson, err)
+		}
+		if !strings.HasPrefix(uri, "kcp://") {
+			t.Fatalf("uri %q", uri)
+		}
+		decoded, err := decodeConfigURI(uri)
+		if err != nil {
+			t.Fatalf("decode %q: %v", uri, err)
+		}
+		if got, want := effectiveConfig(t, decoded), effectiveConfig(t, configJson); got != want {
+			t.Errorf("round trip through %q:\n got %s\nwant %s", uri, got, want)
+		}
+	}
+}
+
+func TestConfigURIFormat(t *testing.T) {
+	uri, err := encodeConfigURI(`{"remoteaddr": "203.0.113.1:4000", "key": "k", "label": "home-1", "mtu": 1200, "unknownfield": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "kcp://203.0.113.1:4000?key=k&mtu=1200#home-1"; uri != want {
+		t.Fatalf("uri %q, want %q", uri, want)
+	}
+}
+
+func TestImportConfigURIErrors(t *testing.T) {
+	for _, uri := range []string{
+		"",
+		"ss://203.0.113.1:4000",
+		"kcp://203.0.113.1:4000?mtu=abc",   // 数字字段不是 JSON
+		"kcp://203.0.113.1:4000?mtu=99999", // 校验失败
+		"kcp://203.0.113.1:4000?rules=[{",  // JSON 不完整
+		"kcp://203.0.113.1:4000?key=%zz",   // 转义错误
+		"kcp://" + strings.Repeat("a", maxConfigLen),
+	} {
+		var result struct {
+			Config json.RawMessage `json:"config"`
+			Error  string          `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(ImportConfigURI(uri)), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Error == "" || result.Config != nil {
+			t.Errorf("ImportConfigURI(%.60q) = %+v", uri, result)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// 默认的联网检测地址，正常网络返回 204
+	defaultProbeURL = "http://connectivitycheck.gstatic.com/generate_204"
+	probeTimeout    = 5 * time.Second
+)
+
+// CheckConnectivity 检测当前网络状态
+// 先直连 (不经过隧道) 请求 url，再通过新建的 KCP 会话探测服务器可达性
+// 返回 JSON: {"result": "open|captive-portal|tunnel-blocked|offline", "direct": {...}, "tunnel": {...}}
+// url 为空时使用默认的 generate_204 地址；代理未运行时只做直连检测
+func CheckConnectivity(url string) string {
+	if url == "" {
+		url = defaultProbeURL
+	}
+
+	type probe struct {
+		OK     bool   `json:"ok"`
+		Status int    `json:"status,omitempty"`
+		Ms     int64  `json:"ms"`
+		Error  string `json:"error,omitempty"`
+	}
+	var result struct {
+		Result string `json:"result"`
+		Direct probe  `json:"direct"`
+		Tunnel *probe `json:"tunnel,omitempty"`
+	}
+
+	// 直连检测: 不跟随重定向，强制门户通常返回 302 或 200 登录页
+	start := clk.Now()
+	status, err := probeDirect(url)
+	result.Direct = probe{Status: status, Ms: clk.Since(start).Milliseconds()}
+	switch {
+	case err != nil:
+		result.Direct.Error = err.Error()
+		result.Result = "offline"
+	case status != http.StatusNoContent:
+		result.Result = "captive-portal"
+	default:
+		result.Direct.OK = true
+		result.Result = "open"
+	}
+
+	// 隧道检测
+	proxyMu.Lock()
+	config := proxyConfig
+	proxyMu.Unlock()
+	if config != nil && result.Direct.OK {
+		rtt, err := probeTunnel(config, probeTimeout)
+		result.Tunnel = &probe{OK: err == nil, Ms: rtt.Milliseconds()}
+		if err != nil {
+			result.Tunnel.Error = err.Error()
+			result.Result = "tunnel-blocked"
+		}
+	}
+
+	b, _ := json.Marshal(result)
+	return string(b)
+}
+
+// probeDirect 直连请求 url，返回 HTTP 状态码
+func probeDirect(url string) (int, error) {
+	client := &http.Client{
+		Timeout:   probeTimeout,
+		Transport: &http.Transport{Proxy: nil, DisableKeepAlives: true},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// probeTunnel 新建一个 KCP 会话并打开一个流，等待服务器的 KCP ACK
+// 收到 ACK 后平滑 RTT 才会被更新，以此确认 UDP 路径双向可达
+func probeTunnel(config *Config, timeout time.Duration) (time.Duration, error) {
+	session, err := createSession(config)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	start := clk.Now()
+	for clk.Since(start) < timeout {
+		if rtt := session.srtt(); rtt > 0 {
+			return time.Duration(rtt) * time.Millisecond, nil
+		}
+		clk.Sleep(20 * time.Millisecond)
+	}
+	return timeout, fmt.Errorf("no response from %s within %v", config.RemoteAddr, timeout)
+}
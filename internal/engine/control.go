@@ -0,0 +1,93 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// startControl 启动控制/状态 HTTP 端点
+// /proxy.pac: 根据路由规则生成的 PAC 文件
+// /stats: 统计快照 JSON
+// /metrics: Prometheus 文本格式的指标 (noprometheus 构建不提供)
+func startControl(config *Config, proxyAddr net.Addr, stop chan struct{}) error {
+	listener, err := net.Listen("tcp", config.ControlAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write([]byte(generatePAC(config, pacProxyAddr(r, proxyAddr))))
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(GetStats()))
+	})
+	handlePrometheus(mux)
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// 与代理端口相同的来源过滤
+			addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+			if err != nil || !sourceAllowed(config, addr) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}),
+	}
+
+	go func() {
+		<-stop
+		server.Close()
+	}()
+	go server.Serve(listener)
+
+	log.Println("Control endpoint started on", listener.Addr())
+	return nil
+}
+
+// pacProxyAddr 返回 PAC 中填写的代理地址
+// 代理监听在通配地址时，使用客户端访问控制端点时所用的本机地址
+func pacProxyAddr(r *http.Request, proxyAddr net.Addr) string {
+	tcpAddr, ok := proxyAddr.(*net.TCPAddr)
+	if !ok {
+		return proxyAddr.String()
+	}
+	if !tcpAddr.IP.IsUnspecified() {
+		return tcpAddr.String()
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, _, err := net.SplitHostPort(local.String()); err == nil {
+			return net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port))
+		}
+	}
+	return tcpAddr.String()
+}
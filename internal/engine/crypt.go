@@ -0,0 +1,81 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"fmt"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// configBlockCrypt 使用配置派生的密钥创建 KCP 加密器
+func configBlockCrypt(config *Config) (kcp.BlockCrypt, error) {
+	deriveSecrets(config)
+
+	var block kcp.BlockCrypt
+	err := config.secrets.block.use(func(pass []byte) error {
+		var err error
+		block, err = newBlockCrypt(config.Crypt, pass)
+		return err
+	})
+	return block, err
+}
+
+// newBlockCrypt 根据 crypt 和派生密钥创建 KCP 加密器 (与 kcptun 客户端一致)
+// 加密器内部会复制或展开密钥，返回后 pass 可以清零
+// crypt 为 null 时返回 nil，不加密也不带校验头
+func newBlockCrypt(crypt string, pass []byte) (kcp.BlockCrypt, error) {
+	switch crypt {
+	case "null":
+		return nil, nil
+	case "none":
+		return kcp.NewNoneBlockCrypt(pass)
+	case "sm4":
+		return kcp.NewSM4BlockCrypt(pass[:16])
+	case "tea":
+		return kcp.NewTEABlockCrypt(pass[:16])
+	case "xor":
+		return kcp.NewSimpleXORBlockCrypt(pass)
+	case "aes-128":
+		return kcp.NewAESBlockCrypt(pass[:16])
+	case "aes-192":
+		return kcp.NewAESBlockCrypt(pass[:24])
+	case "blowfish":
+		return kcp.NewBlowfishBlockCrypt(pass)
+	case "twofish":
+		return kcp.NewTwofishBlockCrypt(pass)
+	case "cast5":
+		return kcp.NewCast5BlockCrypt(pass[:16])
+	case "3des":
+		return kcp.NewTripleDESBlockCrypt(pass[:24])
+	case "xtea":
+		return kcp.NewXTEABlockCrypt(pass[:16])
+	case "salsa20":
+		return kcp.NewSalsa20BlockCrypt(pass)
+	case "aes":
+		return kcp.NewAESBlockCrypt(pass)
+	}
+	return nil, fmt.Errorf("unsupported crypt: %s", crypt)
+}
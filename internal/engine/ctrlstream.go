@@ -0,0 +1,309 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// 控制流: 每个实例在会话池上维持一条很小的 SMUX 流，与服务端交换带签名的心跳
+// 需要服务端转发目标支持该协议 (识别 ctrlPreamble)，因此默认关闭
+//
+// 帧格式: 长度 (4 字节，大端，不含长度本身) + JSON 消息 + HMAC-SHA256 (32 字节)
+// 客户端 ping: {"type":"ping","seq":n,"t1":发送时间}
+// 服务端 pong: {"type":"pong","seq":n,"t1":..,"t2":服务端接收时间,"t3":服务端发送时间,"load":0~1}
+// 时间均为 UnixNano，时钟偏差与单向时延按 NTP 算法估算
+
+const (
+	ctrlPreamble    = "KCPM-CTRL/1\n"
+	ctrlMaxFrame    = 64 * 1024
+	ctrlMacSize     = sha256.Size
+	ctrlRetryDelay  = 5 * time.Second
+	ctrlHMACContext = "kcp-mobile-ctrl"
+)
+
+// ctrlMessage 控制流消息
+type ctrlMessage struct {
+	Type  string          `json:"type"`
+	Seq   uint64          `json:"seq,omitempty"`
+	T1    int64           `json:"t1,omitempty"`
+	T2    int64           `json:"t2,omitempty"`
+	T3    int64           `json:"t3,omitempty"`
+	Load  float64         `json:"load,omitempty"`
+	Hints json.RawMessage `json:"hints,omitempty"`
+	Caps  []string        `json:"caps,omitempty"`
+	Rate  int64           `json:"rate,omitempty"` // caps 回复: 服务端对本客户端的带宽上限字节/秒
+	FEC   *fecDirs        `json:"fec,omitempty"`  // ping: 期望的分方向 FEC；fec 回复: 服务端已应用的状态
+
+	Mapped *natMapping `json:"mapped,omitempty"` // 第一个 ping: 客户端的静态端口映射
+}
+
+// ctrlStats 控制流统计
+type ctrlStats struct {
+	Connected     bool     `json:"connected"`
+	RTT           int64    `json:"rtt"`      // 毫秒
+	Offset        int64    `json:"offset"`   // 服务端时钟 - 本地时钟，毫秒
+	Uplink        int64    `json:"uplink"`   // 最近一次心跳的上行单向时延估计，毫秒 (平滑值见 oneway)
+	Downlink      int64    `json:"downlink"` // 最近一次心跳的下行单向时延估计，毫秒
+	ServerTime    int64    `json:"servertime"`
+	ServerLoad    float64  `json:"serverload"`
+	LastHeartbeat int64    `json:"lastheartbeat"` // 最后一次收到心跳的时间 (Unix 毫秒)
+	Sent          uint64   `json:"sent"`
+	Received      uint64   `json:"received"`
+	BadMAC        uint64   `json:"badmac"`
+	Caps          []string `json:"caps,omitempty"` // 服务端确认支持的能力
+
+	ServerRate int64 `json:"serverrate,omitempty"` // 服务端通告的带宽上限字节/秒
+}
+
+var (
+	ctrlMu    sync.Mutex
+	ctrlState ctrlStats
+
+	// ctrlHandlers 按消息类型分发的处理函数 (pong 以外的服务端消息)
+	ctrlHandlers = map[string]func(config *Config, msg *ctrlMessage){
+		"hints": handleServerHints,
+		"caps":  handleServerCaps,
+		"fec":   handleServerFEC,
+	}
+)
+
+// ctrlLoop 维持控制流，断开后自动重建
+func ctrlLoop(config *Config, stop chan struct{}) {
+	key := ctrlKey(config)
+	interval := time.Duration(config.Heartbeat) * time.Second
+
+	for {
+		if err := runCtrlStream(config, key, interval, stop); err != nil {
+			logError("Control stream:", err)
+		}
+		ctrlMu.Lock()
+		ctrlState.Connected = false
+		ctrlMu.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-clk.After(ctrlRetryDelay):
+		}
+	}
+}
+
+// ctrlKey 返回心跳签名密钥 (启动时由预共享密钥派生)
+func ctrlKey(config *Config) *secretBuf {
+	deriveSecrets(config)
+	return config.secrets.ctrl
+}
+
+// signCtrl 计算帧签名
+func signCtrl(key *secretBuf, payload []byte) ([]byte, error) {
+	var sum []byte
+	err := key.use(func(k []byte) error {
+		mac := hmac.New(sha256.New, k)
+		mac.Write(payload)
+		sum = mac.Sum(nil)
+		return nil
+	})
+	return sum, err
+}
+
+// runCtrlStream 在一个存活的会话上打开控制流并收发心跳，直到出错或停止
+func runCtrlStream(config *Config, key *secretBuf, interval time.Duration, stop chan struct{}) error {
+	session := pickAliveSession()
+	if session == nil {
+		return errors.New("no alive session")
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if _, err := stream.Write([]byte(ctrlPreamble)); err != nil {
+		return err
+	}
+
+	ctrlMu.Lock()
+	ctrlState.Connected = true
+	ctrlState.Caps = nil
+	ctrlState.ServerRate = 0
+	ctrlMu.Unlock()
+	resetFECApplied()
+	resetOneWay()
+
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := readCtrlFrame(stream, key)
+			if err == errCtrlBadMAC {
+				ctrlMu.Lock()
+				ctrlState.BadMAC++
+				ctrlMu.Unlock()
+				continue
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+			handleCtrlMessage(config, msg)
+		}
+	}()
+
+	current := scaleByKeepAlive(config, interval)
+	ticker := clk.NewTicker(current)
+	defer ticker.Stop()
+
+	var seq uint64
+	for {
+		seq++
+		ping := &ctrlMessage{Type: "ping", Seq: seq, T1: clk.Now().UnixNano()}
+		if seq == 1 {
+			ping.Caps = clientCaps(config)
+			ping.Mapped = clientMapping(config)
+		} else {
+			ping.FEC = fecDirRequest(config)
+		}
+		if err := writeCtrlFrame(stream, key, ping); err != nil {
+			return err
+		}
+		ctrlMu.Lock()
+		ctrlState.Sent++
+		ctrlMu.Unlock()
+
+		select {
+		case <-stop:
+			return nil
+		case err := <-errc:
+			return err
+		case <-ticker.Chan():
+		}
+
+		// 自适应心跳: 控制流心跳随之缩放
+		if next := scaleByKeepAlive(config, interval); next != current {
+			current = next
+			ticker.Reset(current)
+		}
+	}
+}
+
+// handleCtrlMessage 处理服务端消息
+func handleCtrlMessage(config *Config, msg *ctrlMessage) {
+	if msg.Type != "pong" {
+		if h, ok := ctrlHandlers[msg.Type]; ok {
+			h(config, msg)
+		}
+		return
+	}
+
+	t4 := clk.Now().UnixNano()
+	offset := ((msg.T2 - msg.T1) + (msg.T3 - t4)) / 2
+	rtt := (t4 - msg.T1) - (msg.T3 - msg.T2)
+
+	ctrlMu.Lock()
+	ctrlState.Received++
+	ctrlState.RTT = rtt / int64(time.Millisecond)
+	ctrlState.Offset = offset / int64(time.Millisecond)
+	ctrlState.Uplink = (msg.T2 - msg.T1 - offset) / int64(time.Millisecond)
+	ctrlState.Downlink = (t4 - msg.T3 + offset) / int64(time.Millisecond)
+	ctrlState.ServerTime = msg.T3 / int64(time.Millisecond)
+	ctrlState.ServerLoad = msg.Load
+	ctrlState.LastHeartbeat = t4 / int64(time.Millisecond)
+	ctrlMu.Unlock()
+	sampleOneWay(msg.T1, msg.T2, msg.T3, t4)
+}
+
+// snapshotCtrl 返回控制流统计快照
+func snapshotCtrl() ctrlStats {
+	ctrlMu.Lock()
+	defer ctrlMu.Unlock()
+	return ctrlState
+}
+
+// resetCtrl 清空控制流统计
+func resetCtrl() {
+	ctrlMu.Lock()
+	ctrlState = ctrlStats{}
+	ctrlMu.Unlock()
+}
+
+var errCtrlBadMAC = errors.New("control frame: bad mac")
+
+// writeCtrlFrame 写入一个签名帧
+func writeCtrlFrame(w io.Writer, key *secretBuf, msg *ctrlMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	sum, err := signCtrl(key, payload)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4, 4+len(payload)+ctrlMacSize)
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)+ctrlMacSize))
+	frame = append(frame, payload...)
+	frame = append(frame, sum...)
+	_, err = w.Write(frame)
+	return err
+}
+
+// readCtrlFrame 读取并校验一个签名帧
+func readCtrlFrame(r io.Reader, key *secretBuf) (*ctrlMessage, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < ctrlMacSize || n > ctrlMaxFrame {
+		return nil, errors.New("control frame: bad length")
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	payload, sum := buf[:n-ctrlMacSize], buf[n-ctrlMacSize:]
+
+	expected, err := signCtrl(key, payload)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(sum, expected) {
+		return nil, errCtrlBadMAC
+	}
+
+	var msg ctrlMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
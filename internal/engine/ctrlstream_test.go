@@ -0,0 +1,182 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigHeartbeat(t *testing.T) {
+	for configJson, want := range map[string]int{
+		`{"remoteaddr": "203.0.113.1:4000"}`:                           5,
+		`{"remoteaddr": "203.0.113.1:4000", "heartbeat": -1}`:          5,
+		`{"remoteaddr": "203.0.113.1:4000", "heartbeat": 3600}`:        3600,
+		`{"remoteaddr": "203.0.113.1:4000", "heartbeat": 3601}`:        0,
+		`{"remoteaddr": "203.0.113.1:4000", "heartbeat": 10000000000}`: 0, // 换算成 Duration 会溢出
+	} {
+		config, err := parseConfig(configJson)
+		if want == 0 {
+			if err == nil {
+				t.Errorf("parseConfig(%s) accepted heartbeat %d", configJson, config.Heartbeat)
+			}
+			continue
+		}
+		if err != nil || config.Heartbeat != want {
+			t.Errorf("parseConfig(%s) = %v, want heartbeat %d", configJson, err, want)
+		}
+	}
+}
+
+// fuzzCtrlConfig 打开各类服务端消息处理的配置，让模糊测试覆盖到能力协商、带宽上限、建议和 FEC 方向
+const fuzzCtrlConfig = `{"remoteaddr": "203.0.113.1:4000", "key": "secret", "parityshard": 3,
+	"fecup": "auto", "fecdown": "off", "acceptserverhints": true, "acceptserverrate": true}`
+
+// ctrlFrame 用 key 签名 payload 并按帧格式编码
+func ctrlFrame(t testing.TB, key *secretBuf, payload []byte) []byte {
+	sum, err := signCtrl(key, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+ctrlMacSize))
+	frame = append(frame, payload...)
+	return append(frame, sum...)
+}
+
+// FuzzReadCtrlFrame 服务端发来的任意字节流 (含伪造长度和错误签名) 都不能让控制流读取或
+// 消息处理崩溃；每个被接受的帧必须带有正确签名，且重新编码后读回的消息不变
+func FuzzReadCtrlFrame(f *testing.F) {
+	config, err := parseConfig(fuzzCtrlConfig)
+	if err != nil {
+		f.Fatal(err)
+	}
+	key := ctrlKey(config)
+	defer resetCtrl()
+
+	var stream bytes.Buffer
+	for _, msg := range []*ctrlMessage{
+		{Type: "pong", Seq: 1, T1: 1, T2: 2, T3: 3, Load: 0.5},
+		{Type: "caps", Caps: []string{"fecdir", "mapping"}, Rate: 1 << 20},
+		{Type: "fec", FEC: &fecDirs{Up: false, Down: true}},
+		{Type: "hints", Hints: json.RawMessage(`{"sndwnd": 512, "rcvwnd": 1024, "mode": "fast2"}`)},
+	} {
+		writeCtrlFrame(&stream, key, msg)
+	}
+	f.Add(stream.Bytes())
+
+	bad := ctrlFrame(f, key, []byte(`{"type":"pong","seq":1}`))
+	bad[len(bad)-1] ^= 1
+	f.Add(bad)
+	f.Add(ctrlFrame(f, key, []byte(`{"type":"hints","hints":{"sndwnd":-1}}`)))
+	f.Add(ctrlFrame(f, key, []byte(`{"type":"pong","t1":-9223372036854775808,"t3":9223372036854775807}`)))
+	f.Add(ctrlFrame(f, key, []byte(`not json`)))
+	f.Add(append([]byte(ctrlPreamble), stream.Bytes()...))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0, 0, ctrlMacSize - 1})
+	f.Add([]byte{0, 0, 0, ctrlMacSize})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for {
+			before := r.Len()
+			msg, err := readCtrlFrame(r, key)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return
+			}
+			if r.Len() == before {
+				t.Fatalf("readCtrlFrame consumed nothing (err %v)", err)
+			}
+			if err == errCtrlBadMAC {
+				continue
+			}
+			if err != nil {
+				if n := before - r.Len(); n > 4+ctrlMaxFrame {
+					t.Fatalf("read %d bytes for a rejected frame", n)
+				}
+				return
+			}
+
+			var buf bytes.Buffer
+			if err := writeCtrlFrame(&buf, key, msg); err != nil {
+				t.Fatalf("re-encode %+v: %v", msg, err)
+			}
+			again, err := readCtrlFrame(&buf, key)
+			if err != nil {
+				t.Fatalf("re-read %+v: %v", msg, err)
+			}
+			if !reflect.DeepEqual(msg, again) {
+				t.Fatalf("frame round trip changed message: %+v -> %+v", msg, again)
+			}
+			handleCtrlMessage(config, msg)
+		}
+	})
+}
+
+// FuzzCtrlMessage 签名正确但内容任意的消息 (即握手后服务端的能力回复、建议、FEC 回复等)
+// 都不能让消息处理崩溃，被采纳的带宽上限必须为正
+func FuzzCtrlMessage(f *testing.F) {
+	config, err := parseConfig(fuzzCtrlConfig)
+	if err != nil {
+		f.Fatal(err)
+	}
+	key := ctrlKey(config)
+	defer resetCtrl()
+
+	for _, payload := range []string{
+		`{"type":"caps","caps":["fecdir"],"rate":1048576}`,
+		`{"type":"caps","caps":null,"rate":-1}`,
+		`{"type":"hints","hints":{"sndwnd":512,"rcvwnd":1024,"datashard":10,"parityshard":3,"mode":"fast3"}}`,
+		`{"type":"hints","hints":"x"}`,
+		`{"type":"fec","fec":{"up":false,"down":false}}`,
+		`{"type":"fec","fec":null}`,
+		`{"type":"pong","seq":18446744073709551615,"t1":1,"t2":0,"t3":-1,"load":1e308}`,
+		`{"type":"ping","mapped":{"localport":1}}`,
+		`{"type":""}`,
+		`[]`,
+	} {
+		f.Add([]byte(payload))
+	}
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		if len(payload)+ctrlMacSize > ctrlMaxFrame {
+			return
+		}
+		msg, err := readCtrlFrame(bytes.NewReader(ctrlFrame(t, key, payload)), key)
+		if err == errCtrlBadMAC {
+			t.Fatal("correctly signed frame rejected")
+		}
+		if err != nil {
+			return
+		}
+		resetCtrl()
+		handleCtrlMessage(config, msg)
+		if rate := snapshotCtrl().ServerRate; rate < 0 || (rate > 0 && rate != msg.Rate) {
+			t.Fatalf("server rate %d adopted from %+v", rate, msg)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"container/list"
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 按目标主机聚合的连接统计，使用 LRU 限制条目数
+const maxDestinations = 1000
+
+// destStat 一个目标主机的累计统计
+type destStat struct {
+	Host      string `json:"host"`
+	Conns     uint64 `json:"conns"`
+	BytesUp   uint64 `json:"bytesup"`
+	BytesDown uint64 `json:"bytesdown"`
+	Last      int64  `json:"last"` // 最近一次连接结束时间 (Unix 秒)
+}
+
+var (
+	destMu    sync.Mutex
+	destLRU   = list.New() // 元素为 *destStat，最近使用的在前
+	destIndex = make(map[string]*list.Element)
+)
+
+// destHost 去掉端口，统一小写
+func destHost(target string) string {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	return strings.ToLower(host)
+}
+
+// recordDestination 连接结束时累加到目标主机
+func recordDestination(target string, up, down uint64) {
+	if target == "" {
+		return
+	}
+	host := destHost(target)
+
+	destMu.Lock()
+	defer destMu.Unlock()
+
+	var d *destStat
+	if e, ok := destIndex[host]; ok {
+		destLRU.MoveToFront(e)
+		d = e.Value.(*destStat)
+	} else {
+		if destLRU.Len() >= maxDestinations {
+			oldest := destLRU.Back()
+			destLRU.Remove(oldest)
+			delete(destIndex, oldest.Value.(*destStat).Host)
+		}
+		d = &destStat{Host: host}
+		destIndex[host] = destLRU.PushFront(d)
+	}
+	d.Conns++
+	d.BytesUp += up
+	d.BytesDown += down
+	d.Last = clk.Now().Unix()
+}
+
+// GetTopDestinations 返回按总流量排序的前 n 个目标主机 (JSON)，n <= 0 返回全部
+// 目标从代理握手 (SOCKS5/SOCKS4/HTTP) 中识别，无法识别的连接不计入
+func GetTopDestinations(n int) string {
+	destMu.Lock()
+	list := make([]destStat, 0, destLRU.Len())
+	for e := destLRU.Front(); e != nil; e = e.Next() {
+		list = append(list, *e.Value.(*destStat))
+	}
+	destMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].BytesUp+list[i].BytesDown > list[j].BytesUp+list[j].BytesDown
+	})
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+
+	b, _ := json.Marshal(list)
+	return string(b)
+}
@@ -0,0 +1,176 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// 与 kcptun 客户端一致的诊断参数: log (日志文件)、snmplog/snmpperiod (KCP SNMP 计数 CSV)、pprof (见 pprof.go)
+
+var logFile *os.File // 由 proxyMu 保护
+
+// 日志级别: 普通日志用 log.Println/Printf，错误日志用 logError/logErrorf。
+// quiet 模式下标准 logger 的输出全部丢弃，错误日志经 errorSink 绕过丢弃写出
+
+// quietLogs 非 0 表示 quiet 模式: 日志只保留错误，单条连接的日志不输出
+var quietLogs int32
+
+// logSink 错误日志的输出
+type logSink struct {
+	w io.Writer
+}
+
+// errorSink quiet 模式下错误日志的输出 (日志文件或标准错误，已按配置脱敏)，非 quiet 时为 nil
+var errorSink atomic.Pointer[logSink]
+
+// redactingLogs 非 0 表示日志输出经过 redactWriter
+var redactingLogs int32
+
+// startRedaction 启动时在输出与配置相关的日志 (自动选择的服务器、未知字段等) 之前按配置开关脱敏，
+// 此时只对标准错误输出脱敏，日志文件和 quiet 过滤在 openLogFile 中设置 (调用方需持有 proxyMu，且实例处于 idle)
+func startRedaction(config *Config) {
+	setRedaction(config)
+	if *config.RedactLogs {
+		atomic.StoreInt32(&redactingLogs, 1)
+		log.SetOutput(redactWriter{os.Stderr})
+	} else if atomic.SwapInt32(&redactingLogs, 0) != 0 {
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// openLogFile 将日志输出重定向到 config.Log，quiet 时过滤非错误日志，redactlogs 时脱敏 (调用方需持有 proxyMu)
+func openLogFile(config *Config) error {
+	setRedaction(config)
+	var out io.Writer = os.Stderr
+	if config.Log != "" {
+		f, err := os.OpenFile(config.Log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		out = f
+		logFile = f
+	}
+	if *config.RedactLogs {
+		atomic.StoreInt32(&redactingLogs, 1)
+		out = redactWriter{out}
+	}
+	if config.Quiet {
+		atomic.StoreInt32(&quietLogs, 1)
+		errorSink.Store(&logSink{out})
+		out = io.Discard
+	}
+	if logFile != nil || config.Quiet || *config.RedactLogs {
+		log.SetOutput(out)
+	}
+	return nil
+}
+
+// closeLogFile 恢复默认日志输出 (调用方需持有 proxyMu)
+func closeLogFile() {
+	if atomic.SwapInt32(&quietLogs, 0) != 0 {
+		errorSink.Store(nil)
+		log.SetOutput(os.Stderr)
+	}
+	if atomic.SwapInt32(&redactingLogs, 0) != 0 {
+		log.SetOutput(os.Stderr)
+	}
+	if logFile != nil {
+		log.SetOutput(os.Stderr)
+		logFile.Close()
+		logFile = nil
+	}
+}
+
+// logError 输出错误日志 (quiet 模式下也输出)
+func logError(v ...interface{}) {
+	errorOutput(fmt.Sprintln(v...))
+}
+
+// logErrorf 按格式输出错误日志 (quiet 模式下也输出)
+func logErrorf(format string, v ...interface{}) {
+	errorOutput(fmt.Sprintf(format, v...))
+}
+
+// errorOutput 写出一条错误日志: 非 quiet 时与普通日志相同，quiet 时以标准 logger 的前缀和格式写到 errorSink
+func errorOutput(s string) {
+	sink := errorSink.Load()
+	if sink == nil {
+		log.Output(3, s)
+		return
+	}
+	log.New(sink.w, log.Prefix(), log.Flags()).Output(3, s)
+}
+
+// connLog 输出单条连接的日志 (quiet 模式下不输出，也不格式化)
+func connLog(v ...interface{}) {
+	if atomic.LoadInt32(&quietLogs) == 0 {
+		log.Println(v...)
+	}
+}
+
+// snmpLoop 每 snmpperiod 秒向 snmplog 追加一行 SNMP 计数
+// 与 kcptun 相同，路径按 Go 时间格式展开 (如 "snmp-20060102.log" 每天一个文件)
+func snmpLoop(config *Config, stop chan struct{}) {
+	ticker := clk.NewTicker(time.Duration(config.SnmpPeriod) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.Chan():
+		}
+		if err := writeSnmp(clk.Now().Format(config.SnmpLog)); err != nil {
+			logError("SNMP log:", err)
+		}
+	}
+}
+
+// writeSnmp 追加一行 SNMP 计数，新文件先写表头
+func writeSnmp(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		w.Write(append([]string{"Unix"}, kcp.DefaultSnmp.Header()...))
+	}
+	snmp := kcp.DefaultSnmp.Copy()
+	w.Write(append([]string{fmt.Sprint(clk.Now().Unix())}, snmp.ToSlice()...))
+	w.Flush()
+	return w.Error()
+}
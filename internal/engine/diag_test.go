@@ -0,0 +1,68 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestQuietLogs quiet 模式按级别过滤: 普通日志 (即使含 error/fail 等字样) 丢弃，logError 的日志保留
+func TestQuietLogs(t *testing.T) {
+	oldPrefix := log.Prefix()
+	log.SetPrefix("[quiet] ")
+	defer log.SetPrefix(oldPrefix)
+
+	for _, quiet := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "kcp.log")
+		redact := false
+		config := &Config{Log: path, Quiet: quiet, RedactLogs: &redact}
+		if err := openLogFile(config); err != nil {
+			t.Fatal(err)
+		}
+		log.Println("Retry failed handshake counter reset") // 普通日志
+		connLog("Connection error: reset by peer")          // 单条连接
+		logError("Accept error:", "too many open files")
+		logErrorf("Session %d recycle: %v", 2, "dial timeout")
+		closeLogFile()
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := string(b)
+		for _, line := range []string{"Accept error: too many open files", "Session 2 recycle: dial timeout"} {
+			if !strings.Contains(out, "[quiet] ") || !strings.Contains(out, line) {
+				t.Errorf("quiet=%v: missing %q:\n%s", quiet, line, out)
+			}
+		}
+		for _, line := range []string{"Retry failed handshake", "Connection error"} {
+			if logged := strings.Contains(out, line); logged == quiet {
+				t.Errorf("quiet=%v: %q logged=%v:\n%s", quiet, line, logged, out)
+			}
+		}
+	}
+}
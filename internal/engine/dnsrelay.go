@@ -0,0 +1,282 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 热点 DNS 转发: 局域网客户端的查询经隧道以 DNS over TCP 转发到 dnsupstream (与 dnsstub 相同)，
+// 不从手机的上行网络直接发出，热点客户端的解析不泄漏、不绕过代理
+// 防护措施:
+//   - 每个客户端 IP 按 dnsrate 限制每秒查询数 (令牌桶，突发量为 1 秒)，超出直接丢弃
+//   - 上游查询使用随机事务 ID，并对域名做 0x20 大小写随机化 (dnsno0x20 关闭)，
+//     应答的 ID、问题节 (含大小写) 必须与发出的查询一致，否则视为可疑并丢弃
+// 发回客户端前恢复原始 ID 和问题节
+
+const (
+	dnsPacketSize  = 1500            // DNS UDP 报文最大长度
+	dnsTimeout     = 5 * time.Second // 上游查询超时
+	dnsMaxInflight = 64              // 并发查询上限
+	dnsMaxClients  = 1024            // 限速表最多记录的客户端数，超过时清空
+)
+
+var (
+	statDNSQueries     uint64 // 收到的查询
+	statDNSRateLimited uint64 // 因限速丢弃的查询
+	statDNSMalformed   uint64 // 无法解析的查询或应答
+	statDNSSuspicious  uint64 // ID 或问题节不匹配的应答 (可能是投毒)
+	statDNSFailures    uint64 // 上游超时或出错
+)
+
+var (
+	errDNSMalformed = errors.New("malformed DNS message")
+	errDNSMismatch  = errors.New("DNS response does not match query")
+)
+
+// dnsRelay 热点 DNS 转发
+type dnsRelay struct {
+	conn     net.PacketConn
+	upstream string
+	rate     int  // 每客户端每秒查询数 (<= 0 不限制)
+	no0x20   bool // 关闭 0x20 大小写随机化
+
+	mu      sync.Mutex
+	clients map[string]*rateLimiter
+}
+
+// startDNSRelay 在热点网卡上启动 DNS 转发，向局域网客户端提供解析服务
+func startDNSRelay(addr string, config *Config, stop chan struct{}) (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-stop
+		conn.Close()
+	}()
+	r := &dnsRelay{
+		conn:     conn,
+		upstream: config.DNSUpstream,
+		rate:     config.DNSRate,
+		no0x20:   config.DNSNo0x20,
+		clients:  make(map[string]*rateLimiter),
+	}
+	go r.loop()
+
+	log.Printf("DNS relay started on %s -> %s (via tunnel)", addr, config.DNSUpstream)
+	return conn, nil
+}
+
+// loop DNS 转发循环
+func (r *dnsRelay) loop() {
+	sem := make(chan struct{}, dnsMaxInflight)
+	for {
+		buf := make([]byte, dnsPacketSize)
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddUint64(&statDNSQueries, 1)
+		metricCount("kcp_dns_queries_total", "", 1)
+
+		if !r.allow(from) {
+			atomic.AddUint64(&statDNSRateLimited, 1)
+			metricCount("kcp_dns_ratelimited_total", "", 1)
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			// 并发过多时丢弃，客户端会重试
+			continue
+		}
+
+		go func() {
+			defer func() { <-sem }()
+			resp, err := r.exchange(buf[:n])
+			if err != nil {
+				if err == errDNSMalformed {
+					atomic.AddUint64(&statDNSMalformed, 1)
+					metricCount("kcp_dns_malformed_total", "", 1)
+				} else {
+					atomic.AddUint64(&statDNSFailures, 1)
+					logError("DNS relay error:", err)
+				}
+				return
+			}
+			r.conn.WriteTo(resp, from)
+		}()
+	}
+}
+
+// allow 按客户端 IP 限速
+func (r *dnsRelay) allow(from net.Addr) bool {
+	if r.rate <= 0 {
+		return true
+	}
+	host := from.String()
+	if addr, ok := from.(*net.UDPAddr); ok {
+		host = addr.IP.String()
+	}
+
+	r.mu.Lock()
+	l, ok := r.clients[host]
+	if !ok {
+		if len(r.clients) >= dnsMaxClients {
+			r.clients = make(map[string]*rateLimiter)
+		}
+		l = newRateLimiter(r.rate)
+		r.clients[host] = l
+	}
+	r.mu.Unlock()
+	return l.allow(1)
+}
+
+// exchange 经隧道向上游发送一次查询，返回恢复了客户端 ID 和问题节的应答
+func (r *dnsRelay) exchange(query []byte) ([]byte, error) {
+	qEnd, err := dnsQuestionEnd(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// 随机事务 ID 和 0x20 大小写
+	out := append([]byte(nil), query...)
+	var id [2]byte
+	rand.Read(id[:])
+	copy(out[:2], id[:])
+	if !r.no0x20 {
+		randomizeCase(out[12 : qEnd-4])
+	}
+
+	resp, err := tunnelDNS(r.upstream, out)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDNSResponse(resp, out[:qEnd]); err != nil {
+		if err == errDNSMismatch {
+			atomic.AddUint64(&statDNSSuspicious, 1)
+			metricCount("kcp_dns_suspicious_total", "", 1)
+			return nil, err
+		}
+		atomic.AddUint64(&statDNSMalformed, 1)
+		metricCount("kcp_dns_malformed_total", "", 1)
+		return nil, err
+	}
+	copy(resp[:2], query[:2])
+	copy(resp[12:qEnd], query[12:qEnd])
+	return resp, nil
+}
+
+// dnsQuestionEnd 校验只有一个问题的查询，返回问题节结束的偏移
+func dnsQuestionEnd(msg []byte) (int, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return 0, errDNSMalformed
+	}
+	i := 12
+	for {
+		if i >= len(msg) {
+			return 0, errDNSMalformed
+		}
+		l := int(msg[i])
+		if l == 0 {
+			i++
+			break
+		}
+		// 查询的问题节不应出现压缩指针
+		if l > 63 || i+1+l > len(msg) {
+			return 0, errDNSMalformed
+		}
+		i += 1 + l
+	}
+	if i+4 > len(msg) {
+		return 0, errDNSMalformed
+	}
+	return i + 4, nil
+}
+
+// checkDNSResponse 校验应答: QR 置位，ID 与问题节 (含大小写、类型、类) 与查询完全一致
+func checkDNSResponse(resp, question []byte) error {
+	if len(resp) < 12 {
+		return errDNSMalformed
+	}
+	if resp[2]&0x80 == 0 {
+		return errDNSMalformed
+	}
+	if len(resp) < len(question) || binary.BigEndian.Uint16(resp[4:6]) != 1 {
+		return errDNSMismatch
+	}
+	if string(resp[:2]) != string(question[:2]) || string(resp[12:len(question)]) != string(question[12:]) {
+		return errDNSMismatch
+	}
+	return nil
+}
+
+// randomizeCase 随机翻转域名标签中字母的大小写 (长度字节不受影响)
+func randomizeCase(name []byte) {
+	bits := make([]byte, len(name))
+	rand.Read(bits)
+	for i, c := range name {
+		lower := c | 0x20
+		if lower >= 'a' && lower <= 'z' && bits[i]&1 == 1 {
+			name[i] = c ^ 0x20
+		}
+	}
+}
+
+// dnsStats 热点 DNS 转发统计
+type dnsStats struct {
+	Queries     uint64 `json:"queries"`
+	RateLimited uint64 `json:"ratelimited"`
+	Malformed   uint64 `json:"malformed"`
+	Suspicious  uint64 `json:"suspicious"` // ID 或问题节不匹配的应答
+	Failures    uint64 `json:"failures"`
+}
+
+func snapshotDNS() *dnsStats {
+	return &dnsStats{
+		Queries:     atomic.LoadUint64(&statDNSQueries),
+		RateLimited: atomic.LoadUint64(&statDNSRateLimited),
+		Malformed:   atomic.LoadUint64(&statDNSMalformed),
+		Suspicious:  atomic.LoadUint64(&statDNSSuspicious),
+		Failures:    atomic.LoadUint64(&statDNSFailures),
+	}
+}
+
+// resetDNS 清零 DNS 转发统计
+func resetDNS() {
+	for _, c := range []*uint64{&statDNSQueries, &statDNSRateLimited, &statDNSMalformed, &statDNSSuspicious, &statDNSFailures} {
+		atomic.StoreUint64(c, 0)
+	}
+}
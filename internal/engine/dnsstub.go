@@ -0,0 +1,218 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// 本地 DNS 存根: 在 dnsstub 地址 (如 "127.0.0.1:5353") 上接收 UDP 查询，
+// A/AAAA 查询经隧道以 DNS over TCP 转发到 dnsupstream (服务端代理负责连接上游)，
+// 只能设置 DNS 服务器、不能设置代理的 App 也能得到不泄漏、不被污染的解析结果。
+// 其他类型的查询直接回复 REFUSED，不经隧道也不直连
+
+const (
+	dnsTypeAAAA     = 28
+	dnsRcodeRefused = 5
+)
+
+var (
+	statStubQueries  uint64 // 收到的查询
+	statStubRefused  uint64 // 非 A/AAAA 或来源不允许而拒绝的查询
+	statStubFailures uint64 // 隧道或上游出错
+)
+
+// dnsStub 本地 DNS 存根
+type dnsStub struct {
+	conn     net.PacketConn
+	upstream string
+	lan      bool // 允许非回环来源 (allowlan)
+}
+
+// startDNSStub 启动本地 DNS 存根
+func startDNSStub(config *Config, stop chan struct{}) error {
+	conn, err := net.ListenPacket("udp", config.DNSStub)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-stop
+		conn.Close()
+	}()
+	s := &dnsStub{conn: conn, upstream: config.DNSUpstream, lan: config.AllowLAN}
+	go s.loop()
+
+	log.Printf("DNS stub started on %s -> %s (via tunnel)", conn.LocalAddr(), config.DNSUpstream)
+	return nil
+}
+
+// loop 查询处理循环
+func (s *dnsStub) loop() {
+	sem := make(chan struct{}, dnsMaxInflight)
+	for {
+		buf := make([]byte, dnsPacketSize)
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddUint64(&statStubQueries, 1)
+		metricCount("kcp_dnsstub_queries_total", "", 1)
+
+		if addr, ok := from.(*net.UDPAddr); ok && !s.lan && !addr.IP.IsLoopback() {
+			atomic.AddUint64(&statStubRefused, 1)
+			continue
+		}
+		query := buf[:n]
+		qEnd, err := dnsQuestionEnd(query)
+		if err != nil {
+			atomic.AddUint64(&statDNSMalformed, 1)
+			continue
+		}
+		if qtype := binary.BigEndian.Uint16(query[qEnd-4:]); qtype != dnsTypeA && qtype != dnsTypeAAAA {
+			atomic.AddUint64(&statStubRefused, 1)
+			s.conn.WriteTo(dnsRefused(query[:qEnd]), from)
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			// 并发过多时丢弃，客户端会重试
+			continue
+		}
+		go func() {
+			defer func() { <-sem }()
+			resp, err := s.exchange(query, qEnd)
+			if err != nil {
+				atomic.AddUint64(&statStubFailures, 1)
+				connLog("DNS stub error:", err)
+				return
+			}
+			s.conn.WriteTo(resp, from)
+		}()
+	}
+}
+
+// exchange 经隧道向上游查询
+func (s *dnsStub) exchange(query []byte, qEnd int) ([]byte, error) {
+	resp, err := tunnelDNS(s.upstream, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDNSResponse(resp, query[:qEnd]); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// tunnelDNS 经隧道以 DNS over TCP 向 upstream 发送一次查询 (服务端代理负责连接上游)
+func tunnelDNS(upstream string, query []byte) ([]byte, error) {
+	session := pickAliveSession()
+	if session == nil {
+		return nil, fmt.Errorf("no alive session")
+	}
+	hs, err := socks5Connect(upstream)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := openTunnel(session, hs)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(clk.Now().Add(dnsTimeout))
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err := stream.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(stream, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// socks5Connect 构造连接 target 的 SOCKS5 握手 (服务端回复的方法选择需丢弃)
+func socks5Connect(target string) (*proxyHandshake, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	req := []byte{5, 1, 0, 5, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(append(req, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(p))
+	return &proxyHandshake{proto: 5, cmd: socksCmdConnect, target: target, head: req, swallow: 2}, nil
+}
+
+// dnsRefused 构造 REFUSED 应答 (只含问题节)
+func dnsRefused(question []byte) []byte {
+	resp := append([]byte(nil), question...)
+	resp[2] |= 0x80 // QR
+	resp[3] = resp[3]&0xf0 | dnsRcodeRefused
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	return resp
+}
+
+// dnsStubStats DNS 存根统计
+type dnsStubStats struct {
+	Queries  uint64 `json:"queries"`
+	Refused  uint64 `json:"refused"`
+	Failures uint64 `json:"failures"`
+}
+
+// snapshotDNSStub 返回 DNS 存根统计 (未启用时为 nil)
+func snapshotDNSStub(config *Config) *dnsStubStats {
+	if config.DNSStub == "" {
+		return nil
+	}
+	return &dnsStubStats{
+		Queries:  atomic.LoadUint64(&statStubQueries),
+		Refused:  atomic.LoadUint64(&statStubRefused),
+		Failures: atomic.LoadUint64(&statStubFailures),
+	}
+}
@@ -0,0 +1,262 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 域名嗅探: 目标是 IP 时 (App 自行解析了 DNS) 从客户端发出的第一段数据中识别域名，
+// 用于规则匹配和连接日志，使 domain/suffix 等规则对这类连接同样生效
+//   - sniffsni: TLS ClientHello 中的 SNI
+//   - sniffhost: 明文 HTTP 请求的 Host 头 (只看前 sniffHostLimit 字节)
+// 在本地完成握手时先以成功应答客户端，再在 sniffTimeout 内等待其首段数据；
+// 透传握手时在上行数据中被动识别，命中 reject 规则后以 RST 关闭
+
+const (
+	sniffHelloLimit = 8 * 1024               // 等待完整 ClientHello 最多缓存的字节数
+	sniffHostLimit  = 4 * 1024               // 查找 Host 头最多缓存的字节数
+	sniffTimeout    = 300 * time.Millisecond // 本地握手后等待客户端首段数据的时间 (服务端先发言的协议会等满)
+)
+
+// sniffable 是否对该目标嗅探域名: 已开启嗅探、目标为 IP 且为可在本地应答的连接请求
+func sniffable(config *Config, hs *proxyHandshake) bool {
+	if !(config.SniffSNI || config.SniffHost) || !isIPTarget(hs.target) {
+		return false
+	}
+	switch hs.proto {
+	case 5:
+		return hs.cmd == socksCmdConnect
+	case 4:
+		return true
+	case 'H':
+		return hs.connect
+	}
+	return false
+}
+
+// isIPTarget 目标 host:port 的主机部分是否为 IP
+func isIPTarget(target string) bool {
+	host, _, err := net.SplitHostPort(target)
+	return err == nil && net.ParseIP(host) != nil
+}
+
+// sniffLocal 本地完成握手时嗅探域名: 先应答客户端，再读取首段数据 (追加到 hs.early 由出口重放)
+// 应答后 hs.replied 为 true，之后的成功/失败应答不再发送
+func sniffLocal(config *Config, conn net.Conn, hs *proxyHandshake) string {
+	if !sniffable(config, hs) {
+		return ""
+	}
+	if err := replyHandshake(conn, hs, true); err != nil {
+		return ""
+	}
+	hs.replied = true
+
+	conn.SetReadDeadline(clk.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := hs.early
+	b := make([]byte, 2048)
+	for {
+		if domain, ok := parseDomain(config.SniffSNI, config.SniffHost, buf); ok || len(buf) >= sniffHelloLimit {
+			hs.early = buf
+			return domain
+		}
+		n, err := conn.Read(b)
+		buf = append(buf, b[:n]...)
+		if err != nil {
+			// 超时或客户端关闭: 已读取的数据仍需转发，连接错误由之后的转发处理
+			hs.early = buf
+			domain, _ := parseDomain(config.SniffSNI, config.SniffHost, buf)
+			return domain
+		}
+	}
+}
+
+// parseDomain 按首字节选择 TLS 或 HTTP 解析客户端首段数据中的域名
+// ok 为 false 表示数据还不完整；ok 为 true 且 domain 为空表示无法识别
+func parseDomain(sni, host bool, b []byte) (domain string, ok bool) {
+	if len(b) == 0 {
+		return "", false
+	}
+	switch {
+	case sni && b[0] == 0x16:
+		return parseClientHelloSNI(b)
+	case host && b[0] >= 'A' && b[0] <= 'Z':
+		return parseHTTPHost(b)
+	}
+	return "", true
+}
+
+// parseHTTPHost 解析明文 HTTP 请求头中的 Host (去掉端口)，超过 sniffHostLimit 仍未读完请求头则放弃
+func parseHTTPHost(b []byte) (string, bool) {
+	if len(b) > sniffHostLimit {
+		b = b[:sniffHostLimit]
+	}
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", len(b) >= sniffHostLimit
+	}
+	lines := strings.Split(string(b[:end]), "\r\n")
+	if fields := strings.Fields(lines[0]); len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return "", true
+	}
+	for _, line := range lines[1:] {
+		name, value, found := strings.Cut(line, ":")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		// Host 本身是 IP 时没有额外信息
+		if net.ParseIP(host) != nil {
+			return "", true
+		}
+		return host, true
+	}
+	return "", true
+}
+
+// matchSniffed 先按嗅探出的域名匹配规则，未命中时再按 IP 匹配
+func matchSniffed(config *Config, domain, host string) string {
+	if rs := currentRules(config); rs != nil && domain != "" {
+		if idx := rs.match(domain); idx >= 0 {
+			atomic.AddUint64(&rs.hits[idx], 1)
+			return rs.rules[idx].Action
+		}
+	}
+	return matchRule(config, host)
+}
+
+// parseClientHelloSNI 从 TLS 记录中解析 ClientHello 的 SNI
+// ok 为 false 表示数据还不完整；ok 为 true 且 sni 为空表示不是 TLS 或没有 SNI
+func parseClientHelloSNI(b []byte) (sni string, ok bool) {
+	// 握手消息可能跨多个记录，先拼接记录内容
+	var msg []byte
+	for len(msg) < 4 || len(msg) < 4+handshakeLen(msg) {
+		if len(msg) > 0 && msg[0] != 1 { // 不是 ClientHello
+			return "", true
+		}
+		if len(b) > 0 && b[0] != 0x16 {
+			return "", true
+		}
+		if len(b) < 5 {
+			return "", false
+		}
+		if b[1] != 3 {
+			return "", true
+		}
+		n := int(binary.BigEndian.Uint16(b[3:5]))
+		if len(b) < 5+n {
+			msg = append(msg, b[5:]...)
+			b = nil
+			continue
+		}
+		msg = append(msg, b[5:5+n]...)
+		b = b[5+n:]
+	}
+	if msg[0] != 1 {
+		return "", true
+	}
+	return clientHelloSNI(msg[4 : 4+handshakeLen(msg)]), true
+}
+
+// handshakeLen 握手消息头中的长度 (24 位)
+func handshakeLen(msg []byte) int {
+	return int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+}
+
+// clientHelloSNI 解析 ClientHello 消息体中的 server_name 扩展
+func clientHelloSNI(m []byte) string {
+	// client_version(2) + random(32)
+	if len(m) < 34 {
+		return ""
+	}
+	m = m[34:]
+	// session_id
+	if len(m) < 1 || len(m) < 1+int(m[0]) {
+		return ""
+	}
+	m = m[1+int(m[0]):]
+	// cipher_suites
+	if len(m) < 2 {
+		return ""
+	}
+	if n := int(binary.BigEndian.Uint16(m)); len(m) >= 2+n {
+		m = m[2+n:]
+	} else {
+		return ""
+	}
+	// compression_methods
+	if len(m) < 1 || len(m) < 1+int(m[0]) {
+		return ""
+	}
+	m = m[1+int(m[0]):]
+	// extensions
+	if len(m) < 2 {
+		return ""
+	}
+	if n := int(binary.BigEndian.Uint16(m)); len(m) >= 2+n {
+		m = m[2 : 2+n]
+	} else {
+		return ""
+	}
+	for len(m) >= 4 {
+		typ, n := binary.BigEndian.Uint16(m), int(binary.BigEndian.Uint16(m[2:]))
+		if len(m) < 4+n {
+			return ""
+		}
+		ext := m[4 : 4+n]
+		m = m[4+n:]
+		if typ != 0 { // server_name
+			continue
+		}
+		// server_name_list: 长度(2) + [name_type(1) + 长度(2) + 名称]
+		if len(ext) < 2 {
+			return ""
+		}
+		list := ext[2:]
+		for len(list) >= 3 {
+			l := int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+l {
+				return ""
+			}
+			if list[0] == 0 {
+				return strings.ToLower(strings.TrimSuffix(string(list[3:3+l]), "."))
+			}
+			list = list[3+l:]
+		}
+		return ""
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 排空: App 计划内维护 (切换配置、升级) 前调用 Drain，实例不再接受新的本地连接
+// (新连接以 SOCKS "connection refused" 拒绝，计入 draining 关闭原因)，
+// 已有连接继续转发直到结束。排空状态保持到 CancelDrain、StopProxy 或 UpdateConfig 完成切换
+
+const drainPoll = 100 * time.Millisecond
+
+// draining 非 0 表示正在排空
+var draining int32
+
+// isDraining 是否正在排空
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+// rejectDraining 排空期间拒绝新连接
+func rejectDraining(conn net.Conn, client *hotspotClient) {
+	closeParked(parkedConn{conn: conn, client: client}, closeDraining, socksRefused)
+}
+
+// Drain 停止接受新连接，等待已有连接结束 (阻塞调用，最长 timeoutMs 毫秒)
+// 全部连接在超时前结束时返回空字符串，否则返回错误信息；超时后仍保持排空状态
+func Drain(timeoutMs int) string {
+	proxyMu.Lock()
+	running := proxyRunning()
+	proxyMu.Unlock()
+	if !running {
+		return "Proxy not running"
+	}
+
+	if atomic.CompareAndSwapInt32(&draining, 0, 1) {
+		active := atomic.LoadInt64(&statActiveConns)
+		log.Printf("Draining: %d connections active", active)
+		emitEvent("draining", map[string]interface{}{"active": active})
+	}
+
+	deadline := clk.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	for {
+		active := atomic.LoadInt64(&statActiveConns)
+		if active == 0 {
+			emitEvent("drained", map[string]interface{}{"remaining": 0})
+			return ""
+		}
+		if !isDraining() {
+			return "Drain cancelled"
+		}
+		if !clk.Now().Before(deadline) {
+			emitEvent("drained", map[string]interface{}{"remaining": active, "timedout": true})
+			return fmt.Sprintf("Drain timed out: %d connections active", active)
+		}
+		clk.Sleep(drainPoll)
+	}
+}
+
+// CancelDrain 取消排空，恢复接受新连接
+func CancelDrain() {
+	if atomic.CompareAndSwapInt32(&draining, 1, 0) {
+		log.Println("Drain cancelled")
+		emitEvent("drain-cancelled", nil)
+	}
+}
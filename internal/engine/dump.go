@@ -0,0 +1,80 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"runtime"
+)
+
+// DumpState 返回一份完整的运行状态 JSON，便于附在用户的问题反馈中
+// 包括生效配置 (密钥已隐去)、统计、会话列表、最近事件、goroutine 数量和内存统计
+func DumpState() string {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	state := map[string]interface{}{
+		"version":    VERSION,
+		"goos":       runtime.GOOS,
+		"goarch":     runtime.GOARCH,
+		"goversion":  runtime.Version(),
+		"goroutines": runtime.NumGoroutine(),
+		"memory": map[string]uint64{
+			"alloc":      mem.Alloc,
+			"totalalloc": mem.TotalAlloc,
+			"sys":        mem.Sys,
+			"heapinuse":  mem.HeapInuse,
+			"numgc":      uint64(mem.NumGC),
+		},
+		"config":   json.RawMessage(effectiveConfigJSON()),
+		"stats":    json.RawMessage(GetStats()),
+		"sessions": json.RawMessage(GetSessions()),
+		"streams":  json.RawMessage(GetActiveStreams()),
+		"events":   recentEvents(),
+	}
+
+	b, _ := json.Marshal(state)
+	return redactText(string(b))
+}
+
+// effectiveConfigJSON 返回当前生效的配置，密钥替换为占位符
+func effectiveConfigJSON() string {
+	proxyMu.Lock()
+	if proxyConfig == nil {
+		proxyMu.Unlock()
+		return "null"
+	}
+	config := *proxyConfig
+	proxyMu.Unlock()
+
+	if config.Key != "" {
+		config.Key = "<redacted>"
+	}
+	if config.LocalTLSKey != "" {
+		config.LocalTLSKey = "<redacted>"
+	}
+	b, _ := json.Marshal(&config)
+	return string(b)
+}
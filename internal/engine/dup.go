@@ -0,0 +1,67 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// 小包复制: 不超过 duplicate 字节的 UDP 包发送两份，以带宽换取交互流量 (按键、小请求、ACK) 的丢包恢复时间
+// KCP 按序号去重，FEC 解码器按分片序号去重，重复包只会被丢弃
+
+var statDupPackets uint64 // 额外发送的副本数
+
+// dupConn 复制小包的 PacketConn
+type dupConn struct {
+	net.PacketConn
+	size int
+	auto bool // 阈值随 auto 档位变化
+}
+
+// duplicateSmall 按配置包装连接 (未开启时原样返回)
+func duplicateSmall(config *Config, conn net.PacketConn) net.PacketConn {
+	auto := config.Profile == profileAuto
+	if config.Duplicate <= 0 && !auto {
+		return conn
+	}
+	return &dupConn{PacketConn: conn, size: config.Duplicate, auto: auto}
+}
+
+func (d *dupConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	size := d.size
+	if d.auto {
+		size = int(atomic.LoadInt64(&autoDup))
+	}
+	n, err := d.PacketConn.WriteTo(b, addr)
+	if err == nil && len(b) <= size {
+		// 副本发送失败不影响原包
+		if _, err := d.PacketConn.WriteTo(b, addr); err == nil {
+			atomic.AddUint64(&statDupPackets, 1)
+			metricCount("kcp_dup_packets_total", "", 1)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,193 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// testTunnel 本机的 SMUX over TLS 服务端 (自签名证书)，接受流后立即关闭
+// down/up 模拟服务端中断和恢复 (恢复后监听同一地址)
+type testTunnel struct {
+	t         testing.TB
+	addr      string
+	caPEM     string
+	tlsConfig *tls.Config
+
+	mu    sync.Mutex
+	ln    net.Listener
+	conns map[net.Conn]bool
+}
+
+func newTestTunnel(t testing.TB) *testTunnel {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testTunnel{
+		t:         t,
+		addr:      "127.0.0.1:0",
+		caPEM:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		conns:     make(map[net.Conn]bool),
+	}
+	s.up()
+	t.Cleanup(s.down)
+	return s
+}
+
+// up 开始监听
+func (s *testTunnel) up() {
+	ln, err := tls.Listen("tcp", s.addr, s.tlsConfig)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.ln, s.addr = ln, ln.Addr().String()
+	s.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = true
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+}
+
+// down 关闭监听和所有连接
+func (s *testTunnel) down() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln != nil {
+		s.ln.Close()
+		s.ln = nil
+	}
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+func (s *testTunnel) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	session, err := smux.Server(conn, smux.DefaultConfig())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer session.Close()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		stream.Close()
+	}
+}
+
+// config 连接该服务端的配置 JSON，extra 中的字段覆盖默认值
+func (s *testTunnel) config(localAddr string, extra map[string]interface{}) string {
+	fields := map[string]interface{}{
+		"label":      "test",
+		"localaddr":  localAddr,
+		"remoteaddr": s.addr,
+		"transport":  transportTLS,
+		"capem":      s.caPEM,
+	}
+	for k, v := range extra {
+		fields[k] = v
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return string(b)
+}
+
+// tunnelConfig 连接新建的 testTunnel 的配置 JSON
+func tunnelConfig(t testing.TB, localAddr string, extra map[string]interface{}) string {
+	return newTestTunnel(t).config(localAddr, extra)
+}
+
+// freeLocalAddr 返回当前空闲的回环端口
+func freeLocalAddr(t testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// isolated 在子进程中单独运行当前测试，返回 true 表示当前是父进程 (结果已报告)
+// 启动过代理的测试需要隔离: 停止后后台协程仍可能读取 clk 等全局变量，
+// 与其他测试替换这些变量构成数据竞争
+func isolated(t *testing.T) bool {
+	if os.Getenv("ENGINE_TEST_CHILD") == t.Name() {
+		return false
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.count=1")
+	cmd.Env = append(os.Environ(), "ENGINE_TEST_CHILD="+t.Name())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	return true
+}
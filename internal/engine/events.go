@@ -0,0 +1,129 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	// 事件队列长度，App 处理过慢时丢弃新事件而不是阻塞引擎
+	eventQueueLen = 256
+	// 保留的最近事件数 (用于 DumpState)
+	eventHistoryLen = 100
+)
+
+// EventListener 事件回调接口 (由 App 实现)
+// eventJson 格式: {"apiversion": 2, "instance": "标签", "type": "...", "time": 毫秒时间戳, "data": {...}}
+type EventListener interface {
+	OnEvent(eventJson string)
+}
+
+var (
+	eventMu       sync.Mutex
+	eventListener EventListener
+	eventQueue    chan string
+	eventHistory  []string // 最近的事件，无论是否设置了回调
+)
+
+// SetEventListener 设置事件回调，传入 nil 取消
+// 回调在独立 goroutine 中按顺序调用，不会阻塞代理
+func SetEventListener(l EventListener) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+
+	eventListener = l
+	if l != nil && eventQueue == nil {
+		eventQueue = make(chan string, eventQueueLen)
+		go eventLoop(eventQueue)
+	}
+}
+
+// emitEvent 发送一个事件 (非阻塞)
+func emitEvent(kind string, data map[string]interface{}) {
+	defer wakeStateWatchers()
+	eventMu.Lock()
+	defer eventMu.Unlock()
+
+	ev := map[string]interface{}{
+		"apiversion": apiVersion,
+		"instance":   currentLabel(),
+		"type":       kind,
+		"time":       clk.Now().UnixNano() / int64(time.Millisecond),
+		"data":       data,
+	}
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		logError("Event marshal error:", err)
+		return
+	}
+	b := redactText(string(raw))
+
+	if len(eventHistory) >= eventHistoryLen {
+		eventHistory = eventHistory[1:]
+	}
+	eventHistory = append(eventHistory, b)
+
+	if eventListener == nil {
+		return
+	}
+
+	select {
+	case eventQueue <- b:
+	default:
+		logError("Event queue full, dropped:", kind)
+	}
+}
+
+// eventLoop 事件分发循环
+func eventLoop(queue chan string) {
+	for ev := range queue {
+		payload, n := nextEvents(queue, ev)
+
+		eventMu.Lock()
+		l := eventListener
+		eventMu.Unlock()
+
+		if l != nil {
+			start := clk.Now()
+			l.OnEvent(payload)
+			observeCallback(&eventCalls, "event", clk.Since(start), n)
+		}
+	}
+}
+
+// recentEvents 返回最近的事件 (JSON 字符串列表)
+func recentEvents() []json.RawMessage {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+
+	list := make([]json.RawMessage, len(eventHistory))
+	for i, ev := range eventHistory {
+		list[i] = json.RawMessage(ev)
+	}
+	return list
+}
@@ -0,0 +1,70 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 空闲退出: 本次启动以来至少处理过一个连接，且全部连接结束后空闲 exitonidle 秒，自动停止实例。
+// 适合由 WorkManager 等任务驱动的一次性传输 (如单次大文件上传)，停止前发送 "exit-idle" 事件
+
+var launchConns uint64 // 本次启动以来处理的连接数
+
+// resetLaunchConns 每次启动时清零
+func resetLaunchConns() {
+	atomic.StoreUint64(&launchConns, 0)
+}
+
+// checkExitOnIdle 满足空闲退出条件时停止实例 (仅监管协程调用)
+func (s *sessionSupervisor) checkExitOnIdle() {
+	if s.config.ExitOnIdle <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	parked := len(s.parked)
+	s.mu.Unlock()
+	served := atomic.LoadUint64(&launchConns)
+	if served == 0 || atomic.LoadInt64(&statActiveConns) > 0 || parked > 0 {
+		s.exitSince = time.Time{}
+		return
+	}
+	if s.exitSince.IsZero() {
+		s.exitSince = clk.Now()
+		return
+	}
+	idle := clk.Since(s.exitSince)
+	if idle < time.Duration(s.config.ExitOnIdle)*time.Second {
+		return
+	}
+
+	log.Printf("All %d connections closed, idle for %s, exiting", served, idle.Round(time.Second))
+	emitEvent("exit-idle", map[string]interface{}{"idle": idle.Seconds(), "conns": served})
+	// 在新协程中停止，避免 stopLocked 等待监管协程自身
+	go stopInstance(s.stop)
+}
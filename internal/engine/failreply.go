@@ -0,0 +1,93 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// 隧道不可用时不再直接关闭客户端连接，而是读取代理握手并按隧道状态回复失败码，
+// 让客户端 App 区分情况并正确退避:
+//   - 重连持续失败 (服务端不可达): host unreachable
+//   - 正在重连但等待超时: TTL expired
+//   - 断网保护、停车场已满或代理停止: connection refused
+// 无法识别的协议 (或需要认证的 SOCKS5) 仍直接关闭
+
+// SOCKS5 回复码
+const (
+	socksHostUnreachable byte = 4
+	socksRefused         byte = 5
+	socksTTLExpired      byte = 6
+	socksCmdUnsupported  byte = 7
+)
+
+// failWriteTimeout 回复失败码的写入超时
+const failWriteTimeout = 2 * time.Second
+
+// replyFailure 以对应代理协议回复失败
+// code 为 SOCKS5 回复码；SOCKS4 只有一种拒绝码，HTTP 代理映射为 502/503/504
+func replyFailure(w io.Writer, hs *proxyHandshake, code byte) error {
+	if hs.replied {
+		// 已提前以成功应答，只能直接关闭
+		return nil
+	}
+	var reply []byte
+	switch hs.proto {
+	case 5:
+		reply = []byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0}
+	case 4:
+		reply = []byte{0, 0x5b, 0, 0, 0, 0, 0, 0}
+	case 'H':
+		switch code {
+		case socksTTLExpired:
+			reply = []byte("HTTP/1.1 504 Gateway Timeout\r\nContent-Length: 0\r\n\r\n")
+		case socksRefused:
+			reply = []byte("HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n")
+		default:
+			reply = []byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		}
+	}
+	if len(reply) == 0 {
+		return nil
+	}
+	_, err := w.Write(reply)
+	return err
+}
+
+// failClient 回复失败码并关闭连接
+// hs 为 nil 表示握手尚未读取 (透传模式或未分发的连接)，先在本地读取
+func failClient(conn net.Conn, hs *proxyHandshake, code byte) {
+	defer conn.Close()
+	if hs == nil {
+		var err error
+		if hs, err = readHandshake(conn); err != nil {
+			return
+		}
+	}
+	conn.SetWriteDeadline(clk.Now().Add(failWriteTimeout))
+	replyFailure(conn, hs, code)
+}
@@ -0,0 +1,89 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// sessionFeatures 会话建立时实际协商/启用的功能，字段和取值固定，便于在版本混杂的服务端之间对比会话行为
+type sessionFeatures struct {
+	Transport string `json:"transport"`     // kcp-udp, kcp-tcp (TCP 模拟), tls
+	Crypt     string `json:"crypt"`         // 加密方式 (TLS 传输时为 tls)
+	Comp      string `json:"comp"`          // zstd, snappy, none
+	SmuxVer   int    `json:"smuxver"`       // SMUX 协议版本
+	Obfs      string `json:"obfs"`          // qpp, none
+	FEC       string `json:"fec,omitempty"` // 数据分片/校验分片 (仅 KCP 传输)
+	TLS       string `json:"tls,omitempty"` // TLS 版本和 ALPN (仅 TLS 传输)
+}
+
+var (
+	featuresMu   sync.Mutex
+	lastFeatures *sessionFeatures // 上一个建立的会话的功能，用于发现变化
+)
+
+// negotiatedFeatures 记录新会话的功能，与上一个会话不同时发送 "session-features" 事件
+func negotiatedFeatures(config *Config, kcpConn *kcp.UDPSession, link net.Conn) *sessionFeatures {
+	f := &sessionFeatures{Crypt: config.Crypt, Comp: "none", SmuxVer: config.SmuxVer, Obfs: "none"}
+	if kcpConn != nil {
+		f.Transport = "kcp-udp"
+		if kcpConn.LocalAddr().Network() == "tcp" {
+			f.Transport = "kcp-tcp"
+		}
+		switch {
+		case config.Comp == compZstd:
+			f.Comp = compZstd
+		case !*config.NoComp:
+			f.Comp = compSnappy
+		}
+		if config.QPP {
+			f.Obfs = "qpp"
+		}
+		p := effectiveParams(config)
+		f.FEC = fmt.Sprintf("%d/%d", p.DataShard, p.ParityShard)
+	} else {
+		f.Transport, f.Crypt = transportTLS, transportTLS
+		if version, alpn, ok := tlsConnState(link); ok {
+			f.TLS = tls.VersionName(version)
+			if alpn != "" {
+				f.TLS += " " + alpn
+			}
+		}
+	}
+
+	featuresMu.Lock()
+	prev := lastFeatures
+	lastFeatures = f
+	featuresMu.Unlock()
+	if prev != nil && *prev != *f {
+		emitEvent("session-features", map[string]interface{}{"from": prev, "to": f})
+	}
+	return f
+}
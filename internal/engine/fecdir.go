@@ -0,0 +1,310 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// 分方向 FEC: fecup/fecdown 分别控制上行和下行是否发送校验分片。
+// 两端仍按 datashard/parityshard 收发 FEC 帧头，关闭某一方向只是发送方不再发出校验分片，
+// 接收方的 FEC 解码器对只有数据分片的组照常交付。
+//
+// 客户端在能力协商中声明 "fecdir"，服务端确认后，心跳 ping 携带期望的状态
+// {"fec":{"up":bool,"down":bool}}，服务端按 down 调整自己的校验分片并回复
+// {"type":"fec","fec":{"up":..,"down":..}} 确认。上行在服务端确认后才在本地丢弃校验分片。
+// auto: 上行按重传率、下行按 FEC 恢复率开关，带滞回；下行关闭后无法测量恢复率，
+// 每 fecDirProbe 个采样周期重新打开一次以复测
+
+const (
+	capFECDir = "fecdir"
+
+	fecDirOffBelow = 0.005 // 丢包率低于此值时关闭
+	fecDirOnAbove  = 0.02  // 丢包率高于此值时打开
+	fecDirEWMA     = 0.2
+	fecDirProbe    = 60 // 下行关闭后重新测量的采样周期数
+
+	fecFlagParity    = 0xf2 // kcp-go 校验分片标记
+	fecCryptHeader   = 20   // kcp-go 加密头: nonce (16) + crc32 (4)
+	parityMarksLimit = 4096
+)
+
+var statParityDropped uint64 // 上行关闭时丢弃的校验分片数
+
+// fecDirs 两个方向是否发送校验分片
+type fecDirs struct {
+	Up   bool `json:"up"`
+	Down bool `json:"down"`
+}
+
+var (
+	fecDirMu      sync.Mutex
+	fecDirWant    = fecDirs{Up: true, Down: true} // 期望的状态
+	fecDirApplied = fecDirs{Up: true, Down: true} // 服务端确认的状态
+	fecUpLoss     float64
+	fecDownLoss   float64
+	fecDirSamples int
+	fecDirOffFor  int // 下行已关闭的采样周期数
+	fecDirLast    *kcp.Snmp
+
+	// fecUpDropped 服务端已确认上行关闭，本地丢弃校验分片
+	fecUpDropped int32
+)
+
+// fecDirEnabled 是否需要分方向协商 (未启用 FEC 或两个方向都固定打开时不需要)
+func fecDirEnabled(config *Config) bool {
+	return config.ParityShard > 0 && (config.FECUp != fecDirOn || config.FECDown != fecDirOn)
+}
+
+// resetFECDirs 启动时恢复为两个方向都打开
+func resetFECDirs(config *Config) {
+	fecDirMu.Lock()
+	fecDirWant = fecDirs{Up: config.FECUp != fecDirOff, Down: config.FECDown != fecDirOff}
+	fecDirApplied = fecDirs{Up: true, Down: true}
+	fecUpLoss, fecDownLoss, fecDirSamples, fecDirOffFor = 0, 0, 0, 0
+	fecDirLast = nil
+	fecDirMu.Unlock()
+	atomic.StoreInt32(&fecUpDropped, 0)
+}
+
+// fecDirRequest 心跳 ping 中携带的期望状态 (与已确认的状态相同时为 nil)
+func fecDirRequest(config *Config) *fecDirs {
+	if !fecDirEnabled(config) || !serverSupports(capFECDir) {
+		return nil
+	}
+	fecDirMu.Lock()
+	defer fecDirMu.Unlock()
+	if fecDirWant == fecDirApplied {
+		return nil
+	}
+	want := fecDirWant
+	return &want
+}
+
+// handleServerFEC 处理服务端的 "fec" 确认
+func handleServerFEC(config *Config, msg *ctrlMessage) {
+	if !fecDirEnabled(config) || msg.FEC == nil {
+		return
+	}
+	fecDirMu.Lock()
+	changed := fecDirApplied != *msg.FEC
+	fecDirApplied = *msg.FEC
+	fecDirMu.Unlock()
+
+	dropped := int32(0)
+	if !msg.FEC.Up {
+		dropped = 1
+	}
+	atomic.StoreInt32(&fecUpDropped, dropped)
+	if !changed {
+		return
+	}
+	log.Printf("FEC directions: up %v, down %v", msg.FEC.Up, msg.FEC.Down)
+	emitEvent("fec-direction", map[string]interface{}{"up": msg.FEC.Up, "down": msg.FEC.Down})
+}
+
+// resetFECApplied 控制流重连时服务端恢复为两个方向都发送
+func resetFECApplied() {
+	fecDirMu.Lock()
+	fecDirApplied = fecDirs{Up: true, Down: true}
+	fecDirMu.Unlock()
+	atomic.StoreInt32(&fecUpDropped, 0)
+}
+
+// sampleFECDirs 按测得的丢包率更新 auto 方向的期望状态
+func sampleFECDirs(config *Config) {
+	if !fecDirEnabled(config) {
+		return
+	}
+	quality.mu.Lock()
+	upLoss, ok := quality.loss, quality.valid
+	quality.mu.Unlock()
+
+	snmp := kcp.DefaultSnmp.Copy()
+	fecDirMu.Lock()
+	defer fecDirMu.Unlock()
+	last := fecDirLast
+	fecDirLast = snmp
+	if last == nil || !ok {
+		return
+	}
+
+	// 下行: 只有服务端发送校验分片时才能由恢复数估算丢包
+	var downLoss float64
+	downMeasured := fecDirApplied.Down
+	if in := snmp.InPkts - last.InPkts; downMeasured && in > 0 {
+		rec := snmp.FECRecovered - last.FECRecovered
+		downLoss = float64(rec) / float64(in+rec)
+	}
+	if fecDirSamples == 0 {
+		fecUpLoss, fecDownLoss = upLoss, downLoss
+	} else {
+		fecUpLoss += fecDirEWMA * (upLoss - fecUpLoss)
+		if downMeasured {
+			fecDownLoss += fecDirEWMA * (downLoss - fecDownLoss)
+		}
+	}
+	fecDirSamples++
+
+	if config.FECUp == fecDirAuto {
+		fecDirWant.Up = nextFECDir(fecDirWant.Up, fecUpLoss)
+	}
+	if config.FECDown == fecDirAuto {
+		if fecDirWant.Down {
+			fecDirOffFor = 0
+			fecDirWant.Down = nextFECDir(true, fecDownLoss)
+		} else if fecDirOffFor++; fecDirOffFor >= fecDirProbe {
+			// 重新打开以复测下行丢包
+			fecDirOffFor = 0
+			fecDirWant.Down = true
+		}
+	}
+}
+
+// nextFECDir 带滞回的开关判断
+func nextFECDir(on bool, loss float64) bool {
+	if on {
+		return loss >= fecDirOffBelow
+	}
+	return loss > fecDirOnAbove
+}
+
+// fecDirStats 分方向 FEC 统计
+type fecDirStats struct {
+	Want     fecDirs `json:"want"`
+	Applied  fecDirs `json:"applied"`
+	UpLoss   float64 `json:"uploss"`
+	DownLoss float64 `json:"downloss"`
+	Dropped  uint64  `json:"dropped"` // 上行丢弃的校验分片数
+}
+
+// snapshotFECDirs 返回分方向 FEC 统计 (未启用时为 nil)
+func snapshotFECDirs(config *Config) *fecDirStats {
+	if !fecDirEnabled(config) {
+		return nil
+	}
+	fecDirMu.Lock()
+	defer fecDirMu.Unlock()
+	return &fecDirStats{
+		Want:     fecDirWant,
+		Applied:  fecDirApplied,
+		UpLoss:   fecUpLoss,
+		DownLoss: fecDownLoss,
+		Dropped:  atomic.LoadUint64(&statParityDropped),
+	}
+}
+
+// parityMarks 加密后的校验分片缓冲区 (按首字节地址识别，kcp-go 原地加密后原样交给 WriteTo)
+type parityMarks struct {
+	mu    sync.Mutex
+	marks map[*byte]struct{}
+}
+
+func (m *parityMarks) mark(b []byte) {
+	m.mu.Lock()
+	if len(m.marks) >= parityMarksLimit {
+		// 会话关闭时未发送的缓冲区不会被取走
+		m.marks = make(map[*byte]struct{})
+	}
+	m.marks[&b[0]] = struct{}{}
+	m.mu.Unlock()
+}
+
+func (m *parityMarks) take(b []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.marks[&b[0]]; ok {
+		delete(m.marks, &b[0])
+		return true
+	}
+	return false
+}
+
+// isParity FEC 帧头 (seqid 4 字节 + flag 2 字节，小端) 是否为校验分片
+func isParity(b []byte, offset int) bool {
+	return len(b) >= offset+6 && binary.LittleEndian.Uint16(b[offset+4:]) == fecFlagParity
+}
+
+// parityBlock 在加密前识别校验分片
+type parityBlock struct {
+	kcp.BlockCrypt
+	marks *parityMarks
+}
+
+func (b *parityBlock) Encrypt(dst, src []byte) {
+	parity := atomic.LoadInt32(&fecUpDropped) == 1 && isParity(src, fecCryptHeader)
+	b.BlockCrypt.Encrypt(dst, src)
+	if parity && len(dst) > 0 {
+		b.marks.mark(dst)
+	}
+}
+
+// markParity 上行可能关闭时包装加密器 (crypt 为 null 时在 WriteTo 中直接识别)
+func markParity(config *Config, block kcp.BlockCrypt) kcp.BlockCrypt {
+	if block == nil || !fecDirEnabled(config) || config.FECUp == fecDirOn {
+		return block
+	}
+	return &parityBlock{BlockCrypt: block, marks: &parityMarks{marks: make(map[*byte]struct{})}}
+}
+
+// parityDropConn 上行关闭时丢弃校验分片
+type parityDropConn struct {
+	net.PacketConn
+	marks *parityMarks // nil 表示未加密
+}
+
+// dropParity 按 markParity 的结果包装连接
+func dropParity(config *Config, block kcp.BlockCrypt, conn net.PacketConn) net.PacketConn {
+	if !fecDirEnabled(config) || config.FECUp == fecDirOn {
+		return conn
+	}
+	if pb, ok := block.(*parityBlock); ok {
+		return &parityDropConn{PacketConn: conn, marks: pb.marks}
+	}
+	if block != nil {
+		return conn
+	}
+	return &parityDropConn{PacketConn: conn}
+}
+
+func (c *parityDropConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var drop bool
+	if c.marks != nil {
+		drop = len(b) > 0 && c.marks.take(b)
+	} else {
+		drop = atomic.LoadInt32(&fecUpDropped) == 1 && isParity(b, 0)
+	}
+	if drop {
+		atomic.AddUint64(&statParityDropped, 1)
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
@@ -0,0 +1,95 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// FEC 自检: 启动时用生效的 datashard/parityshard 做一次 Reed-Solomon 编码/校验/恢复，
+// 提前发现无效的分片组合和个别 ARM 设备上出错的 SIMD 实现，以明确的错误让 StartProxy 失败，
+// 而不是在之后悄悄损坏数据。只在两端都启用 FEC 时运行 (kcp-go 同样只在此时创建编解码器)
+
+// fecSelfTestSizes 分片长度: 覆盖 SIMD 主循环和尾部处理
+var fecSelfTestSizes = [...]int{64, 1400}
+
+// fecSelfTest 编码后按几种丢失模式恢复，结果必须与原数据一致
+func fecSelfTest(dataShards, parityShards int) error {
+	if dataShards <= 0 || parityShards <= 0 {
+		return nil
+	}
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return fmt.Errorf("datashard %d parityshard %d: %v", dataShards, parityShards, err)
+	}
+	total := dataShards + parityShards
+
+	for _, size := range fecSelfTestSizes {
+		want := make([][]byte, total)
+		for i := range want {
+			want[i] = make([]byte, size)
+			if i < dataShards {
+				for j := range want[i] {
+					want[i][j] = byte(i*31 + j*7 + size)
+				}
+			}
+		}
+		if err := enc.Encode(want); err != nil {
+			return fmt.Errorf("encode: %v", err)
+		}
+		if ok, err := enc.Verify(want); err != nil || !ok {
+			return fmt.Errorf("verify failed for %d-byte shards (err %v)", size, err)
+		}
+
+		// 丢失模式: 前 parity 个数据分片、全部校验分片、数据和校验交错
+		patterns := [][]int{{}, {}, {}}
+		for i := 0; i < parityShards; i++ {
+			patterns[0] = append(patterns[0], i%dataShards)
+			patterns[1] = append(patterns[1], dataShards+i)
+			patterns[2] = append(patterns[2], (i*2+1)%total)
+		}
+		for _, lost := range patterns {
+			shards := make([][]byte, total)
+			for i := range shards {
+				shards[i] = append([]byte(nil), want[i]...)
+			}
+			for _, i := range lost {
+				shards[i] = nil
+			}
+			if err := enc.Reconstruct(shards); err != nil {
+				return fmt.Errorf("reconstruct: %v", err)
+			}
+			for i := range shards {
+				if !bytes.Equal(shards[i], want[i]) {
+					return fmt.Errorf("shard %d corrupted after reconstruct (%d-byte shards, lost %v)", i, size, lost)
+				}
+			}
+		}
+	}
+	return nil
+}
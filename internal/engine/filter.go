@@ -0,0 +1,76 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+var statRejected uint64 // 被来源过滤拒绝的连接数
+
+// sourceAllowed 检查客户端来源地址是否允许接入
+// 默认只允许回环地址; AllowLAN 开启后若配置了白名单则必须命中
+// 热点模式下额外要求来源位于热点网段内
+func sourceAllowed(config *Config, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	if tcpAddr.IP.IsLoopback() {
+		return true
+	}
+	if config.hotspotNet != nil {
+		if !config.hotspotNet.Contains(tcpAddr.IP) {
+			return false
+		}
+	} else if !config.AllowLAN {
+		return false
+	}
+	if len(config.allowNets) == 0 {
+		return true
+	}
+	for _, ipnet := range config.allowNets {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopbackAddr 判断监听地址是否为回环地址
+func isLoopbackAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+// rejectSource 拒绝来源不允许的连接
+func rejectSource(conn net.Conn) {
+	atomic.AddUint64(&statRejected, 1)
+	connLog("Rejected source:", conn.RemoteAddr())
+	countClose(closePolicy)
+	logAccess(&accessRecord{Peer: conn.RemoteAddr().String(), Reason: closePolicy})
+	conn.Close()
+}
@@ -0,0 +1,115 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+)
+
+// 按权重分配服务器: serverselect 为 weighted 时不探测排序，而是按地址簿各项的 weight
+// 以加权最高随机权重 (rendezvous) 哈希把 clientid 映射到服务器。同一份分发配置下每个客户端的选择是确定的，
+// 整体上各服务器分到的客户端比例与权重成正比，增删服务器只影响原本落在该服务器上的客户端。
+// weight 为 0 的服务器不再分配 (用于下线)；maxconns 限制在该服务器上建立的会话数 (conn)。
+// 连续重连失败时按同一顺序切换到下一台服务器
+
+var errNoWeightedServer = errors.New("no server with positive weight")
+
+// fleetOptions 基础配置中与服务器分配相关的字段
+type fleetOptions struct {
+	ServerSelect string `json:"serverselect"`
+	ClientID     string `json:"clientid"`
+}
+
+// parseFleetOptions 从基础配置读取分配方式
+func parseFleetOptions(configJson string) fleetOptions {
+	var o fleetOptions
+	json.Unmarshal([]byte(configJson), &o)
+	if o.ServerSelect == "" {
+		o.ServerSelect = serverSelectRank
+	}
+	return o
+}
+
+// rendezvousScore 加权 rendezvous 哈希分数: -weight / ln(h)，h 为 (0,1) 内的均匀哈希
+func rendezvousScore(clientID, server string, weight int) float64 {
+	sum := sha256.Sum256([]byte(clientID + "\x00" + server))
+	h := (float64(binary.BigEndian.Uint64(sum[:8])>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(h)
+}
+
+// weightedOrder 按分数从高到低排列权重为正的服务器 (调用方需持有 addrMu)
+func weightedOrder(clientID string) []*serverProfile {
+	type scored struct {
+		p     *serverProfile
+		score float64
+	}
+	var list []scored
+	for _, p := range addrBook {
+		if p.Weight > 0 {
+			list = append(list, scored{p, rendezvousScore(clientID, p.Name, p.Weight)})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].score > list[j].score })
+	order := make([]*serverProfile, len(list))
+	for i, s := range list {
+		order[i] = s.p
+	}
+	return order
+}
+
+// weightedServer 返回分配给 clientID 的服务器；avoid 不为空时返回顺序中它之后的一台 (循环)
+func weightedServer(clientID, avoid string) (*serverProfile, error) {
+	addrMu.Lock()
+	defer addrMu.Unlock()
+	order := weightedOrder(clientID)
+	if len(order) == 0 {
+		if len(addrBook) == 0 {
+			return nil, errors.New("address book is empty")
+		}
+		return nil, errNoWeightedServer
+	}
+	for i, p := range order {
+		if avoid != "" && p.RemoteAddr == avoid {
+			return order[(i+1)%len(order)], nil
+		}
+	}
+	return order[0], nil
+}
+
+// applyMaxConns 按服务器的 maxconns 限制会话数
+func applyMaxConns(config *Config, p *serverProfile) {
+	if p.MaxConns <= 0 || config.Conn <= p.MaxConns {
+		return
+	}
+	config.Conn = p.MaxConns
+	if config.MinReady > config.Conn {
+		config.MinReady = config.Conn
+	}
+}
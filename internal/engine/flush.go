@@ -0,0 +1,146 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// 排空检查间隔
+const flushPoll = 20 * time.Millisecond
+
+// queueWriter 记录已交给流、尚未被 SMUX 写入 KCP 的字节
+// (SMUX 的流写入在帧写入传输层后才返回，KCP 发送窗口满时也会阻塞在这里)
+type queueWriter struct {
+	w io.Writer
+	s *poolSession
+}
+
+func (q *queueWriter) Write(p []byte) (int, error) {
+	m := q.s.mark
+	if m != nil {
+		m.wait(q.s)
+	}
+	queued := atomic.AddInt64(&q.s.queued, int64(len(p)))
+	if m != nil {
+		m.check(q.s, queued)
+	}
+	n, err := q.w.Write(p)
+	queued = atomic.AddInt64(&q.s.queued, -int64(len(p)))
+	if m != nil {
+		m.check(q.s, queued)
+	}
+	return n, err
+}
+
+// queuedBytes 会话上待写出的字节数 (流写入中 + 写入合并缓冲)
+func (s *poolSession) queuedBytes() int64 {
+	if s == nil {
+		return 0
+	}
+	n := atomic.LoadInt64(&s.queued)
+	if s.batch != nil {
+		n += int64(s.batch.buffered())
+	}
+	return n
+}
+
+// flush 立即写出写入合并缓冲
+func (s *poolSession) flush() {
+	if s != nil && s.batch != nil {
+		s.batch.Flush()
+	}
+}
+
+// FlushAll 等待所有会话的发送队列排空，最多等待 timeoutMs 毫秒
+// 用于主动切换网络或 Pause 之前，避免丢失尾部数据
+// kcp-go 不导出发送队列长度，队列排空后再等待两个平滑 RTT 让最后的段得到确认
+// 返回空字符串表示已排空，否则返回错误信息
+func FlushAll(timeoutMs int) string {
+	proxyMu.Lock()
+	if !proxyRunning() {
+		proxyMu.Unlock()
+		return "Proxy not running"
+	}
+	sessions := append([]*poolSession(nil), proxySessions...)
+	proxyMu.Unlock()
+
+	if timeoutMs <= 0 {
+		return fmt.Sprintf("Invalid timeout: %d", timeoutMs)
+	}
+	deadline := clk.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+
+	var settle time.Duration
+	for _, s := range sessions {
+		if !s.alive() {
+			continue
+		}
+		s.flush()
+		if rtt := 2 * time.Duration(s.srtt()) * time.Millisecond; rtt > settle {
+			settle = rtt
+		}
+	}
+
+	for {
+		var queued int64
+		for _, s := range sessions {
+			if s.alive() {
+				queued += s.queuedBytes()
+			}
+		}
+		if queued == 0 {
+			break
+		}
+		if !clk.Now().Before(deadline) {
+			logErrorf("FlushAll: timed out with %d bytes queued", queued)
+			return fmt.Sprintf("Flush timeout: %d bytes queued", queued)
+		}
+		<-clk.After(flushPoll)
+	}
+
+	if remain := deadline.Sub(clk.Now()); settle > remain {
+		settle = remain
+	}
+	if settle > 0 {
+		<-clk.After(settle)
+	}
+	return ""
+}
+
+// sessionQueues 各会话槽位的待写出字节数及总和 (调用方持有 proxyMu)
+func sessionQueues() ([]int64, int64) {
+	list := make([]int64, len(proxySessions))
+	var total int64
+	for i, s := range proxySessions {
+		if s.alive() {
+			list[i] = s.queuedBytes()
+			total += list[i]
+		}
+	}
+	return list, total
+}
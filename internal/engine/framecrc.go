@@ -0,0 +1,130 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// 帧校验 (调试): 每个 SMUX 帧后附加 4 字节 CRC32 (IEEE，小端，覆盖帧头和数据)，
+// 用于定位中间设备或 FEC 引入的数据损坏。需要服务端以相同格式收发。
+// 校验失败只记录和计数，数据照常交给 SMUX，与未开启时的行为一致。
+
+const smuxHeaderSize = 8 // 版本 (1) + 命令 (1) + 长度 (2) + 流 ID (4)
+
+var (
+	statCRCFrames     uint64 // 已校验的接收帧数
+	statCRCMismatches uint64 // 校验失败帧数
+)
+
+var errPartialFrame = errors.New("framecrc: write is not a whole number of frames")
+
+// crcConn 在 SMUX 帧上附加/校验 CRC32
+type crcConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// 读取状态: 当前帧剩余待交给 SMUX 的字节
+	pending []byte
+}
+
+func newCRCConn(conn net.Conn) *crcConn {
+	return &crcConn{Conn: conn, r: bufio.NewReaderSize(conn, 64<<10)}
+}
+
+// Write SMUX 每次写入完整的帧，逐帧附加校验
+func (c *crcConn) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+4*(len(p)/smuxHeaderSize+1))
+	for rest := p; len(rest) > 0; {
+		if len(rest) < smuxHeaderSize {
+			return 0, errPartialFrame
+		}
+		size := smuxHeaderSize + int(binary.LittleEndian.Uint16(rest[2:4]))
+		if len(rest) < size {
+			return 0, errPartialFrame
+		}
+		out = append(out, rest[:size]...)
+		out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(rest[:size]))
+		rest = rest[size:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read 读取一个完整帧并校验，去掉校验字段后交给 SMUX
+func (c *crcConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *crcConn) readFrame() error {
+	var hdr [smuxHeaderSize]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	frame := make([]byte, smuxHeaderSize+int(binary.LittleEndian.Uint16(hdr[2:4]))+4)
+	copy(frame, hdr[:])
+	if _, err := io.ReadFull(c.r, frame[smuxHeaderSize:]); err != nil {
+		return err
+	}
+
+	body, sum := frame[:len(frame)-4], binary.LittleEndian.Uint32(frame[len(frame)-4:])
+	atomic.AddUint64(&statCRCFrames, 1)
+	if got := crc32.ChecksumIEEE(body); got != sum {
+		n := atomic.AddUint64(&statCRCMismatches, 1)
+		logErrorf("Frame CRC mismatch: cmd=%d sid=%d len=%d want=%08x got=%08x (total %d)",
+			hdr[1], binary.LittleEndian.Uint32(hdr[4:]), len(body)-smuxHeaderSize, sum, got, n)
+	}
+	c.pending = body
+	return nil
+}
+
+// crcStats 帧校验统计
+type crcStats struct {
+	Frames     uint64 `json:"frames"`
+	Mismatches uint64 `json:"mismatches"`
+}
+
+// snapshotCRC 返回帧校验统计
+func snapshotCRC() *crcStats {
+	return &crcStats{
+		Frames:     atomic.LoadUint64(&statCRCFrames),
+		Mismatches: atomic.LoadUint64(&statCRCMismatches),
+	}
+}
@@ -0,0 +1,142 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !nogeoip && !js
+
+package engine
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP 路由: geoip 规则按目标 IP 所属国家匹配 (如 {"type": "geoip", "value": "CN", "action": "direct"})
+// 数据库由 App 提供 MMDB 文件 (GeoLite2-Country 等)，通过 geoipdb 配置路径
+// 只对 IP 目标生效；PAC 无法查询 GeoIP，生成 PAC 时忽略该类规则
+// 使用 nogeoip 构建标签时不链接 MMDB 读取库 (见 geoip_off.go)
+
+// geoipBuilt 当前构建是否支持 GeoIP
+const geoipBuilt = true
+
+const geoipCacheSize = 4096 // 查询缓存条目数，满后整体清空
+
+var (
+	geoipMu    sync.RWMutex
+	geoipDB    *maxminddb.Reader
+	geoipCache = make(map[string]string) // IP -> 国家代码 (查不到为空)
+
+	statGeoIPLookups uint64 // 查询次数
+	statGeoIPHits    uint64 // 缓存命中次数
+	statGeoIPMatches uint64 // geoip 规则命中次数
+	statGeoIPErrors  uint64 // 数据库查询错误次数
+)
+
+// geoipRecord MMDB 中需要的字段
+type geoipRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// openGeoIP 打开 GeoIP 数据库，path 为空时关闭
+func openGeoIP(path string) error {
+	var db *maxminddb.Reader
+	if path != "" {
+		var err error
+		if db, err = maxminddb.Open(path); err != nil {
+			return err
+		}
+	}
+
+	geoipMu.Lock()
+	old := geoipDB
+	geoipDB = db
+	geoipCache = make(map[string]string)
+	geoipMu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// lookupCountry 返回 IP 所属国家代码 (大写)，未知时为空
+func lookupCountry(ip net.IP) string {
+	atomic.AddUint64(&statGeoIPLookups, 1)
+	key := ip.String()
+
+	geoipMu.RLock()
+	db := geoipDB
+	country, ok := geoipCache[key]
+	geoipMu.RUnlock()
+	if ok {
+		atomic.AddUint64(&statGeoIPHits, 1)
+		return country
+	}
+	if db == nil {
+		return ""
+	}
+
+	var rec geoipRecord
+	if err := db.Lookup(ip, &rec); err != nil {
+		atomic.AddUint64(&statGeoIPErrors, 1)
+		return ""
+	}
+	country = rec.Country.ISOCode
+
+	geoipMu.Lock()
+	if geoipDB == db {
+		if len(geoipCache) >= geoipCacheSize {
+			geoipCache = make(map[string]string)
+		}
+		geoipCache[key] = country
+	}
+	geoipMu.Unlock()
+	return country
+}
+
+// geoipStats GeoIP 统计
+type geoipStats struct {
+	Lookups uint64 `json:"lookups"`
+	Hits    uint64 `json:"hits"` // 缓存命中
+	Matches uint64 `json:"matches"`
+	Errors  uint64 `json:"errors"`
+	Cached  int    `json:"cached"`
+}
+
+// snapshotGeoIP 返回 GeoIP 统计
+func snapshotGeoIP() *geoipStats {
+	geoipMu.RLock()
+	cached := len(geoipCache)
+	geoipMu.RUnlock()
+
+	return &geoipStats{
+		Lookups: atomic.LoadUint64(&statGeoIPLookups),
+		Hits:    atomic.LoadUint64(&statGeoIPHits),
+		Matches: atomic.LoadUint64(&statGeoIPMatches),
+		Errors:  atomic.LoadUint64(&statGeoIPErrors),
+		Cached:  cached,
+	}
+}
@@ -0,0 +1,58 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build nogeoip || js
+
+package engine
+
+import (
+	"fmt"
+	"net"
+)
+
+// nogeoip 构建和网页端 (js/wasm): 不链接 MMDB 读取库，配置 geoipdb 时校验失败，geoip 规则不会命中
+
+// geoipBuilt 当前构建是否支持 GeoIP
+const geoipBuilt = false
+
+var statGeoIPMatches uint64 // 与 geoip.go 一致，始终为 0
+
+// geoipStats GeoIP 统计 (nogeoip 构建中不输出)
+type geoipStats struct{}
+
+// openGeoIP path 非空时返回错误
+func openGeoIP(path string) error {
+	if path != "" {
+		return fmt.Errorf("not supported in this build (nogeoip)")
+	}
+	return nil
+}
+
+// lookupCountry 始终返回空
+func lookupCountry(ip net.IP) string {
+	return ""
+}
+
+// snapshotGeoIP 始终返回 nil
+func snapshotGeoIP() *geoipStats {
+	return nil
+}
@@ -0,0 +1,278 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// 引擎交接: App 原地替换本库 (如动态功能模块下发新版本) 时，旧引擎导出本地监听 fd 和
+// 各会话的 UDP socket fd，新引擎导入后直接复用。监听 socket 不关闭，交接期间的新连接
+// 留在 backlog 中由新引擎接受；UDP socket 保留本地端口 (NAT 映射不变)，会话在其上重新握手。
+// KCP/SMUX 协议状态无法跨版本迁移，交接时正在转发的连接会断开
+
+// handoffState 导出的引擎状态
+type handoffState struct {
+	APIVersion int              `json:"apiversion"`
+	Version    string           `json:"version"`
+	Listener   int              `json:"listener"` // 本地监听 fd
+	Sessions   []handoffSession `json:"sessions"`
+	Error      string           `json:"error,omitempty"` // 导出失败的原因
+}
+
+// handoffSession 会话描述
+type handoffSession struct {
+	FD         int    `json:"fd"` // UDP socket fd，-1 表示无法交接 (TLS/TCP 模拟等)，导入时新建
+	LocalAddr  string `json:"localaddr"`
+	RemoteAddr string `json:"remoteaddr"`
+}
+
+var (
+	handoffMu sync.Mutex
+	// 导出的 fd 副本，保持引用避免被 GC 关闭；同一引擎导入时取走，下一次导出时关闭上一次未导入的
+	exportedFiles []*os.File
+	// 导入中待复用的监听和 UDP socket
+	importListener net.Listener
+	importConns    []net.PacketConn
+)
+
+// ExportEngineState 导出监听和会话描述并停止引擎 (不关闭导出的 socket)
+// 返回 JSON: {"apiversion": 2, "version": "...", "listener": fd, "sessions": [{"fd": fd, ...}]}，
+// 失败时返回 {"error": "..."}；再次导出时上一次导出且未被本引擎导入的 fd 会被关闭
+func ExportEngineState() string {
+	state, err := exportEngineState()
+	if err != nil {
+		b, _ := json.Marshal(map[string]string{"error": err.Error()})
+		return string(b)
+	}
+	b, _ := json.Marshal(state)
+	return string(b)
+}
+
+func exportEngineState() (*handoffState, error) {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	if !proxyRunning() {
+		return nil, fmt.Errorf("proxy not running")
+	}
+	tl, ok := primaryListener(proxyListener).(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("listener cannot be handed off")
+	}
+
+	// File 返回 dup 出的 fd，原 socket 随引擎停止关闭后副本仍然有效
+	var files []*os.File
+	lf, err := tl.File()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, lf)
+	state := &handoffState{APIVersion: apiVersion, Version: VERSION, Listener: int(lf.Fd())}
+
+	for _, s := range proxySessions {
+		desc := handoffSession{FD: -1}
+		if s.alive() {
+			desc.LocalAddr = s.link.LocalAddr().String()
+			desc.RemoteAddr = s.link.RemoteAddr().String()
+		}
+		if bc, ok := s.link.(*boundConn); ok {
+			if uc, ok := bc.pconn.(*net.UDPConn); ok {
+				if f, err := uc.File(); err == nil {
+					files = append(files, f)
+					desc.FD = int(f.Fd())
+				}
+			}
+		}
+		state.Sessions = append(state.Sessions, desc)
+	}
+
+	handoffMu.Lock()
+	releaseExportedLocked()
+	exportedFiles = files
+	handoffMu.Unlock()
+
+	config := proxyConfig
+	if config.MetricsFile != "" {
+		saveMetrics(config.MetricsFile)
+	}
+	stopLocked()
+	wipeSecrets(config)
+	log.Printf("Engine state exported (%d sessions), proxy stopped", len(state.Sessions))
+	emitEvent("handoff", map[string]interface{}{"direction": "export", "sessions": len(state.Sessions)})
+	return state, nil
+}
+
+// ImportEngineState 使用旧引擎导出的状态启动代理
+// configJson 与 StartProxy 相同 (导出的状态不包含配置和密钥)
+// 返回空字符串表示成功，否则返回错误信息；状态中的 fd 缺失、重复或不是 socket 时不使用也不关闭任何 fd，
+// 否则导入的 fd 均由本引擎接管，无法复用的会被关闭
+func ImportEngineState(configJson string, stateJson string) string {
+	state := handoffState{Listener: -1}
+	if err := json.Unmarshal([]byte(stateJson), &state); err != nil {
+		return "State Error: " + err.Error()
+	}
+	if state.Error != "" {
+		return "State Error: export failed: " + state.Error
+	}
+	if state.APIVersion > apiVersion {
+		return fmt.Sprintf("State Error: apiversion %d not supported", state.APIVersion)
+	}
+	if err := checkHandoffFDs(&state); err != nil {
+		return "State Error: " + err.Error()
+	}
+
+	handoffMu.Lock()
+	f := takeExportedLocked(state.Listener, "listener")
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		closeHandoffFDsLocked(state.Sessions)
+		handoffMu.Unlock()
+		return "State Error: listener: " + err.Error()
+	}
+	importListener = l
+	for _, s := range state.Sessions {
+		if s.FD < 0 {
+			continue
+		}
+		f := takeExportedLocked(s.FD, "udp")
+		if c, err := net.FilePacketConn(f); err == nil {
+			importConns = append(importConns, c)
+		}
+		f.Close()
+	}
+	handoffMu.Unlock()
+
+	msg := StartProxy(configJson)
+
+	// 启动失败或会话数变少时释放未使用的 socket
+	handoffMu.Lock()
+	if importListener != nil {
+		importListener.Close()
+		importListener = nil
+	}
+	for _, c := range importConns {
+		c.Close()
+	}
+	importConns = nil
+	// 导入成功后本引擎之前导出的其余 fd 不再需要
+	if msg == "" {
+		releaseExportedLocked()
+	}
+	handoffMu.Unlock()
+
+	if msg == "" {
+		log.Printf("Engine state imported from %s", state.Version)
+		emitEvent("handoff", map[string]interface{}{"direction": "import", "from": state.Version})
+	}
+	return msg
+}
+
+// checkHandoffFDs 校验状态中的 fd: 监听 fd 必须存在，会话 fd 为 -1 或有效值；
+// 有效的 fd 大于 0 (缺失的字段解析为 0，不能误用标准输入)、互不重复且是 socket
+func checkHandoffFDs(state *handoffState) error {
+	seen := make(map[int]bool)
+	check := func(name string, fd int) error {
+		if fd <= 0 {
+			return fmt.Errorf("%s: invalid fd %d", name, fd)
+		}
+		if seen[fd] {
+			return fmt.Errorf("%s: duplicate fd %d", name, fd)
+		}
+		seen[fd] = true
+		if err := checkSocketFD(fd); err != nil {
+			return fmt.Errorf("%s: fd %d: %v", name, fd, err)
+		}
+		return nil
+	}
+	if err := check("listener", state.Listener); err != nil {
+		return err
+	}
+	for _, s := range state.Sessions {
+		if s.FD == -1 {
+			continue
+		}
+		if err := check("session", s.FD); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeExportedLocked 接管导入的 fd: 由本引擎导出的取走保存的副本 (避免副本被 GC 时再次关闭)，
+// 否则新建 (调用方需持有 handoffMu)
+func takeExportedLocked(fd int, name string) *os.File {
+	for i, f := range exportedFiles {
+		if int(f.Fd()) == fd {
+			exportedFiles = append(exportedFiles[:i], exportedFiles[i+1:]...)
+			return f
+		}
+	}
+	return os.NewFile(uintptr(fd), name)
+}
+
+// releaseExportedLocked 关闭未被导入的导出 fd (调用方需持有 handoffMu)
+func releaseExportedLocked() {
+	for _, f := range exportedFiles {
+		f.Close()
+	}
+	exportedFiles = nil
+}
+
+// closeHandoffFDsLocked 关闭无法导入的会话 fd (调用方需持有 handoffMu)
+func closeHandoffFDsLocked(sessions []handoffSession) {
+	for _, s := range sessions {
+		if s.FD >= 0 {
+			takeExportedLocked(s.FD, "udp").Close()
+		}
+	}
+}
+
+// takeImportListener 取出导入中的监听 (没有时返回 nil)
+func takeImportListener() net.Listener {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+	l := importListener
+	importListener = nil
+	return l
+}
+
+// takeImportConn 取出一个导入中的 UDP socket (没有时返回 nil)
+func takeImportConn() net.PacketConn {
+	handoffMu.Lock()
+	defer handoffMu.Unlock()
+	if len(importConns) == 0 {
+		return nil
+	}
+	c := importConns[0]
+	importConns = importConns[1:]
+	return c
+}
@@ -0,0 +1,108 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestImportEngineStateFDs 状态中的 fd 缺失、重复或不是 socket 时拒绝导入，且不关闭任何 fd
+func TestImportEngineStateFDs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sock, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	file, err := os.CreateTemp(t.TempDir(), "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for stateJson, want := range map[string]string{
+		`{"error": "proxy not running"}`:                             "export failed",
+		`{"apiversion": 2}`:                                          "listener: invalid fd -1",
+		`{"listener": 0}`:                                            "listener: invalid fd 0",
+		fmt.Sprintf(`{"listener": %d}`, file.Fd()):                   "not a socket",
+		fmt.Sprintf(`{"listener": %d, "sessions": [{}]}`, sock.Fd()): "session: invalid fd 0",
+		fmt.Sprintf(`{"listener": %d, "sessions": [{"fd": %d}]}`, sock.Fd(), sock.Fd()): "duplicate fd",
+	} {
+		err := ImportEngineState(`{"remoteaddr": "203.0.113.1:4000"}`, stateJson)
+		if !strings.Contains(err, want) {
+			t.Errorf("ImportEngineState(%s) = %q, want %q", stateJson, err, want)
+		}
+	}
+	for _, f := range []*os.File{sock, file} {
+		if _, err := f.Stat(); err != nil {
+			t.Errorf("%s closed by rejected import: %v", f.Name(), err)
+		}
+	}
+}
+
+// TestEngineHandoff 导出后在同一进程导入: 沿用监听地址，导出的 fd 全部由导入接管
+func TestEngineHandoff(t *testing.T) {
+	if isolated(t) {
+		return
+	}
+	localAddr := freeLocalAddr(t)
+	config := tunnelConfig(t, localAddr, nil)
+	if err := StartProxy(config); err != "" {
+		t.Fatal(err)
+	}
+	t.Cleanup(StopProxy)
+
+	state := ExportEngineState()
+	if IsRunning() {
+		t.Fatal("proxy still running after export")
+	}
+	if err := ImportEngineState(config, state); err != "" {
+		t.Fatalf("import %s: %s", state, err)
+	}
+	handoffMu.Lock()
+	left := len(exportedFiles)
+	handoffMu.Unlock()
+	if left != 0 {
+		t.Fatalf("%d exported files kept after import", left)
+	}
+
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read through imported listener: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 会话休眠: 连续 hibernateafter 分钟没有客户端连接时关闭全部会话 (无线电完全静默)，
+// 本地监听保持打开；下一个客户端连接进入停车场并唤醒监管协程重新建立会话。
+// 适合常驻但很少使用的隧道
+
+var (
+	hibernating     int32 // 非 0 表示会话已因空闲关闭
+	hibernatedSince int64 // 进入休眠的时间 (UnixNano)
+)
+
+// isHibernating 会话是否处于休眠
+func isHibernating() bool {
+	return atomic.LoadInt32(&hibernating) != 0
+}
+
+// checkIdle 空闲超过 hibernateafter 时关闭全部会话 (仅监管协程调用)
+func (s *sessionSupervisor) checkIdle() {
+	if s.config.HibernateAfter <= 0 || isHibernating() {
+		return
+	}
+
+	s.mu.Lock()
+	parked := len(s.parked)
+	s.mu.Unlock()
+	if atomic.LoadInt64(&statActiveConns) > 0 || parked > 0 {
+		s.idleSince = time.Time{}
+		return
+	}
+	if s.idleSince.IsZero() {
+		s.idleSince = clk.Now()
+		return
+	}
+	idle := clk.Since(s.idleSince)
+	if idle < time.Duration(s.config.HibernateAfter)*time.Minute {
+		return
+	}
+
+	atomic.StoreInt64(&hibernatedSince, clk.Now().UnixNano())
+	atomic.StoreInt32(&hibernating, 1)
+	s.idleSince = time.Time{}
+
+	proxyMu.Lock()
+	for _, session := range proxySessions {
+		if session.alive() {
+			session.Close()
+		}
+	}
+	proxyMu.Unlock()
+
+	log.Printf("Idle for %s, sessions hibernated", idle.Round(time.Second))
+	emitEvent("hibernate", map[string]interface{}{"idle": idle.Seconds()})
+}
+
+// wakeUp 结束休眠 (有新连接或手动重连)，由监管协程重新建立会话
+func wakeUp() {
+	if atomic.CompareAndSwapInt32(&hibernating, 1, 0) {
+		slept := clk.Since(time.Unix(0, atomic.LoadInt64(&hibernatedSince)))
+		log.Printf("Waking sessions after %s", slept.Round(time.Second))
+		emitEvent("wake", map[string]interface{}{"hibernated": slept.Seconds()})
+	}
+}
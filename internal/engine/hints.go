@@ -0,0 +1,144 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// 服务端通过控制流下发的参数建议
+// 开启 acceptserverhints 后: 窗口和模式立即作用于现有会话，FEC 只作用于之后新建的会话
+
+// serverHints 服务端建议的参数，0/空表示不调整
+type serverHints struct {
+	SndWnd      int    `json:"sndwnd"`
+	RcvWnd      int    `json:"rcvwnd"`
+	DataShard   int    `json:"datashard"`
+	ParityShard int    `json:"parityshard"`
+	Mode        string `json:"mode"`
+}
+
+// kcpParams 建立和调整会话使用的 KCP 参数
+type kcpParams struct {
+	NoDelay, Interval, Resend, NoCongestion int
+	SndWnd, RcvWnd                          int
+	DataShard, ParityShard                  int
+}
+
+var (
+	hintsMu     sync.Mutex
+	activeHints *serverHints
+)
+
+// handleServerHints 处理服务端的 "hints" 消息
+func handleServerHints(config *Config, msg *ctrlMessage) {
+	if !config.AcceptServerHints {
+		log.Println("Server hints ignored (acceptserverhints disabled)")
+		return
+	}
+
+	var h serverHints
+	if err := json.Unmarshal(msg.Hints, &h); err != nil || !validHints(&h) {
+		logError("Invalid server hints:", string(msg.Hints))
+		return
+	}
+
+	hintsMu.Lock()
+	activeHints = &h
+	hintsMu.Unlock()
+
+	// 窗口和模式可以直接调整现有会话
+	p := effectiveParams(config)
+	proxyMu.Lock()
+	for _, s := range proxySessions {
+		if s.alive() && s.conn != nil {
+			s.conn.SetWindowSize(p.SndWnd, p.RcvWnd)
+			s.conn.SetNoDelay(p.NoDelay, kcpInterval(config, p), p.Resend, p.NoCongestion)
+		}
+	}
+	proxyMu.Unlock()
+
+	log.Printf("Server hints applied: %s", msg.Hints)
+	emitEvent("server-hints", map[string]interface{}{"hints": h})
+}
+
+// validHints 检查建议值是否在合理范围内
+func validHints(h *serverHints) bool {
+	switch h.Mode {
+	case "", "normal", "fast", "fast2", "fast3":
+	default:
+		return false
+	}
+	return h.SndWnd >= 0 && h.SndWnd <= 65535 &&
+		h.RcvWnd >= 0 && h.RcvWnd <= 65535 &&
+		h.DataShard >= 0 && h.ParityShard >= 0 && h.DataShard+h.ParityShard <= 256
+}
+
+// effectiveParams 合并配置和服务端建议，得到当前应使用的 KCP 参数
+func effectiveParams(config *Config) kcpParams {
+	p := kcpParams{
+		NoDelay: config.NoDelay, Interval: config.Interval, Resend: config.Resend, NoCongestion: config.NoCongestion,
+		SndWnd: config.SndWnd, RcvWnd: config.RcvWnd,
+		DataShard: config.DataShard, ParityShard: config.ParityShard,
+	}
+
+	// auto 档位覆盖配置中的计时和窗口，服务端建议仍然优先
+	if ap := autoParams(); ap != nil {
+		p.NoDelay, p.Interval, p.Resend, p.NoCongestion = ap.NoDelay, ap.Interval, ap.Resend, ap.NoCongestion
+		p.SndWnd, p.RcvWnd = ap.SndWnd, ap.RcvWnd
+	}
+
+	hintsMu.Lock()
+	h := activeHints
+	hintsMu.Unlock()
+	if h == nil {
+		return p
+	}
+
+	if h.Mode != "" {
+		tmp := Config{Mode: h.Mode}
+		applyMode(&tmp)
+		p.NoDelay, p.Interval, p.Resend, p.NoCongestion = tmp.NoDelay, tmp.Interval, tmp.Resend, tmp.NoCongestion
+	}
+	if h.SndWnd > 0 {
+		p.SndWnd = h.SndWnd
+	}
+	if h.RcvWnd > 0 {
+		p.RcvWnd = h.RcvWnd
+	}
+	if h.DataShard > 0 || h.ParityShard > 0 {
+		p.DataShard, p.ParityShard = h.DataShard, h.ParityShard
+	}
+	return p
+}
+
+// resetHints 清除服务端建议
+func resetHints() {
+	hintsMu.Lock()
+	activeHints = nil
+	hintsMu.Unlock()
+}
@@ -0,0 +1,240 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 热点模式: 监听热点网卡，局域网设备通过手机隧道上网
+// 隧道本身是透明转发，SOCKS/HTTP 代理协议由服务端转发目标提供 (本地不单独提供代理服务)，
+// 本地额外提供经隧道的 DNS 转发、按客户端统计和限速
+
+// 常见的热点网卡名 (Android: ap0/swlan0/softap0/wlan1, iOS: bridge100)
+var hotspotIfaces = []string{"ap0", "swlan0", "softap0", "wlan1", "bridge100"}
+
+// hotspotClient 热点模式下的单个局域网客户端
+type hotspotClient struct {
+	IP        string `json:"ip"`
+	MAC       string `json:"mac"`
+	Conns     int64  `json:"conns"`     // 当前连接数
+	BytesUp   uint64 `json:"bytesup"`   // 上行字节数
+	BytesDown uint64 `json:"bytesdown"` // 下行字节数
+
+	upLimit   *rateLimiter
+	downLimit *rateLimiter
+}
+
+var (
+	hotspotMu      sync.Mutex
+	hotspotClients = make(map[string]*hotspotClient)
+)
+
+// resolveHotspot 查找热点网卡，返回监听地址和网段
+func resolveHotspot(config *Config) (string, *net.IPNet, error) {
+	names := hotspotIfaces
+	if config.HotspotIface != "" {
+		names = []string{config.HotspotIface}
+	}
+
+	_, port, err := net.SplitHostPort(config.LocalAddr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			subnet := &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}
+			return net.JoinHostPort(ipnet.IP.String(), port), subnet, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no hotspot interface found (tried %v)", names)
+}
+
+// acquireHotspotClient 获取 (或创建) 来源地址对应的客户端记录
+// 优先以 MAC 区分客户端，无法获取 MAC 时退化为 IP
+func acquireHotspotClient(config *Config, addr net.Addr) *hotspotClient {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	ip := tcpAddr.IP.String()
+	mac := lookupMAC(ip)
+	key := mac
+	if key == "" {
+		key = ip
+	}
+
+	hotspotMu.Lock()
+	defer hotspotMu.Unlock()
+
+	client, ok := hotspotClients[key]
+	if !ok {
+		client = &hotspotClient{MAC: mac}
+		if config.ClientRate > 0 {
+			client.upLimit = newRateLimiter(config.ClientRate)
+			client.downLimit = newRateLimiter(config.ClientRate)
+		}
+		hotspotClients[key] = client
+	}
+	client.IP = ip
+	atomic.AddInt64(&client.Conns, 1)
+	return client
+}
+
+// release 连接结束
+func (c *hotspotClient) release() {
+	atomic.AddInt64(&c.Conns, -1)
+}
+
+// wrap 为上下行写入方向加上客户端计数和限速
+func (c *hotspotClient) wrap(up, down io.Writer) (io.Writer, io.Writer) {
+	up = &countWriter{up, &c.BytesUp}
+	down = &countWriter{down, &c.BytesDown}
+	if c.upLimit != nil {
+		up = &limitWriter{up, c.upLimit}
+		down = &limitWriter{down, c.downLimit}
+	}
+	return up, down
+}
+
+// GetHotspotClients 返回热点模式下各局域网客户端的 JSON 统计
+func GetHotspotClients() string {
+	hotspotMu.Lock()
+	list := make([]hotspotClient, 0, len(hotspotClients))
+	for _, c := range hotspotClients {
+		list = append(list, hotspotClient{
+			IP:        c.IP,
+			MAC:       c.MAC,
+			Conns:     atomic.LoadInt64(&c.Conns),
+			BytesUp:   atomic.LoadUint64(&c.BytesUp),
+			BytesDown: atomic.LoadUint64(&c.BytesDown),
+		})
+	}
+	hotspotMu.Unlock()
+
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
+// resetHotspotClients 清空客户端记录
+func resetHotspotClients() {
+	hotspotMu.Lock()
+	hotspotClients = make(map[string]*hotspotClient)
+	hotspotMu.Unlock()
+}
+
+// rateLimiter 令牌桶限速器 (字节/秒，突发量为 1 秒)
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: clk.Now()}
+}
+
+// setRate 修改速率，已积累的令牌不超过新的突发量
+func (r *rateLimiter) setRate(bytesPerSec float64) {
+	r.mu.Lock()
+	r.rate = bytesPerSec
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.mu.Unlock()
+}
+
+// currentRate 当前速率
+func (r *rateLimiter) currentRate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate
+}
+
+// wait 消耗 n 个令牌，不足时睡眠等待
+func (r *rateLimiter) wait(n int) {
+	r.mu.Lock()
+	now := clk.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	deficit := -r.tokens
+	r.mu.Unlock()
+
+	if deficit > 0 {
+		clk.Sleep(time.Duration(deficit / r.rate * float64(time.Second)))
+	}
+}
+
+// allow 令牌足够时消耗 n 个令牌并返回 true，不足时不等待直接返回 false
+func (r *rateLimiter) allow(n int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := clk.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+	if r.tokens < float64(n) {
+		return false
+	}
+	r.tokens -= float64(n)
+	return true
+}
+
+// limitWriter 限速写入
+type limitWriter struct {
+	w io.Writer
+	r *rateLimiter
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	l.r.wait(len(p))
+	return l.w.Write(p)
+}
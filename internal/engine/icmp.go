@@ -0,0 +1,282 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ICMP echo 中继: App 的 TUN 层 (VpnService/NEPacketTunnelProvider) 把捕获的 echo 请求交给 RelayEcho，
+// 引擎经隧道打开一条特殊的流由服务端代为 ping，收到回复后构造 echo reply 报文交回 TUN，
+// 使 VPN 内的 ping 和连通性检查正常工作。需要服务端支持 (能力 "icmp")
+//
+// 流格式: icmpPreamble + 一行 JSON 请求 {"dst":"ip","id":n,"seq":n,"data":"base64","timeout":ms}，
+// 服务端回复一行 JSON {"ok":true,"ttl":n} 或 {"ok":false,"error":"..."} 后关闭流
+
+const (
+	icmpPreamble = "KCPM-ICMP/1\n"
+	capICMP      = "icmp"
+
+	icmpMaxTimeout  = 10 * time.Second
+	icmpDefaultTTL  = 64
+	icmpMaxResponse = 4096
+)
+
+var (
+	statICMPRequests uint64
+	statICMPReplies  uint64
+	statICMPFailures uint64 // 超时、不可达或服务端错误
+)
+
+// icmpStats ICMP 中继统计
+type icmpStats struct {
+	Requests uint64 `json:"requests"`
+	Replies  uint64 `json:"replies"`
+	Failures uint64 `json:"failures"`
+}
+
+func snapshotICMP() *icmpStats {
+	return &icmpStats{
+		Requests: atomic.LoadUint64(&statICMPRequests),
+		Replies:  atomic.LoadUint64(&statICMPReplies),
+		Failures: atomic.LoadUint64(&statICMPFailures),
+	}
+}
+
+// resetICMP 清零 ICMP 中继统计
+func resetICMP() {
+	atomic.StoreUint64(&statICMPRequests, 0)
+	atomic.StoreUint64(&statICMPReplies, 0)
+	atomic.StoreUint64(&statICMPFailures, 0)
+}
+
+// echoRequest 从 IP 报文中解析出的 echo 请求
+type echoRequest struct {
+	v6       bool
+	src, dst net.IP
+	id, seq  uint16
+	data     []byte
+}
+
+type icmpRelayRequest struct {
+	Dst     string `json:"dst"`
+	ID      uint16 `json:"id"`
+	Seq     uint16 `json:"seq"`
+	Data    []byte `json:"data"`
+	Timeout int64  `json:"timeout"` // 毫秒
+}
+
+type icmpRelayResponse struct {
+	OK    bool   `json:"ok"`
+	TTL   int    `json:"ttl,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+var errNotEcho = errors.New("not an icmp echo request")
+
+// RelayEcho 经隧道中继一个 ICMP echo 请求
+// packet 为 TUN 读到的完整 IPv4/IPv6 报文 (ICMP/ICMPv6 echo request)，
+// 返回应写回 TUN 的 echo reply 报文；超时、目标不可达或未启用 icmprelay 时返回 nil (等同丢包)
+// 调用会阻塞到收到回复或 timeoutMs 超时，App 应在独立线程中调用
+func RelayEcho(packet []byte, timeoutMs int) []byte {
+	proxyMu.Lock()
+	enabled := proxyRunning() && proxyConfig.ICMPRelay
+	proxyMu.Unlock()
+	if !enabled || !serverSupports(capICMP) {
+		return nil
+	}
+
+	req, err := parseEcho(packet)
+	if err != nil {
+		return nil
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout <= 0 || timeout > icmpMaxTimeout {
+		timeout = icmpMaxTimeout
+	}
+
+	atomic.AddUint64(&statICMPRequests, 1)
+	ttl, err := relayEcho(req, timeout)
+	if err != nil {
+		atomic.AddUint64(&statICMPFailures, 1)
+		logErrorf("ICMP relay to %s: %v", req.dst, err)
+		return nil
+	}
+	atomic.AddUint64(&statICMPReplies, 1)
+	return buildEchoReply(req, ttl)
+}
+
+// relayEcho 通过一条中继流让服务端 ping，返回回复的 TTL
+func relayEcho(req *echoRequest, timeout time.Duration) (int, error) {
+	session := pickAliveSession()
+	if session == nil {
+		return 0, errors.New("no alive session")
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	// 留出一个往返给服务端回复
+	stream.SetDeadline(clk.Now().Add(timeout + time.Duration(session.srtt())*time.Millisecond))
+
+	b, _ := json.Marshal(&icmpRelayRequest{
+		Dst:     req.dst.String(),
+		ID:      req.id,
+		Seq:     req.seq,
+		Data:    req.data,
+		Timeout: timeout.Milliseconds(),
+	})
+	if _, err := stream.Write(append(append([]byte(icmpPreamble), b...), '\n')); err != nil {
+		return 0, err
+	}
+
+	line, err := bufio.NewReaderSize(stream, icmpMaxResponse).ReadSlice('\n')
+	if err != nil {
+		return 0, err
+	}
+	var resp icmpRelayResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return 0, err
+	}
+	if !resp.OK {
+		return 0, errors.New(resp.Error)
+	}
+	if resp.TTL <= 0 || resp.TTL > 255 {
+		resp.TTL = icmpDefaultTTL
+	}
+	return resp.TTL, nil
+}
+
+// parseEcho 解析 IPv4 ICMP 或 IPv6 ICMPv6 (不含扩展头) echo 请求
+func parseEcho(p []byte) (*echoRequest, error) {
+	if len(p) < 1 {
+		return nil, errNotEcho
+	}
+	var req echoRequest
+	var icmp []byte
+	switch p[0] >> 4 {
+	case 4:
+		ihl := int(p[0]&0x0f) * 4
+		if len(p) < 20 || ihl < 20 || len(p) < ihl || p[9] != 1 {
+			return nil, errNotEcho
+		}
+		total := int(binary.BigEndian.Uint16(p[2:4]))
+		if total < ihl || total > len(p) {
+			return nil, errNotEcho
+		}
+		req.src, req.dst = net.IP(p[12:16]), net.IP(p[16:20])
+		icmp = p[ihl:total]
+		if len(icmp) < 8 || icmp[0] != 8 {
+			return nil, errNotEcho
+		}
+	case 6:
+		if len(p) < 40 || p[6] != 58 {
+			return nil, errNotEcho
+		}
+		end := 40 + int(binary.BigEndian.Uint16(p[4:6]))
+		if end > len(p) {
+			return nil, errNotEcho
+		}
+		req.v6 = true
+		req.src, req.dst = net.IP(p[8:24]), net.IP(p[24:40])
+		icmp = p[40:end]
+		if len(icmp) < 8 || icmp[0] != 128 {
+			return nil, errNotEcho
+		}
+	default:
+		return nil, errNotEcho
+	}
+	// 调用期间 App 可能复用 packet 缓冲区
+	req.src, req.dst = append(net.IP(nil), req.src...), append(net.IP(nil), req.dst...)
+	req.id = binary.BigEndian.Uint16(icmp[4:6])
+	req.seq = binary.BigEndian.Uint16(icmp[6:8])
+	req.data = append([]byte(nil), icmp[8:]...)
+	return &req, nil
+}
+
+// buildEchoReply 构造从目标发回请求方的 echo reply 报文
+func buildEchoReply(req *echoRequest, ttl int) []byte {
+	icmp := make([]byte, 8+len(req.data))
+	binary.BigEndian.PutUint16(icmp[4:6], req.id)
+	binary.BigEndian.PutUint16(icmp[6:8], req.seq)
+	copy(icmp[8:], req.data)
+
+	if !req.v6 {
+		// icmp[0] = 0 (echo reply)
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+
+		p := make([]byte, 20, 20+len(icmp))
+		p[0] = 0x45
+		binary.BigEndian.PutUint16(p[2:4], uint16(20+len(icmp)))
+		p[8] = byte(ttl)
+		p[9] = 1
+		copy(p[12:16], req.dst.To4())
+		copy(p[16:20], req.src.To4())
+		binary.BigEndian.PutUint16(p[10:12], checksum(p, 0))
+		return append(p, icmp...)
+	}
+
+	icmp[0] = 129
+	// ICMPv6 校验和包含伪首部: 源地址、目的地址、上层长度、下一个头部
+	var sum uint32
+	for _, ip := range []net.IP{req.dst, req.src} {
+		for i := 0; i < 16; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(ip[i : i+2]))
+		}
+	}
+	sum += uint32(len(icmp)) + 58
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, sum))
+
+	p := make([]byte, 40, 40+len(icmp))
+	p[0] = 0x60
+	binary.BigEndian.PutUint16(p[4:6], uint16(len(icmp)))
+	p[6] = 58
+	p[7] = byte(ttl)
+	copy(p[8:24], req.dst)
+	copy(p[24:40], req.src)
+	return append(p, icmp...)
+}
+
+// checksum 互联网校验和 (RFC 1071)，sum 为已累加的伪首部
+func checksum(b []byte, sum uint32) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,128 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 流空闲回收: 配置 streamidle 后，双向都超过该秒数没有数据的流被关闭 (关闭原因为 timeout)，
+// 释放 App 忘记关闭的连接占用的服务端资源。推送、长轮询等长时间静默的连接
+// 可按目标端口 (idleexemptports) 或域名 (idleexemptdomains，匹配该域名及其子域名) 豁免
+
+const idleCheckInterval = 5 * time.Second // 检查空闲流的间隔
+
+var (
+	statIdleReaped uint64 // 因空闲被关闭的流数
+	statIdleExempt uint64 // 空闲超时但被豁免的检查次数
+)
+
+// idleStats 流空闲回收统计
+type idleStats struct {
+	Reaped uint64 `json:"reaped"`
+	Exempt uint64 `json:"exempt"` // 超时但命中豁免而保留的次数 (每次检查计一次)
+}
+
+// idleExempt 流是否豁免空闲回收
+func idleExempt(config *Config, s *streamInfo) bool {
+	host, port, err := net.SplitHostPort(s.getTarget())
+	if err != nil {
+		return false
+	}
+	if p, err := strconv.Atoi(port); err == nil {
+		for _, ep := range config.IdleExemptPorts {
+			if ep == p {
+				return true
+			}
+		}
+	}
+	if domain := s.getDomain(); domain != "" {
+		host = domain
+	}
+	host = strings.ToLower(host)
+	for _, d := range config.IdleExemptDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// idleLoop 定期关闭空闲超过 streamidle 的流
+func idleLoop(config *Config, stop chan struct{}) {
+	limit := time.Duration(config.StreamIdle) * time.Second
+	ticker := clk.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.Chan():
+		}
+
+		cutoff := clk.Now().Add(-limit).UnixNano()
+		streamsMu.Lock()
+		var idle []*streamInfo
+		for _, s := range activeStreams {
+			if s.kill != nil && atomic.LoadInt64(&s.lastActive) < cutoff {
+				idle = append(idle, s)
+			}
+		}
+		streamsMu.Unlock()
+
+		for _, s := range idle {
+			if idleExempt(config, s) {
+				atomic.AddUint64(&statIdleExempt, 1)
+				continue
+			}
+			atomic.AddUint64(&statIdleReaped, 1)
+			atomic.StoreInt32(&s.reaped, 1)
+			s.kill()
+			connLog("Stream idle, closed:", s.id, s.getTarget())
+			emitEvent("stream-idle", map[string]interface{}{"id": s.id, "target": s.getTarget(), "idle": config.StreamIdle})
+		}
+	}
+}
+
+// snapshotIdle 返回流空闲回收统计 (未配置 streamidle 时为 nil)
+func snapshotIdle(config *Config) *idleStats {
+	if config.StreamIdle <= 0 {
+		return nil
+	}
+	return &idleStats{
+		Reaped: atomic.LoadUint64(&statIdleReaped),
+		Exempt: atomic.LoadUint64(&statIdleExempt),
+	}
+}
+
+// resetIdle 清零流空闲回收统计
+func resetIdle() {
+	atomic.StoreUint64(&statIdleReaped, 0)
+	atomic.StoreUint64(&statIdleExempt, 0)
+}
@@ -0,0 +1,109 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// 实例标签: App 管理多条隧道时，统计、事件、日志和 Prometheus 指标都带上实例标签以便归属。
+// 引擎目前每个进程只运行一个实例，ListInstances 返回当前 (运行或待命中的) 实例；
+// 未配置或空白的标签使用 "default" (与旧版配置兼容)，其余标签必须合法
+
+var (
+	labelMu       sync.Mutex
+	instanceLabel = defaultLabel
+)
+
+// currentLabel 当前实例标签
+func currentLabel() string {
+	labelMu.Lock()
+	defer labelMu.Unlock()
+	return instanceLabel
+}
+
+// setInstanceLabel 启动或待命时设置实例标签，非默认标签时日志加上 [label] 前缀
+func setInstanceLabel(label string) {
+	labelMu.Lock()
+	instanceLabel = label
+	labelMu.Unlock()
+
+	if label == defaultLabel {
+		log.SetPrefix("")
+	} else {
+		log.SetPrefix("[" + label + "] ")
+	}
+}
+
+// instanceSummary 实例摘要
+type instanceSummary struct {
+	Label       string `json:"label"`
+	State       string `json:"state"` // running 或 armed
+	RemoteAddr  string `json:"remoteaddr"`
+	Sessions    int    `json:"sessions"`
+	Alive       int    `json:"alive"`
+	ActiveConns int64  `json:"activeconns"`
+	BytesUp     uint64 `json:"bytesup"`
+	BytesDown   uint64 `json:"bytesdown"`
+}
+
+// ListInstances 返回所有实例的标签和摘要 (JSON 数组)，没有运行或待命中的实例时返回 []
+func ListInstances() string {
+	list := []instanceSummary{}
+
+	proxyMu.Lock()
+	var config *Config
+	state := ""
+	switch {
+	case proxyRunning():
+		config, state = proxyConfig, "running"
+	case armedConfig != nil:
+		config, state = armedConfig, "armed"
+	}
+	if config != nil {
+		sum := instanceSummary{
+			Label:       config.Label,
+			State:       state,
+			RemoteAddr:  config.RemoteAddr,
+			Sessions:    len(proxySessions),
+			ActiveConns: atomic.LoadInt64(&statActiveConns),
+			BytesUp:     atomic.LoadUint64(&statBytesUp),
+			BytesDown:   atomic.LoadUint64(&statBytesDown),
+		}
+		for _, s := range proxySessions {
+			if s.alive() {
+				sum.Alive++
+			}
+		}
+		list = append(list, sum)
+	}
+	proxyMu.Unlock()
+
+	b, _ := json.Marshal(list)
+	return string(b)
+}
@@ -0,0 +1,69 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLabel(t *testing.T) {
+	for label, ok := range map[string]bool{
+		"home":                  true,
+		"a.b-c_1":               true,
+		strings.Repeat("x", 32): true,
+		"":                      false,
+		" ":                     false,
+		"\t\n":                  false,
+		" home":                 false,
+		"a b":                   false,
+		"家":                     false,
+		strings.Repeat("x", 33): false,
+	} {
+		if err := validateLabel(label); (err == nil) != ok {
+			t.Errorf("validateLabel(%q) = %v", label, err)
+		}
+	}
+}
+
+func TestParseConfigLabel(t *testing.T) {
+	for configJson, want := range map[string]string{
+		`{"remoteaddr": "203.0.113.1:4000"}`:                   defaultLabel, // 旧版配置没有标签
+		`{"remoteaddr": "203.0.113.1:4000", "label": ""}`:      defaultLabel,
+		`{"remoteaddr": "203.0.113.1:4000", "label": "   "}`:   defaultLabel,
+		`{"remoteaddr": "203.0.113.1:4000", "label": "home"}`:  "home",
+		`{"remoteaddr": "203.0.113.1:4000", "label": " home"}`: "",
+		`{"remoteaddr": "203.0.113.1:4000", "label": "a/b"}`:   "",
+	} {
+		config, err := parseConfig(configJson)
+		if want == "" {
+			if err == nil {
+				t.Errorf("parseConfig(%s) accepted label %q", configJson, config.Label)
+			}
+			continue
+		}
+		if err != nil || config.Label != want {
+			t.Errorf("parseConfig(%s) = %v, want label %q", configJson, err, want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !nospeedtest && !js
+
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// 端到端完整性测试: RunIntegrityTest 经隧道打开一条特殊的流，服务端把收到的数据原样回送，
+// 客户端发送由随机种子生成的伪随机数据并逐字节校验回送结果，
+// 用于在真实网络上验证新的加密/FEC/压缩组合，同时给出往返吞吐 (测速)。需要服务端支持 echoPreamble
+// 使用 nospeedtest 构建标签时不提供 (见 integrity_off.go)
+//
+// 流格式: echoPreamble + 8 字节数据长度 (大端)，之后服务端回送随后的全部数据
+
+const (
+	echoPreamble = "KCPM-ECHO/1\n"
+
+	integrityChunk     = 32 << 10
+	integrityMaxMB     = 1024
+	integrityIdle      = 15 * time.Second // 读写无进展的最长时间
+	integrityMaxRanges = 32               // 报告的损坏区间数上限
+)
+
+// corruptRange 一段连续的损坏字节 [Offset, Offset+Length)
+type corruptRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// integrityResult 完整性测试结果
+type integrityResult struct {
+	OK        bool           `json:"ok"`
+	Bytes     int64          `json:"bytes"`     // 已校验的字节数
+	Corrupted int64          `json:"corrupted"` // 不一致的字节数
+	Ranges    []corruptRange `json:"ranges,omitempty"`
+	Ms        int64          `json:"ms"`
+	Mbps      float64        `json:"mbps"` // 往返吞吐
+	Seed      int64          `json:"seed"` // 伪随机数据的种子，便于复现
+	Burst     *burstMeasure  `json:"burst,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// patternReader 由种子生成的伪随机数据
+type patternReader struct {
+	rng *rand.Rand
+}
+
+func newPattern(seed int64) *patternReader {
+	return &patternReader{rng: rand.New(rand.NewSource(seed))}
+}
+
+func (p *patternReader) Read(b []byte) (int, error) {
+	for i := 0; i < len(b); i += 8 {
+		var word [8]byte
+		binary.LittleEndian.PutUint64(word[:], p.rng.Uint64())
+		copy(b[i:], word[:])
+	}
+	return len(b), nil
+}
+
+// RunIntegrityTest 经隧道向服务端回送端发送 sizeMB MB 伪随机数据并逐字节校验 (阻塞调用)
+// 返回 JSON: {"ok", "bytes", "corrupted", "ranges": [{"offset", "length"}], "ms", "mbps", "seed", "burst", "error"}
+// sizeMB 取值 1~1024，需要服务端支持回送
+func RunIntegrityTest(sizeMB int) string {
+	if sizeMB <= 0 {
+		sizeMB = 1
+	}
+	if sizeMB > integrityMaxMB {
+		sizeMB = integrityMaxMB
+	}
+	result := runIntegrity(int64(sizeMB)<<20, clk.Now().UnixNano())
+	if result.Error != "" {
+		logError("Integrity test:", result.Error)
+	} else {
+		log.Printf("Integrity test: %d bytes, %d corrupted, %.1f Mbps", result.Bytes, result.Corrupted, result.Mbps)
+	}
+	emitEvent("integrity", map[string]interface{}{
+		"ok":        result.OK,
+		"bytes":     result.Bytes,
+		"corrupted": result.Corrupted,
+		"seed":      result.Seed,
+	})
+	b, _ := json.Marshal(result)
+	return string(b)
+}
+
+func runIntegrity(size, seed int64) *integrityResult {
+	result := &integrityResult{Seed: seed}
+	session := pickAliveSession()
+	if session == nil {
+		result.Error = "Proxy not running"
+		return result
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer stream.Close()
+
+	start := clk.Now()
+	burst := snapshotBurst()
+	hdr := make([]byte, len(echoPreamble)+8)
+	copy(hdr, echoPreamble)
+	binary.BigEndian.PutUint64(hdr[len(echoPreamble):], uint64(size))
+	stream.SetWriteDeadline(clk.Now().Add(integrityIdle))
+	if _, err := stream.Write(hdr); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// 发送协程: 读取端出错时关闭流使其退出
+	writeErr := make(chan error, 1)
+	up := &countWriter{stream, &session.bytesUp}
+	go func() {
+		src := io.LimitReader(newPattern(seed), size)
+		buf := make([]byte, integrityChunk)
+		for {
+			n, _ := src.Read(buf)
+			if n == 0 {
+				writeErr <- nil
+				return
+			}
+			stream.SetWriteDeadline(clk.Now().Add(integrityIdle))
+			if _, err := up.Write(buf[:n]); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}()
+
+	want := newPattern(seed)
+	got := make([]byte, integrityChunk)
+	exp := make([]byte, integrityChunk)
+	for result.Bytes < size {
+		chunk := int64(integrityChunk)
+		if rest := size - result.Bytes; rest < chunk {
+			chunk = rest
+		}
+		stream.SetReadDeadline(clk.Now().Add(integrityIdle))
+		if _, err := io.ReadFull(stream, got[:chunk]); err != nil {
+			stream.Close()
+			if werr := <-writeErr; werr != nil && !errors.Is(err, io.EOF) {
+				err = werr
+			}
+			result.Error = fmt.Sprintf("after %d bytes: %v", result.Bytes, err)
+			break
+		}
+		want.Read(exp[:chunk])
+		result.compare(got[:chunk], exp[:chunk])
+		result.Bytes += chunk
+	}
+	if result.Error == "" {
+		if err := <-writeErr; err != nil {
+			result.Error = err.Error()
+		}
+	}
+
+	elapsed := clk.Since(start)
+	result.Ms = elapsed.Milliseconds()
+	if elapsed > 0 {
+		result.Mbps = float64(result.Bytes) * 8 / elapsed.Seconds() / 1e6
+	}
+	result.Burst = snapshotBurst().since(burst)
+	result.OK = result.Error == "" && result.Corrupted == 0
+	return result
+}
+
+// compare 比较一块数据，记录损坏字节数和区间
+func (r *integrityResult) compare(got, exp []byte) {
+	for i := range got {
+		if got[i] == exp[i] {
+			continue
+		}
+		r.Corrupted++
+		off := r.Bytes + int64(i)
+		if n := len(r.Ranges); n > 0 && r.Ranges[n-1].Offset+r.Ranges[n-1].Length == off {
+			r.Ranges[n-1].Length++
+		} else if n < integrityMaxRanges {
+			r.Ranges = append(r.Ranges, corruptRange{Offset: off, Length: 1})
+		}
+	}
+}
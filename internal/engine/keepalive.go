@@ -0,0 +1,212 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// 合并心跳: Conn > 1 时关闭 SMUX 自带的心跳 (每个会话各自计时，相位随机)，
+// 改为统一计时，在 keepalivewindow 毫秒内依次给所有会话发送 NOP，
+// 使无线电每个心跳周期只唤醒一次，而不是 Conn 次
+//
+// 自适应心跳 (adaptivekeepalive): 同样由 keepAliveLoop 发送，每轮按平均 RTT 和
+// 上一周期的重传率调整间隔: 不稳定的路径缩短间隔以更快发现断线，稳定的路径延长间隔以省电
+// (不超过常见运营商 NAT 的 UDP 映射超时)
+
+const (
+	adaptiveMinKeepAlive = 2 * time.Second
+	adaptiveMaxKeepAlive = 25 * time.Second
+	unstableLoss         = 0.05 // 重传率高于该值视为不稳定
+	stableLoss           = 0.01 // 重传率低于该值 (且 RTT 正常) 视为稳定
+	stableRTT            = 200 * time.Millisecond
+	keepAliveMinSegs     = 16 // 周期内发送的段数不足时不计算重传率
+)
+
+var currentKeepAlive int64 // 当前心跳间隔 (纳秒，由 keepAliveLoop 维护)
+
+// trackedConn 记录最后一次收到数据的时间，代替 SMUX 内部的超时检测 (开启 predictloss 时也用于记录到达间隔)
+type trackedConn struct {
+	net.Conn
+	lastRead int64 // UnixNano
+	gapAvg   int64 // 空闲到达间隔的平滑值 (纳秒，断线预测用)
+	gaps     int64 // 记录的空闲到达间隔数
+}
+
+func newTrackedConn(conn net.Conn) *trackedConn {
+	return &trackedConn{Conn: conn, lastRead: clk.Now().UnixNano()}
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		now := clk.Now().UnixNano()
+		c.noteGap(time.Duration(now - atomic.SwapInt64(&c.lastRead, now)))
+	}
+	return n, err
+}
+
+// idle 距离最后一次收到数据的时间
+func (c *trackedConn) idle() time.Duration {
+	return clk.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+}
+
+// coalesceKeepAlive 是否启用合并心跳
+func coalesceKeepAlive(config *Config) bool {
+	return config.Conn > 1 && config.KeepAliveWindow > 0
+}
+
+// managedKeepAlive 心跳是否由 keepAliveLoop 发送 (合并或自适应)
+func managedKeepAlive(config *Config) bool {
+	return coalesceKeepAlive(config) || config.AdaptiveKeepAlive
+}
+
+// adaptKeepAlive 按 RTT 和重传率计算下一轮心跳间隔
+func adaptKeepAlive(base time.Duration, rtt time.Duration, loss float64) time.Duration {
+	switch {
+	case loss >= unstableLoss || rtt >= degradedRTT:
+		if d := base / 2; d > adaptiveMinKeepAlive {
+			return d
+		}
+		return adaptiveMinKeepAlive
+	case loss < stableLoss && rtt < stableRTT:
+		d := base * 2
+		if limit := maxDuration(base, adaptiveMaxKeepAlive); d > limit {
+			d = limit
+		}
+		return d
+	}
+	return base
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// scaleByKeepAlive 自适应心跳开启时按当前心跳间隔相对 keepalive 的比例缩放 d (如控制流心跳)
+func scaleByKeepAlive(config *Config, d time.Duration) time.Duration {
+	cur := atomic.LoadInt64(&currentKeepAlive)
+	if !config.AdaptiveKeepAlive || cur == 0 {
+		return d
+	}
+	base := time.Duration(config.KeepAlive) * time.Second
+	return time.Duration(int64(d) * cur / int64(base))
+}
+
+// sessionsRTT 存活会话的平均平滑 RTT
+func sessionsRTT() time.Duration {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	var sum, n int64
+	for _, s := range proxySessions {
+		if s.alive() {
+			sum += int64(s.srtt())
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(sum/n) * time.Millisecond
+}
+
+// keepAliveLoop 合并/自适应心跳循环
+func keepAliveLoop(config *Config, stop chan struct{}) {
+	base := time.Duration(config.KeepAlive) * time.Second
+	interval := base
+	window := time.Duration(config.KeepAliveWindow) * time.Millisecond
+	atomic.StoreInt64(&currentKeepAlive, int64(interval))
+	defer atomic.StoreInt64(&currentKeepAlive, 0)
+
+	last := kcp.DefaultSnmp.Copy()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-clk.After(interval):
+		}
+
+		if config.AdaptiveKeepAlive {
+			snmp := kcp.DefaultSnmp.Copy()
+			out := snmp.OutSegs - last.OutSegs
+			retrans := snmp.RetransSegs - last.RetransSegs
+			last = snmp
+			loss := 0.0
+			if out >= keepAliveMinSegs {
+				loss = float64(retrans) / float64(out)
+			}
+			if next := adaptKeepAlive(base, sessionsRTT(), loss); next != interval {
+				log.Printf("Keepalive interval %v -> %v (retrans %.1f%%)", interval, next, loss*100)
+				interval = next
+				atomic.StoreInt64(&currentKeepAlive, int64(interval))
+			}
+		}
+		timeout := 3 * interval
+
+		proxyMu.Lock()
+		sessions := append([]*poolSession(nil), proxySessions...)
+		proxyMu.Unlock()
+
+		// 在窗口内均匀错开，避免同一时刻的突发
+		spacing := window / time.Duration(len(sessions))
+		for i, s := range sessions {
+			if !s.alive() || s.tracked == nil {
+				continue
+			}
+			if s.tracked.idle() > timeout {
+				logErrorf("Session %d keepalive timeout", i)
+				s.Close()
+				continue
+			}
+			s.sendNOP(byte(config.SmuxVer))
+			if i < len(sessions)-1 {
+				select {
+				case <-stop:
+					return
+				case <-clk.After(spacing):
+				}
+			}
+		}
+	}
+}
+
+// sendNOP 直接向底层连接写入一个 SMUX NOP 帧
+// SMUX 的发送循环每次用一次 Write/WriteBuffers 写完整帧，KCP/TLS 的写入是原子的，不会与之交错
+func (s *poolSession) sendNOP(version byte) {
+	// 帧头: 版本 (1) + 命令 (1, cmdNOP=3) + 长度 (2) + 流 ID (4)
+	frame := [8]byte{version, 3}
+	if _, err := s.tracked.Write(frame[:]); err != nil {
+		logError("Keepalive error:", err)
+	}
+}
@@ -0,0 +1,128 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 断网保护 (killswitch): 全部会话断开期间拒绝所有新连接，包括命中 direct/auto 规则的连接，
+// 并关闭停车场中的连接和正在直连的连接，避免隧道恢复前流量绕过隧道 (fail-closed)。
+// 会话因空闲休眠不算断开。本地代理和热点监听同样生效
+
+var (
+	killEngaged int32 // 非 0 表示断网保护已生效
+	killSince   int64 // 生效时间 (UnixNano)
+
+	directMu    sync.Mutex
+	directConns = make(map[net.Conn]struct{}) // 正在直连的本地连接
+)
+
+// killSwitchEngaged 断网保护是否生效
+func killSwitchEngaged() bool {
+	return atomic.LoadInt32(&killEngaged) != 0
+}
+
+// resetKillSwitch 清除断网保护状态 (代理启动时)
+func resetKillSwitch() {
+	atomic.StoreInt32(&killEngaged, 0)
+}
+
+// trackDirect 登记直连的本地连接，返回注销函数
+func trackDirect(conn net.Conn) func() {
+	directMu.Lock()
+	directConns[conn] = struct{}{}
+	directMu.Unlock()
+	return func() {
+		directMu.Lock()
+		delete(directConns, conn)
+		directMu.Unlock()
+	}
+}
+
+// tunnelDown 全部会话断开且不是休眠
+func tunnelDown() bool {
+	if isHibernating() {
+		return false
+	}
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	for _, s := range proxySessions {
+		if s.alive() {
+			return false
+		}
+	}
+	return true
+}
+
+// checkKillSwitch 根据会话状态开启或解除断网保护 (仅监管协程调用)
+func (s *sessionSupervisor) checkKillSwitch() {
+	if !s.config.KillSwitch {
+		return
+	}
+
+	down := tunnelDown()
+	if down && atomic.CompareAndSwapInt32(&killEngaged, 0, 1) {
+		atomic.StoreInt64(&killSince, clk.Now().UnixNano())
+
+		s.mu.Lock()
+		parked := s.parked
+		s.parked = nil
+		s.mu.Unlock()
+		for _, p := range parked {
+			closeParked(p, closeKillSwitch, socksRefused)
+		}
+
+		directMu.Lock()
+		direct := len(directConns)
+		for conn := range directConns {
+			conn.Close()
+		}
+		directMu.Unlock()
+
+		log.Printf("Tunnel down, kill switch engaged (dropped %d parked, %d direct)", len(parked), direct)
+		emitEvent("killswitch", map[string]interface{}{
+			"engaged": true,
+			"parked":  len(parked),
+			"direct":  direct,
+		})
+	} else if !down && atomic.CompareAndSwapInt32(&killEngaged, 1, 0) {
+		blocked := clk.Since(time.Unix(0, atomic.LoadInt64(&killSince)))
+		log.Printf("Tunnel restored, kill switch disengaged after %s", blocked.Round(time.Second))
+		emitEvent("killswitch", map[string]interface{}{
+			"engaged":  false,
+			"duration": blocked.Seconds(),
+		})
+	}
+}
+
+// rejectKillSwitch 断网保护生效时立即拒绝连接 (回复 connection refused)
+func rejectKillSwitch(conn net.Conn, client *hotspotClient) {
+	closeParked(parkedConn{conn: conn, client: client}, closeKillSwitch, socksRefused)
+}
@@ -0,0 +1,171 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// 引擎状态机: 生命周期阶段 (proxyPhase) 在启动、停止时显式切换，
+// 运行中的细分状态由会话池和排空/休眠标志推导，GetState 返回其中之一:
+//   - idle:         未运行
+//   - starting:     正在启动 (建立监听和会话池)，或离线待命等待网络恢复
+//   - ready:        运行中，会话全部正常 (休眠或按需模式下没有会话时按需建立，也视为 ready)
+//   - degraded:     运行中，部分会话异常或正在重连
+//   - reconnecting: 运行中，没有可用会话
+//   - draining:     正在排空，不再接受新连接
+//   - stopping:     正在停止
+// 每次状态变化发送 "state" 事件 {"from", "to"}；推导出的状态由 stateLoop 在事件或轮询时检查
+
+const (
+	phaseIdle int32 = iota
+	phaseStarting
+	phaseRunning
+	phaseStopping
+)
+
+const (
+	stateIdle         = "idle"
+	stateStarting     = "starting"
+	stateReady        = "ready"
+	stateDegraded     = "degraded"
+	stateReconnecting = "reconnecting"
+	stateDraining     = "draining"
+	stateStopping     = "stopping"
+)
+
+var (
+	proxyPhase int32 // 生命周期阶段，由 proxyMu 保护写入，可原子读取
+
+	lifeMu    sync.Mutex
+	lifeState = stateIdle // 最近一次通知的状态
+)
+
+// proxyRunning 代理是否在运行 (调用方需持有 proxyMu)
+func proxyRunning() bool {
+	return atomic.LoadInt32(&proxyPhase) == phaseRunning
+}
+
+// setPhaseLocked 切换生命周期阶段并通知状态变化 (调用方需持有 proxyMu)
+func setPhaseLocked(phase int32) {
+	atomic.StoreInt32(&proxyPhase, phase)
+	noteStateLocked()
+}
+
+// GetState 返回引擎状态: idle, starting, ready, degraded, reconnecting, draining, stopping
+// 启动和停止期间不等待引擎锁，立即返回
+func GetState() string {
+	switch atomic.LoadInt32(&proxyPhase) {
+	case phaseStarting:
+		return stateStarting
+	case phaseStopping:
+		return stateStopping
+	}
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	return currentStateLocked()
+}
+
+// currentStateLocked 计算当前状态 (调用方需持有 proxyMu)
+func currentStateLocked() string {
+	switch atomic.LoadInt32(&proxyPhase) {
+	case phaseStarting:
+		return stateStarting
+	case phaseStopping:
+		return stateStopping
+	case phaseIdle:
+		if armedConfig != nil {
+			return stateStarting
+		}
+		return stateIdle
+	}
+	if isDraining() {
+		return stateDraining
+	}
+	if isHibernating() {
+		return stateReady
+	}
+	alive, healthy := 0, 0
+	for _, s := range proxySessions {
+		if !s.alive() {
+			continue
+		}
+		alive++
+		if s.state() == "healthy" {
+			healthy++
+		}
+	}
+	switch {
+	case alive == 0 && proxyConfig.onDemand:
+		return stateReady
+	case alive == 0:
+		return stateReconnecting
+	case healthy < expectedSessionsLocked(alive):
+		return stateDegraded
+	}
+	return stateReady
+}
+
+// noteStateLocked 状态变化时记录并发送 "state" 事件 (调用方需持有 proxyMu)
+func noteStateLocked() {
+	state := currentStateLocked()
+	lifeMu.Lock()
+	from := lifeState
+	lifeState = state
+	lifeMu.Unlock()
+	if state == from {
+		return
+	}
+	log.Printf("State: %s -> %s", from, state)
+	emitEvent("state", map[string]interface{}{"from": from, "to": state})
+}
+
+// stateLoop 运行期间在每个事件后或定期检查推导出的状态
+func stateLoop(stop chan struct{}) {
+	for {
+		stateWatchMu.Lock()
+		ch := stateWatchCh
+		stateWatchMu.Unlock()
+
+		proxyMu.Lock()
+		select {
+		case <-stop:
+			proxyMu.Unlock()
+			return
+		default:
+		}
+		noteStateLocked()
+		proxyMu.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-ch:
+		case <-clk.After(stateWatchPoll):
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// BenchmarkLocalHop 本地一跳 (App 到引擎监听) 的往返延迟和吞吐，
+// 对比标准库默认参数和 tuneLocalConn 的回环参数
+func BenchmarkLocalHop(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		tune bool
+	}{
+		{"default", false},
+		{"tuned", true},
+	} {
+		b.Run(c.name+"/pingpong", func(b *testing.B) {
+			conn := localEchoPair(b, c.tune)
+			buf := make([]byte, 64)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(c.name+"/bulk", func(b *testing.B) {
+			conn := localEchoPair(b, c.tune)
+			buf := make([]byte, 256<<10)
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				go conn.Write(buf)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// localEchoPair 建立一条回环连接，服务端回显收到的数据；tune 时两端都按本地连接调整
+func localEchoPair(b *testing.B, tune bool) net.Conn {
+	ln, err := listenLocal("127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if tune {
+			tuneLocalConn(conn)
+		}
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	if tune {
+		tuneLocalConn(conn)
+	}
+	return conn
+}
@@ -0,0 +1,42 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// 本地监听 TLS: 配置 localtlscert/localtlskey 后本地监听作为 HTTPS 代理端点，
+// 供要求 HTTPS 代理的浏览器或库 (如安全 PAC 部署中的 "HTTPS host:port") 连接。
+// TLS 在本地终止，解密后的 CONNECT/SOCKS 握手照常处理
+
+// localHandshake 对本地 TLS 连接完成握手 (超时与代理握手相同)
+// 接受循环只包装连接，握手在各连接自己的协程中进行，慢客户端不会阻塞接受
+func localHandshake(tc *tls.Conn) error {
+	tc.SetDeadline(clk.Now().Add(handshakeTimeout))
+	defer tc.SetDeadline(time.Time{})
+	return tc.Handshake()
+}
@@ -0,0 +1,1021 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+var (
+	proxyListener net.Listener
+	proxySessions []*poolSession
+	proxyMu       profileMutex
+	proxyConfig   *Config
+	stopChan      chan struct{}
+
+	pauseMu    sync.Mutex
+	resumeChan chan struct{} // 非 nil 表示已暂停
+)
+
+// StartProxy 启动代理服务
+// configJson: JSON 格式的配置字符串
+// 返回空字符串表示成功，否则返回错误信息
+func StartProxy(configJson string) string {
+	return StartProxyWithOverrides(configJson, "")
+}
+
+// startProxy 解析合并后的配置并启动
+func startProxy(configJson string) string {
+	config, err := parseConfig(configJson)
+	if err != nil {
+		return err.Error()
+	}
+	if config.StartupTimeout > 0 {
+		return startWithTimeout(config, configJson)
+	}
+	return startParsed(config, configJson)
+}
+
+// startParsed 启动已解析的配置
+func startParsed(config *Config, configJson string) string {
+	// 先按配置开启日志脱敏，之后的日志 (含自动选择服务器的探测) 才不会泄露地址
+	proxyMu.Lock()
+	if atomic.LoadInt32(&proxyPhase) == phaseIdle && armedConfig == nil {
+		startRedaction(config)
+	}
+	proxyMu.Unlock()
+
+	// 自动选择服务器: 探测耗时较长，在加锁前完成
+	setBaseConfig(configJson)
+	if config.AutoServer {
+		auto, best, err := selectAutoServer(configJson, "")
+		if err != nil {
+			return "Config Error: autoserver: " + err.Error()
+		}
+		log.Printf("Auto server: using %s (%s)", best.Name, best.RemoteAddr)
+		auto.start = config.start
+		config = auto
+	}
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	// 时长上限只作用于本次启动 (待命后的启动、会话重建不受限)
+	defer func() { config.start = nil }()
+
+	if config.start.abandoned() {
+		wipeSecrets(config)
+		return "Startup Error: abandoned"
+	}
+
+	if proxyRunning() {
+		return "Proxy already running"
+	}
+	if armedConfig != nil {
+		return "Proxy already armed"
+	}
+	setInstanceLabel(config.Label)
+	for _, field := range config.unknownFields {
+		log.Println("Unknown config field:", field)
+	}
+
+	// 离线时进入待命，网络恢复后自动启动
+	if !networkUp {
+		if !config.start.claim() {
+			wipeSecrets(config)
+			return "Startup Error: abandoned"
+		}
+		armLocked(config)
+		return ""
+	}
+	if err := launchLocked(config); err != nil {
+		wipeSecrets(config)
+		return err.Error()
+	}
+	if !config.start.claim() {
+		// 已超时返回，撤销这次启动
+		logError("Startup finished after timeout, stopping")
+		stopLocked()
+		wipeSecrets(config)
+		return "Startup Error: abandoned"
+	}
+	return ""
+}
+
+// launchLocked 重置实例状态并启动 (调用方需持有 proxyMu)
+func launchLocked(config *Config) error {
+	resetHotspotClients()
+	resetHints()
+	resetAutoCache()
+	resetMTUClamp()
+	resetKillSwitch()
+	resetBlacklist()
+	resetLaunchConns()
+	resetOwner()
+	resetQuality()
+	resetBloat()
+	resetRates()
+	resetAdmission(config)
+	resetIdle()
+	resetTrace()
+	resetPeer()
+	resetTuning()
+	resetFECDirs(config)
+	resetAutoProfile(config)
+	atomic.StoreInt32(&hibernating, 0)
+	if config.MetricsFile != "" {
+		loadMetrics(config.MetricsFile)
+	}
+	return startLocked(config)
+}
+
+// startLocked 启动引擎，期间状态为 starting，失败时回到 idle (调用方需持有 proxyMu)
+func startLocked(config *Config) error {
+	setPhaseLocked(phaseStarting)
+	if err := runLocked(config); err != nil {
+		setPhaseLocked(phaseIdle)
+		return err
+	}
+	return nil
+}
+
+// runLocked 启动监听、会话池和后台协程 (调用方需持有 proxyMu)
+func runLocked(config *Config) error {
+	deriveSecrets(config)
+
+	// 热点模式: 改为监听热点网卡地址
+	listenAddr := config.LocalAddr
+	if config.Hotspot {
+		addr, subnet, err := resolveHotspot(config)
+		if err != nil {
+			return fmt.Errorf("Hotspot Error: %v", err)
+		}
+		listenAddr = addr
+		config.hotspotNet = subnet
+	}
+
+	if err := openGeoIP(config.GeoIPDB); err != nil {
+		return fmt.Errorf("GeoIP Error: %v", err)
+	}
+	if err := loadCompDict(config); err != nil {
+		return fmt.Errorf("Comp Error: %v", err)
+	}
+	if !useTLS(config) {
+		p := effectiveParams(config)
+		if err := fecSelfTest(p.DataShard, p.ParityShard); err != nil {
+			return fmt.Errorf("FEC Error: self-test failed: %v", err)
+		}
+	}
+
+	// 启动 TCP 监听 (引擎交接时复用旧引擎的监听)
+	listener := takeImportListener()
+	if listener == nil {
+		var err error
+		if listener, err = listenLocal(listenAddr); err != nil {
+			return fmt.Errorf("Listen Error: %v", err)
+		}
+	}
+	merged, err := listenExtra(config, listener)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("Listen Error: %v", err)
+	}
+	listener = merged
+
+	sessions, stop := takePrebuiltSessions()
+	if stop == nil {
+		stop = make(chan struct{})
+	}
+
+	// 启动失败时清理已创建的资源
+	fail := func(prefix string, err error) error {
+		close(stop)
+		for _, s := range sessions {
+			if s != nil {
+				s.Close()
+			}
+		}
+		listener.Close()
+		closeLogFile()
+		return fmt.Errorf("%s: %v", prefix, err)
+	}
+
+	if err := openLogFile(config); err != nil {
+		return fail("Log Error", err)
+	}
+
+	// 预创建 SMUX 会话池 (并发建立，minready 个成功即开始服务)
+	if sessions == nil {
+		var err error
+		if sessions, err = dialSessions(config, stop); err != nil {
+			return fail("Session Error", err)
+		}
+	}
+
+	if config.Hotspot && config.HotspotDNS > 0 {
+		host, _, _ := net.SplitHostPort(listenAddr)
+		dnsAddr := net.JoinHostPort(host, strconv.Itoa(config.HotspotDNS))
+		if _, err := startDNSRelay(dnsAddr, config, stop); err != nil {
+			return fail("DNS Error", err)
+		}
+	}
+
+	if config.DNSStub != "" {
+		if err := startDNSStub(config, stop); err != nil {
+			return fail("DNS Error", err)
+		}
+	}
+
+	if config.ControlAddr != "" {
+		if err := startControl(config, listener.Addr(), stop); err != nil {
+			return fail("Control Error", err)
+		}
+	}
+
+	proxyListener = listener
+	proxySessions = sessions
+	proxyConfig = config
+	setPhaseLocked(phaseRunning)
+	stopChan = stop
+	atomic.StoreInt32(&draining, 0)
+	startTime = clk.Now()
+	// 类别份额随配置更新生效
+	resetClasses(config)
+
+	if !config.AllowLAN && !config.Hotspot && !isLoopbackAddr(listener.Addr()) {
+		log.Printf("Listening on %s, but only loopback clients are accepted (set allowlan to share)", listener.Addr())
+	}
+
+	if config.Advertise {
+		// 广播失败不影响代理本身
+		if err := startAdvertise(config, listener.Addr()); err != nil {
+			logError("Advertise error:", err)
+		}
+	}
+
+	if err := openAccessLog(config); err != nil {
+		logError("Access log error:", err)
+	}
+	sup := newSupervisor(config, stopChan)
+	go sup.run()
+	go acceptLoop(listener, config, sup, stopChan)
+	go stateLoop(stopChan)
+	if config.Watchdog > 0 {
+		go watchdogLoop(config, sup, stopChan)
+	}
+	if managedKeepAlive(config) {
+		go keepAliveLoop(config, stopChan)
+	}
+	go metricsLoop(config, stopChan)
+	if config.MemoryBudget > 0 {
+		go memoryLoop(config, stopChan)
+	}
+	if config.MTUClamp && !useTLS(config) {
+		go mtuLoop(config, stopChan)
+	}
+	if config.BurstBudget > 0 && config.RateLimit == 0 && !useTLS(config) {
+		go burstLoop(config, stopChan)
+	}
+	if config.WarmStream {
+		go warmLoop(stopChan)
+	}
+	if config.TimerResolution > 0 && !useTLS(config) {
+		go timerLoop(config, stopChan)
+	}
+	if config.RulesURL != "" {
+		go subscriptionLoop(config, listener.Addr(), stopChan)
+	}
+	if config.SnmpLog != "" {
+		go snmpLoop(config, stopChan)
+	}
+	if config.DNSPrefetch > 0 {
+		go prefetchLoop(config, stopChan)
+	}
+	if config.StreamIdle > 0 {
+		go idleLoop(config, stopChan)
+	}
+	if config.TraceFile != "" {
+		go traceLoop(config, stopChan)
+	}
+	if config.PeerServe != "" {
+		go peerServeLoop(config, stopChan)
+	}
+	if config.PProf {
+		startPprof(stopChan)
+	}
+	if config.ControlStream {
+		resetCtrl()
+		go ctrlLoop(config, stopChan)
+	}
+
+	log.Printf("KCP Proxy started on %s -> %s (mode: %s)", listenAddr, config.RemoteAddr, config.Mode)
+	return nil
+}
+
+// StopProxy 停止代理服务 (待命中时取消待命)
+func StopProxy() {
+	stopInstance(nil)
+}
+
+// stopInstance 停止代理；stop 不为 nil 时仅在它仍是当前运行的实例时停止
+func stopInstance(stop chan struct{}) {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	if stop != nil && stop != stopChan {
+		return
+	}
+	if disarmLocked() || !proxyRunning() {
+		return
+	}
+
+	if proxyConfig.MetricsFile != "" {
+		saveMetrics(proxyConfig.MetricsFile)
+	}
+	config := proxyConfig
+	stopLocked()
+	wipeSecrets(config)
+	log.Println("KCP Proxy stopped")
+}
+
+// stopLocked 关闭监听和所有会话 (调用方需持有 proxyMu)
+func stopLocked() {
+	for _, session := range detachLocked() {
+		if session != nil {
+			closeSessionForShutdown(session)
+		}
+	}
+	setPhaseLocked(phaseIdle)
+}
+
+// detachLocked 停止后台任务并关闭监听，返回尚未关闭的会话 (调用方需持有 proxyMu)
+func detachLocked() []*poolSession {
+	setPhaseLocked(phaseStopping)
+	close(stopChan)
+	stopAdvertise()
+	closeAccessLog()
+	openGeoIP("")
+
+	if proxyListener != nil {
+		proxyListener.Close()
+		proxyListener = nil
+	}
+
+	sessions := proxySessions
+	proxySessions = nil
+	proxyConfig = nil
+	closeLogFile()
+	return sessions
+}
+
+// IsRunning 返回代理是否正在运行
+func IsRunning() bool {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	return proxyRunning()
+}
+
+// Pause 通知引擎 App 已进入后台，暂停统计推送等非必要的周期任务
+// 代理本身继续运行
+func Pause() {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	if resumeChan == nil {
+		resumeChan = make(chan struct{})
+	}
+}
+
+// Resume 通知引擎 App 已回到前台，恢复周期任务
+func Resume() {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	if resumeChan != nil {
+		close(resumeChan)
+		resumeChan = nil
+	}
+}
+
+// pauseWait 暂停时返回在 Resume 时关闭的通道，未暂停时返回 nil
+func pauseWait() chan struct{} {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	return resumeChan
+}
+
+// createSession 创建 KCP + SMUX 会话
+func createSession(config *Config) (*poolSession, error) {
+	var link net.Conn
+	var kcpConn *kcp.UDPSession
+	var handshake time.Duration
+	if useTLS(config) {
+		tlsConn, rtt, err := dialTLS(config)
+		if err != nil {
+			return nil, err
+		}
+		link, handshake = tlsConn, rtt
+	} else {
+		var err error
+		if kcpConn, link, err = dialKCP(config); err != nil {
+			return nil, err
+		}
+	}
+
+	// 创建 SMUX 会话
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = config.SmuxVer
+	smuxConfig.MaxReceiveBuffer = config.SmuxBuf
+	smuxConfig.MaxStreamBuffer = streamBufFor(config)
+	smuxConfig.MaxFrameSize = config.FrameSize
+	smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
+
+	transport := link
+	var batch *batchConn
+
+	// 写入合并 (仅 KCP 传输，在压缩和 QPP 之下，合并的是最终写入 KCP 的数据)
+	if config.WriteBatch > 0 && kcpConn != nil {
+		batch = newBatchConn(link, time.Duration(config.WriteBatch)*time.Millisecond, currentMTU(config))
+		link = batch
+	}
+
+	// 压缩 (仅 KCP 传输): zstd 需先与服务端协商，snappy 与 kcptun 一致
+	if kcpConn != nil {
+		switch {
+		case config.Comp == compZstd:
+			if err := negotiateZstd(link, config.compDict); err != nil {
+				link.Close()
+				return nil, err
+			}
+			zc, err := newZstdConn(link, config.compDict)
+			if err != nil {
+				link.Close()
+				return nil, err
+			}
+			link = zc
+		case !*config.NoComp:
+			link = newCompConn(link)
+		}
+	}
+
+	// QPP 混淆 (与 kcptun 一致，仅 KCP 传输)
+	if config.QPP && kcpConn != nil {
+		qc, err := newQPPConn(link, config)
+		if err != nil {
+			link.Close()
+			return nil, err
+		}
+		link = qc
+	}
+
+	// 调试: 帧校验 (需要服务端支持)
+	if config.Debug && config.FrameCRC {
+		link = newCRCConn(link)
+	}
+
+	// 单条流接收缓冲上限
+	buffers := newStreamBuffers(config)
+	if buffers != nil {
+		link = newCapConn(link, buffers)
+	}
+
+	// 合并/自适应心跳: 由 keepAliveLoop 统一发送并检测超时
+	var tracked *trackedConn
+	var conn io.ReadWriteCloser = link
+	if managedKeepAlive(config) {
+		smuxConfig.KeepAliveDisabled = true
+		tracked = newTrackedConn(link)
+		conn = tracked
+	} else if config.PredictLoss > 0 {
+		// 断线预测需要记录到达间隔，超时检测仍由 SMUX 负责
+		tracked = newTrackedConn(link)
+		conn = tracked
+	}
+
+	if err := smux.VerifyConfig(smuxConfig); err != nil {
+		link.Close()
+		return nil, err
+	}
+
+	session, err := smux.Client(conn, smuxConfig)
+	if err != nil {
+		link.Close()
+		return nil, err
+	}
+
+	atomic.AddUint64(&statSessionsCreated, 1)
+	metricCount("kcp_sessions_created_total", "", 1)
+	log.Printf("Session created: %s -> %s", link.LocalAddr(), link.RemoteAddr())
+	ps := &poolSession{
+		Session:   session,
+		conn:      kcpConn,
+		link:      transport,
+		handshake: handshake,
+		created:   clk.Now(),
+		tracked:   tracked,
+		batch:     batch,
+		mark:      newQueueMark(config),
+		buffers:   buffers,
+		features:  negotiatedFeatures(config, kcpConn, transport),
+	}
+	if config.BoostHandshakes {
+		ps.gate = newPriorityGate()
+	}
+	if config.WarmStream {
+		ps.refreshWarm()
+	}
+	return ps, nil
+}
+
+// dialKCPOverUDP 通过 UDP 建立 KCP 连接 (指定网络时由 protector 绑定 socket)
+func dialKCPOverUDP(config *Config, block kcp.BlockCrypt, dataShard, parityShard int) (*kcp.UDPSession, net.Conn, error) {
+	if config.Network != 0 {
+		return dialKCPOnNetwork(config, block, dataShard, parityShard)
+	}
+	raddr, err := resolveRemote(config, net.DefaultResolver)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.WriteGrace < 0 && currentSocketHook() == nil && !fecDirEnabled(config) && config.trace == nil && config.LocalPort == 0 {
+		kcpConn, err := kcp.DialWithOptions(raddr.String(), block, dataShard, parityShard)
+		if err != nil {
+			return nil, nil, err
+		}
+		return kcpConn, kcpConn, nil
+	}
+
+	// 自建 socket 以便拦截写错误
+	pconn := takeImportConn()
+	if pconn == nil {
+		if pconn, err = listenKCP(config, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	wire := newWireCounter(pconn)
+	sess, err := kcp.NewConn2(raddr, block, dataShard, parityShard, guardWrites(config, dropParity(config, block, duplicateSmall(config, impairTrace(config, wire)))))
+	if err != nil {
+		pconn.Close()
+		return nil, nil, err
+	}
+	return sess, &boundConn{UDPSession: sess, pconn: pconn, wire: wire}, nil
+}
+
+// dialKCP 建立 KCP 连接并设置参数，同时返回供 SMUX 使用的连接
+func dialKCP(config *Config) (*kcp.UDPSession, net.Conn, error) {
+	// 使用 PBKDF2 派生密钥 (与 kcptun 服务端 --key/--crypt 匹配)
+	block, err := configBlockCrypt(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	block = markParity(config, block)
+
+	// 合并服务端建议的参数
+	p := effectiveParams(config)
+
+	// 点对点: 先向对端打洞，失败时经服务端中转
+	var kcpConn *kcp.UDPSession
+	var link net.Conn
+	if config.PeerDial != "" {
+		if kcpConn, link, err = dialPeer(config, block, p.DataShard, p.ParityShard); err != nil {
+			log.Printf("Peer %s: %v, relaying via %s", config.PeerDial, err, config.RemoteAddr)
+		}
+	}
+
+	// 建立 KCP 连接 (TCP 模拟失败且允许回退时改用 UDP)
+	switch {
+	case kcpConn != nil:
+	case config.TCP:
+		kcpConn, link, err = dialKCPOverTCP(config, block, p.DataShard, p.ParityShard)
+		if err != nil && tcpFallback(config, err) {
+			kcpConn, link, err = dialKCPOverUDP(config, block, p.DataShard, p.ParityShard)
+		}
+	default:
+		kcpConn, link, err = dialKCPOverUDP(config, block, p.DataShard, p.ParityShard)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	tuneKCP(config, kcpConn, p)
+	return kcpConn, link, nil
+}
+
+// tuneKCP 设置 KCP 参数 (主动建立和 peerserve 接受的会话相同)
+func tuneKCP(config *Config, kcpConn *kcp.UDPSession, p kcpParams) {
+	kcpConn.SetStreamMode(true)
+	kcpConn.SetWriteDelay(false)
+	kcpConn.SetNoDelay(p.NoDelay, kcpInterval(config, p), p.Resend, p.NoCongestion)
+	kcpConn.SetWindowSize(p.SndWnd, p.RcvWnd)
+	kcpConn.SetMtu(currentMTU(config))
+	kcpConn.SetACKNoDelay(config.AckNodelay)
+	if config.RateLimit > 0 {
+		kcpConn.SetRateLimit(uint32(config.RateLimit))
+	}
+	if config.DSCP > 0 {
+		if err := kcpConn.SetDSCP(config.DSCP); err != nil {
+			logError("SetDSCP:", err)
+		}
+	}
+
+	if err := kcpConn.SetReadBuffer(config.SockBuf); err != nil {
+		logError("SetReadBuffer:", err)
+	}
+	if err := kcpConn.SetWriteBuffer(config.SockBuf); err != nil {
+		logError("SetWriteBuffer:", err)
+	}
+}
+
+// acceptLoop 接受连接的循环
+// 只选择存活的会话，不在此处重连；没有可用会话时交给监管协程暂存
+func acceptLoop(listener net.Listener, config *Config, sup *sessionSupervisor, stop chan struct{}) {
+	rr := 0 // 轮询起点 (权重相同时按序轮询)
+	tlsConfig, err := localTLSConfig(config)
+	if err != nil {
+		logError("Local TLS:", err)
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			default:
+				logError("Accept error:", err)
+				continue
+			}
+		}
+
+		if !sourceAllowed(config, conn.RemoteAddr()) {
+			rejectSource(conn)
+			continue
+		}
+		if isDraining() {
+			rejectDraining(conn, nil)
+			continue
+		}
+		tuneLocalConn(conn)
+		if tlsConfig != nil {
+			conn = tls.Server(conn, tlsConfig)
+		}
+
+		// 标记正在处理连接，供看门狗判断是否卡死
+		atomic.StoreInt64(&acceptBusySince, clk.Now().UnixNano())
+
+		proxyMu.Lock()
+		select {
+		case <-stop:
+			proxyMu.Unlock()
+			atomic.StoreInt64(&acceptBusySince, 0)
+			conn.Close()
+			return
+		default:
+		}
+
+		// 选择存活会话 (按吞吐加权轮询)，断开的会话交给监管协程重连
+		session, dead := pickSessionLocked(&rr)
+		proxyMu.Unlock()
+		atomic.StoreInt64(&acceptBusySince, 0)
+		if dead {
+			sup.kick()
+		}
+
+		var client *hotspotClient
+		if config.Hotspot {
+			client = acquireHotspotClient(config, conn.RemoteAddr())
+		}
+		if session == nil {
+			if killSwitchEngaged() {
+				rejectKillSwitch(conn, client)
+				continue
+			}
+			sup.park(conn, client)
+			continue
+		}
+
+		atomic.AddUint64(&acceptCount, 1)
+		go handleClient(config, conn, session, client)
+	}
+}
+
+// handleClient 处理单个客户端连接
+// client 为热点模式下的客户端记录，非热点模式为 nil
+func handleClient(config *Config, p1 net.Conn, session *poolSession, client *hotspotClient) {
+	defer p1.Close()
+	if client != nil {
+		defer client.release()
+	}
+
+	atomic.AddUint64(&statTotalConns, 1)
+	atomic.AddUint64(&launchConns, 1)
+	atomic.AddInt64(&statActiveConns, 1)
+	defer atomic.AddInt64(&statActiveConns, -1)
+	timerActive(config)
+
+	if tc, ok := p1.(*tls.Conn); ok {
+		if err := localHandshake(tc); err != nil {
+			connLog("Local TLS handshake error:", err)
+			countClose(closeClientError)
+			logAccess(&accessRecord{Peer: p1.RemoteAddr().String(), Outbound: actionProxy, Reason: closeClientError})
+			return
+		}
+	}
+
+	// 存在 direct/auto 规则时先在本地完成握手，按目标选择出口
+	var hs *proxyHandshake
+	var p2 *smux.Stream
+	class := ""
+	if routeLocally(config) {
+		var err error
+		if hs, err = readHandshake(p1); err != nil {
+			connLog("Handshake error:", err)
+			countClose(closeClientError)
+			logAccess(&accessRecord{Peer: p1.RemoteAddr().String(), Outbound: actionProxy, Reason: closeClientError})
+			return
+		}
+		// BIND 的监听端在服务端，只能经隧道转发；开启 socksbind 时需要服务端确认支持
+		if hs.proto == 5 && hs.cmd == socksCmdBind && config.SocksBind && !serverSupports(capBind) {
+			replyFailure(p1, hs, socksCmdUnsupported)
+			countClose(closePolicy)
+			logAccess(&accessRecord{Peer: p1.RemoteAddr().String(), Outbound: actionReject, Reason: closePolicy})
+			return
+		}
+		if hs.target != "" && pinnedPort(config, hs.target) {
+			if ps := pinnedSession(); ps != nil {
+				session = ps
+			}
+		}
+		if hs.target != "" {
+			host, _, _ := net.SplitHostPort(hs.target)
+			hs.domain = sniffLocal(config, p1, hs)
+			action := matchSniffed(config, hs.domain, host)
+			if hs.domain != "" {
+				host = hs.domain
+			}
+			class = streamClass(config, host, hs.target)
+			if action != actionReject {
+				ip, err := resolveSOCKS5(config, hs)
+				if err != nil {
+					connLog("SOCKS5 resolve error:", err)
+					replyFailure(p1, hs, socksHostUnreachable)
+					countClose(closeOpenFailed)
+					countOutbound(actionProxy, 0, 0, true)
+					logAccess(&accessRecord{Peer: p1.RemoteAddr().String(), Target: hs.target, Outbound: action, Reason: closeOpenFailed})
+					return
+				}
+				// 按解析结果重新匹配 (cidr/geoip 规则)，仍以域名规则优先
+				if rs := currentRules(config); ip != "" && rs != nil && rs.match(host) < 0 {
+					action = matchRule(config, ip)
+				}
+			}
+			var raced net.Conn
+			if action == actionAuto {
+				var err error
+				if action, raced, err = resolveAuto(config, session, hs, host); err != nil {
+					connLog("Outbound race error:", err)
+					replyHandshake(p1, hs, false)
+					countClose(closeOpenFailed)
+					countOutbound(actionProxy, 0, 0, true)
+					logAccess(&accessRecord{Peer: p1.RemoteAddr().String(), Target: hs.target, Outbound: actionAuto, Reason: closeOpenFailed})
+					return
+				}
+			}
+			switch action {
+			case actionReject:
+				atomic.AddUint64(&statRuleRejects, 1)
+				if tcpConn, ok := p1.(*net.TCPConn); ok {
+					tcpConn.SetLinger(0)
+				}
+				countClose(closePolicy)
+				countOutbound(actionReject, 0, 0, false)
+				recordDestination(hs.destination(), 0, 0)
+				logAccess(&accessRecord{Peer: p1.RemoteAddr().String(), Target: hs.target, Domain: hs.domain, Outbound: actionReject, Reason: closePolicy})
+				return
+			case actionDirect:
+				if killSwitchEngaged() {
+					if raced != nil {
+						raced.Close()
+					}
+					replyFailure(p1, hs, socksRefused)
+					countClose(closeKillSwitch)
+					countOutbound(actionReject, 0, 0, false)
+					logAccess(&accessRecord{Peer: p1.RemoteAddr().String(), Target: hs.target, Outbound: actionDirect, Reason: closeKillSwitch})
+					return
+				}
+				handleDirect(config, p1, hs, client, raced)
+				return
+			}
+			if raced != nil {
+				// 隧道竞速胜出: 已与服务端完成握手，本地应答客户端
+				p2 = raced.(*smux.Stream)
+				hs.head, hs.swallow = nil, 0
+				if err := replyHandshake(p1, hs, true); err != nil {
+					p2.Close()
+					countClose(closeClientError)
+					countOutbound(actionProxy, 0, 0, false)
+					return
+				}
+			}
+		}
+	}
+
+	// 流重放: 本地应答握手，服务端的连接应答在重放握手时丢弃
+	replay := false
+	if hs != nil && p2 == nil && len(hs.head) > 0 && replayable(config, hs.target) {
+		if err := replyHandshake(p1, hs, true); err != nil {
+			countClose(closeClientError)
+			logAccess(&accessRecord{Peer: p1.RemoteAddr().String(), Target: hs.target, Outbound: actionProxy, Reason: closeClientError})
+			return
+		}
+		hs.replied = true
+		replay = true
+	}
+
+	// 优先接管预热流
+	warm := false
+	if p2 == nil && config.WarmStream {
+		p2 = session.takeWarm()
+		warm = p2 != nil
+	}
+
+	// 在 SMUX 会话上打开一个流 (auto 竞速时已打开)
+	if p2 == nil {
+		opened := clk.Now()
+		var err error
+		p2, session, err = openWithFallback(session)
+		recordOpen(clk.Since(opened), err)
+		if err != nil {
+			logError("OpenStream error:", err)
+			reason := closeOpenFailed
+			if session.IsClosed() {
+				reason = classifyClose(session, false, err)
+			}
+			failClient(p1, hs, socksHostUnreachable)
+			countClose(reason)
+			countOutbound(actionProxy, 0, 0, true)
+			logAccess(&accessRecord{Peer: p1.RemoteAddr().String(), Outbound: actionProxy, Reason: reason})
+			return
+		}
+	}
+	defer p2.Close()
+
+	info := registerStream(p1, p2, session)
+	defer unregisterStream(info)
+	if t := watchTTFB(config, info, session); t != nil {
+		defer t.Stop()
+	}
+	info.warm = warm
+	info.sniff.sni, info.sniff.host = config.SniffSNI, config.SniffHost
+	if hs != nil && hs.target != "" {
+		// 已在本地识别并匹配过规则
+		info.target = hs.target
+		info.domain = hs.domain
+		info.sniff.done = true
+	}
+
+	// reject 规则: 识别出目标后立即以 RST 关闭客户端连接
+	info.onTarget = func(target string) error {
+		err := checkTarget(config, target)
+		if err != nil {
+			if tcpConn, ok := p1.(*net.TCPConn); ok {
+				tcpConn.SetLinger(0)
+			}
+		}
+		return err
+	}
+
+	// 先结束的方向决定关闭原因
+	var closedBy sync.Once
+	reason := ""
+	closed := func(fromClient bool, err error) {
+		closedBy.Do(func() {
+			reason = classifyClose(session, fromClient, err)
+			if atomic.LoadInt32(&info.trimmed) != 0 {
+				reason = closeTrimmed
+			} else if atomic.LoadInt32(&info.reaped) != 0 {
+				reason = closeTimeout
+			}
+		})
+	}
+	defer func() {
+		countClose(reason)
+		up, down := atomic.LoadUint64(&info.bytesUp), atomic.LoadUint64(&info.bytesDown)
+		if reason == closePolicy {
+			countOutbound(actionReject, up, down, false)
+		} else {
+			countOutbound(actionProxy, up, down, false)
+		}
+		recordDestination(info.destination(), up, down)
+		recordTag(info.tag, up, down)
+		logAccess(streamRecord(info, reason))
+	}()
+
+	// 隧道端: 开启重放时可在会话断开后切换到新流
+	var tunnel io.ReadWriteCloser = p2
+	var rc *replayConn
+	if replay {
+		rc = newReplayConn(hs, info, p2, session)
+		tunnel = rc
+	}
+
+	var up, down io.Writer = &countWriter{&queueWriter{tunnel, session}, &statBytesUp}, &countWriter{p1, &statBytesDown}
+	if session.gate != nil {
+		up = &boostWriter{w: up, gate: session.gate}
+	}
+	up, down = &countWriter{up, &session.bytesUp}, &countWriter{down, &session.bytesDown}
+	up, down = &streamWriter{up, info, 'U'}, &streamWriter{down, info, 'D'}
+	if client != nil {
+		up, down = client.wrap(up, down)
+	}
+	if class != "" {
+		up, down = wrapClass(class, up, down)
+	}
+
+	// 重放本地读取的握手
+	if hs != nil {
+		if _, err := up.Write(append(hs.head, hs.early...)); err != nil {
+			closed(true, err)
+			return
+		}
+		if err := skipReply(p2, hs.swallow); err != nil {
+			connLog("Handshake replay error:", err)
+			closed(false, err)
+			return
+		}
+		if hs.replied && len(hs.head) > 0 {
+			// 客户端已收到本地应答，丢弃服务端的连接应答
+			p2.SetReadDeadline(clk.Now().Add(directDialTimeout))
+			err := readProxyReply(p2, hs)
+			p2.SetReadDeadline(time.Time{})
+			if err != nil {
+				connLog("Handshake replay error:", err)
+				closed(false, err)
+				return
+			}
+		}
+		if rc != nil {
+			rc.arm()
+		}
+	}
+
+	// 双向数据转发
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// p2 -> p1
+	go func() {
+		defer wg.Done()
+		_, err := relay(down, tunnel)
+		closed(false, err)
+		if tcpConn, ok := p1.(*net.TCPConn); ok {
+			tcpConn.CloseRead()
+		}
+	}()
+
+	// p1 -> p2
+	go func() {
+		defer wg.Done()
+		_, err := relay(up, p1)
+		closed(true, err)
+		tunnel.Close()
+	}()
+
+	wg.Wait()
+}
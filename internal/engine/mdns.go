@@ -0,0 +1,319 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mDNS/DNS-SD 广播本地代理，便于局域网设备 (热点模式) 自动发现
+
+const (
+	mdnsAddr     = "224.0.0.251:5353"
+	mdnsTTL      = 120 // 记录 TTL 秒数
+	mdnsMetaName = "_services._dns-sd._udp.local."
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+
+	dnsClassIN    = 1
+	dnsCacheFlush = 0x8000
+)
+
+// mdnsAdvertiser mDNS 广播器
+type mdnsAdvertiser struct {
+	conn     *net.UDPConn
+	group    *net.UDPAddr
+	service  string // 如 _socks._tcp.local.
+	instance string // 如 kcp-mobile._socks._tcp.local.
+	host     string // 如 kcp-mobile.local.
+	ip       net.IP
+	port     int
+	done     chan struct{}
+}
+
+var (
+	advMu      sync.Mutex
+	advertiser *mdnsAdvertiser
+)
+
+// SetAdvertise 运行时开启或关闭 mDNS 广播
+// 返回空字符串表示成功，否则返回错误信息
+func SetAdvertise(enable bool) string {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	if !enable {
+		stopAdvertise()
+		return ""
+	}
+	if !proxyRunning() {
+		return "Proxy not running"
+	}
+	if err := startAdvertise(proxyConfig, proxyListener.Addr()); err != nil {
+		return "Advertise Error: " + err.Error()
+	}
+	return ""
+}
+
+// startAdvertise 在监听地址所在的网卡上启动 mDNS 广播
+func startAdvertise(config *Config, addr net.Addr) error {
+	advMu.Lock()
+	defer advMu.Unlock()
+
+	if advertiser != nil {
+		return nil
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || tcpAddr.IP.IsLoopback() || tcpAddr.IP.IsUnspecified() || tcpAddr.IP.To4() == nil {
+		return errors.New("advertise requires a LAN IPv4 bind (hotspot or allowlan)")
+	}
+	iface, err := interfaceByIP(tcpAddr.IP)
+	if err != nil {
+		return err
+	}
+
+	group, _ := net.ResolveUDPAddr("udp4", mdnsAddr)
+	conn, err := net.ListenMulticastUDP("udp4", iface, group)
+	if err != nil {
+		return err
+	}
+
+	service := config.AdvertiseType + ".local."
+	a := &mdnsAdvertiser{
+		conn:     conn,
+		group:    group,
+		service:  service,
+		instance: config.AdvertiseName + "." + service,
+		host:     config.AdvertiseName + ".local.",
+		ip:       tcpAddr.IP.To4(),
+		port:     tcpAddr.Port,
+		done:     make(chan struct{}),
+	}
+	advertiser = a
+
+	go a.serve()
+	go a.announce()
+
+	log.Printf("mDNS advertising %s on %s", a.instance, iface.Name)
+	return nil
+}
+
+// stopAdvertise 发送 goodbye 报文并停止广播
+func stopAdvertise() {
+	advMu.Lock()
+	defer advMu.Unlock()
+
+	if advertiser == nil {
+		return
+	}
+	close(advertiser.done)
+	advertiser.conn.WriteToUDP(advertiser.response(0, false), advertiser.group)
+	advertiser.conn.Close()
+	advertiser = nil
+}
+
+// announce 启动时主动通告两次 (RFC 6762 8.3)
+func (a *mdnsAdvertiser) announce() {
+	for i := 0; i < 2; i++ {
+		a.conn.WriteToUDP(a.response(mdnsTTL, false), a.group)
+		select {
+		case <-a.done:
+			return
+		case <-clk.After(time.Second):
+		}
+	}
+}
+
+// serve 应答查询
+func (a *mdnsAdvertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		names, err := parseQuestions(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		match, meta := false, false
+		for _, name := range names {
+			switch strings.ToLower(name) {
+			case strings.ToLower(a.service), strings.ToLower(a.instance), strings.ToLower(a.host):
+				match = true
+			case mdnsMetaName:
+				match, meta = true, true
+			}
+		}
+		if match {
+			a.conn.WriteToUDP(a.response(mdnsTTL, meta), a.group)
+		}
+	}
+}
+
+// response 构造包含 PTR/SRV/TXT/A 记录的应答报文
+func (a *mdnsAdvertiser) response(ttl uint32, meta bool) []byte {
+	var records [][]byte
+	if meta {
+		records = append(records, dnsRecord(mdnsMetaName, dnsTypePTR, dnsClassIN, ttl, encodeName(a.service)))
+	}
+	records = append(records, dnsRecord(a.service, dnsTypePTR, dnsClassIN, ttl, encodeName(a.instance)))
+
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(a.port))
+	srv = append(srv, encodeName(a.host)...)
+	records = append(records, dnsRecord(a.instance, dnsTypeSRV, dnsClassIN|dnsCacheFlush, ttl, srv))
+
+	txt := "version=" + VERSION
+	records = append(records, dnsRecord(a.instance, dnsTypeTXT, dnsClassIN|dnsCacheFlush, ttl, append([]byte{byte(len(txt))}, txt...)))
+	records = append(records, dnsRecord(a.host, dnsTypeA, dnsClassIN|dnsCacheFlush, ttl, a.ip))
+
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // 应答 + 权威
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(records)))
+	for _, r := range records {
+		msg = append(msg, r...)
+	}
+	return msg
+}
+
+// dnsRecord 编码一条资源记录
+func dnsRecord(name string, rtype, class uint16, ttl uint32, rdata []byte) []byte {
+	b := encodeName(name)
+	hdr := make([]byte, 10)
+	binary.BigEndian.PutUint16(hdr[0:], rtype)
+	binary.BigEndian.PutUint16(hdr[2:], class)
+	binary.BigEndian.PutUint32(hdr[4:], ttl)
+	binary.BigEndian.PutUint16(hdr[8:], uint16(len(rdata)))
+	b = append(b, hdr...)
+	return append(b, rdata...)
+}
+
+// encodeName 将域名编码为 DNS 标签序列
+func encodeName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// parseQuestions 解析查询报文中的问题域名，忽略应答报文
+func parseQuestions(msg []byte) ([]string, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("short message")
+	}
+	if msg[2]&0x80 != 0 {
+		return nil, errors.New("not a query")
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+
+	names := make([]string, 0, qdcount)
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := decodeName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, errors.New("short question")
+		}
+		names = append(names, name)
+		off = next + 4 // QTYPE + QCLASS
+	}
+	return names, nil
+}
+
+// decodeName 解码 off 处的域名 (支持压缩指针)，返回域名和之后的偏移
+func decodeName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("name out of range")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("bad pointer")
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("pointer loop")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("label out of range")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// interfaceByIP 查找拥有指定 IP 的网卡
+func interfaceByIP(ip net.IP) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface with address %s", ip)
+}
@@ -0,0 +1,208 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 持久化统计: 累计流量和会话质量汇总保存到 App 指定的文件 (metricsfile)，
+// 启动时加载、停止时保存，运行期间定期保存以应对进程被杀
+
+const (
+	metricsSaveInterval = time.Minute
+	rttSampleInterval   = 30 * time.Second
+)
+
+var (
+	statSessionsCreated uint64 // 累计建立的会话数
+	statReconnects      uint64 // 累计重连次数
+	statRTTSum          uint64 // RTT 采样总和 (毫秒)
+	statRTTSamples      uint64 // RTT 采样次数
+
+	metricsMu    sync.Mutex
+	metricsSince = clk.Now().Unix() // 统计起始时间 (Unix 秒)
+)
+
+// persistedMetrics 持久化文件格式
+type persistedMetrics struct {
+	Since           int64  `json:"since"`
+	BytesUp         uint64 `json:"bytesup"`
+	BytesDown       uint64 `json:"bytesdown"`
+	TotalConns      uint64 `json:"totalconns"`
+	SessionsCreated uint64 `json:"sessionscreated"`
+	Reconnects      uint64 `json:"reconnects"`
+	RTTSum          uint64 `json:"rttsum"`
+	RTTSamples      uint64 `json:"rttsamples"`
+}
+
+// cumulativeCounters 持久化的累计计数器
+var cumulativeCounters = []struct {
+	ptr *uint64
+	get func(m *persistedMetrics) *uint64
+}{
+	{&statBytesUp, func(m *persistedMetrics) *uint64 { return &m.BytesUp }},
+	{&statBytesDown, func(m *persistedMetrics) *uint64 { return &m.BytesDown }},
+	{&statTotalConns, func(m *persistedMetrics) *uint64 { return &m.TotalConns }},
+	{&statSessionsCreated, func(m *persistedMetrics) *uint64 { return &m.SessionsCreated }},
+	{&statReconnects, func(m *persistedMetrics) *uint64 { return &m.Reconnects }},
+	{&statRTTSum, func(m *persistedMetrics) *uint64 { return &m.RTTSum }},
+	{&statRTTSamples, func(m *persistedMetrics) *uint64 { return &m.RTTSamples }},
+}
+
+// ResetCounters 清零累计统计 (包括持久化文件中的数据)
+func ResetCounters() {
+	for _, c := range cumulativeCounters {
+		atomic.StoreUint64(c.ptr, 0)
+	}
+	resetSLO()
+	resetOutbounds()
+	resetStalls()
+	resetWriteErrors()
+	resetWarm()
+	resetBatch()
+	resetComp()
+	resetTags()
+	resetICMP()
+	resetDNS()
+	memMetrics.reset()
+	metricsMu.Lock()
+	metricsSince = clk.Now().Unix()
+	metricsMu.Unlock()
+
+	proxyMu.Lock()
+	config := proxyConfig
+	proxyMu.Unlock()
+	if config != nil && config.MetricsFile != "" {
+		saveMetrics(config.MetricsFile)
+	}
+}
+
+// loadMetrics 从文件恢复累计统计，文件不存在时从零开始
+func loadMetrics(path string) {
+	var m persistedMetrics
+	b, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(b, &m)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logError("Load metrics:", err)
+	}
+	if m.Since == 0 {
+		m.Since = clk.Now().Unix()
+	}
+
+	for _, c := range cumulativeCounters {
+		atomic.StoreUint64(c.ptr, *c.get(&m))
+	}
+	metricsMu.Lock()
+	metricsSince = m.Since
+	metricsMu.Unlock()
+}
+
+// saveMetrics 将累计统计写入文件 (先写临时文件再重命名，避免写到一半被杀)
+func saveMetrics(path string) {
+	var m persistedMetrics
+	for _, c := range cumulativeCounters {
+		*c.get(&m) = atomic.LoadUint64(c.ptr)
+	}
+	metricsMu.Lock()
+	m.Since = metricsSince
+	metricsMu.Unlock()
+
+	b, _ := json.Marshal(&m)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		logError("Save metrics:", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		logError("Save metrics:", err)
+	}
+}
+
+// metricsLoop 定期采样 RTT 并保存统计
+func metricsLoop(config *Config, stop chan struct{}) {
+	sample := clk.NewTicker(rttSampleInterval)
+	defer sample.Stop()
+	save := clk.NewTicker(metricsSaveInterval)
+	defer save.Stop()
+	wire := clk.NewTicker(wireSampleInterval)
+	defer wire.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sample.Chan():
+			sampleRTT()
+			sampleGauges()
+		case <-wire.Chan():
+			sampleWire()
+			sampleRates()
+			sampleQuality()
+			sampleBloat(config)
+			sampleBalance()
+			samplePacing(config)
+			sampleClasses(config)
+			sampleServerRate(config)
+			sampleBDP()
+			sampleFEC(config)
+			sampleFECDirs(config)
+			sampleProfile(config)
+		case <-save.Chan():
+			if config.MetricsFile != "" {
+				saveMetrics(config.MetricsFile)
+			}
+		}
+	}
+}
+
+// sampleRTT 对所有存活会话的平滑 RTT 采样
+func sampleRTT() {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	for _, s := range proxySessions {
+		if s.alive() {
+			if rtt := s.srtt(); rtt > 0 {
+				atomic.AddUint64(&statRTTSum, uint64(rtt))
+				atomic.AddUint64(&statRTTSamples, 1)
+			}
+		}
+	}
+}
+
+// avgRTT 历史平均 RTT (毫秒)
+func avgRTT() uint64 {
+	if n := atomic.LoadUint64(&statRTTSamples); n > 0 {
+		return atomic.LoadUint64(&statRTTSum) / n
+	}
+	return 0
+}
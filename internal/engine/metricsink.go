@@ -0,0 +1,213 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// 统一指标: 各子系统通过 metricCount/metricGauge/metricObserve 记录指标，
+// 同时写入内置的内存后端 (GetStats 的 metrics 字段、控制端点 /metrics 的 Prometheus 文本，见 prometheus.go)
+// 和 App 通过 SetMetricsSink 设置的回调后端。
+// 热路径上的字节数等高频计数仍使用原子计数器，由 metricsLoop 周期性作为 gauge 上报
+
+// MetricsSink 指标后端接口 (可由 App 实现)
+// labels 为逗号分隔的 key=value (如 "reason=timeout")，没有标签时为空
+type MetricsSink interface {
+	Counter(name string, labels string, delta int64)
+	Gauge(name string, labels string, value float64)
+	Histogram(name string, labels string, value float64)
+}
+
+// 直方图桶上限 (毫秒)
+var histogramBuckets = [...]float64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+type histogram struct {
+	buckets [len(histogramBuckets)]uint64
+	count   uint64
+	sum     float64
+}
+
+// memorySink 内置的内存后端
+type memorySink struct {
+	mu         sync.Mutex
+	counters   map[string]int64
+	gauges     map[string]float64
+	histograms map[string]*histogram
+}
+
+func newMemorySink() *memorySink {
+	return &memorySink{
+		counters:   make(map[string]int64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// metricKey 指标名和标签组成的键
+func metricKey(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func (m *memorySink) Counter(name, labels string, delta int64) {
+	m.mu.Lock()
+	m.counters[metricKey(name, labels)] += delta
+	m.mu.Unlock()
+}
+
+func (m *memorySink) Gauge(name, labels string, value float64) {
+	m.mu.Lock()
+	m.gauges[metricKey(name, labels)] = value
+	m.mu.Unlock()
+}
+
+func (m *memorySink) Histogram(name, labels string, value float64) {
+	m.mu.Lock()
+	key := metricKey(name, labels)
+	h := m.histograms[key]
+	if h == nil {
+		h = &histogram{}
+		m.histograms[key] = h
+	}
+	for i, le := range histogramBuckets {
+		if value <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+	m.mu.Unlock()
+}
+
+// reset 清空所有指标
+func (m *memorySink) reset() {
+	m.mu.Lock()
+	m.counters = make(map[string]int64)
+	m.gauges = make(map[string]float64)
+	m.histograms = make(map[string]*histogram)
+	m.mu.Unlock()
+}
+
+// histogramSummary 直方图摘要 (用于 JSON 统计)
+type histogramSummary struct {
+	Count uint64  `json:"count"`
+	Avg   float64 `json:"avg"`
+}
+
+// metricsSnapshot GetStats 中的指标
+type metricsSnapshot struct {
+	Counters   map[string]int64            `json:"counters"`
+	Gauges     map[string]float64          `json:"gauges"`
+	Histograms map[string]histogramSummary `json:"histograms"`
+}
+
+func (m *memorySink) snapshot() metricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := metricsSnapshot{
+		Counters:   make(map[string]int64, len(m.counters)),
+		Gauges:     make(map[string]float64, len(m.gauges)),
+		Histograms: make(map[string]histogramSummary, len(m.histograms)),
+	}
+	for k, v := range m.counters {
+		s.Counters[k] = v
+	}
+	for k, v := range m.gauges {
+		s.Gauges[k] = v
+	}
+	for k, h := range m.histograms {
+		s.Histograms[k] = histogramSummary{Count: h.count, Avg: h.sum / float64(h.count)}
+	}
+	return s
+}
+
+var (
+	memMetrics = newMemorySink()
+
+	appSinkMu sync.RWMutex
+	appSink   MetricsSink
+)
+
+// SetMetricsSink 设置 App 的指标回调后端，传入 nil 取消
+// 回调在记录指标的 goroutine 中同步调用，实现应当快速返回
+func SetMetricsSink(s MetricsSink) {
+	appSinkMu.Lock()
+	appSink = s
+	appSinkMu.Unlock()
+}
+
+func currentAppSink() MetricsSink {
+	appSinkMu.RLock()
+	defer appSinkMu.RUnlock()
+	return appSink
+}
+
+// metricCount 计数器增加 delta
+func metricCount(name, labels string, delta int64) {
+	memMetrics.Counter(name, labels, delta)
+	if s := currentAppSink(); s != nil {
+		s.Counter(name, labels, delta)
+	}
+}
+
+// metricGauge 设置 gauge
+func metricGauge(name, labels string, value float64) {
+	memMetrics.Gauge(name, labels, value)
+	if s := currentAppSink(); s != nil {
+		s.Gauge(name, labels, value)
+	}
+}
+
+// metricObserve 记录一个直方图样本 (毫秒)
+func metricObserve(name, labels string, value float64) {
+	memMetrics.Histogram(name, labels, value)
+	if s := currentAppSink(); s != nil {
+		s.Histogram(name, labels, value)
+	}
+}
+
+// sampleGauges 周期性上报高频计数和状态
+func sampleGauges() {
+	metricGauge("kcp_active_conns", "", float64(atomic.LoadInt64(&statActiveConns)))
+	metricGauge("kcp_bytes_up", "", float64(atomic.LoadUint64(&statBytesUp)))
+	metricGauge("kcp_bytes_down", "", float64(atomic.LoadUint64(&statBytesDown)))
+
+	proxyMu.Lock()
+	alive := 0
+	for i, s := range proxySessions {
+		if s.alive() {
+			alive++
+			metricGauge("kcp_session_srtt_ms", fmt.Sprintf("session=%d", i), float64(s.srtt()))
+		}
+	}
+	proxyMu.Unlock()
+	metricGauge("kcp_sessions_alive", "", float64(alive))
+}
@@ -0,0 +1,322 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// 运行中迁移: UpdateConfig 先用新配置 (如切换到新的 remoteaddr) 在锁外并发建立会话池
+// (与启动相同，minready 个建立成功即可切换，其余建立完成后放入新实例的槽位)，
+// 再复制监听 socket 并以新配置重启后台任务；旧会话不再接收新连接，
+// 现有连接在 scavengettl 内继续完成后关闭 (先建后拆)，不需要 StopProxy/StartProxy 中断传输
+//
+// 更新分阶段进行，每个阶段发送 "config-update" 事件 (phase 字段):
+//   - validated: 新配置通过校验
+//   - staged: 新会话池已在 updatetimeout 内建好 (超时或失败时发送 failed，继续使用旧配置)
+//   - applied: 已切换到新配置
+//   - rolled-back: 切换失败，已用旧配置和旧会话恢复运行
+//   - failed: 更新失败 (error 字段给出原因)，rollback 字段表示是否仍在以旧配置运行
+
+// UpdateConfig 预先建立的会话及建立时使用的停止通道，由 startLocked 接管 (由 proxyMu 保护)
+// 新实例沿用该通道，minready 之后才建立完成的会话据此放入新实例的槽位
+var (
+	prebuiltSessions []*poolSession
+	prebuiltStop     chan struct{}
+)
+
+// takePrebuiltSessions 取出预先建立的会话和停止通道 (调用方持有 proxyMu)
+func takePrebuiltSessions() ([]*poolSession, chan struct{}) {
+	s, stop := prebuiltSessions, prebuiltStop
+	prebuiltSessions, prebuiltStop = nil, nil
+	return s, stop
+}
+
+// UpdateConfig 以新配置替换运行中的实例，不中断现有连接
+// 先用新配置建好会话池再切换，旧会话上的现有连接在 scavengettl 内继续完成；
+// 建立新会话失败时继续使用旧配置；localaddr 或 hotspot 变化时在新地址重新监听，
+// 旧地址上已接受的连接不受影响
+// 返回空字符串表示成功，否则返回错误信息
+func UpdateConfig(configJson string) string {
+	config, err := parseConfig(configJson)
+	if err != nil {
+		updatePhase("failed", map[string]interface{}{"error": err.Error(), "running": IsRunning()})
+		return err.Error()
+	}
+
+	proxyMu.Lock()
+	if !proxyRunning() {
+		proxyMu.Unlock()
+		return "Proxy not running"
+	}
+	stop, from := stopChan, proxyConfig.RemoteAddr
+	proxyMu.Unlock()
+	updatePhase("validated", map[string]interface{}{"remoteaddr": config.RemoteAddr})
+
+	// 服务端建议、MTU 钳制和 IP 黑名单属于旧服务器
+	if config.RemoteAddr != from {
+		resetHints()
+		resetMTUClamp()
+		resetBlacklist()
+	}
+
+	// 锁外建立新会话池，期间旧会话继续服务
+	deriveSecrets(config)
+	sessions, staged, err := stageSessions(config, time.Duration(config.UpdateTimeout)*time.Second)
+	if err != nil {
+		wipeSecrets(config)
+		updatePhase("failed", map[string]interface{}{"error": err.Error(), "running": true})
+		return err.Error()
+	}
+	updatePhase("staged", map[string]interface{}{"sessions": aliveCount(sessions)})
+	discard := func() {
+		closeStaged(sessions, staged)
+		wipeSecrets(config)
+	}
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	if !proxyRunning() || stopChan != stop {
+		discard()
+		return "Proxy restarted during update"
+	}
+	old, draining, err := swapLocked(config, sessions, staged)
+	if err != nil {
+		wipeSecrets(config)
+		rerr := err.(*restartError)
+		switch {
+		case rerr.listen:
+			updatePhase("failed", map[string]interface{}{"error": err.Error(), "running": true})
+			return "Listen Error: " + err.Error()
+		case rerr.rollback != nil:
+			logError("Config update failed, rollback failed, proxy stopped:", rerr.rollback)
+			updatePhase("failed", map[string]interface{}{"error": err.Error(), "rollback": rerr.rollback.Error(), "running": false})
+			return err.Error()
+		}
+		logError("Config update failed, rolled back:", err)
+		updatePhase("rolled-back", map[string]interface{}{"error": err.Error(), "remoteaddr": old.RemoteAddr})
+		return err.Error()
+	}
+	go drainDetached(draining, old, time.Duration(config.ScavengeTTL)*time.Second, stopChan)
+	updatePhase("applied", map[string]interface{}{"remoteaddr": config.RemoteAddr})
+	log.Printf("Config updated, migrated %s -> %s (%d sessions draining)", from, config.RemoteAddr, len(draining))
+	emitEvent("migrated", map[string]interface{}{
+		"from":       from,
+		"remoteaddr": config.RemoteAddr,
+		"draining":   len(draining),
+	})
+	return ""
+}
+
+// restartError swapLocked 失败: listen 表示复制监听失败 (实例未受影响)，
+// 否则已尝试用旧配置和旧会话恢复，rollback 为恢复失败的原因 (nil 表示已恢复运行)
+type restartError struct {
+	err      error
+	listen   bool
+	rollback error
+}
+
+func (e *restartError) Error() string { return e.err.Error() }
+
+// swapLocked 以 config 和预建的会话 (staged 为建立时的停止通道) 重启运行中的实例 (调用方需持有 proxyMu)
+// 主监听地址未变时沿用当前监听，否则在新地址重新绑定；附加监听总是按新配置重新打开
+// 成功时返回旧配置和旧实例的会话，由调用方排空或关闭；失败时返回 *restartError，预建的会话已关闭
+func swapLocked(config *Config, sessions []*poolSession, staged chan struct{}) (*Config, []*poolSession, error) {
+	var listener net.Listener
+	if !listenChanged(proxyConfig, config) {
+		var err error
+		if listener, err = dupListener(proxyListener); err != nil {
+			closeStaged(sessions, staged)
+			return nil, nil, &restartError{err: err, listen: true}
+		}
+	}
+	// 再复制一份监听，启动失败时用于以旧配置恢复
+	spare, err := dupListener(proxyListener)
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		closeStaged(sessions, staged)
+		return nil, nil, &restartError{err: err, listen: true}
+	}
+
+	old := proxyConfig
+	draining := detachLocked()
+	handoffMu.Lock()
+	importListener = listener
+	handoffMu.Unlock()
+	prebuiltSessions, prebuiltStop = sessions, staged
+
+	err = startLocked(config)
+
+	// 启动失败时 startLocked 已关闭接管的监听和会话，这里只清理未被接管的部分
+	handoffMu.Lock()
+	if importListener != nil {
+		importListener.Close()
+		importListener = nil
+	}
+	handoffMu.Unlock()
+	if rest, stop := takePrebuiltSessions(); stop != nil {
+		closeStaged(rest, stop)
+	}
+
+	if err != nil {
+		return old, nil, &restartError{err: err, rollback: rollbackLocked(old, draining, spare)}
+	}
+	spare.Close()
+	return old, draining, nil
+}
+
+// listenChanged 主监听地址是否变化 (需要重新绑定)
+func listenChanged(old, config *Config) bool {
+	return old.LocalAddr != config.LocalAddr || old.Hotspot != config.Hotspot
+}
+
+// updatePhase 发送配置更新的阶段事件
+func updatePhase(phase string, data map[string]interface{}) {
+	data["phase"] = phase
+	emitEvent("config-update", data)
+}
+
+// stageSessions 在 timeout 内并发建立新会话池 (与启动相同，minready 个建立成功即返回)，
+// 返回会话和建立时使用的停止通道；超时后晚到的会话被关闭
+func stageSessions(config *Config, timeout time.Duration) ([]*poolSession, chan struct{}, error) {
+	if err := loadCompDict(config); err != nil {
+		return nil, nil, fmt.Errorf("Comp Error: %v", err)
+	}
+	type result struct {
+		sessions []*poolSession
+		err      error
+	}
+	stop := make(chan struct{})
+	done := make(chan result, 1)
+	go func() {
+		sessions, err := dialSessions(config, stop)
+		done <- result{sessions, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			close(stop)
+			return nil, nil, fmt.Errorf("Session Error: %v", r.err)
+		}
+		return r.sessions, stop, nil
+	case <-clk.After(timeout):
+		go func() { closeStaged((<-done).sessions, stop) }()
+		return nil, nil, fmt.Errorf("Session Error: new sessions not established within %s", timeout)
+	}
+}
+
+// closeStaged 关闭未被新实例接管的预建会话，之后才建立完成的会话随 stop 关闭
+func closeStaged(sessions []*poolSession, stop chan struct{}) {
+	close(stop)
+	for _, s := range sessions {
+		if s != nil {
+			s.Close()
+		}
+	}
+}
+
+// aliveCount 返回存活的会话数
+func aliveCount(sessions []*poolSession) int {
+	n := 0
+	for _, s := range sessions {
+		if s.alive() {
+			n++
+		}
+	}
+	return n
+}
+
+// rollbackLocked 新配置启动失败时，用旧配置、旧会话和备用监听恢复运行 (调用方需持有 proxyMu)
+func rollbackLocked(old *Config, sessions []*poolSession, listener net.Listener) error {
+	alive := make([]*poolSession, len(sessions))
+	for i, s := range sessions {
+		if s.alive() {
+			alive[i] = s
+		}
+	}
+	handoffMu.Lock()
+	importListener = listener
+	handoffMu.Unlock()
+	prebuiltSessions = alive
+
+	err := startLocked(old)
+
+	handoffMu.Lock()
+	if importListener != nil {
+		importListener.Close()
+		importListener = nil
+	}
+	handoffMu.Unlock()
+	takePrebuiltSessions()
+	if err != nil {
+		// startLocked 失败时已关闭接管的会话，这里关闭其余部分并清零旧配置的密钥
+		for _, s := range sessions {
+			if s != nil {
+				s.Close()
+			}
+		}
+		wipeSecrets(old)
+	}
+	return err
+}
+
+// dupListener 复制监听 socket，关闭原监听后旧的 accept 循环退出而副本继续接受连接
+func dupListener(l net.Listener) (net.Listener, error) {
+	tl, ok := primaryListener(l).(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("listener cannot be migrated")
+	}
+	f, err := tl.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// drainDetached 等待旧会话上的连接结束 (或超时、新实例停止) 后关闭，最后清零旧配置的密钥
+func drainDetached(sessions []*poolSession, old *Config, timeout time.Duration, stop chan struct{}) {
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		if s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *poolSession) {
+			defer wg.Done()
+			drainAndClose(s, timeout, stop)
+		}(s)
+	}
+	wg.Wait()
+	wipeSecrets(old)
+}
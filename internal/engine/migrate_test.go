@@ -0,0 +1,138 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestUpdateConfigMigrates 运行中切换到新服务端: 新会话池并发建立，minready 个成功即切换，
+// 其余会话建立完成后放入新实例的槽位
+func TestUpdateConfigMigrates(t *testing.T) {
+	if isolated(t) {
+		return
+	}
+	localAddr := freeLocalAddr(t)
+	if err := StartProxy(tunnelConfig(t, localAddr, map[string]interface{}{"conn": 2})); err != "" {
+		t.Fatal(err)
+	}
+	t.Cleanup(StopProxy)
+
+	update := tunnelConfig(t, localAddr, map[string]interface{}{"conn": 3, "minready": 1})
+	if err := UpdateConfig(update); err != "" {
+		t.Fatal(err)
+	}
+	proxyMu.Lock()
+	remote := proxyConfig.RemoteAddr
+	proxyMu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		proxyMu.Lock()
+		alive := 0
+		for _, s := range proxySessions {
+			if s.alive() && s.link.RemoteAddr().String() == remote {
+				alive++
+			}
+		}
+		total := len(proxySessions)
+		proxyMu.Unlock()
+		if total == 3 && alive == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d/%d sessions to %s after update", alive, total, remote)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read through migrated tunnel: %v", err)
+	}
+}
+
+// TestUpdateConfigFailureKeepsRunning 新会话池建立失败时继续以旧配置运行
+func TestUpdateConfigFailureKeepsRunning(t *testing.T) {
+	if isolated(t) {
+		return
+	}
+	localAddr := freeLocalAddr(t)
+	config := tunnelConfig(t, localAddr, nil)
+	if err := StartProxy(config); err != "" {
+		t.Fatal(err)
+	}
+	t.Cleanup(StopProxy)
+
+	// 服务端不可达 (端口已关闭)
+	update := tunnelConfig(t, localAddr, map[string]interface{}{"remoteaddr": freeLocalAddr(t)})
+	if err := UpdateConfig(update); err == "" {
+		t.Fatal("update to an unreachable server succeeded")
+	}
+	if state := GetState(); state != stateReady {
+		t.Fatalf("state %q after failed update", state)
+	}
+}
+
+// TestUpdateConfigRebinds localaddr 变化时在新的主监听和附加监听地址上接受连接，旧地址停止监听
+func TestUpdateConfigRebinds(t *testing.T) {
+	if isolated(t) {
+		return
+	}
+	srv := newTestTunnel(t)
+	oldAddr := freeLocalAddr(t)
+	if err := StartProxy(srv.config(oldAddr, nil)); err != "" {
+		t.Fatal(err)
+	}
+	t.Cleanup(StopProxy)
+
+	newAddr, extraAddr := freeLocalAddr(t), freeLocalAddr(t)
+	update := srv.config("", map[string]interface{}{"localaddr": []string{newAddr, extraAddr}})
+	if err := UpdateConfig(update); err != "" {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{newAddr, extraAddr} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial %s after update: %v", addr, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		if err != io.EOF {
+			t.Fatalf("read through %s: %v", addr, err)
+		}
+	}
+	if conn, err := net.Dial("tcp", oldAddr); err == nil {
+		conn.Close()
+		t.Fatalf("%s still listening after update", oldAddr)
+	}
+}
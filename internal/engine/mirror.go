@@ -0,0 +1,145 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 流量镜像 (调试用): 将指定连接的双向数据复制到文件或 TCP 套接字
+// 每个数据块的格式: 方向 (1 字节, 'U'/'D') + 时间戳 (8 字节, UnixNano) + 长度 (4 字节) + 数据
+
+const maxMirrorDuration = 10 * time.Minute
+
+// streamMirror 镜像输出
+type streamMirror struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	timer  clockTimer
+	closed bool
+}
+
+// MirrorStream 将 GetActiveStreams 中指定 id 的连接镜像 durationMs 毫秒
+// target: "file:/path/to/file" 或 "tcp:host:port"
+// 仅在配置开启 debug 时可用; 返回空字符串表示成功，否则返回错误信息
+func MirrorStream(id int64, target string, durationMs int) string {
+	proxyMu.Lock()
+	debug := proxyRunning() && proxyConfig.Debug
+	proxyMu.Unlock()
+	if !debug {
+		return "Mirror requires debug mode"
+	}
+
+	streamsMu.Lock()
+	s, ok := activeStreams[uint64(id)]
+	streamsMu.Unlock()
+	if !ok {
+		return fmt.Sprintf("Stream not found: %d", id)
+	}
+
+	duration := time.Duration(durationMs) * time.Millisecond
+	if duration <= 0 || duration > maxMirrorDuration {
+		duration = maxMirrorDuration
+	}
+
+	w, err := openMirrorTarget(target)
+	if err != nil {
+		return "Mirror Error: " + err.Error()
+	}
+
+	m := &streamMirror{w: w}
+	m.mu.Lock()
+	m.timer = clk.AfterFunc(duration, func() {
+		s.mu.Lock()
+		if s.mirror == m {
+			s.mirror = nil
+		}
+		s.mu.Unlock()
+		m.close()
+	})
+	m.mu.Unlock()
+	s.setMirror(m)
+
+	log.Printf("Mirroring stream %d to %s for %v", id, target, duration)
+	return ""
+}
+
+// openMirrorTarget 打开镜像目标
+func openMirrorTarget(target string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasPrefix(target, "file:"):
+		return os.OpenFile(strings.TrimPrefix(target, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	case strings.HasPrefix(target, "tcp:"):
+		return net.DialTimeout("tcp", strings.TrimPrefix(target, "tcp:"), 5*time.Second)
+	}
+	return nil, fmt.Errorf("unsupported target: %s", target)
+}
+
+// write 写入一个镜像数据块，出错后自动关闭镜像
+func (m *streamMirror) write(dir byte, p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	var hdr [13]byte
+	hdr[0] = dir
+	binary.BigEndian.PutUint64(hdr[1:], uint64(clk.Now().UnixNano()))
+	binary.BigEndian.PutUint32(hdr[9:], uint32(len(p)))
+	if _, err := m.w.Write(hdr[:]); err == nil {
+		_, err = m.w.Write(p)
+		if err == nil {
+			return
+		}
+	}
+
+	logError("Mirror write error, stopped")
+	m.closed = true
+	m.timer.Stop()
+	m.w.Close()
+}
+
+// close 关闭镜像输出
+func (m *streamMirror) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+	m.closed = true
+	m.timer.Stop()
+	m.w.Close()
+}
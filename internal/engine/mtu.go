@@ -0,0 +1,148 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// MTU 黑洞检测: 不少运营商 NAT 静默丢弃分片或超过路径 MTU 的报文，表现为握手 (小包) 正常、
+// 批量传输时满 MTU 的报文反复重传而停滞。开启 mtuclamp 后周期性比较 KCP 的重传计数，
+// 对端仍有回包 (ACK/心跳) 且 RTT 正常、但重传率持续过高时，逐级降低 MTU 并发送 "mtu-clamp" 事件
+
+const (
+	mtuCheckInterval = 5 * time.Second
+	mtuSuspectRounds = 3   // 连续可疑的检测周期数
+	mtuMinSegs       = 32  // 周期内发送的段数不足时不判断
+	mtuRetransRatio  = 0.5 // 重传段数 / 发送段数
+)
+
+// 逐级降低的 MTU
+var mtuSteps = []int{1200, 1000, 800, 576}
+
+var clampedMTU int32 // 降低后的 MTU，0 表示未降低
+
+// currentMTU 当前应使用的 MTU
+func currentMTU(config *Config) int {
+	if mtu := atomic.LoadInt32(&clampedMTU); mtu > 0 {
+		return int(mtu)
+	}
+	return config.MTU
+}
+
+// resetMTUClamp 清除降低的 MTU (代理启动时)
+func resetMTUClamp() {
+	atomic.StoreInt32(&clampedMTU, 0)
+}
+
+// nextMTU 返回低于 mtu 的下一级，已是最低时返回 0
+func nextMTU(mtu int) int {
+	for _, step := range mtuSteps {
+		if step < mtu {
+			return step
+		}
+	}
+	return 0
+}
+
+// mtuLoop 黑洞检测循环
+func mtuLoop(config *Config, stop chan struct{}) {
+	ticker := clk.NewTicker(mtuCheckInterval)
+	defer ticker.Stop()
+
+	last := kcp.DefaultSnmp.Copy()
+	suspect := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.Chan():
+		}
+
+		snmp := kcp.DefaultSnmp.Copy()
+		out := snmp.OutSegs - last.OutSegs
+		retrans := snmp.RetransSegs - last.RetransSegs
+		in := snmp.InSegs - last.InSegs
+		last = snmp
+
+		if out < mtuMinSegs || in == 0 || !sessionsResponsive() {
+			suspect = 0
+			continue
+		}
+		ratio := float64(retrans) / float64(out)
+		if ratio < mtuRetransRatio {
+			suspect = 0
+			continue
+		}
+		if suspect++; suspect < mtuSuspectRounds {
+			continue
+		}
+		suspect = 0
+
+		from := currentMTU(config)
+		to := nextMTU(from)
+		if to == 0 {
+			continue
+		}
+		clampMTU(to)
+		log.Printf("MTU blackhole suspected (retrans %.0f%% with responsive peer), clamping MTU %d -> %d", ratio*100, from, to)
+		emitEvent("mtu-clamp", map[string]interface{}{
+			"from":    from,
+			"to":      to,
+			"retrans": ratio,
+			"reason":  "large packets retransmitted while small packets get through; likely path MTU blackhole",
+		})
+	}
+}
+
+// sessionsResponsive 是否存在 RTT 正常的 KCP 会话 (小包能往返)
+func sessionsResponsive() bool {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	for _, s := range proxySessions {
+		if s.alive() && s.conn != nil && time.Duration(s.srtt())*time.Millisecond < degradedRTT {
+			return true
+		}
+	}
+	return false
+}
+
+// clampMTU 降低 MTU，作用于现有会话和之后新建的会话
+func clampMTU(mtu int) {
+	atomic.StoreInt32(&clampedMTU, int32(mtu))
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	for _, s := range proxySessions {
+		if s.alive() && s.conn != nil {
+			s.conn.SetMtu(mtu)
+		}
+	}
+}
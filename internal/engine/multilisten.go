@@ -0,0 +1,175 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// 多地址监听: localaddr 可以写成数组，同一个实例同时在多个地址上接受连接并共用会话池，
+// 例如 ["127.0.0.1:1080", "unix:/data/local/tmp/kcp.sock"]
+//   - 第一个地址是主监听 (必须是 host:port)，热点模式、引擎交接和热更新都只作用于它
+//   - 其余地址为附加监听，可以是 host:port 或 "unix:" 加 socket 路径
+//   - 附加监听随引擎启停；热更新时先关闭旧实例的附加监听再重新绑定
+//   - Unix socket 启动时若路径上残留旧的 socket 文件会先删除，关闭时不删除 (交接后新实例可能已在使用)
+
+// listenExtra 打开全部附加监听，与主监听合并 (没有附加地址时原样返回主监听)
+func listenExtra(config *Config, primary net.Listener) (net.Listener, error) {
+	if len(config.listenExtra) == 0 {
+		return primary, nil
+	}
+	all := []net.Listener{primary}
+	for _, addr := range config.listenExtra {
+		l, err := listenAny(addr)
+		if err != nil {
+			for _, opened := range all[1:] {
+				opened.Close()
+			}
+			return nil, err
+		}
+		log.Printf("Also listening on %s", addr)
+		all = append(all, l)
+	}
+	return newMultiListener(all), nil
+}
+
+// listenAny 按地址形式监听 TCP 或 Unix socket
+func listenAny(addr string) (net.Listener, error) {
+	path, ok := unixListenPath(addr)
+	if !ok {
+		return listenLocal(addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+	return &unixListener{UnixListener: ul, path: path}, nil
+}
+
+// unixListener 为匿名的 Unix 客户端补上远端地址，日志和访问记录里可以区分来源
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.UnixListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &unixConn{Conn: conn, remote: &net.UnixAddr{Name: l.path, Net: "unix"}}, nil
+}
+
+// unixConn 远端地址固定为监听路径的 Unix 连接
+type unixConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr { return c.remote }
+
+// multiListener 把多个监听合并为一个，Addr 返回主监听地址
+type multiListener struct {
+	all     []net.Listener
+	accepts chan acceptResult
+	done    chan struct{}
+	once    sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(all []net.Listener) *multiListener {
+	m := &multiListener{
+		all:     all,
+		accepts: make(chan acceptResult),
+		done:    make(chan struct{}),
+	}
+	for _, l := range all {
+		go m.serve(l)
+	}
+	return m
+}
+
+// serve 在单个监听上循环接受连接并转交给 Accept
+func (m *multiListener) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil && errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case m.accepts <- acceptResult{conn, err}:
+		case <-m.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.accepts:
+		return r.conn, r.err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		for _, l := range m.all {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr { return m.all[0].Addr() }
+
+// primaryListener 返回主监听 (交接和热更新只复制它)
+func primaryListener(l net.Listener) net.Listener {
+	if m, ok := l.(*multiListener); ok {
+		return m.all[0]
+	}
+	return l
+}
@@ -0,0 +1,154 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// 命名流: App 通过 OpenNamedStream 在现有会话上打开自己的流 (如推送通道)，与代理流量复用同一隧道。
+// 需要服务端识别 namedPreamble 并按名称把流交给对应的服务
+//
+// 流格式: namedPreamble + 名称 + "\n"，之后为 App 数据
+
+const (
+	namedPreamble = "KCPM-NAMED/1\n"
+
+	namedReadChunk = 32 << 10
+	namedMaxWait   = 5 * time.Minute // Read 的最长等待
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// Stream App 打开的命名流
+type Stream struct {
+	name   string
+	stream *smux.Stream
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// OpenNamedStream 在一个存活的会话上打开名为 name 的流 (名称为 1-32 个字母、数字、'_'、'.'、'-')
+// 未运行、名称无效或打开失败时返回 nil。流随会话断开而关闭，之后需重新打开
+func OpenNamedStream(name string) *Stream {
+	if !labelPattern.MatchString(name) {
+		logErrorf("Named stream: invalid name %q", name)
+		return nil
+	}
+	session := pickAliveSession()
+	if session == nil {
+		logErrorf("Named stream %s: no alive session", name)
+		return nil
+	}
+	st, err := session.OpenStream()
+	if err != nil {
+		logErrorf("Named stream %s: %v", name, err)
+		return nil
+	}
+	st.SetWriteDeadline(clk.Now().Add(directDialTimeout))
+	if _, err := st.Write([]byte(namedPreamble + name + "\n")); err != nil {
+		st.Close()
+		logErrorf("Named stream %s: %v", name, err)
+		return nil
+	}
+	st.SetWriteDeadline(time.Time{})
+	log.Printf("Named stream %s opened (sid %d)", name, st.ID())
+	return &Stream{name: name, stream: st}
+}
+
+// ID SMUX 流 ID (仅在所属会话内唯一)
+func (s *Stream) ID() int64 {
+	return int64(s.stream.ID())
+}
+
+// Name 流名称
+func (s *Stream) Name() string {
+	return s.name
+}
+
+// Write 发送数据，成功返回空字符串，否则返回错误信息
+func (s *Stream) Write(data []byte) string {
+	if s.IsClosed() {
+		return errStreamClosed.Error()
+	}
+	if _, err := s.stream.Write(data); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// Read 读取已到达的数据 (阻塞到有数据或 timeoutMs 超时，最长 5 分钟)
+// 超时返回空数组，流已关闭返回 nil (可用 IsClosed 区分)
+func (s *Stream) Read(timeoutMs int) []byte {
+	if s.IsClosed() {
+		return nil
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout <= 0 || timeout > namedMaxWait {
+		timeout = namedMaxWait
+	}
+	buf := make([]byte, namedReadChunk)
+	s.stream.SetReadDeadline(clk.Now().Add(timeout))
+	n, err := s.stream.Read(buf)
+	if n > 0 {
+		return buf[:n]
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return []byte{}
+	}
+	if err != nil && err != io.EOF {
+		logErrorf("Named stream %s: %v", s.name, err)
+	}
+	s.Close()
+	return nil
+}
+
+// IsClosed 流是否已关闭 (本地关闭、对端关闭或会话断开)
+func (s *Stream) IsClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close 关闭流
+func (s *Stream) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	s.stream.Close()
+}
@@ -0,0 +1,80 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// 静态端口映射: 客户端设备在路由器上配置了端口转发 (或位于一对一 NAT 之后) 时，
+// kcplocalport 固定 KCP UDP socket 的本地端口，mappedaddr 为该端口在外部的地址。
+// 映射在控制流的能力协商中随 "mapped" 能力通告给服务端 (需要 controlstream)，
+// 服务端确认后可主动向该地址发起连接，为之后由服务端发起的会合功能做准备。
+// 多个会话依次绑定 kcplocalport 起的后续端口，外部端口按相同偏移对应
+
+const capMapped = "mapped"
+
+// natMapping 通告给服务端的静态映射
+type natMapping struct {
+	Addr  string `json:"addr"`  // 第一个本地端口在外部的地址
+	Ports int    `json:"ports"` // 连续映射的端口数
+}
+
+// mappedPorts 需要转发的端口数: 会话数加一 (替换会话时新旧会话短暂并存)
+func mappedPorts(config *Config) int {
+	n := config.Conn
+	if config.onDemand {
+		n = config.MaxConn
+	}
+	return n + 1
+}
+
+// clientMapping 能力协商时通告的映射 (未配置时为 nil)
+func clientMapping(config *Config) *natMapping {
+	if config.MappedAddr == "" {
+		return nil
+	}
+	return &natMapping{Addr: config.MappedAddr, Ports: mappedPorts(config)}
+}
+
+// listenKCP 创建 KCP 使用的 UDP socket: 配置了 kcplocalport 时依次尝试映射范围内的端口
+func listenKCP(config *Config, control func(string, string, syscall.RawConn) error) (net.PacketConn, error) {
+	if config.LocalPort == 0 {
+		return listenUDP(control)
+	}
+	lc := net.ListenConfig{Control: withSocketHook(control)}
+	var lastErr error
+	for i := 0; i < mappedPorts(config) && config.LocalPort+i <= 65535; i++ {
+		conn, err := lc.ListenPacket(context.Background(), "udp", fmt.Sprintf(":%d", config.LocalPort+i))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no free port from kcplocalport %d: %v", config.LocalPort, lastErr)
+}
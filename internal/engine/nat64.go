@@ -0,0 +1,162 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// NAT64: 运营商的纯 IPv6 网络 (没有 IPv4 路由) 上，remoteaddr 为 IPv4 地址时无法直接连接。
+// 此时按 RFC 7050 查询 ipv4only.arpa 的 AAAA 记录得到 NAT64 前缀，
+// 再按 RFC 6052 把 IPv4 地址嵌入前缀合成 IPv6 地址。前缀在网络变化前缓存
+
+// nat64WellKnown ipv4only.arpa 对应的两个 IPv4 地址 (RFC 7050)
+var nat64WellKnown = []net.IP{net.IPv4(192, 0, 0, 170).To4(), net.IPv4(192, 0, 0, 171).To4()}
+
+// nat64Probe 检测 IPv4 路由时连接的地址 (UDP connect 只查路由，不发送数据)
+const nat64Probe = "192.0.2.1:53"
+
+var errNoNAT64 = errors.New("no NAT64 prefix on this network")
+
+var (
+	nat64Mu     sync.Mutex
+	nat64Known  bool      // 本网络已检测过
+	nat64Prefix *nat64Pfx // 检测到的前缀 (nil 表示网络有 IPv4 或没有 NAT64)
+)
+
+// nat64Pfx NAT64 前缀
+type nat64Pfx struct {
+	ip   net.IP // 16 字节
+	bits int    // 32, 40, 48, 56, 64 或 96
+}
+
+func (p *nat64Pfx) String() string {
+	return (&net.IPNet{IP: p.ip, Mask: net.CIDRMask(p.bits, 128)}).String()
+}
+
+// resetNAT64 网络变化后重新检测
+func resetNAT64() {
+	nat64Mu.Lock()
+	nat64Known, nat64Prefix = false, nil
+	nat64Mu.Unlock()
+}
+
+// hasIPv4Route 是否有 IPv4 默认路由
+func hasIPv4Route() bool {
+	c, err := net.Dial("udp4", nat64Probe)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// synthesizeNAT64 没有 IPv4 路由时把 IPv4 地址合成为 NAT64 地址，其他情况原样返回
+func synthesizeNAT64(config *Config, resolver *net.Resolver, ip net.IP) net.IP {
+	v4 := ip.To4()
+	if config.NoNAT64 || v4 == nil {
+		return ip
+	}
+	p, err := discoverNAT64(resolver)
+	if err != nil {
+		return ip
+	}
+	out := embedIPv4(p, v4)
+	log.Printf("NAT64: %s -> %s (prefix %s)", ip, out, p)
+	return out
+}
+
+// discoverNAT64 返回本网络的 NAT64 前缀 (有 IPv4 路由或未找到前缀时返回错误)
+func discoverNAT64(resolver *net.Resolver) (*nat64Pfx, error) {
+	nat64Mu.Lock()
+	defer nat64Mu.Unlock()
+	if nat64Known {
+		if nat64Prefix == nil {
+			return nil, errNoNAT64
+		}
+		return nat64Prefix, nil
+	}
+
+	if hasIPv4Route() {
+		nat64Known = true
+		return nil, errNoNAT64
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tlsDialTimeout)
+	defer cancel()
+	ips, err := resolver.LookupIP(ctx, "ip6", "ipv4only.arpa")
+	if err != nil {
+		// 查询失败 (如网络尚未就绪) 不缓存，下次重连时再试
+		return nil, err
+	}
+	nat64Known = true
+	for _, ip := range ips {
+		if p := extractNAT64(ip); p != nil {
+			nat64Prefix = p
+			emitEvent("nat64", map[string]interface{}{"prefix": p.String()})
+			return p, nil
+		}
+	}
+	return nil, errNoNAT64
+}
+
+// nat64Lengths RFC 6052 允许的前缀长度
+var nat64Lengths = []int{96, 64, 56, 48, 40, 32}
+
+// extractNAT64 从 ipv4only.arpa 的合成地址中找出前缀
+func extractNAT64(ip net.IP) *nat64Pfx {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	for _, bits := range nat64Lengths {
+		p := &nat64Pfx{ip: make(net.IP, net.IPv6len), bits: bits}
+		copy(p.ip, ip[:bits/8])
+		for _, wk := range nat64WellKnown {
+			if embedIPv4(p, wk).Equal(ip) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// embedIPv4 按 RFC 6052 把 IPv4 地址嵌入前缀 (第 64~71 位保留为 0)
+func embedIPv4(p *nat64Pfx, v4 net.IP) net.IP {
+	out := make(net.IP, net.IPv6len)
+	copy(out, p.ip[:p.bits/8])
+	pos := p.bits / 8
+	for _, b := range v4 {
+		if pos == 8 {
+			pos++
+		}
+		out[pos] = b
+		pos++
+	}
+	return out
+}
@@ -0,0 +1,57 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseConfigMapping kcplocalport 固定 KCP 端口；localport 仍是旧版的本地监听端口
+func TestParseConfigMapping(t *testing.T) {
+	config, err := parseConfig(`{"remoteaddr": "203.0.113.1:4000", "controlstream": true,
+		"kcplocalport": 40000, "mappedaddr": "198.51.100.7:40000"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LocalPort != 40000 || config.MappedAddr != "198.51.100.7:40000" {
+		t.Fatalf("kcplocalport %d, mappedaddr %q", config.LocalPort, config.MappedAddr)
+	}
+	if m := clientMapping(config); m == nil || m.Addr != config.MappedAddr || m.Ports != config.Conn+1 {
+		t.Fatalf("mapping %+v", m)
+	}
+
+	config, err = parseConfig(`{"remoteaddr": "203.0.113.1:4000", "localport": 40000}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LocalPort != 0 || config.LocalAddr != "127.0.0.1:40000" {
+		t.Fatalf("legacy localport: kcplocalport %d, localaddr %q", config.LocalPort, config.LocalAddr)
+	}
+
+	_, err = parseConfig(`{"remoteaddr": "203.0.113.1:4000", "controlstream": true,
+		"localport": 40000, "mappedaddr": "198.51.100.7:40000"}`)
+	if err == nil || !strings.Contains(err.Error(), "kcplocalport") {
+		t.Fatalf("mappedaddr with legacy localport: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// 指定网络: Android 上默认路由之外的网络 (如 WiFi 连接时使用蜂窝) 需要将 socket
+// 绑定到对应的 Network。Go 无法直接调用 Android API，因此由 App 实现 NetworkProtector，
+// 在 socket 创建后、连接前收到 fd，调用
+// Network.fromNetworkHandle(network).bindSocket(...) 或 VpnService.protect(fd)。
+// 配置 network 非 0 时，KCP/TLS 连接和 remoteaddr 的 DNS 解析都经过 protector。
+
+// NetworkProtector socket 绑定回调接口 (由 App 实现)
+type NetworkProtector interface {
+	// Protect 将 fd 绑定到 network (Network.getNetworkHandle() 的值)，成功返回 true
+	Protect(fd int, network int64) bool
+}
+
+var (
+	protectorMu      sync.Mutex
+	networkProtector NetworkProtector
+)
+
+var errNoProtector = errors.New("network is set but no NetworkProtector registered")
+
+// SetNetworkProtector 设置 socket 绑定回调，传入 nil 取消
+func SetNetworkProtector(p NetworkProtector) {
+	protectorMu.Lock()
+	networkProtector = p
+	protectorMu.Unlock()
+}
+
+// socketControl 返回在 socket 创建后调用 protector 的 Control 函数
+func socketControl(network int64) (func(string, string, syscall.RawConn) error, error) {
+	protectorMu.Lock()
+	p := networkProtector
+	protectorMu.Unlock()
+	if p == nil {
+		return nil, errNoProtector
+	}
+
+	return func(_, address string, c syscall.RawConn) error {
+		var ok bool
+		if err := c.Control(func(fd uintptr) {
+			ok = p.Protect(int(fd), network)
+		}); err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("protect socket failed for " + address)
+		}
+		return nil
+	}, nil
+}
+
+// networkDialer 返回绑定到指定网络的 Dialer (DNS 解析也走该网络)
+func networkDialer(network int64) (*net.Dialer, error) {
+	control, err := socketControl(network)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Control: control}
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, netw, address string) (net.Conn, error) {
+			return (&net.Dialer{Control: control}).DialContext(ctx, netw, address)
+		},
+	}
+	return d, nil
+}
+
+// boundConn KCP 会话及其独占的 PacketConn (自建 UDP socket 或 TCP 模拟)
+// kcp-go 不会关闭外部传入的 PacketConn，由 Close 一并关闭
+type boundConn struct {
+	*kcp.UDPSession
+	pconn net.PacketConn
+	wire  *wireCounter // 收发包统计
+}
+
+func (c *boundConn) Close() error {
+	err := c.UDPSession.Close()
+	c.pconn.Close()
+	return err
+}
+
+// dialKCPOnNetwork 在指定网络上创建 UDP socket 并建立 KCP 连接
+func dialKCPOnNetwork(config *Config, block kcp.BlockCrypt, dataShard, parityShard int) (*kcp.UDPSession, net.Conn, error) {
+	d, err := networkDialer(config.Network)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raddr, err := resolveRemote(config, d.Resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pconn, err := listenKCP(config, d.Control)
+	if err != nil {
+		return nil, nil, err
+	}
+	wire := newWireCounter(pconn)
+	sess, err := kcp.NewConn2(raddr, block, dataShard, parityShard, guardWrites(config, dropParity(config, block, duplicateSmall(config, impairTrace(config, wire)))))
+	if err != nil {
+		pconn.Close()
+		return nil, nil, err
+	}
+	return sess, &boundConn{UDPSession: sess, pconn: pconn, wire: wire}, nil
+}
@@ -0,0 +1,132 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 前台服务通知: Android 前台服务通知栏每秒刷新一次，完整的 GetStats 序列化开销过大，
+// GetNotificationStats 只计算通知需要的几项并返回已格式化的一行文本
+
+// notifyMinInterval 两次调用间隔小于该值时返回上次的结果，多个调用方同时轮询时速度不会抖动
+const notifyMinInterval = 500 * time.Millisecond
+
+var notifyState struct {
+	sync.Mutex
+	at       time.Time
+	up, down uint64
+	text     string
+}
+
+// engineState 引擎整体状态: stopped, armed, connecting, connected, degraded, hibernating, draining
+func engineState() string {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	if !proxyRunning() {
+		if armedConfig != nil {
+			return "armed"
+		}
+		return "stopped"
+	}
+	if isDraining() {
+		return "draining"
+	}
+	if isHibernating() {
+		return "hibernating"
+	}
+	alive, healthy := 0, 0
+	for _, s := range proxySessions {
+		if !s.alive() {
+			continue
+		}
+		alive++
+		if s.state() == "healthy" {
+			healthy++
+		}
+	}
+	switch {
+	case alive == 0 && proxyConfig.onDemand:
+		// 按需模式没有连接时不保留会话，与休眠相同
+		return "hibernating"
+	case alive == 0:
+		return "connecting"
+	case healthy < expectedSessionsLocked(alive):
+		return "degraded"
+	}
+	return "connected"
+}
+
+// GetNotificationStats 返回用于通知栏的摘要，适合每秒轮询:
+// "connected · ↑ 12.0 KB/s ↓ 1.5 MB/s · 320.4 MB · 1:02:03"
+// 依次为状态、上/下行速度、累计总流量和本次运行时长；未运行时只返回状态
+func GetNotificationStats() string {
+	state := engineState()
+	proxyMu.Lock()
+	running, started := proxyRunning(), startTime
+	proxyMu.Unlock()
+	if !running {
+		return state
+	}
+
+	now := clk.Now()
+	up, down := atomic.LoadUint64(&statBytesUp), atomic.LoadUint64(&statBytesDown)
+
+	notifyState.Lock()
+	defer notifyState.Unlock()
+	if !notifyState.at.IsZero() && now.Sub(notifyState.at) < notifyMinInterval && notifyState.text != "" {
+		return notifyState.text
+	}
+	var upRate, downRate float64
+	if secs := now.Sub(notifyState.at).Seconds(); !notifyState.at.IsZero() && secs > 0 &&
+		up >= notifyState.up && down >= notifyState.down {
+		upRate = float64(up-notifyState.up) / secs
+		downRate = float64(down-notifyState.down) / secs
+	}
+	notifyState.at, notifyState.up, notifyState.down = now, up, down
+
+	uptime := int64(now.Sub(started).Seconds())
+	notifyState.text = fmt.Sprintf("%s · ↑ %s/s ↓ %s/s · %s · %d:%02d:%02d", state,
+		formatBytes(upRate), formatBytes(downRate), formatBytes(float64(up+down)),
+		uptime/3600, uptime/60%60, uptime%60)
+	return notifyState.text
+}
+
+// formatBytes 以 B/KB/MB/GB 格式化字节数 (1024 进制，保留一位小数)
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,120 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"time"
+)
+
+// 按需会话: conn 显式配置为 0 时启动不预先建立会话，会话池有 maxconn 个空槽位。
+// 第一个客户端连接暂存在停车场并唤醒监管协程建立会话；
+// 现有会话的流都达到 onDemandStreams 个时再多建立一个，直到 maxconn；
+// 没有流的会话空闲 onDemandIdle 后关闭，不常用的隧道平时不占用 UDP socket 和定时器
+
+const (
+	onDemandStreams = 8               // 每个会话的流数达到此值时扩充会话
+	onDemandIdle    = 5 * time.Minute // 空闲会话保留的时间
+)
+
+// expectedSessionsLocked 应当存活的会话数，按需模式下空槽位不算异常 (调用方需持有 proxyMu)
+func expectedSessionsLocked(alive int) int {
+	if proxyConfig != nil && proxyConfig.onDemand {
+		return alive
+	}
+	return len(proxySessions)
+}
+
+// demandSlotsLocked 按需模式下需要建立会话的空槽位 (调用方需持有 proxyMu)
+// parked 为停车场中等待会话的连接数
+func demandSlotsLocked(parked int) []int {
+	alive, busy := 0, 0
+	var empty []int
+	for i, s := range proxySessions {
+		if !s.alive() {
+			empty = append(empty, i)
+			continue
+		}
+		alive++
+		if s.NumStreams() >= onDemandStreams {
+			busy++
+		}
+	}
+	want := 0
+	switch {
+	case alive == 0 && parked > 0:
+		want = 1
+	case alive > 0 && busy == alive:
+		want = 1
+	}
+	if want > len(empty) {
+		want = len(empty)
+	}
+	return empty[:want]
+}
+
+// trimOnDemand 关闭空闲超过 onDemandIdle 的会话 (仅监管协程调用)
+func (s *sessionSupervisor) trimOnDemand() {
+	if !s.config.onDemand {
+		return
+	}
+	now := clk.Now()
+	if s.idleSessions == nil {
+		s.idleSessions = make(map[*poolSession]time.Time)
+	}
+
+	proxyMu.Lock()
+	present := make(map[*poolSession]bool, len(proxySessions))
+	var closed []int
+	for i, session := range proxySessions {
+		if !session.alive() {
+			continue
+		}
+		present[session] = true
+		if session.NumStreams() > 0 {
+			delete(s.idleSessions, session)
+			continue
+		}
+		since, ok := s.idleSessions[session]
+		if !ok {
+			s.idleSessions[session] = now
+			continue
+		}
+		if now.Sub(since) >= onDemandIdle {
+			closeSessionForShutdown(session)
+			closed = append(closed, i)
+		}
+	}
+	proxyMu.Unlock()
+
+	for session := range s.idleSessions {
+		if !present[session] {
+			delete(s.idleSessions, session)
+		}
+	}
+	for _, idx := range closed {
+		log.Printf("Session %d idle for %s, closed (on demand)", idx, onDemandIdle)
+	}
+}
@@ -0,0 +1,117 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// 打开流失败重试: 选中的会话 OpenStream 失败时 (会话刚断开、流 ID 用尽等)，
+// 依次在其余存活且未被判定可疑的会话上重试，每次重试前等待一小段随机时间，避免同时压向同一会话；
+// 全部失败才让客户端连接失败。统计按第几个备选会话成功分别计数
+
+const (
+	openRetryDelay  = 20 * time.Millisecond // 重试前的基础等待
+	openRetryJitter = 30 * time.Millisecond // 额外的随机等待上限
+	openRetrySlots  = 4                     // 按备选序号统计的档数，更靠后的计入最后一档
+)
+
+var (
+	openRetried   uint64 // 首选会话失败后进入重试的次数
+	openRecovered uint64 // 重试成功的次数
+	openExhausted uint64 // 全部会话都失败的次数
+	openByAttempt [openRetrySlots]uint64
+)
+
+// openRetryStats 打开流重试统计
+type openRetryStats struct {
+	Retried   uint64   `json:"retried"`
+	Recovered uint64   `json:"recovered"`
+	Exhausted uint64   `json:"exhausted"`
+	ByAttempt []uint64 `json:"byattempt"` // 第 1、2、3、4 及以后的备选会话成功的次数
+}
+
+// snapshotOpenRetry 返回打开流重试统计 (还没有重试过时为 nil)
+func snapshotOpenRetry() *openRetryStats {
+	retried := atomic.LoadUint64(&openRetried)
+	if retried == 0 {
+		return nil
+	}
+	s := &openRetryStats{
+		Retried:   retried,
+		Recovered: atomic.LoadUint64(&openRecovered),
+		Exhausted: atomic.LoadUint64(&openExhausted),
+		ByAttempt: make([]uint64, openRetrySlots),
+	}
+	for i := range s.ByAttempt {
+		s.ByAttempt[i] = atomic.LoadUint64(&openByAttempt[i])
+	}
+	return s
+}
+
+// openWithFallback 在 session 上打开流，失败时在其余会话上重试
+// 返回打开的流和实际使用的会话；全部失败时返回首选会话的错误
+func openWithFallback(session *poolSession) (*smux.Stream, *poolSession, error) {
+	stream, err := session.openAdmitted()
+	if err == nil {
+		return stream, session, nil
+	}
+
+	proxyMu.Lock()
+	var others []*poolSession
+	for _, s := range proxySessions {
+		if s != session && s.alive() && atomic.LoadInt32(&s.suspect) == 0 {
+			others = append(others, s)
+		}
+	}
+	proxyMu.Unlock()
+	if len(others) == 0 {
+		return nil, session, err
+	}
+
+	atomic.AddUint64(&openRetried, 1)
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	for i, s := range others {
+		clk.Sleep(openRetryDelay + time.Duration(rand.Int63n(int64(openRetryJitter))))
+		if !s.alive() {
+			continue
+		}
+		stream, rerr := s.openAdmitted()
+		if rerr != nil {
+			continue
+		}
+		atomic.AddUint64(&openRecovered, 1)
+		atomic.AddUint64(&openByAttempt[minInt(i, openRetrySlots-1)], 1)
+		log.Printf("OpenStream failed (%v), opened on fallback session %d", err, sessionIndex(s))
+		return stream, s, nil
+	}
+	atomic.AddUint64(&openExhausted, 1)
+	return nil, session, err
+}
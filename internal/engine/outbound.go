@@ -0,0 +1,445 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 出口选择: 规则中存在 direct/auto 动作 (或 defaultaction 为 direct/auto) 时，代理握手改为在本地完成，
+// 识别出目标后按规则选择出口:
+//   - proxy: 打开 SMUX 流，向服务端重放握手，丢弃服务端对已在本地应答部分的回复
+//   - direct: 本地直连目标 (设置了 NetworkProtector 时 socket 先经过 protect，
+//     避免 VpnService 内的直连流量再次进入 TUN)，并以对应代理协议应答客户端
+//   - reject: 以 RST 关闭
+// SOCKS5 客户端要求认证、非 CONNECT 命令或无法识别的协议一律透传给服务端
+
+const (
+	handshakeTimeout  = 10 * time.Second // 本地握手的读取超时
+	directDialTimeout = 10 * time.Second
+	httpHeadLimit     = 16 * 1024 // HTTP 代理请求头的最大长度
+	socks4FieldLimit  = 255       // SOCKS4 用户 ID 和 SOCKS4a 域名的最大长度
+)
+
+var errBadHandshake = errors.New("malformed proxy handshake")
+
+// proxyHandshake 在本地读取的代理握手
+type proxyHandshake struct {
+	proto   byte   // 5: SOCKS5, 4: SOCKS4, 'H': HTTP 代理, 0: 透传
+	cmd     byte   // SOCKS5 命令 (socksCmdConnect/socksCmdBind)
+	target  string // 目标 host:port，为空表示无法在本地识别
+	connect bool   // HTTP CONNECT 请求
+	head    []byte // 需要向服务端重放的握手数据
+	early   []byte // 握手之后客户端已发送的数据
+	swallow int    // 服务端回复中需要丢弃的字节数 (已在本地应答的 SOCKS5 方法选择)
+	domain  string // 目标为 IP 时嗅探出的域名
+	replied bool   // 已在本地以成功应答客户端 (嗅探域名时)，服务端的连接应答需丢弃
+}
+
+// destination 用于目的地统计的地址: 嗅探出域名时使用域名，否则为目标
+func (hs *proxyHandshake) destination() string {
+	if hs.domain != "" {
+		return hs.domain
+	}
+	return hs.target
+}
+
+// routeLocally 当前规则 (或 socksbind、pinnedports、replayports、classports、socksresolve) 是否需要在本地完成握手
+func routeLocally(config *Config) bool {
+	if config.SocksBind || len(config.PinnedPorts) > 0 || len(config.ReplayPorts) > 0 || len(config.ClassPorts) > 0 {
+		return true
+	}
+	if config.DefaultAction == actionDirect || config.DefaultAction == actionAuto || config.SocksResolve == socksResolveLocal {
+		return true
+	}
+	rs := currentRules(config)
+	return rs != nil && rs.local
+}
+
+// readHandshake 从客户端读取代理握手，SOCKS5 的方法选择直接在本地应答
+func readHandshake(conn net.Conn) (*proxyHandshake, error) {
+	conn.SetReadDeadline(clk.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var hs *proxyHandshake
+	switch {
+	case first[0] == 5:
+		hs, err = readSOCKS5(br, conn)
+	case first[0] == 4:
+		hs, err = readSOCKS4(br)
+	case first[0] >= 'A' && first[0] <= 'Z':
+		hs, err = readHTTPProxy(br)
+	default:
+		hs = &proxyHandshake{}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// bufio 可能多读了握手之后的数据 (如 HTTP 请求体)
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		hs.early = append([]byte(nil), b...)
+	}
+	return hs, nil
+}
+
+// SOCKS5 命令
+const (
+	socksCmdConnect byte = 1
+	socksCmdBind    byte = 2
+)
+
+// readSOCKS5 读取问候和请求，仅处理无认证的 CONNECT
+func readSOCKS5(br *bufio.Reader, w io.Writer) (*proxyHandshake, error) {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(br, greeting); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return nil, err
+	}
+	greeting = append(greeting, methods...)
+	if bytes.IndexByte(methods, 0) < 0 {
+		// 需要认证，交给服务端处理
+		return &proxyHandshake{head: greeting}, nil
+	}
+	if _, err := w.Write([]byte{5, 0}); err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return nil, err
+	}
+	var n int
+	switch req[3] {
+	case 1:
+		n = 4
+	case 4:
+		n = 16
+	case 3:
+		l, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		req, n = append(req, l), int(l)
+	default:
+		return nil, errBadHandshake
+	}
+	addr := make([]byte, n+2)
+	if _, err := io.ReadFull(br, addr); err != nil {
+		return nil, err
+	}
+	req = append(req, addr...)
+
+	// 服务端收到重放的问候后回复的方法选择已在本地应答过
+	hs := &proxyHandshake{proto: 5, cmd: req[1], head: append([]byte{5, 1, 0}, req...), swallow: 2}
+	if req[1] == socksCmdConnect {
+		hs.target, _ = parseSOCKS5(hs.head)
+	}
+	return hs, nil
+}
+
+// readSOCKS4 读取 SOCKS4/4a 请求
+func readSOCKS4(br *bufio.Reader) (*proxyHandshake, error) {
+	req := make([]byte, 8)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return nil, err
+	}
+	user, err := readCString(br, socks4FieldLimit)
+	if err != nil {
+		return nil, err
+	}
+	req = append(req, user...)
+	if req[4] == 0 && req[5] == 0 && req[6] == 0 && req[7] != 0 {
+		host, err := readCString(br, socks4FieldLimit)
+		if err != nil {
+			return nil, err
+		}
+		req = append(req, host...)
+	}
+
+	hs := &proxyHandshake{proto: 4, head: req}
+	if req[1] == 1 {
+		hs.target, _ = parseSOCKS4(req)
+	}
+	return hs, nil
+}
+
+// readCString 读取以 0 结尾的字段 (含结尾的 0)，超过 limit 字节视为异常握手
+func readCString(br *bufio.Reader, limit int) ([]byte, error) {
+	var field []byte
+	for len(field) <= limit {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		field = append(field, c)
+		if c == 0 {
+			return field, nil
+		}
+	}
+	return nil, errBadHandshake
+}
+
+// readHTTPProxy 读取 HTTP 代理请求头
+func readHTTPProxy(br *bufio.Reader) (*proxyHandshake, error) {
+	var head []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		head = append(head, line...)
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		if len(head) > httpHeadLimit {
+			return nil, errBadHandshake
+		}
+		if bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+			break
+		}
+	}
+
+	hs := &proxyHandshake{proto: 'H', head: head}
+	hs.target, _ = parseHTTPProxy(head)
+	hs.connect = bytes.HasPrefix(head, []byte("CONNECT "))
+	if hs.target == "" {
+		hs.proto = 0
+	}
+	return hs, nil
+}
+
+// replyHandshake 直连时以对应代理协议应答客户端 (已提前应答时不再发送)
+func replyHandshake(w io.Writer, hs *proxyHandshake, ok bool) error {
+	if hs.replied {
+		return nil
+	}
+	if !ok {
+		return replyFailure(w, hs, socksHostUnreachable)
+	}
+	var reply []byte
+	switch hs.proto {
+	case 5:
+		reply = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	case 4:
+		reply = []byte{0, 0x5a, 0, 0, 0, 0, 0, 0}
+	case 'H':
+		if hs.connect {
+			reply = []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+		}
+	}
+	if len(reply) == 0 {
+		return nil
+	}
+	_, err := w.Write(reply)
+	return err
+}
+
+// directDialer 返回直连使用的 Dialer
+// 设置了 NetworkProtector 时 socket 经过 protect (并绑定到 network，为 0 时仅 protect)
+func directDialer(config *Config) *net.Dialer {
+	d, err := networkDialer(config.Network)
+	if err != nil {
+		d = &net.Dialer{}
+	}
+	d.Timeout = directDialTimeout
+	return d
+}
+
+// handleDirect 直连目标并转发，p2 为竞速中已建立的直连 (为 nil 时拨号)
+func handleDirect(config *Config, p1 net.Conn, hs *proxyHandshake, client *hotspotClient, p2 net.Conn) {
+	start := clk.Now()
+	tag := takeTag(p1.RemoteAddr())
+	var bytesUp, bytesDown uint64
+	reason := ""
+	defer func() {
+		countClose(reason)
+		countOutbound(actionDirect, bytesUp, bytesDown, reason == closeOpenFailed)
+		recordDestination(hs.destination(), bytesUp, bytesDown)
+		recordTag(tag, bytesUp, bytesDown)
+		logAccess(&accessRecord{
+			Peer:      p1.RemoteAddr().String(),
+			Target:    hs.target,
+			Domain:    hs.domain,
+			Tag:       tag,
+			Outbound:  actionDirect,
+			Duration:  clk.Since(start).Milliseconds(),
+			BytesUp:   bytesUp,
+			BytesDown: bytesDown,
+			Reason:    reason,
+		})
+	}()
+
+	defer trackDirect(p1)()
+
+	if p2 == nil {
+		var err error
+		if p2, err = directDialer(config).Dial("tcp", hs.target); err != nil {
+			connLog("Direct dial error:", err)
+			replyHandshake(p1, hs, false)
+			reason = closeOpenFailed
+			return
+		}
+	}
+	defer p2.Close()
+
+	if err := replyHandshake(p1, hs, true); err != nil {
+		reason = closeClientError
+		return
+	}
+	pending := hs.early
+	if hs.proto == 'H' && !hs.connect {
+		// 普通 HTTP 代理请求原样发给目标 (绝对 URI 形式，源站应当接受)
+		pending = append(hs.head, hs.early...)
+	}
+
+	var up, down io.Writer = &countWriter{p2, &bytesUp}, &countWriter{p1, &bytesDown}
+	if client != nil {
+		up, down = client.wrap(up, down)
+	}
+	if len(pending) > 0 {
+		if _, err := up.Write(pending); err != nil {
+			reason = closeRemoteError
+			return
+		}
+	}
+
+	var closedBy sync.Once
+	closed := func(fromClient bool, err error) {
+		closedBy.Do(func() { reason = classifyClose(nil, fromClient, err) })
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := relay(down, p2)
+		closed(false, err)
+		if tcpConn, ok := p1.(*net.TCPConn); ok {
+			tcpConn.CloseRead()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := relay(up, p1)
+		closed(true, err)
+		if tcpConn, ok := p2.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		} else {
+			p2.Close()
+		}
+	}()
+	wg.Wait()
+}
+
+// skipReply 读取并丢弃服务端对已在本地应答部分的回复
+func skipReply(p2 net.Conn, n int) error {
+	if n == 0 {
+		return nil
+	}
+	p2.SetReadDeadline(clk.Now().Add(handshakeTimeout))
+	defer p2.SetReadDeadline(time.Time{})
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(p2, b); err != nil {
+		return err
+	}
+	if b[0] != 5 || b[1] != 0 {
+		return fmt.Errorf("unexpected SOCKS5 method reply: %d", b[1])
+	}
+	return nil
+}
+
+// outboundStats 单个出口的统计
+type outboundStats struct {
+	Conns     uint64 `json:"conns"`
+	Failures  uint64 `json:"failures"` // 建立失败 (OpenStream/直连拨号失败)
+	BytesUp   uint64 `json:"bytesup"`
+	BytesDown uint64 `json:"bytesdown"`
+}
+
+// 各出口的计数，键固定，不需要加锁
+var outbounds = map[string]*outboundStats{
+	actionProxy:  {},
+	actionDirect: {},
+	actionReject: {},
+}
+
+// countOutbound 连接结束时按出口计数
+func countOutbound(action string, bytesUp, bytesDown uint64, failed bool) {
+	metricCount("kcp_outbound_conns_total", "outbound="+action, 1)
+	if failed {
+		metricCount("kcp_outbound_failures_total", "outbound="+action, 1)
+	}
+	o := outbounds[action]
+	atomic.AddUint64(&o.Conns, 1)
+	atomic.AddUint64(&o.BytesUp, bytesUp)
+	atomic.AddUint64(&o.BytesDown, bytesDown)
+	if failed {
+		atomic.AddUint64(&o.Failures, 1)
+	}
+}
+
+// outboundStatsSnapshot 返回各出口的统计
+func outboundStatsSnapshot() map[string]outboundStats {
+	m := make(map[string]outboundStats, len(outbounds))
+	for name, o := range outbounds {
+		m[name] = outboundStats{
+			Conns:     atomic.LoadUint64(&o.Conns),
+			Failures:  atomic.LoadUint64(&o.Failures),
+			BytesUp:   atomic.LoadUint64(&o.BytesUp),
+			BytesDown: atomic.LoadUint64(&o.BytesDown),
+		}
+	}
+	return m
+}
+
+// resetOutbounds 清零出口统计和竞速计数
+func resetOutbounds() {
+	for _, o := range outbounds {
+		atomic.StoreUint64(&o.Conns, 0)
+		atomic.StoreUint64(&o.Failures, 0)
+		atomic.StoreUint64(&o.BytesUp, 0)
+		atomic.StoreUint64(&o.BytesDown, 0)
+	}
+	for i := range autoWins {
+		atomic.StoreUint64(&autoWins[i], 0)
+	}
+}
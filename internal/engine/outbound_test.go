@@ -0,0 +1,216 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handshakeConn 从固定字节读取的 net.Conn，写入的内容 (SOCKS5 方法选择) 记录在 out
+type handshakeConn struct {
+	net.Conn
+	in  *bytes.Reader
+	out bytes.Buffer
+}
+
+func newHandshakeConn(b []byte) *handshakeConn {
+	return &handshakeConn{in: bytes.NewReader(b)}
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error)         { return c.in.Read(b) }
+func (c *handshakeConn) Write(b []byte) (int, error)        { return c.out.Write(b) }
+func (c *handshakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *handshakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func cat(parts ...interface{}) []byte {
+	var b []byte
+	for _, p := range parts {
+		switch v := p.(type) {
+		case string:
+			b = append(b, v...)
+		case []byte:
+			b = append(b, v...)
+		}
+	}
+	return b
+}
+
+func TestReadSOCKS5(t *testing.T) {
+	long := strings.Repeat("a", 255)
+	cases := []struct {
+		name   string
+		in     []byte
+		target string
+		proto  byte
+		reply  bool // 是否在本地应答了方法选择
+		err    bool
+	}{
+		{name: "ipv4", in: []byte{5, 1, 0, 5, 1, 0, 1, 1, 2, 3, 4, 0, 80}, target: "1.2.3.4:80", proto: 5, reply: true},
+		{name: "domain", in: cat([]byte{5, 2, 2, 0, 5, 1, 0, 3, 11}, "example.com", []byte{1, 187}), target: "example.com:443", proto: 5, reply: true},
+		{name: "ipv6", in: cat([]byte{5, 1, 0, 5, 1, 0, 4}, make([]byte, 15), []byte{1, 0, 53}), target: "[::1]:53", proto: 5, reply: true},
+		{name: "max domain", in: cat([]byte{5, 1, 0, 5, 1, 0, 3, 255}, long, []byte{0, 80}), target: long + ":80", proto: 5, reply: true},
+		{name: "bind", in: []byte{5, 1, 0, 5, 2, 0, 1, 1, 2, 3, 4, 0, 80}, proto: 5, reply: true},
+		{name: "auth only", in: []byte{5, 1, 2}, proto: 0},
+		{name: "empty greeting", in: []byte{5}, err: true},
+		{name: "truncated methods", in: []byte{5, 3, 0}, err: true},
+		{name: "truncated request", in: []byte{5, 1, 0, 5, 1, 0}, reply: true, err: true},
+		{name: "truncated ipv4", in: []byte{5, 1, 0, 5, 1, 0, 1, 1, 2}, reply: true, err: true},
+		{name: "truncated domain", in: cat([]byte{5, 1, 0, 5, 1, 0, 3, 20}, "short"), reply: true, err: true},
+		{name: "missing domain length", in: []byte{5, 1, 0, 5, 1, 0, 3}, reply: true, err: true},
+		{name: "bad address type", in: []byte{5, 1, 0, 5, 1, 0, 9, 1, 2, 3, 4, 0, 80}, reply: true, err: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			hs, err := readSOCKS5(bufio.NewReader(bytes.NewReader(c.in)), &out)
+			if (err != nil) != c.err {
+				t.Fatalf("err = %v, want error %v", err, c.err)
+			}
+			if got := out.Len() > 0; got != c.reply {
+				t.Fatalf("replied = %v, want %v", got, c.reply)
+			}
+			if err != nil {
+				return
+			}
+			if hs.proto != c.proto || hs.target != c.target {
+				t.Fatalf("proto %d target %q, want %d %q", hs.proto, hs.target, c.proto, c.target)
+			}
+		})
+	}
+}
+
+func TestReadSOCKS4(t *testing.T) {
+	cases := []struct {
+		name   string
+		in     []byte
+		target string
+		err    error
+	}{
+		{name: "ipv4", in: cat([]byte{4, 1, 0, 80, 1, 2, 3, 4}, "user", []byte{0}), target: "1.2.3.4:80"},
+		{name: "socks4a", in: cat([]byte{4, 1, 1, 187, 0, 0, 0, 1, 0}, "example.com", []byte{0}), target: "example.com:443"},
+		{name: "bind", in: []byte{4, 2, 0, 80, 1, 2, 3, 4, 0}},
+		{name: "truncated header", in: []byte{4, 1, 0, 80}, err: io.ErrUnexpectedEOF},
+		{name: "unterminated user", in: cat([]byte{4, 1, 0, 80, 1, 2, 3, 4}, "user"), err: io.EOF},
+		{name: "unterminated host", in: cat([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "example.com"), err: io.EOF},
+		{name: "oversized user", in: cat([]byte{4, 1, 0, 80, 1, 2, 3, 4}, strings.Repeat("u", 4096), []byte{0}), err: errBadHandshake},
+		{name: "oversized host", in: cat([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, strings.Repeat("h", 300), []byte{0}), err: errBadHandshake},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hs, err := readSOCKS4(bufio.NewReader(bytes.NewReader(c.in)))
+			if !errors.Is(err, c.err) {
+				t.Fatalf("err = %v, want %v", err, c.err)
+			}
+			if err == nil && hs.target != c.target {
+				t.Fatalf("target %q, want %q", hs.target, c.target)
+			}
+		})
+	}
+}
+
+func TestReadHTTPProxy(t *testing.T) {
+	cases := []struct {
+		name    string
+		in      string
+		target  string
+		connect bool
+		err     error
+	}{
+		{name: "connect", in: "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", target: "example.com:443", connect: true},
+		{name: "get", in: "GET http://example.com/index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", target: "example.com:80"},
+		{name: "https uri", in: "GET https://example.com?q HTTP/1.1\r\n\r\n", target: "example.com:443"},
+		{name: "origin form", in: "GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{name: "not http", in: "HELLO\r\n\r\n"},
+		{name: "truncated", in: "CONNECT example.com:443 HTTP/1.1\r\nHost: exa", err: io.EOF},
+		{name: "no blank line", in: "CONNECT example.com:443 HTTP/1.1\r\n", err: io.EOF},
+		{name: "oversized", in: "GET http://example.com/ HTTP/1.1\r\nX-Pad: " + strings.Repeat("a", httpHeadLimit) + "\r\n\r\n", err: errBadHandshake},
+		{name: "oversized line", in: "GET http://example.com/" + strings.Repeat("a", httpHeadLimit) + " HTTP/1.1\r\n\r\n", err: errBadHandshake},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hs, err := readHTTPProxy(bufio.NewReader(strings.NewReader(c.in)))
+			if !errors.Is(err, c.err) {
+				t.Fatalf("err = %v, want %v", err, c.err)
+			}
+			if err != nil {
+				return
+			}
+			if hs.target != c.target || hs.connect != c.connect {
+				t.Fatalf("target %q connect %v, want %q %v", hs.target, hs.connect, c.target, c.connect)
+			}
+			if (hs.proto == 'H') != (c.target != "") {
+				t.Fatalf("proto %q for target %q", hs.proto, hs.target)
+			}
+		})
+	}
+}
+
+func TestReadHandshakeEarlyData(t *testing.T) {
+	conn := newHandshakeConn([]byte("POST http://example.com/ HTTP/1.1\r\nContent-Length: 4\r\n\r\nbody"))
+	hs, err := readHandshake(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.target != "example.com:80" || string(hs.early) != "body" {
+		t.Fatalf("target %q early %q", hs.target, hs.early)
+	}
+}
+
+// FuzzReadHandshake 任意客户端字节都不能让握手解析崩溃或无限读取；
+// 成功时 early 必须来自输入，HTTP/SOCKS4 的 head 必须是输入的开头
+func FuzzReadHandshake(f *testing.F) {
+	f.Add([]byte{5, 1, 0, 5, 1, 0, 1, 1, 2, 3, 4, 0, 80})
+	f.Add(cat([]byte{5, 1, 0, 5, 1, 0, 3, 11}, "example.com", []byte{1, 187}))
+	f.Add([]byte{5, 1, 2})
+	f.Add(cat([]byte{4, 1, 0, 80, 0, 0, 0, 1, 0}, "example.com", []byte{0}))
+	f.Add([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n"))
+	f.Add([]byte("GET http://example.com/ HTTP/1.1\r\n\r\nearly"))
+	f.Add([]byte{0x16, 3, 1, 0, 5})
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		conn := newHandshakeConn(in)
+		hs, err := readHandshake(conn)
+		if err != nil {
+			return
+		}
+		if len(hs.early) > len(in) {
+			t.Fatalf("early data longer than input: %d > %d", len(hs.early), len(in))
+		}
+		if !bytes.Contains(in, hs.early) {
+			t.Fatalf("early data is not part of the input (%d bytes)", len(hs.early))
+		}
+		if hs.proto == 'H' && !bytes.HasPrefix(in, hs.head) {
+			t.Fatalf("http head %q is not the input prefix", hs.head)
+		}
+		if hs.proto == 4 && !bytes.HasPrefix(in, hs.head) {
+			t.Fatalf("socks4 request %q is not the input prefix", hs.head)
+		}
+	})
+}
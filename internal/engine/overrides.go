@@ -0,0 +1,144 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix 环境变量覆盖前缀，如 KCPMOBILE_MODE=fast3、KCPMOBILE_CONN=2
+const envPrefix = "KCPMOBILE_"
+
+// StartProxyWithOverrides 以 configJson 为基础配置，深度合并 overridesJson 后启动代理
+// 适用于 App 保存一份基础配置，每次启动时临时调整个别字段 (如调试日志、端口)
+// 合并顺序: 基础配置 < 环境变量 < overridesJson
+// 返回空字符串表示成功，否则返回错误信息
+func StartProxyWithOverrides(configJson string, overridesJson string) string {
+	merged, err := mergeConfigJSON(configJson, overridesJson)
+	if err != nil {
+		msg := "Config Error: " + err.Error()
+		startFailed(configJson, msg)
+		return msg
+	}
+	msg := startProxy(merged)
+	if msg != "" {
+		startFailed(merged, msg)
+	} else {
+		clearStartError()
+	}
+	return msg
+}
+
+// mergeConfigJSON 合并基础配置、环境变量和覆盖配置
+func mergeConfigJSON(configJson string, overridesJson string) (string, error) {
+	base, err := decodeObject(configJson)
+	if err != nil {
+		return "", err
+	}
+
+	deepMerge(base, envOverrides())
+
+	if strings.TrimSpace(overridesJson) != "" {
+		overrides, err := decodeObject(overridesJson)
+		if err != nil {
+			return "", fmt.Errorf("overrides: %v", err)
+		}
+		deepMerge(base, overrides)
+	}
+
+	b, err := json.Marshal(base)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeObject 解析 JSON 对象，顶层字段名统一为规范名
+func decodeObject(s string) (map[string]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+
+	var m map[string]interface{}
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	return normalizeKeys(m), nil
+}
+
+// normalizeKeys 将字段名转为小写并展开别名，使覆盖配置能命中基础配置中的同一字段
+func normalizeKeys(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		name := strings.ToLower(k)
+		if canon, ok := configAliases[name]; ok {
+			name = canon
+		}
+		out[name] = v
+	}
+	return out
+}
+
+// deepMerge 将 src 合并到 dst: 对象递归合并，其余类型 (含数组) 直接替换
+func deepMerge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sm, ok := v.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				deepMerge(dm, sm)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// envOverrides 读取 KCPMOBILE_* 环境变量
+// 值为合法 JSON 时按 JSON 解析 (数字、布尔、数组)，否则作为字符串
+func envOverrides() map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, envPrefix)
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			continue
+		}
+		key, raw := kv[:i], kv[i+1:]
+
+		dec := json.NewDecoder(bytes.NewReader([]byte(raw)))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil || dec.More() {
+			v = raw
+		}
+		m[key] = v
+	}
+	return normalizeKeys(m)
+}
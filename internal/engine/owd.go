@@ -0,0 +1,180 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// 单向时延: 控制流每个 pong 带有服务端的收发时间戳 (T2/T3)，结合本地的 T1/T4 分别得到上下行时延。
+// 单次 NTP 估算的时钟偏差受排队影响较大，这里按时钟过滤 (最近 owdFilterSize 个样本中 RTT 最小者的偏差)
+// 换算各样本的上下行时延，并记录窗口内的最小值作为基线: 时延高出基线的部分即该方向的排队时延。
+// 蜂窝网络的拥塞常常只发生在一个方向，对称的 RTT 看不出是哪一边的问题
+
+const (
+	owdFilterSize = 8     // 时钟过滤样本数
+	owdBaseWindow = 60    // 基线最小值的窗口样本数
+	owdEWMA       = 0.125 // 时延平滑系数
+)
+
+// owdSample 一次心跳的测量
+type owdSample struct {
+	offset int64 // 服务端时钟 - 本地时钟，纳秒
+	rtt    int64
+	up     int64 // T2 - T1
+	down   int64 // T4 - T3
+}
+
+// owdStats 单向时延统计 (毫秒)
+type owdStats struct {
+	Uplink    float64 `json:"uplink"`    // 平滑的上行时延
+	Downlink  float64 `json:"downlink"`  // 平滑的下行时延
+	UpQueue   float64 `json:"upqueue"`   // 上行时延高出基线的部分 (排队)
+	DownQueue float64 `json:"downqueue"` // 下行时延高出基线的部分 (排队)
+	Asymmetry float64 `json:"asymmetry"` // 上行 - 下行
+	Offset    float64 `json:"offset"`    // 过滤后的时钟偏差
+	Samples   int     `json:"samples"`
+	Congested string  `json:"congested,omitempty"` // 排队明显偏向的方向: up, down
+}
+
+var (
+	owdMu     sync.Mutex
+	owdRecent []owdSample // 时钟过滤窗口
+	owdUps    []int64     // 基线窗口 (已按过滤偏差换算)
+	owdDowns  []int64
+	owdUp     float64
+	owdDown   float64
+	owdCount  int
+	owdOffset int64
+)
+
+// sampleOneWay 记录一次 ping/pong 的四个时间戳 (UnixNano)
+func sampleOneWay(t1, t2, t3, t4 int64) {
+	s := owdSample{
+		offset: ((t2 - t1) + (t3 - t4)) / 2,
+		rtt:    (t4 - t1) - (t3 - t2),
+		up:     t2 - t1,
+		down:   t4 - t3,
+	}
+	if s.rtt < 0 {
+		return
+	}
+
+	owdMu.Lock()
+	defer owdMu.Unlock()
+	if owdRecent = append(owdRecent, s); len(owdRecent) > owdFilterSize {
+		owdRecent = owdRecent[1:]
+	}
+	best := owdRecent[0]
+	for _, r := range owdRecent[1:] {
+		if r.rtt < best.rtt {
+			best = r
+		}
+	}
+	owdOffset = best.offset
+
+	upNs, downNs := s.up-owdOffset, s.down+owdOffset
+	if upNs < 0 {
+		upNs = 0
+	}
+	if downNs < 0 {
+		downNs = 0
+	}
+	owdUps = pushWindow(owdUps, upNs, owdBaseWindow)
+	owdDowns = pushWindow(owdDowns, downNs, owdBaseWindow)
+	up := float64(upNs) / float64(time.Millisecond)
+	down := float64(downNs) / float64(time.Millisecond)
+	if owdCount == 0 {
+		owdUp, owdDown = up, down
+	} else {
+		owdUp += owdEWMA * (up - owdUp)
+		owdDown += owdEWMA * (down - owdDown)
+	}
+	owdCount++
+	metricGauge("kcp_owd_uplink_ms", "", owdUp)
+	metricGauge("kcp_owd_downlink_ms", "", owdDown)
+}
+
+// pushWindow 追加样本，只保留最近 size 个
+func pushWindow(w []int64, v int64, size int) []int64 {
+	w = append(w, v)
+	if len(w) > size {
+		w = w[len(w)-size:]
+	}
+	return w
+}
+
+// minOf 窗口内的最小值
+func minOf(w []int64) int64 {
+	m := w[0]
+	for _, v := range w[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// snapshotOneWay 返回单向时延统计 (尚无样本时为 nil)
+func snapshotOneWay() *owdStats {
+	owdMu.Lock()
+	defer owdMu.Unlock()
+	if owdCount == 0 {
+		return nil
+	}
+	ms := float64(time.Millisecond)
+	s := &owdStats{
+		Uplink:    owdUp,
+		Downlink:  owdDown,
+		UpQueue:   owdUp - float64(minOf(owdUps))/ms,
+		DownQueue: owdDown - float64(minOf(owdDowns))/ms,
+		Asymmetry: owdUp - owdDown,
+		Offset:    float64(owdOffset) / ms,
+		Samples:   owdCount,
+	}
+	if s.UpQueue < 0 {
+		s.UpQueue = 0
+	}
+	if s.DownQueue < 0 {
+		s.DownQueue = 0
+	}
+	// 排队时延相差一倍以上且超过 20ms 时认为拥塞偏向一侧
+	switch {
+	case s.UpQueue > 20 && s.UpQueue > 2*s.DownQueue:
+		s.Congested = "up"
+	case s.DownQueue > 20 && s.DownQueue > 2*s.UpQueue:
+		s.Congested = "down"
+	}
+	return s
+}
+
+// resetOneWay 控制流重新开始时清空 (服务端可能已变化)
+func resetOneWay() {
+	owdMu.Lock()
+	owdRecent, owdUps, owdDowns = nil, nil, nil
+	owdUp, owdDown, owdCount, owdOffset = 0, 0, 0, 0
+	owdMu.Unlock()
+}
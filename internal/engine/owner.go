@@ -0,0 +1,63 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 宿主心跳: 多进程 App 中 UI 进程崩溃后，服务进程里的代理可能无人管理地一直运行。
+// 配置 ownertimeout 后 App 需定期调用 OwnerHeartbeat，超过 ownertimeout 秒没有调用时自动停止实例，
+// 停止前发送 "owner-lost" 事件。启动时视为收到一次心跳
+
+var ownerBeat int64 // 最近一次 OwnerHeartbeat 的时间 (UnixNano)
+
+// OwnerHeartbeat 宿主存活心跳，配置 ownertimeout 时需在超时前定期调用
+func OwnerHeartbeat() {
+	atomic.StoreInt64(&ownerBeat, clk.Now().UnixNano())
+}
+
+// resetOwner 每次启动时视为收到心跳
+func resetOwner() {
+	OwnerHeartbeat()
+}
+
+// checkOwner 宿主心跳超时时停止实例 (仅监管协程调用)
+func (s *sessionSupervisor) checkOwner() {
+	if s.config.OwnerTimeout <= 0 {
+		return
+	}
+	silent := clk.Since(time.Unix(0, atomic.LoadInt64(&ownerBeat)))
+	if silent < time.Duration(s.config.OwnerTimeout)*time.Second {
+		return
+	}
+
+	log.Printf("No owner heartbeat for %s, stopping", silent.Round(time.Second))
+	emitEvent("owner-lost", map[string]interface{}{"silent": silent.Seconds()})
+	// 在新协程中停止，避免 stopLocked 等待监管协程自身
+	go stopInstance(s.stop)
+}
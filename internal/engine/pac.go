@@ -0,0 +1,99 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// generatePAC 根据路由规则生成 PAC 文件
+// proxyAddr 为客户端访问代理使用的地址 (host:port)
+func generatePAC(config *Config, proxyAddr string) string {
+	var b strings.Builder
+
+	proxy := fmt.Sprintf("%s %s", config.PACType, proxyAddr)
+	if config.PACType == "SOCKS5" {
+		// 兼容不识别 SOCKS5 关键字的旧客户端
+		proxy += "; SOCKS " + proxyAddr
+	}
+	actions := map[string]string{
+		actionProxy:  proxy,
+		actionDirect: "DIRECT",
+		actionReject: proxy, // 由代理在识别出目标后拦截
+		actionAuto:   proxy, // 由代理竞速选择出口
+	}
+
+	fmt.Fprintf(&b, "// Generated by kcp_mobile %s\n", VERSION)
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+	var rules []Rule
+	if rs := currentRules(config); rs != nil {
+		rules = rs.rules
+	}
+	for _, r := range rules {
+		cond := pacCondition(r)
+		if cond == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\tif (%s) return %s;\n", cond, jsString(actions[r.Action]))
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n", jsString(actions[config.DefaultAction]))
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// pacCondition 将单条规则转换为 PAC 判断表达式
+func pacCondition(r Rule) string {
+	v := jsString(r.Value)
+	switch r.Type {
+	case "domain":
+		return "host == " + v
+	case "suffix":
+		return fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", v, jsString("."+r.Value))
+	case "keyword":
+		return fmt.Sprintf("host.indexOf(%s) >= 0", v)
+	case "wildcard":
+		return fmt.Sprintf("shExpMatch(host, %s)", v)
+	case "regex":
+		return fmt.Sprintf("new RegExp(%s, \"i\").test(host)", v)
+	case "cidr":
+		// PAC 的 isInNet 只支持 IPv4
+		if r.ipnet == nil || r.ipnet.IP.To4() == nil {
+			return ""
+		}
+		return fmt.Sprintf("isInNet(dnsResolve(host), %s, %s)",
+			jsString(r.ipnet.IP.String()), jsString(net.IP(r.ipnet.Mask).String()))
+	}
+	return ""
+}
+
+// jsString 转义为 JavaScript 字符串字面量
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,65 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+// 平滑发送: 按各会话的 RTT 把发送速率上限设为 sndwnd×mtu/srtt 的 pacingGain 倍，
+// 使一个窗口的数据分散在一个 RTT 内发出，避免整窗突发打满路径上的缓冲
+// 每个 wireSampleInterval 更新一次; 配置了 ratelimit 时以 ratelimit 为准，服务端通告了带宽上限时不超过上限
+// 配置 burstbudget 时会话空闲后的首段数据先以线速突发 (见 burst.go)
+
+const (
+	pacingGain    = 1.25
+	pacingMinRate = 64 << 10 // 最低速率字节/秒，避免 RTT 估计异常时卡住
+)
+
+// samplePacing 更新各会话的发送速率上限
+func samplePacing(config *Config) {
+	if !pacingOn(config) || config.RateLimit > 0 {
+		return
+	}
+	p := effectiveParams(config)
+	mtu := currentMTU(config)
+	limit := sessionRateCap()
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	for _, s := range proxySessions {
+		if !s.alive() || s.conn == nil {
+			continue
+		}
+		srtt := s.srtt()
+		if srtt <= 0 {
+			continue
+		}
+		rate := float64(p.SndWnd*mtu) * 1000 / float64(srtt) * pacingGain
+		if rate < pacingMinRate {
+			rate = pacingMinRate
+		}
+		if limit > 0 && rate > limit {
+			rate = limit
+		}
+		setPaceRate(s, uint32(rate))
+	}
+}
@@ -0,0 +1,377 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// 点对点隧道: 两台设备通过一个轻量的会合中介 (rendezvous) 交换候选地址，
+// 同时向对方的候选地址发送打洞报文，打通后直接在两台设备之间建立 KCP 会话，数据不经过中转服务器。
+//   - peerserve: 在中介上以 peerid 登记并保持 NAT 映射，接受直连的 KCP 会话，把每条流转发到 peerserve 目标
+//     (通常是本机上的 SOCKS 服务)
+//   - peerdial: 新建会话时先向 peerdial 对端打洞，失败时回退到经 remoteaddr 服务端中转，
+//     失败后 peerRetry 内不再尝试打洞
+//
+// 中介协议 (UDP，每个报文一条 JSON):
+//
+//	登记: {"type":"register","id":"本机","peer":"对端 (peerserve 时为空)","candidates":["本地地址:端口",...]}
+//	配对: {"type":"peer","id":"对端","candidates":["中介看到的对端公网地址:端口","对端本地地址:端口",...]}
+//
+// 中介在双方都登记后向两边各发送一条配对消息。打洞报文为 peerPunch/peerPunchAck 前缀加发送方 ID，
+// 打通之后的数据由 KCP 加密 (双方需配置相同的 key/crypt)
+
+const (
+	peerPunchTimeout     = 5 * time.Second        // 打洞的最长时间
+	peerPunchInterval    = 100 * time.Millisecond // 打洞报文的发送间隔
+	peerRegisterInterval = 500 * time.Millisecond // 打洞期间重发登记的间隔
+	peerKeepRegistered   = 15 * time.Second       // peerserve 重新登记的间隔 (保持 NAT 映射)
+	peerRetry            = time.Minute            // 打洞失败后回退到中转的时长
+)
+
+var (
+	peerPunch    = []byte("KCPM-PUNCH/1 ")
+	peerPunchAck = []byte("KCPM-PUNCH-ACK/1 ")
+
+	errPeerUnreachable = errors.New("hole punching timed out")
+)
+
+var (
+	statPeerDirect   uint64 // 打洞成功直连的会话数
+	statPeerRelayed  uint64 // 打洞失败回退中转的会话数
+	statPeerAccepted uint64 // peerserve 接受的直连会话数
+	peerFailedAt     int64  // 最近一次打洞失败的时间 (UnixNano)
+)
+
+// peerMessage 中介消息
+type peerMessage struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Peer       string   `json:"peer,omitempty"`
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+// peerStats 点对点统计
+type peerStats struct {
+	Direct   uint64 `json:"direct"`
+	Relayed  uint64 `json:"relayed"`
+	Accepted uint64 `json:"accepted"`
+}
+
+// resetPeer 清零点对点统计
+func resetPeer() {
+	atomic.StoreUint64(&statPeerDirect, 0)
+	atomic.StoreUint64(&statPeerRelayed, 0)
+	atomic.StoreUint64(&statPeerAccepted, 0)
+	atomic.StoreInt64(&peerFailedAt, 0)
+}
+
+// snapshotPeer 返回点对点统计 (未配置 rendezvous 时为 nil)
+func snapshotPeer(config *Config) *peerStats {
+	if config.Rendezvous == "" {
+		return nil
+	}
+	return &peerStats{
+		Direct:   atomic.LoadUint64(&statPeerDirect),
+		Relayed:  atomic.LoadUint64(&statPeerRelayed),
+		Accepted: atomic.LoadUint64(&statPeerAccepted),
+	}
+}
+
+// peerCandidates 本机各接口上 socket 端口的地址
+func peerCandidates(pconn net.PacketConn) []string {
+	port := pconn.LocalAddr().(*net.UDPAddr).Port
+	addrs, _ := net.InterfaceAddrs()
+	var list []string
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			list = append(list, net.JoinHostPort(ipnet.IP.String(), fmt.Sprint(port)))
+		}
+	}
+	return list
+}
+
+// listenPeer 创建打洞和 KCP 共用的 UDP socket 并解析中介地址
+func listenPeer(config *Config) (net.PacketConn, *net.UDPAddr, error) {
+	control, err := socketControl(config.Network)
+	if err != nil {
+		return nil, nil, err
+	}
+	pconn, err := listenKCP(config, control)
+	if err != nil {
+		return nil, nil, err
+	}
+	broker, err := net.ResolveUDPAddr("udp", config.Rendezvous)
+	if err != nil {
+		pconn.Close()
+		return nil, nil, err
+	}
+	return pconn, broker, nil
+}
+
+// sendPeer 向中介发送一条消息
+func sendPeer(pconn net.PacketConn, broker net.Addr, msg *peerMessage) {
+	b, _ := json.Marshal(msg)
+	pconn.WriteTo(b, broker)
+}
+
+// dialPeer 向 peerdial 对端打洞并建立 KCP 会话
+func dialPeer(config *Config, block kcp.BlockCrypt, dataShard, parityShard int) (*kcp.UDPSession, net.Conn, error) {
+	if failed := atomic.LoadInt64(&peerFailedAt); failed != 0 && clk.Since(time.Unix(0, failed)) < peerRetry {
+		return nil, nil, errPeerUnreachable
+	}
+	pconn, broker, err := listenPeer(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	raddr, err := punchPeer(config, pconn, broker)
+	if err != nil {
+		pconn.Close()
+		atomic.StoreInt64(&peerFailedAt, clk.Now().UnixNano())
+		atomic.AddUint64(&statPeerRelayed, 1)
+		return nil, nil, err
+	}
+
+	wire := newWireCounter(pconn)
+	sess, err := kcp.NewConn2(raddr, block, dataShard, parityShard, &peerConn{PacketConn: wire, config: config, broker: broker})
+	if err != nil {
+		pconn.Close()
+		return nil, nil, err
+	}
+	atomic.AddUint64(&statPeerDirect, 1)
+	log.Printf("Peer %s reached directly at %s", config.PeerDial, raddr)
+	emitEvent("peer-direct", map[string]interface{}{"peer": config.PeerDial, "addr": raddr.String()})
+	return sess, &boundConn{UDPSession: sess, pconn: pconn, wire: wire}, nil
+}
+
+// punchPeer 登记并等待配对，然后向对端的所有候选地址打洞，返回第一个打通的地址
+func punchPeer(config *Config, pconn net.PacketConn, broker *net.UDPAddr) (*net.UDPAddr, error) {
+	defer pconn.SetReadDeadline(time.Time{})
+	reg := &peerMessage{Type: "register", ID: config.PeerID, Peer: config.PeerDial, Candidates: peerCandidates(pconn)}
+	punch := append(append([]byte(nil), peerPunch...), config.PeerID...)
+	ack := append(append([]byte(nil), peerPunchAck...), config.PeerID...)
+
+	var candidates []*net.UDPAddr
+	var registered time.Time
+	buf := make([]byte, 1500)
+	deadline := clk.Now().Add(peerPunchTimeout)
+	for clk.Now().Before(deadline) {
+		if clk.Since(registered) >= peerRegisterInterval {
+			sendPeer(pconn, broker, reg)
+			registered = clk.Now()
+		}
+		for _, c := range candidates {
+			pconn.WriteTo(punch, c)
+		}
+
+		pconn.SetReadDeadline(clk.Now().Add(peerPunchInterval))
+		n, addr, err := pconn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		from, _ := addr.(*net.UDPAddr)
+		switch {
+		case from == nil:
+		case from.String() == broker.String():
+			var msg peerMessage
+			if json.Unmarshal(buf[:n], &msg) == nil && msg.Type == "peer" && msg.ID == config.PeerDial {
+				candidates = candidates[:0]
+				for _, c := range msg.Candidates {
+					if a, err := net.ResolveUDPAddr("udp", c); err == nil {
+						candidates = append(candidates, a)
+					}
+				}
+			}
+		case bytes.HasPrefix(buf[:n], peerPunch):
+			pconn.WriteTo(ack, from)
+			return from, nil
+		case bytes.HasPrefix(buf[:n], peerPunchAck):
+			return from, nil
+		}
+	}
+	return nil, errPeerUnreachable
+}
+
+// peerConn 过滤中介消息和打洞报文，其余报文交给 KCP
+// peerserve 时收到配对消息即向对端打洞，收到打洞报文时回复
+type peerConn struct {
+	net.PacketConn
+	config *Config
+	broker *net.UDPAddr
+}
+
+func (c *peerConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		switch {
+		case addr.String() == c.broker.String():
+			c.onBroker(b[:n])
+		case bytes.HasPrefix(b[:n], peerPunch):
+			c.PacketConn.WriteTo(append(append([]byte(nil), peerPunchAck...), c.config.PeerID...), addr)
+		case bytes.HasPrefix(b[:n], peerPunchAck):
+		default:
+			return n, addr, nil
+		}
+	}
+}
+
+// onBroker 处理中介的配对消息: 在 peerPunchTimeout 内持续向对端的候选地址打洞
+func (c *peerConn) onBroker(b []byte) {
+	var msg peerMessage
+	if json.Unmarshal(b, &msg) != nil || msg.Type != "peer" || c.config.PeerServe == "" {
+		return
+	}
+	var candidates []net.Addr
+	for _, s := range msg.Candidates {
+		if a, err := net.ResolveUDPAddr("udp", s); err == nil {
+			candidates = append(candidates, a)
+		}
+	}
+	punch := append(append([]byte(nil), peerPunch...), c.config.PeerID...)
+	go func() {
+		for end := clk.Now().Add(peerPunchTimeout); clk.Now().Before(end); clk.Sleep(peerPunchInterval) {
+			for _, a := range candidates {
+				c.PacketConn.WriteTo(punch, a)
+			}
+		}
+	}()
+	log.Printf("Peer %s requested a direct session, punching %d candidates", msg.ID, len(candidates))
+}
+
+// peerServeLoop 在中介上保持登记，接受直连的 KCP 会话
+func peerServeLoop(config *Config, stop chan struct{}) {
+	pconn, broker, err := listenPeer(config)
+	if err != nil {
+		logError("Peer serve:", err)
+		return
+	}
+	block, err := configBlockCrypt(config)
+	if err != nil {
+		pconn.Close()
+		logError("Peer serve:", err)
+		return
+	}
+	p := effectiveParams(config)
+	listener, err := kcp.ServeConn(block, p.DataShard, p.ParityShard, &peerConn{PacketConn: pconn, config: config, broker: broker})
+	if err != nil {
+		pconn.Close()
+		logError("Peer serve:", err)
+		return
+	}
+	go func() {
+		<-stop
+		listener.Close()
+		pconn.Close()
+	}()
+
+	// 定期登记，保持中介上的记录和 NAT 映射
+	go func() {
+		reg := &peerMessage{Type: "register", ID: config.PeerID, Candidates: peerCandidates(pconn)}
+		for {
+			sendPeer(pconn, broker, reg)
+			select {
+			case <-stop:
+				return
+			case <-clk.After(peerKeepRegistered):
+			}
+		}
+	}()
+
+	log.Printf("Peer serve: registered as %s at %s, forwarding to %s", config.PeerID, config.Rendezvous, config.PeerServe)
+	for {
+		sess, err := listener.AcceptKCP()
+		if err != nil {
+			select {
+			case <-stop:
+			default:
+				logError("Peer serve:", err)
+			}
+			return
+		}
+		tuneKCP(config, sess, p)
+		atomic.AddUint64(&statPeerAccepted, 1)
+		emitEvent("peer-accepted", map[string]interface{}{"addr": sess.RemoteAddr().String()})
+		go servePeerSession(config, sess)
+	}
+}
+
+// servePeerSession 在直连会话上作为 SMUX 服务端，把每条流转发到 peerserve 目标
+func servePeerSession(config *Config, sess *kcp.UDPSession) {
+	defer sess.Close()
+	var conn io.ReadWriteCloser = sess
+	if !*config.NoComp {
+		conn = newCompConn(sess)
+	}
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = config.SmuxVer
+	smuxConfig.MaxReceiveBuffer = config.SmuxBuf
+	smuxConfig.MaxStreamBuffer = config.StreamBuf
+	smuxConfig.MaxFrameSize = config.FrameSize
+	smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
+	mux, err := smux.Server(conn, smuxConfig)
+	if err != nil {
+		logError("Peer session:", err)
+		return
+	}
+	defer mux.Close()
+
+	for {
+		stream, err := mux.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			target, err := directDialer(config).Dial("tcp", config.PeerServe)
+			if err != nil {
+				connLog("Peer serve dial error:", err)
+				return
+			}
+			defer target.Close()
+			go func() {
+				relay(target, stream)
+				target.Close()
+			}()
+			relay(stream, target)
+		}()
+	}
+}
@@ -0,0 +1,123 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// 性能档位调整 GOMAXPROCS 和会话池锁的争用方式: 不调整线程 nice 值，Android 应用没有
+// CAP_SYS_NICE，降低后无法再恢复，且之后新建的线程继承的值不可控
+
+// 会话池锁 (proxyMu) 被占用时的等待方式
+const (
+	lockYield = iota // 先让出 P 给持锁者再阻塞，等待者不在核心上空转
+	lockBlock        // sync.Mutex 默认行为
+	lockSpin         // 先自旋重试 lockSpinTries 次再阻塞，避免休眠唤醒的延迟
+)
+
+var lockModeNames = [...]string{"yield", "block", "spin"}
+
+// lockSpinTries lockSpin 模式下阻塞前的重试次数 (持锁时间通常在微秒以内)
+const lockSpinTries = 100
+
+// perfProfile 性能档位
+type perfProfile struct {
+	procs func() int // GOMAXPROCS
+	lock  int32      // 会话池锁的争用方式
+}
+
+// perfProfiles 各档位的 GOMAXPROCS 和锁争用方式
+var perfProfiles = map[string]perfProfile{
+	// 省电: 限制为 2 个 P，减少调度器自旋和大核唤醒
+	"efficiency": {func() int { return minInt(runtime.NumCPU(), 2) }, lockYield},
+	// 均衡: 使用一半核心
+	"balanced": {func() int { return maxInt(runtime.NumCPU()/2, 2) }, lockBlock},
+	// 性能: 使用所有核心
+	"performance": {runtime.NumCPU, lockSpin},
+}
+
+var (
+	perfMu   sync.Mutex
+	lockMode int32 = lockBlock
+)
+
+// profileMutex 按性能档位决定争用时等待方式的互斥锁，用于新连接和会话选择等热路径
+type profileMutex struct {
+	sync.Mutex
+}
+
+// Lock 加锁，锁被占用时按 lockMode 让出、阻塞或自旋
+func (m *profileMutex) Lock() {
+	if m.TryLock() {
+		return
+	}
+	switch atomic.LoadInt32(&lockMode) {
+	case lockYield:
+		runtime.Gosched()
+	case lockSpin:
+		for i := 0; i < lockSpinTries; i++ {
+			if m.TryLock() {
+				return
+			}
+		}
+	}
+	m.Mutex.Lock()
+}
+
+// SetPerformanceProfile 设置性能档位
+// profile: "efficiency", "balanced" 或 "performance"
+// 调整 GOMAXPROCS (同时限制调度器自旋线程数) 和会话池锁被占用时的等待方式
+// 返回空字符串表示成功，否则返回错误信息
+func SetPerformanceProfile(profile string) string {
+	p, ok := perfProfiles[profile]
+	if !ok {
+		return "Unknown profile: " + profile
+	}
+
+	perfMu.Lock()
+	defer perfMu.Unlock()
+
+	procs := p.procs()
+	runtime.GOMAXPROCS(procs)
+	atomic.StoreInt32(&lockMode, p.lock)
+	log.Printf("Performance profile: %s (procs: %d, lock: %s)", profile, procs, lockModeNames[p.lock])
+	return ""
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
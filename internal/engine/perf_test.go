@@ -0,0 +1,114 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSetPerformanceProfile(t *testing.T) {
+	old, oldMode := runtime.GOMAXPROCS(0), atomic.LoadInt32(&lockMode)
+	t.Cleanup(func() {
+		runtime.GOMAXPROCS(old)
+		atomic.StoreInt32(&lockMode, oldMode)
+	})
+
+	if err := SetPerformanceProfile("turbo"); err == "" {
+		t.Fatal("unknown profile accepted")
+	}
+	for profile, want := range map[string]struct {
+		procs int
+		lock  int32
+	}{
+		"efficiency":  {minInt(runtime.NumCPU(), 2), lockYield},
+		"balanced":    {maxInt(runtime.NumCPU()/2, 2), lockBlock},
+		"performance": {runtime.NumCPU(), lockSpin},
+	} {
+		if err := SetPerformanceProfile(profile); err != "" {
+			t.Fatalf("%s: %s", profile, err)
+		}
+		if got := runtime.GOMAXPROCS(0); got != want.procs {
+			t.Errorf("%s: GOMAXPROCS %d, want %d", profile, got, want.procs)
+		}
+		if got := atomic.LoadInt32(&lockMode); got != want.lock {
+			t.Errorf("%s: lock mode %s, want %s", profile, lockModeNames[got], lockModeNames[want.lock])
+		}
+	}
+}
+
+func TestProfileMutex(t *testing.T) {
+	oldMode := atomic.LoadInt32(&lockMode)
+	t.Cleanup(func() { atomic.StoreInt32(&lockMode, oldMode) })
+
+	for mode, name := range lockModeNames {
+		atomic.StoreInt32(&lockMode, int32(mode))
+
+		// 持锁期间另一个 goroutine 必须等到解锁才能拿到锁
+		var mu profileMutex
+		mu.Lock()
+		acquired := make(chan struct{})
+		go func() {
+			mu.Lock()
+			close(acquired)
+			mu.Unlock()
+		}()
+		for i := 0; i < 10; i++ {
+			runtime.Gosched()
+		}
+		select {
+		case <-acquired:
+			t.Fatalf("%s: lock acquired while held", name)
+		default:
+		}
+		mu.Unlock()
+		<-acquired
+
+		// 高争用下仍然互斥
+		const workers, rounds = 8, 1000
+		var wg sync.WaitGroup
+		var inside int32
+		count := 0
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < rounds; i++ {
+					mu.Lock()
+					if atomic.AddInt32(&inside, 1) != 1 {
+						t.Errorf("%s: two holders", name)
+					}
+					count++
+					atomic.AddInt32(&inside, -1)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if count != workers*rounds {
+			t.Errorf("%s: count %d, want %d", name, count, workers*rounds)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"net"
+	"strconv"
+)
+
+// 端口专用会话: 目标端口在 pinnedports 中的连接 (如 3478 WebRTC TURN) 使用会话池的最后一个会话，
+// 该会话不参与其余连接的轮询，避免下载等批量流量造成的拥塞影响时延敏感的连接。
+// 需要在本地读取代理握手以得到目标端口
+
+// reservedSlotLocked 专用会话的槽位，未配置 pinnedports 时为 -1 (调用方需持有 proxyMu)
+func reservedSlotLocked() int {
+	if proxyConfig == nil || len(proxyConfig.PinnedPorts) == 0 || len(proxySessions) < 2 {
+		return -1
+	}
+	return len(proxySessions) - 1
+}
+
+// pinnedPort 目标端口是否使用专用会话
+func pinnedPort(config *Config, target string) bool {
+	return portListed(config.PinnedPorts, target)
+}
+
+// portListed 目标的端口是否在 ports 中
+func portListed(ports []int, target string) bool {
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, p := range ports {
+		if p == n {
+			return true
+		}
+	}
+	return false
+}
+
+// pinnedSession 返回存活的专用会话 (没有时返回 nil)
+func pinnedSession() *poolSession {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	if idx := reservedSlotLocked(); idx >= 0 && proxySessions[idx].alive() {
+		return proxySessions[idx]
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !nopprof && !js
+
+package engine
+
+import (
+	"log"
+	"net/http"
+	_ "net/http/pprof" // pprof 处理器注册在 http.DefaultServeMux
+)
+
+// pprof 诊断参数 (与 kcptun 一致)，使用 nopprof 构建标签时不提供 (见 pprof_off.go)
+
+const pprofAddr = "127.0.0.1:6060" // 仅监听本机，kcptun 监听 :6060
+
+// startPprof 在本机启动 pprof HTTP 服务，代理停止时关闭
+func startPprof(stop chan struct{}) {
+	srv := &http.Server{Addr: pprofAddr}
+	go func() {
+		<-stop
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logError("pprof:", err)
+		}
+	}()
+	log.Println("pprof listening on", pprofAddr)
+}
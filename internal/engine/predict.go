@@ -0,0 +1,113 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 断线预测: 服务端的 SMUX 心跳在会话空闲时按固定间隔到达，记录会话上的到达间隔，
+// 空闲间隔 (predictGapMin 以上) 的平滑值即服务端心跳间隔的估计。
+// 会话已稳定收到 predictMinGaps 个心跳后，连续 predictloss 个间隔没有收到任何数据即预测会话将要失效，
+// 先建立替换会话并切换新连接，不等 SMUX 超时 (3 个心跳间隔) 才发现断线；
+// 旧会话上的连接继续保留，心跳只是迟到时可以正常结束
+
+const (
+	predictGapMin  = time.Second // 短于此的到达间隔来自数据流量，不计入心跳估计
+	predictMinGaps = 3           // 至少观察到的心跳间隔数，之前不做预测
+)
+
+// noteGap 记录一次到达间隔 (仅 SMUX 接收协程调用)
+func (c *trackedConn) noteGap(gap time.Duration) {
+	if gap < predictGapMin {
+		return
+	}
+	old := atomic.LoadInt64(&c.gapAvg)
+	avg := int64(gap)
+	if old != 0 {
+		avg = old + (int64(gap)-old)/4
+	}
+	atomic.StoreInt64(&c.gapAvg, avg)
+	atomic.AddInt64(&c.gaps, 1)
+}
+
+// heartbeat 估计的服务端心跳间隔，观察到的间隔还不够时返回 0
+func (c *trackedConn) heartbeat() time.Duration {
+	if atomic.LoadInt64(&c.gaps) < predictMinGaps {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&c.gapAvg))
+}
+
+// predictLoss 检查各会话的心跳，预测将要失效的会话并提前替换 (仅监管协程调用)
+func (s *sessionSupervisor) predictLoss() {
+	if s.config.PredictLoss <= 0 || isHibernating() {
+		return
+	}
+
+	type candidate struct {
+		idx      int
+		session  *poolSession
+		idle     time.Duration
+		interval time.Duration
+	}
+	var found []candidate
+	proxyMu.Lock()
+	for i, session := range proxySessions {
+		if !session.alive() || session.tracked == nil || atomic.LoadInt32(&session.predicted) != 0 {
+			continue
+		}
+		interval := session.tracked.heartbeat()
+		if interval <= 0 {
+			continue
+		}
+		if idle := session.tracked.idle(); idle >= time.Duration(s.config.PredictLoss)*interval {
+			found = append(found, candidate{i, session, idle, interval})
+		}
+	}
+	proxyMu.Unlock()
+
+	for _, c := range found {
+		if !atomic.CompareAndSwapInt32(&c.session.predicted, 0, 1) {
+			continue
+		}
+		log.Printf("Session %d silent for %s (heartbeat %s), replacing early", c.idx, c.idle.Round(time.Second), c.interval.Round(time.Second))
+		metricCount("kcp_predicted_losses_total", "", 1)
+		emitEvent("session-predicted-loss", map[string]interface{}{
+			"index":     c.idx,
+			"idle":      c.idle.Seconds(),
+			"heartbeat": c.interval.Seconds(),
+		})
+		go func(c candidate) {
+			if err := replaceSession(c.idx, s.config, s.stop, drainTimeout); err != nil {
+				logErrorf("Session %d early replace: %v", c.idx, err)
+				// 替换失败时保留旧会话，之后可再次触发
+				atomic.StoreInt32(&c.session.predicted, 0)
+			}
+		}(c)
+	}
+}
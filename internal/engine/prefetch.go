@@ -0,0 +1,217 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNS 预解析: 在后台定期解析 remoteaddr 和地址簿中的服务器域名，
+// 重连和切换服务器时直接使用缓存的结果，不等待 DNS。
+// Go 的解析器不提供记录 TTL，缓存有效期取 dnsprefetch 配置的秒数；
+// 刷新失败时继续使用旧结果，并发送 "dns-prefetch-failed" 事件提前预警
+
+const prefetchTimeout = 5 * time.Second // 单个域名解析的最长时间
+
+// prefetchEntry 一个域名的预解析结果
+type prefetchEntry struct {
+	ips []net.IP
+	at  time.Time // 最近一次成功解析的时间
+	err error     // 最近一次解析的错误 (成功时为 nil)
+}
+
+var (
+	prefetchMu    sync.Mutex
+	prefetchCache = make(map[string]*prefetchEntry)
+)
+
+// prefetchInfo 预解析状态
+type prefetchInfo struct {
+	Host  string   `json:"host"`
+	IPs   []string `json:"ips,omitempty"`
+	Age   int64    `json:"age"`             // 距最近一次成功解析的秒数，-1 表示从未成功
+	Error string   `json:"error,omitempty"` // 最近一次解析失败的原因
+}
+
+// prefetchHosts 需要预解析的服务器域名 (IP 地址不需要)
+func prefetchHosts(config *Config) []string {
+	addrs := []string{config.RemoteAddr}
+	addrMu.Lock()
+	for _, p := range addrBook {
+		addrs = append(addrs, p.RemoteAddr)
+	}
+	addrMu.Unlock()
+
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil || seen[host] {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// prefetchResolver 与会话拨号使用同一网络的解析器
+func prefetchResolver(config *Config) *net.Resolver {
+	if config.Network != 0 {
+		if d, err := networkDialer(config.Network); err == nil {
+			return d.Resolver
+		}
+	}
+	return net.DefaultResolver
+}
+
+// prefetchLoop 按 dnsprefetch 间隔刷新所有服务器域名
+func prefetchLoop(config *Config, stop chan struct{}) {
+	interval := time.Duration(config.DNSPrefetch) * time.Second
+	for {
+		var wg sync.WaitGroup
+		for _, host := range prefetchHosts(config) {
+			wg.Add(1)
+			go func(host string) {
+				defer wg.Done()
+				prefetchHost(config, host)
+			}(host)
+		}
+		wg.Wait()
+
+		select {
+		case <-stop:
+			return
+		case <-clk.After(interval):
+		}
+	}
+}
+
+// prefetchHost 解析一个域名并更新缓存，由成功转为失败时发送事件
+func prefetchHost(config *Config, host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+	addrs, err := prefetchResolver(config).LookupIPAddr(ctx, host)
+	if err == nil {
+		ips := make([]net.IP, len(addrs))
+		for i, a := range addrs {
+			ips[i] = a.IP
+		}
+		storePrefetch(host, ips)
+		return
+	}
+
+	prefetchMu.Lock()
+	e := prefetchCache[host]
+	if e == nil {
+		e = &prefetchEntry{}
+		prefetchCache[host] = e
+	}
+	first := e.err == nil
+	e.err = err
+	stale := len(e.ips) > 0
+	prefetchMu.Unlock()
+
+	if first {
+		logErrorf("DNS prefetch for %s failed: %v", host, err)
+		emitEvent("dns-prefetch-failed", map[string]interface{}{"host": host, "error": err.Error(), "stale": stale})
+	}
+}
+
+// storePrefetch 记录成功的解析结果 (拨号时的解析也会更新缓存)
+func storePrefetch(host string, ips []net.IP) {
+	prefetchMu.Lock()
+	defer prefetchMu.Unlock()
+	e := prefetchCache[host]
+	if e == nil {
+		e = &prefetchEntry{}
+		prefetchCache[host] = e
+	}
+	e.ips, e.at, e.err = ips, clk.Now(), nil
+}
+
+// prefetched 返回 host 的缓存结果
+// stale 为 false 时只返回有效期内的结果，为 true 时也返回过期的结果 (实时解析失败时兜底)
+func prefetched(config *Config, host string, stale bool) []net.IP {
+	if config.DNSPrefetch <= 0 {
+		return nil
+	}
+	prefetchMu.Lock()
+	defer prefetchMu.Unlock()
+	e := prefetchCache[host]
+	if e == nil || len(e.ips) == 0 {
+		return nil
+	}
+	if !stale && clk.Since(e.at) > time.Duration(config.DNSPrefetch)*time.Second {
+		return nil
+	}
+	return e.ips
+}
+
+// prefetchedAddr 把 host:port 中的域名替换为缓存的 IP (没有有效缓存时原样返回)
+func prefetchedAddr(config *Config, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr
+	}
+	ips := prefetched(config, host, false)
+	if len(ips) == 0 {
+		return addr
+	}
+	return net.JoinHostPort(pickRemoteIP(ips).String(), port)
+}
+
+// snapshotPrefetch 返回当前服务器域名的预解析状态 (未启用时为 nil)
+func snapshotPrefetch(config *Config) []prefetchInfo {
+	if config.DNSPrefetch <= 0 {
+		return nil
+	}
+	hosts := prefetchHosts(config)
+	prefetchMu.Lock()
+	defer prefetchMu.Unlock()
+	list := make([]prefetchInfo, 0, len(hosts))
+	for _, host := range hosts {
+		info := prefetchInfo{Host: host, Age: -1}
+		e := prefetchCache[host]
+		if e == nil {
+			list = append(list, info)
+			continue
+		}
+		for _, ip := range e.ips {
+			info.IPs = append(info.IPs, ip.String())
+		}
+		if !e.at.IsZero() {
+			info.Age = int64(clk.Since(e.at).Seconds())
+		}
+		if e.err != nil {
+			info.Error = e.err.Error()
+		}
+		list = append(list, info)
+	}
+	return list
+}
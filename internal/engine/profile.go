@@ -0,0 +1,89 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 预设档位: profile 把一组相互配合的参数作为基础配置，配置中显式给出的字段仍然优先
+// 手工组合这些参数容易出错 (如小窗口配合关闭 fast3 会明显变慢)
+
+// profileAuto 按流量自动切换档位 (见 autoprofile.go)
+const profileAuto = "auto"
+
+// profilePreset 档位参数
+type profilePreset func(c *Config)
+
+var profiles = map[string]profilePreset{
+	// 交互: fast3 计时、小窗口减少排队、小包发送两份、ACK 立即发送、握手数据优先、不做平滑发送
+	"gaming": func(c *Config) {
+		c.Mode = "fast3"
+		c.SndWnd, c.RcvWnd = 64, 128
+		c.Duplicate = 256
+		c.Pacing = false
+		c.AckNodelay = true
+		c.BoostHandshakes = true
+	},
+	// 大流量: 大窗口、按 BDP 设置缓冲区并自动放大流窗口、平滑发送、按丢包建议 FEC
+	"download": func(c *Config) {
+		c.Mode = "fast"
+		c.SndWnd, c.RcvWnd = 1024, 2048
+		c.BDPBuffers = true
+		c.AutoStreamBuf = true
+		c.Pacing = true
+		c.AutoFEC = true
+	},
+	// 自动: 以配置本身为 balanced 档位，运行中按流量切换到 gaming/download 的会话参数
+	profileAuto: func(c *Config) {},
+}
+
+// applyProfile 以档位参数为基础重新解析配置 (未配置 profile 时原样返回)
+func applyProfile(configJson string, config *Config) (*Config, error) {
+	if config.Profile == "" {
+		return config, nil
+	}
+	preset, ok := profiles[config.Profile]
+	if !ok {
+		return nil, fmt.Errorf("Config Error: unknown profile: %s (%s)", config.Profile, profileNames())
+	}
+	var c Config
+	preset(&c)
+	if err := json.Unmarshal([]byte(configJson), &c); err != nil {
+		return nil, fmt.Errorf("Config Error: %v", err)
+	}
+	return &c, nil
+}
+
+// profileNames 支持的档位名
+func profileNames() string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,115 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !noprometheus && !js
+
+package engine
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// 控制端点的 /metrics: 以 Prometheus 文本格式输出内存后端的指标
+// 使用 noprometheus 构建标签时不提供 (见 prometheus_off.go)
+
+// handlePrometheus 在控制端点上注册 /metrics
+func handlePrometheus(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		memMetrics.writePrometheus(w)
+	})
+}
+
+// promLabels 将 "a=b,c=d" 转换为 Prometheus 标签格式，extra 为附加标签
+func promLabels(labels string, extra ...string) string {
+	var parts []string
+	if labels != "" {
+		for _, kv := range strings.Split(labels, ",") {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				parts = append(parts, fmt.Sprintf("%s=%q", k, v))
+			}
+		}
+	}
+	parts = append(parts, extra...)
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// splitKey 拆分 metricKey
+func splitKey(key string) (name, labels string) {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		return key[:i], strings.TrimSuffix(key[i+1:], "}")
+	}
+	return key, ""
+}
+
+// writePrometheus 以 Prometheus 文本格式输出所有指标
+func (m *memorySink) writePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	instance := fmt.Sprintf("instance=%q", currentLabel())
+	typed := make(map[string]bool)
+	header := func(name, kind string) {
+		if !typed[name] {
+			typed[name] = true
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		}
+	}
+
+	for _, key := range sortedKeys(m.counters) {
+		name, labels := splitKey(key)
+		header(name, "counter")
+		fmt.Fprintf(w, "%s%s %d\n", name, promLabels(labels, instance), m.counters[key])
+	}
+	for _, key := range sortedKeys(m.gauges) {
+		name, labels := splitKey(key)
+		header(name, "gauge")
+		fmt.Fprintf(w, "%s%s %g\n", name, promLabels(labels, instance), m.gauges[key])
+	}
+	for _, key := range sortedKeys(m.histograms) {
+		name, labels := splitKey(key)
+		h := m.histograms[key]
+		header(name, "histogram")
+		for i, le := range histogramBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels(labels, instance, fmt.Sprintf("le=\"%g\"", le)), h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels(labels, instance, "le=\"+Inf\""), h.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, promLabels(labels, instance), h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, promLabels(labels, instance), h.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
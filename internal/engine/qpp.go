@@ -0,0 +1,68 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"net"
+
+	"github.com/xtaci/qpp"
+)
+
+// QPP (Quantum Permutation Pad): 与 kcptun 的 --QPP/--QPPCount 一致，
+// 在 KCP 连接与 SMUX 之间按字节置换混淆，置换表和 PRNG 种子均由原始 Key 生成
+
+// qppConn 与 kcptun 的 QPPPort 相同: 读写方向各用一个 PRNG
+type qppConn struct {
+	net.Conn
+	pad   *qpp.QuantumPermutationPad
+	wprng *qpp.Rand
+	rprng *qpp.Rand
+}
+
+// newQPPConn 用配置的置换表包装连接
+func newQPPConn(conn net.Conn, config *Config) (net.Conn, error) {
+	c := &qppConn{Conn: conn, pad: config.secrets.qpp}
+	err := config.secrets.qppSeed.use(func(seed []byte) error {
+		c.wprng = c.pad.CreatePRNG(seed)
+		c.rprng = c.pad.CreatePRNG(seed)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *qppConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.pad.DecryptWithPRNG(b[:n], c.rprng)
+	return n, err
+}
+
+// Write 与 kcptun 一致，原地加密 (SMUX 每次写入的都是已发送完毕即丢弃的帧)
+func (c *qppConn) Write(b []byte) (int, error) {
+	c.pad.EncryptWithPRNG(b, c.wprng)
+	return c.Conn.Write(b)
+}
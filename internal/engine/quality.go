@@ -0,0 +1,204 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// 连接质量评分: 由重传率、RTT、抖动、重连次数和下行缓冲膨胀合成 0~100 的分数，
+// 每个 wireSampleInterval 采样一次并做指数平滑，App 可直接据此显示信号格
+
+const (
+	qualityAlpha = 0.2 // 平滑系数
+
+	qualityLossMax      = 40 // 各项最大扣分
+	qualityRTTMax       = 25
+	qualityJitterMax    = 15
+	qualityReconnectMax = 20
+	qualityBloatMax     = 10
+
+	qualityRTTGood   = 50  // 低于此 RTT 毫秒不扣分
+	qualityRTTBad    = 500 // 高于此 RTT 毫秒扣满
+	qualityJitterBad = 200 // RTT 方差高于此毫秒扣满
+)
+
+// qualityRatings 分数下限 -> 评级 (从高到低)，信号格数为 len-1-下标
+var qualityRatings = [...]struct {
+	min   float64
+	label string
+}{
+	{80, "excellent"},
+	{60, "good"},
+	{40, "fair"},
+	{20, "poor"},
+	{0, "bad"},
+}
+
+// qualityState 评分状态
+type qualityState struct {
+	mu         sync.Mutex
+	valid      bool
+	score      float64 // 平滑后的分数
+	loss       float64 // 最近采样周期的重传率
+	rtt        float64 // 存活会话平均 RTT 毫秒
+	jitter     float64 // 存活会话平均 RTT 方差毫秒
+	reconnects uint64  // 最近采样周期的重连次数
+	bloat      float64 // 下行缓冲膨胀分数 0~100
+
+	lastOut, lastRetrans, lastReconnects uint64
+}
+
+var quality qualityState
+
+// resetQuality 启动时清空评分
+func resetQuality() {
+	snmp := kcp.DefaultSnmp.Copy()
+	quality.mu.Lock()
+	quality.valid = false
+	quality.lastOut, quality.lastRetrans = snmp.OutSegs, snmp.RetransSegs
+	quality.lastReconnects = atomic.LoadUint64(&statReconnects)
+	quality.mu.Unlock()
+}
+
+// sampleQuality 采样一次并更新平滑分数
+func sampleQuality() {
+	var rtt, jitter float64
+	var alive, total int
+	proxyMu.Lock()
+	for _, s := range proxySessions {
+		total++
+		if !s.alive() {
+			continue
+		}
+		alive++
+		rtt += float64(s.srtt())
+		if s.conn != nil {
+			jitter += float64(s.conn.GetSRTTVar())
+		}
+	}
+	proxyMu.Unlock()
+	if alive > 0 {
+		rtt /= float64(alive)
+		jitter /= float64(alive)
+	}
+
+	snmp := kcp.DefaultSnmp.Copy()
+	reconnects := atomic.LoadUint64(&statReconnects)
+	bloat := currentBloat()
+
+	quality.mu.Lock()
+	defer quality.mu.Unlock()
+	q := &quality
+	var loss float64
+	if out := snmp.OutSegs - q.lastOut; snmp.OutSegs > q.lastOut && out > 0 {
+		loss = float64(snmp.RetransSegs-q.lastRetrans) / float64(out)
+	}
+	q.reconnects = 0
+	if reconnects > q.lastReconnects {
+		q.reconnects = reconnects - q.lastReconnects
+	}
+	q.lastOut, q.lastRetrans, q.lastReconnects = snmp.OutSegs, snmp.RetransSegs, reconnects
+	q.loss, q.rtt, q.jitter, q.bloat = loss, rtt, jitter, bloat
+
+	score := 0.0
+	if alive > 0 {
+		score = 100 -
+			math.Min(qualityLossMax, loss*qualityLossMax*10) -
+			qualityRTTMax*clamp01((rtt-qualityRTTGood)/(qualityRTTBad-qualityRTTGood)) -
+			qualityJitterMax*clamp01(jitter/qualityJitterBad) -
+			math.Min(qualityReconnectMax, float64(q.reconnects)*qualityReconnectMax/2) -
+			qualityBloatMax*bloat/100
+		score = math.Max(0, score)
+		// 部分会话断开时按存活比例折算
+		score *= float64(alive) / float64(total)
+	}
+	if !q.valid {
+		q.score, q.valid = score, true
+	} else {
+		q.score += qualityAlpha * (score - q.score)
+	}
+	metricGauge("kcp_quality_score", "", q.score)
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// qualityStats 连接质量评分
+type qualityStats struct {
+	Score      int     `json:"score"`      // 0~100
+	Bars       int     `json:"bars"`       // 信号格 0~4
+	Rating     string  `json:"rating"`     // excellent/good/fair/poor/bad
+	Loss       float64 `json:"loss"`       // 最近采样周期重传率
+	RTT        float64 `json:"rtt"`        // 平均 RTT 毫秒
+	Jitter     float64 `json:"jitter"`     // 平均 RTT 方差毫秒
+	Reconnects uint64  `json:"reconnects"` // 最近采样周期重连次数
+	Bloat      int     `json:"bloat"`      // 下行缓冲膨胀分数 0~100
+}
+
+// snapshotQuality 返回评分，尚未采样时返回 nil
+func snapshotQuality() *qualityStats {
+	quality.mu.Lock()
+	defer quality.mu.Unlock()
+
+	q := &quality
+	if !q.valid {
+		return nil
+	}
+	s := &qualityStats{
+		Score:      int(math.Round(q.score)),
+		Loss:       q.loss,
+		RTT:        q.rtt,
+		Jitter:     q.jitter,
+		Reconnects: q.reconnects,
+		Bloat:      int(math.Round(q.bloat)),
+	}
+	for i, r := range qualityRatings {
+		if q.score >= r.min {
+			s.Bars, s.Rating = len(qualityRatings)-1-i, r.label
+			break
+		}
+	}
+	return s
+}
+
+// GetQualityScore 返回 0~100 的连接质量评分，未运行或尚未采样时返回 -1
+func GetQualityScore() int {
+	proxyMu.Lock()
+	running := proxyRunning()
+	proxyMu.Unlock()
+	if !running {
+		return -1
+	}
+	if q := snapshotQuality(); q != nil {
+		return q.Score
+	}
+	return -1
+}
@@ -0,0 +1,254 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// auto 动作: 对规则无法确定出口的目标，同时发起直连和隧道连接，先建立成功的一方胜出，
+// 胜出的出口按 host 缓存 autottl 秒，期间直接使用，不再竞速
+// 普通 HTTP 代理请求 (非 CONNECT) 无法在不发送请求的情况下竞速，未命中缓存时走隧道
+
+const autoCacheLimit = 4096 // 缓存的最大 host 数
+
+type autoEntry struct {
+	action  string
+	expires time.Time
+}
+
+var (
+	autoMu    sync.Mutex
+	autoCache = make(map[string]autoEntry)
+
+	autoWins [2]uint64 // 竞速胜出次数: 0 直连, 1 隧道
+)
+
+// cachedAuto 返回缓存的胜出出口，未缓存或已过期返回空
+func cachedAuto(host string) string {
+	autoMu.Lock()
+	defer autoMu.Unlock()
+
+	e, ok := autoCache[host]
+	if !ok {
+		return ""
+	}
+	if clk.Now().After(e.expires) {
+		delete(autoCache, host)
+		return ""
+	}
+	return e.action
+}
+
+// storeAuto 缓存胜出的出口
+func storeAuto(config *Config, host, action string) {
+	autoMu.Lock()
+	defer autoMu.Unlock()
+
+	now := clk.Now()
+	if len(autoCache) >= autoCacheLimit {
+		for h, e := range autoCache {
+			if now.After(e.expires) {
+				delete(autoCache, h)
+			}
+		}
+		if len(autoCache) >= autoCacheLimit {
+			autoCache = make(map[string]autoEntry)
+		}
+	}
+	autoCache[host] = autoEntry{action: action, expires: now.Add(time.Duration(config.AutoTTL) * time.Second)}
+
+	if action == actionDirect {
+		atomic.AddUint64(&autoWins[0], 1)
+	} else {
+		atomic.AddUint64(&autoWins[1], 1)
+	}
+}
+
+// resetAutoCache 清空竞速缓存 (规则变化或代理重启时)
+func resetAutoCache() {
+	autoMu.Lock()
+	autoCache = make(map[string]autoEntry)
+	autoMu.Unlock()
+}
+
+// autoWinStats 返回竞速胜出次数
+func autoWinStats() map[string]uint64 {
+	return map[string]uint64{
+		actionDirect: atomic.LoadUint64(&autoWins[0]),
+		actionProxy:  atomic.LoadUint64(&autoWins[1]),
+	}
+}
+
+// resolveAuto 按缓存或竞速为 auto 动作选择出口
+// 竞速时返回胜出一方已建立的连接: 直连为 TCP 连接，隧道为已完成代理握手的流
+func resolveAuto(config *Config, session *poolSession, hs *proxyHandshake, host string) (string, net.Conn, error) {
+	if action := cachedAuto(host); action != "" {
+		return action, nil, nil
+	}
+	if hs.proto == 'H' && !hs.connect {
+		return actionProxy, nil, nil
+	}
+	action, conn, err := raceOutbound(config, session, hs)
+	if err != nil {
+		return "", nil, err
+	}
+	storeAuto(config, host, action)
+	return action, conn, nil
+}
+
+type raceResult struct {
+	action string
+	conn   net.Conn
+	err    error
+}
+
+// raceOutbound 同时直连和通过隧道连接目标，返回先成功的一方
+// 隧道一方返回时已完成与服务端的代理握手，客户端的应答由调用方发送
+func raceOutbound(config *Config, session *poolSession, hs *proxyHandshake) (string, net.Conn, error) {
+	results := make(chan raceResult, 2)
+	go func() {
+		conn, err := directDialer(config).Dial("tcp", hs.target)
+		results <- raceResult{actionDirect, conn, err}
+	}()
+	go func() {
+		conn, err := openTunnel(session, hs)
+		results <- raceResult{actionProxy, conn, err}
+	}()
+
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err == nil {
+			if i == 0 {
+				go closeLoser(results)
+			}
+			return r.action, r.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", r.action, r.err)
+		}
+	}
+	return "", nil, firstErr
+}
+
+// closeLoser 关闭竞速中后完成的连接
+func closeLoser(results chan raceResult) {
+	if r := <-results; r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+// openTunnel 打开流并与服务端完成代理握手
+func openTunnel(session *poolSession, hs *proxyHandshake) (*smux.Stream, error) {
+	stream, err := session.openAdmitted()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(hs.head); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if err := skipReply(stream, hs.swallow); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	stream.SetReadDeadline(clk.Now().Add(directDialTimeout))
+	err = readProxyReply(stream, hs)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// readProxyReply 读取服务端对连接请求的应答，不多读后续数据
+func readProxyReply(r io.Reader, hs *proxyHandshake) error {
+	switch hs.proto {
+	case 5:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return fmt.Errorf("SOCKS5 connect failed: %d", b[1])
+		}
+		var n int
+		switch b[3] {
+		case 1:
+			n = 4
+		case 4:
+			n = 16
+		case 3:
+			l := make([]byte, 1)
+			if _, err := io.ReadFull(r, l); err != nil {
+				return err
+			}
+			n = int(l[0])
+		default:
+			return errBadHandshake
+		}
+		_, err := io.ReadFull(r, make([]byte, n+2))
+		return err
+	case 4:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		if b[1] != 0x5a {
+			return fmt.Errorf("SOCKS4 connect failed: %d", b[1])
+		}
+		return nil
+	case 'H':
+		// 逐字节读取响应头，避免读入之后的数据
+		var head []byte
+		c := make([]byte, 1)
+		for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+			if _, err := io.ReadFull(r, c); err != nil {
+				return err
+			}
+			head = append(head, c[0])
+			if len(head) > httpHeadLimit {
+				return errBadHandshake
+			}
+		}
+		fields := bytes.Fields(head)
+		if len(fields) < 2 || !bytes.Equal(fields[1], []byte("200")) {
+			return fmt.Errorf("HTTP CONNECT failed: %s", bytes.SplitN(head, []byte("\r\n"), 2)[0])
+		}
+		return nil
+	}
+	return errBadHandshake
+}
@@ -0,0 +1,113 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 滑动速率: 累计字节数之外，引擎按 1s/10s/60s 时间常数计算上下行速率的指数平均 (EMA)，
+// App 不必自行对累计计数做差分，也不必处理重启后计数归零。
+// 不另开定时器，在每次读取统计和每个 wireSampleInterval 时按经过的时间更新，
+// 两次更新之间按平均速率计入 (1s 窗口的精度取决于 App 读取统计的频率)
+
+// rateWindows 各窗口的时间常数
+var rateWindows = [...]time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+var (
+	rateMu   sync.Mutex
+	rateLast [2]uint64 // 上次更新时的上行/下行累计字节
+	rateAt   time.Time
+	rateEMA  [2][len(rateWindows)]float64
+)
+
+// windowRates 单个方向各窗口的速率 (字节/秒)
+type windowRates struct {
+	R1s  float64 `json:"1s"`
+	R10s float64 `json:"10s"`
+	R60s float64 `json:"60s"`
+}
+
+// rateStats 上下行滑动速率
+type rateStats struct {
+	Up   windowRates `json:"up"`
+	Down windowRates `json:"down"`
+}
+
+// resetRates 启动时清空
+func resetRates() {
+	rateMu.Lock()
+	rateLast = [2]uint64{atomic.LoadUint64(&statBytesUp), atomic.LoadUint64(&statBytesDown)}
+	rateAt = clk.Now()
+	rateEMA = [2][len(rateWindows)]float64{}
+	rateMu.Unlock()
+}
+
+// updateRatesLocked 按距上次更新经过的时间推进各窗口 (调用方需持有 rateMu)
+func updateRatesLocked() {
+	now := clk.Now()
+	dt := now.Sub(rateAt)
+	if rateAt.IsZero() {
+		dt = 0
+	}
+	cur := [2]uint64{atomic.LoadUint64(&statBytesUp), atomic.LoadUint64(&statBytesDown)}
+	if dt <= 0 {
+		rateLast, rateAt = cur, now
+		return
+	}
+	for dir := range cur {
+		var rate float64
+		// 计数回绕或被清零时本次不计入
+		if cur[dir] >= rateLast[dir] {
+			rate = float64(cur[dir]-rateLast[dir]) / dt.Seconds()
+		}
+		for i, w := range rateWindows {
+			alpha := 1 - math.Exp(-dt.Seconds()/w.Seconds())
+			rateEMA[dir][i] += alpha * (rate - rateEMA[dir][i])
+		}
+	}
+	rateLast, rateAt = cur, now
+}
+
+// sampleRates 定期推进 (App 长时间不读取统计时保持 60s 窗口连续)
+func sampleRates() {
+	rateMu.Lock()
+	updateRatesLocked()
+	rateMu.Unlock()
+}
+
+// snapshotRates 返回当前的滑动速率
+func snapshotRates() *rateStats {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	updateRatesLocked()
+	window := func(e [len(rateWindows)]float64) windowRates {
+		return windowRates{R1s: e[0], R10s: e[1], R60s: e[2]}
+	}
+	return &rateStats{Up: window(rateEMA[0]), Down: window(rateEMA[1])}
+}
@@ -0,0 +1,147 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// 日志脱敏: redactlogs 开启时 (默认开启，debug 时默认关闭)，日志、事件和 DumpState 中的
+// IP 地址和主机名替换为 "ip-xxxxxx"/"host-xxxxxx"，密钥等配置中的敏感字符串替换为 "<redacted>"，
+// 诊断信息可以直接分享而不泄露服务器地址。
+// 同一地址在一次运行中替换结果相同 (便于对照)，哈希使用每次启动随机的盐，不能通过枚举地址还原。
+// 回环和未指定地址 (127.0.0.1、::1、0.0.0.0) 不替换
+
+var (
+	redactIPv4 = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	redactIPv6 = regexp.MustCompile(`\[?\b[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}\b\]?`)
+	redactHost = regexp.MustCompile(`\b(?:[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?\.)+[A-Za-z]{2,}\b`)
+)
+
+// redactKeepSuffix 看起来像主机名但实际是文件名的后缀，不替换
+var redactKeepSuffix = []string{".log", ".json", ".csv", ".txt", ".pem", ".go"}
+
+// redactMinSecret 短于此长度的敏感字符串不替换 (避免误伤普通文本)
+const redactMinSecret = 4
+
+// activeRedactor 当前的脱敏规则 (nil 表示不脱敏)，在启动时按配置设置
+var activeRedactor atomic.Pointer[redactor]
+
+// redactor 一次运行的脱敏规则
+type redactor struct {
+	salt    uint64
+	secrets []string
+}
+
+// setRedaction 按配置设置脱敏规则 (调用方需持有 proxyMu)
+// 已在脱敏时沿用原来的盐，启动前后 (如自动选择服务器、重启) 同一个值的替换结果不变
+func setRedaction(config *Config) {
+	if !*config.RedactLogs {
+		activeRedactor.Store(nil)
+		return
+	}
+	r := &redactor{}
+	if old := activeRedactor.Load(); old != nil {
+		r.salt = old.salt
+	} else {
+		var b [8]byte
+		rand.Read(b[:])
+		r.salt = binary.LittleEndian.Uint64(b[:])
+	}
+	for _, s := range []string{config.Key, config.LocalTLSKey} {
+		if len(s) >= redactMinSecret {
+			r.secrets = append(r.secrets, s)
+		}
+	}
+	activeRedactor.Store(r)
+}
+
+// redactText 按当前规则脱敏一段文本 (未开启时原样返回)
+func redactText(s string) string {
+	r := activeRedactor.Load()
+	if r == nil {
+		return s
+	}
+	return r.redact(s)
+}
+
+func (r *redactor) redact(s string) string {
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, "<redacted>")
+	}
+	s = redactIPv4.ReplaceAllStringFunc(s, func(m string) string { return r.maskIP(m, m) })
+	s = redactIPv6.ReplaceAllStringFunc(s, func(m string) string { return r.maskIP(m, strings.Trim(m, "[]")) })
+	return redactHost.ReplaceAllStringFunc(s, r.maskHost)
+}
+
+// maskIP 替换合法的非回环 IP (m 为匹配的原文，ip 为去掉方括号的地址)
+func (r *redactor) maskIP(m, ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsLoopback() || parsed.IsUnspecified() {
+		return m
+	}
+	return r.token("ip", parsed.String())
+}
+
+func (r *redactor) maskHost(m string) string {
+	lower := strings.ToLower(m)
+	if lower == "localhost" {
+		return m
+	}
+	for _, suffix := range redactKeepSuffix {
+		if strings.HasSuffix(lower, suffix) {
+			return m
+		}
+	}
+	return r.token("host", lower)
+}
+
+// token 同一运行中相同的值得到相同的替换结果
+func (r *redactor) token(kind, v string) string {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, r.salt)
+	io.WriteString(h, v)
+	return fmt.Sprintf("%s-%06x", kind, h.Sum64()&0xffffff)
+}
+
+// redactWriter 写出前对每行日志脱敏
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redactText(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
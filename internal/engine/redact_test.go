@@ -0,0 +1,98 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigRedactLogs(t *testing.T) {
+	for configJson, want := range map[string]bool{
+		`{"remoteaddr": "203.0.113.1:4000"}`:                                       true,
+		`{"remoteaddr": "203.0.113.1:4000", "debug": true}`:                        false,
+		`{"remoteaddr": "203.0.113.1:4000", "redactlogs": false}`:                  false,
+		`{"remoteaddr": "203.0.113.1:4000", "debug": true, "redactlogs": true}`:    true,
+		`{"remoteaddr": "203.0.113.1:4000", "apiversion": 1, "redactlogs": false}`: false,
+	} {
+		config, err := parseConfig(configJson)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *config.RedactLogs != want {
+			t.Errorf("parseConfig(%s): redactlogs %v, want %v", configJson, *config.RedactLogs, want)
+		}
+	}
+}
+
+// TestRedactBeforeLogFile 打开日志文件前输出的配置相关日志 (未知字段等) 同样脱敏，
+// 且与之后写入日志文件的替换结果一致
+func TestRedactBeforeLogFile(t *testing.T) {
+	if isolated(t) {
+		return
+	}
+	dir := t.TempDir()
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	old := os.Stderr
+	os.Stderr = stderr
+	defer func() { os.Stderr = old }()
+
+	logPath := filepath.Join(dir, "kcp.log")
+	configJson := tunnelConfig(t, freeLocalAddr(t), map[string]interface{}{
+		"conn":            1,
+		"log":             logPath,
+		"vps.example.com": true, // 未知字段，在打开日志文件前输出
+	})
+	if err := StartProxy(configJson); err != "" {
+		t.Fatal(err)
+	}
+	log.Println("dialing vps.example.com")
+	StopProxy()
+
+	early, err := os.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	late, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(early)+string(late), "vps.example.com") {
+		t.Fatalf("host leaked:\n%s\n%s", early, late)
+	}
+	m := regexp.MustCompile(`Unknown config field: (host-[0-9a-f]{6})`).FindSubmatch(early)
+	if m == nil {
+		t.Fatalf("unknown field not logged (redacted) before the log file:\n%s", early)
+	}
+	if !strings.Contains(string(late), "dialing "+string(m[1])) {
+		t.Errorf("log file uses a different token than %s:\n%s", m[1], late)
+	}
+}
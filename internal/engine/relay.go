@@ -0,0 +1,94 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// 转发路径
+// writeto:  源实现 io.WriterTo (SMUX 流)，直接把接收缓冲写入目标，省去中间缓冲
+// readfrom: 目标是内核套接字且源也是套接字，由 net.TCPConn.ReadFrom 在 Linux/Android 上走 splice
+// buffer:   通用路径，使用池化缓冲区
+const (
+	copyWriteTo = iota
+	copyReadFrom
+	copyBuffer
+	numCopyPaths
+)
+
+var copyPathNames = [numCopyPaths]string{"writeto", "readfrom", "buffer"}
+
+// 各转发路径的使用次数 (调试统计)
+var copyPathCount [numCopyPaths]uint64
+
+const relayBufSize = 32 * 1024
+
+var relayBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, relayBufSize)
+		return &b
+	},
+}
+
+// relay 从 src 复制到 dst 直到 EOF 或出错，选择开销最小的路径
+// dst 可能是统计/限速包装器；SMUX 流的 Write 在对端窗口耗尽时阻塞，天然形成背压
+func relay(dst io.Writer, src io.Reader) (int64, error) {
+	if wt, ok := src.(io.WriterTo); ok && !isSocket(src) {
+		atomic.AddUint64(&copyPathCount[copyWriteTo], 1)
+		return wt.WriteTo(dst)
+	}
+	if rf, ok := dst.(io.ReaderFrom); ok && isSocket(dst) && isSocket(src) {
+		atomic.AddUint64(&copyPathCount[copyReadFrom], 1)
+		return rf.ReadFrom(src)
+	}
+
+	atomic.AddUint64(&copyPathCount[copyBuffer], 1)
+	buf := relayBufPool.Get().(*[]byte)
+	defer relayBufPool.Put(buf)
+	// 隐藏 src 的 WriterTo，避免 io.CopyBuffer 绕过池化缓冲区
+	return io.CopyBuffer(dst, struct{ io.Reader }{src}, *buf)
+}
+
+// isSocket 判断是否为内核套接字 (可参与 splice)
+func isSocket(v interface{}) bool {
+	switch v.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// copyPathStats 返回各转发路径的使用次数
+func copyPathStats() map[string]uint64 {
+	m := make(map[string]uint64, numCopyPaths)
+	for i, name := range copyPathNames {
+		m[name] = atomic.LoadUint64(&copyPathCount[i])
+	}
+	return m
+}
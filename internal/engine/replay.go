@@ -0,0 +1,226 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// 流重放: 目标端口在 replayports 中的连接 (如 80 上的幂等 HTTP GET) 在本地应答代理握手，
+// 并缓存客户端发出的请求数据 (最多 replayBufferLimit)。所属会话在收到任何响应数据前断开时，
+// 在另一个存活会话上打开新流，重新发送握手和缓存的请求，客户端感知不到短暂的断线。
+// 收到响应、请求超出缓存上限或流被服务端正常关闭后不再重放。
+// 只适用于幂等的协议: 服务端可能已收到并处理了第一次请求
+
+const (
+	replayBufferLimit = 64 << 10
+	replayWait        = 5 * time.Second // 等待可用会话的最长时间
+	replayPoll        = 100 * time.Millisecond
+)
+
+var (
+	statReplays        uint64 // 成功重放的流数
+	statReplayFailures uint64 // 需要重放但失败的流数
+)
+
+var errReplayNoSession = errors.New("no alive session for replay")
+
+// replayConn 可在会话断开后切换到新流的隧道端
+type replayConn struct {
+	hs   *proxyHandshake
+	info *streamInfo
+
+	mu      sync.Mutex
+	stream  *smux.Stream
+	session *poolSession
+	gen     int    // 每次重放加一
+	buf     []byte // 已发送的请求数据
+	armed   bool   // 仍可重放
+	closed  bool
+}
+
+func newReplayConn(hs *proxyHandshake, info *streamInfo, stream *smux.Stream, session *poolSession) *replayConn {
+	return &replayConn{hs: hs, info: info, stream: stream, session: session}
+}
+
+// arm 握手重放完成后开始缓存请求数据
+func (r *replayConn) arm() {
+	r.mu.Lock()
+	r.armed, r.buf = true, nil
+	r.mu.Unlock()
+}
+
+// current 当前流及其代数
+func (r *replayConn) current() (*smux.Stream, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stream, r.gen
+}
+
+func (r *replayConn) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	if r.armed {
+		if len(r.buf)+len(p) > replayBufferLimit {
+			r.armed, r.buf = false, nil
+		} else {
+			r.buf = append(r.buf, p...)
+		}
+	}
+	stream, gen := r.stream, r.gen
+	r.mu.Unlock()
+
+	n, err := stream.Write(p)
+	if err != nil && r.recover(gen) {
+		// 重放时已连同 p 一起重新发送
+		return len(p), nil
+	}
+	return n, err
+}
+
+func (r *replayConn) Read(p []byte) (int, error) {
+	for {
+		stream, gen := r.current()
+		n, err := stream.Read(p)
+		if n > 0 {
+			r.mu.Lock()
+			r.armed, r.buf = false, nil
+			r.mu.Unlock()
+			return n, err
+		}
+		if err != nil && r.recover(gen) {
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close 关闭当前流
+func (r *replayConn) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	stream := r.stream
+	r.mu.Unlock()
+	return stream.Close()
+}
+
+// recover 第 gen 代的流出错后尝试重放，返回 true 表示已切换到新流
+func (r *replayConn) recover(gen int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if gen != r.gen {
+		// 另一方向已完成重放
+		return !r.closed
+	}
+	if r.closed || !r.armed || !r.session.IsClosed() {
+		return false
+	}
+	r.armed = false
+
+	stream, session, err := r.replayLocked()
+	if err != nil {
+		atomic.AddUint64(&statReplayFailures, 1)
+		logErrorf("Stream %d replay failed: %v", r.info.id, err)
+		return false
+	}
+	r.stream.Close()
+	r.stream, r.session = stream, session
+	r.gen++
+	r.armed = true
+	atomic.AddUint64(&statReplays, 1)
+	metricCount("kcp_stream_replays_total", "", 1)
+	emitEvent("stream-replayed", map[string]interface{}{
+		"id":     r.info.id,
+		"target": r.hs.target,
+		"bytes":  len(r.buf),
+	})
+	return true
+}
+
+// replayLocked 在另一个存活会话上重新发送握手和请求 (调用方持有 r.mu)
+func (r *replayConn) replayLocked() (*smux.Stream, *poolSession, error) {
+	var session *poolSession
+	deadline := clk.Now().Add(replayWait)
+	for {
+		if session = pickAliveSession(); session != nil && session != r.session {
+			break
+		}
+		if !clk.Now().Before(deadline) {
+			return nil, nil, errReplayNoSession
+		}
+		clk.Sleep(replayPoll)
+	}
+
+	stream, err := session.openAdmitted()
+	if err != nil {
+		return nil, nil, err
+	}
+	req := append(append(append([]byte(nil), r.hs.head...), r.hs.early...), r.buf...)
+	if _, err := stream.Write(req); err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+	if err := skipReply(stream, r.hs.swallow); err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+	if len(r.hs.head) > 0 {
+		stream.SetReadDeadline(clk.Now().Add(directDialTimeout))
+		err := readProxyReply(stream, r.hs)
+		stream.SetReadDeadline(time.Time{})
+		if err != nil {
+			stream.Close()
+			return nil, nil, fmt.Errorf("replay handshake: %v", err)
+		}
+	}
+	return stream, session, nil
+}
+
+// replayable 连接是否按 replayports 开启重放
+func replayable(config *Config, target string) bool {
+	return portListed(config.ReplayPorts, target)
+}
+
+// replayStats 流重放统计
+type replayStats struct {
+	Replays  uint64 `json:"replays"`
+	Failures uint64 `json:"failures"`
+}
+
+// snapshotReplay 返回流重放统计 (未配置 replayports 时为 nil)
+func snapshotReplay(config *Config) *replayStats {
+	if len(config.ReplayPorts) == 0 {
+		return nil
+	}
+	return &replayStats{
+		Replays:  atomic.LoadUint64(&statReplays),
+		Failures: atomic.LoadUint64(&statReplayFailures),
+	}
+}
@@ -0,0 +1,124 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 休眠唤醒: 设备深度睡眠时单调时钟停止而墙上时钟继续走，唤醒后两者的差值就是睡眠时长。
+// 此时 NAT 映射多半已经过期，而心跳计时器还认为会话刚刚活跃，唤醒后的第一个请求常常失败。
+// 监管协程发现睡眠超过 resumeGap 后立即探测所有会话: 发出一个帧并等待服务端的 KCP 报文，
+// 在 resumeProbeTimeout 内没有收到任何报文的会话立即重建 (现有流已收不到数据，不等待排空)。
+// 没有收包统计的会话 (TLS 传输、外部传入的连接) 无法探测，没有流时直接重建
+
+const (
+	resumeGap           = 5 * time.Second // 睡眠超过该时长才探测
+	resumeProbeTimeout  = 3 * time.Second // 等待服务端报文的最长时间
+	resumeProbeInterval = 50 * time.Millisecond
+)
+
+// checkResume 比较墙上时钟和单调时钟的流逝，发现系统睡眠后探测会话
+func (s *sessionSupervisor) checkResume() {
+	now := clk.Now()
+	last := s.lastTick
+	s.lastTick = now
+	if last.IsZero() || isHibernating() {
+		return
+	}
+	// Round(0) 去掉单调时钟读数，按墙上时钟相减
+	slept := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+	if slept < resumeGap {
+		return
+	}
+
+	log.Printf("System resumed after %s asleep, probing sessions", slept.Round(time.Second))
+	metricCount("kcp_resumes_total", "", 1)
+	emitEvent("resume", map[string]interface{}{"slept": slept.Seconds()})
+	go probeAfterResume(s.config, s.stop)
+}
+
+// probeAfterResume 并发探测所有存活会话，重建没有响应的会话
+func probeAfterResume(config *Config, stop chan struct{}) {
+	proxyMu.Lock()
+	sessions := append([]*poolSession(nil), proxySessions...)
+	proxyMu.Unlock()
+
+	var wg sync.WaitGroup
+	for i, session := range sessions {
+		if !session.alive() {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, session *poolSession) {
+			defer wg.Done()
+			if session.probeResume(config) {
+				return
+			}
+			if !atomic.CompareAndSwapInt32(&session.suspect, 0, 1) {
+				return
+			}
+			log.Printf("Session %d silent after resume, recycling", idx)
+			metricCount("kcp_resume_recycled_total", "", 1)
+			emitEvent("session-resume-dead", map[string]interface{}{"index": idx})
+			if err := replaceSession(idx, config, stop, 0); err != nil {
+				logErrorf("Session %d resume recycle: %v", idx, err)
+				atomic.StoreInt32(&session.suspect, 0)
+			}
+		}(i, session)
+	}
+	wg.Wait()
+}
+
+// probeResume 发出一个帧并等待服务端的报文 (KCP ACK)，返回会话是否仍然可用
+func (s *poolSession) probeResume(config *Config) bool {
+	w := s.wire()
+	if w == nil {
+		return s.NumStreams() > 0
+	}
+	before := atomic.LoadUint64(&w.inPkts)
+	if s.tracked != nil {
+		s.sendNOP(byte(config.SmuxVer))
+	} else {
+		// SYN 和 FIN 帧同样会让服务端回复 ACK
+		stream, err := s.OpenStream()
+		if err != nil {
+			return false
+		}
+		stream.Close()
+	}
+
+	deadline := clk.Now().Add(resumeProbeTimeout)
+	for clk.Now().Before(deadline) {
+		if atomic.LoadUint64(&w.inPkts) != before {
+			return true
+		}
+		clk.Sleep(resumeProbeInterval)
+	}
+	return atomic.LoadUint64(&w.inPkts) != before
+}
@@ -0,0 +1,74 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestRestartCycles 用户快速开关代理: 同一端口连续启动/停止 100 次，
+// 每轮都有客户端连接 (停止后监听端口上留下 TIME_WAIT 等状态)，不应出现地址占用
+func TestRestartCycles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("restart stress test")
+	}
+	if isolated(t) {
+		return
+	}
+	localAddr := freeLocalAddr(t)
+	config := tunnelConfig(t, localAddr, nil)
+	t.Cleanup(StopProxy)
+	base := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		if err := StartProxy(config); err != "" {
+			t.Fatalf("cycle %d: start: %s", i, err)
+		}
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			StopProxy()
+			t.Fatalf("cycle %d: dial: %v", i, err)
+		}
+		// 服务端接受流后立即关闭，读到 EOF 说明连接经过了本次启动的会话
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		StopProxy()
+		if err != io.EOF {
+			t.Fatalf("cycle %d: read: %v", i, err)
+		}
+	}
+
+	// 停止后后台协程应全部退出
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left after stop", runtime.NumGoroutine()-base)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,362 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 路由动作
+const (
+	actionProxy  = "proxy"
+	actionDirect = "direct"
+	actionReject = "reject" // 识别出目标后立即以 RST 关闭连接 (广告/跟踪拦截)
+	actionAuto   = "auto"   // 直连和隧道竞速，按 host 缓存胜出的一方
+)
+
+// Rule 路由规则
+type Rule struct {
+	Type    string `json:"type"`    // 匹配类型: domain (完整域名), suffix (域名后缀), wildcard (通配符，如 *.example.com), keyword (关键字), regex (正则), cidr (IP 网段), geoip (国家代码，需要 geoipdb)
+	Value   string `json:"value"`   // 匹配值
+	Action  string `json:"action"`  // 动作: proxy, direct, reject, auto
+	Class   string `json:"class"`   // 连接类别，用于 classshares 按类别整形 (默认空)
+	Resolve string `json:"resolve"` // socksresolve 为 rules 时命中该规则的 SOCKS5 域名目标的解析方: local, remote (默认空即 remote)
+
+	ipnet *net.IPNet     // cidr 规则解析结果
+	re    *regexp.Regexp // regex/wildcard 规则编译结果
+}
+
+// ruleSet 预编译的规则集，保持"按顺序第一条命中"的语义:
+// 完整域名用哈希表，后缀和 *.xxx 通配符用按标签反向的 trie，
+// 其余 (关键字、正则、一般通配符、网段) 线性匹配，只检查序号小于当前最优的规则
+type ruleSet struct {
+	rules   []Rule
+	domains map[string]int // 完整域名 -> 最小规则序号
+	suffix  *suffixNode
+	linear  []int    // 需要线性匹配的规则序号 (升序)
+	geoip   bool     // 是否包含 geoip 规则
+	local   bool     // 是否包含 direct/auto 规则或带 class 的规则 (需要在本地完成握手)
+	hits    []uint64 // 各规则命中次数
+}
+
+// suffixNode 域名后缀 trie 节点，从顶级域开始逐级向下
+type suffixNode struct {
+	children map[string]*suffixNode
+	self     int // suffix 规则: 匹配该域名及其子域名的最小序号，-1 表示无
+	sub      int // *.xxx 规则: 只匹配子域名的最小序号，-1 表示无
+}
+
+func newSuffixNode() *suffixNode {
+	return &suffixNode{self: -1, sub: -1}
+}
+
+// insert 插入后缀，返回对应节点
+func (n *suffixNode) insert(domain string) *suffixNode {
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*suffixNode)
+			}
+			child = newSuffixNode()
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// match 返回 host 命中的最小规则序号，-1 表示未命中
+func (n *suffixNode) match(host string) int {
+	best := -1
+	for end := len(host); end > 0; {
+		start := strings.LastIndexByte(host[:end], '.') + 1
+		child, ok := n.children[host[start:end]]
+		if !ok {
+			break
+		}
+		n = child
+		best = minIndex(best, n.self)
+		if start > 0 {
+			best = minIndex(best, n.sub)
+		}
+		end = start - 1
+	}
+	return best
+}
+
+// minIndex 更新最小序号
+func minIndex(best, idx int) int {
+	if idx >= 0 && (best < 0 || idx < best) {
+		return idx
+	}
+	return best
+}
+
+// wildcardRegexp 将 shExpMatch 风格的通配符 (* 任意字符, ? 单个字符) 转换为正则
+func wildcardRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// compileRules 校验并预处理路由规则，返回预编译的规则集
+func compileRules(rules []Rule) (*ruleSet, error) {
+	rs := &ruleSet{
+		rules:   rules,
+		domains: make(map[string]int),
+		suffix:  newSuffixNode(),
+		hits:    make([]uint64, len(rules)),
+	}
+	for i := range rules {
+		r := &rules[i]
+		r.Value = strings.TrimSpace(r.Value)
+		if r.Type != "regex" {
+			r.Value = strings.ToLower(r.Value)
+		}
+		if r.Value == "" {
+			return nil, fmt.Errorf("rule %d: empty value", i)
+		}
+		if r.Class != "" {
+			rs.local = true
+		}
+		switch r.Resolve {
+		case "", socksResolveRemote:
+		case socksResolveLocal:
+			rs.local = true
+		default:
+			return nil, fmt.Errorf("rule %d: unknown resolve: %s", i, r.Resolve)
+		}
+		switch r.Action {
+		case actionDirect, actionAuto:
+			rs.local = true
+		case actionProxy, actionReject:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown action: %s", i, r.Action)
+		}
+		switch r.Type {
+		case "domain":
+			if _, ok := rs.domains[r.Value]; !ok {
+				rs.domains[r.Value] = i
+			}
+		case "suffix":
+			r.Value = strings.TrimPrefix(r.Value, ".")
+			n := rs.suffix.insert(r.Value)
+			n.self = minIndex(n.self, i)
+		case "wildcard":
+			// *.example.com 只匹配子域名，走 trie；其他形式转换为正则
+			if rest := strings.TrimPrefix(r.Value, "*."); rest != r.Value && !strings.ContainsAny(rest, "*?") {
+				n := rs.suffix.insert(rest)
+				n.sub = minIndex(n.sub, i)
+				break
+			}
+			re, err := wildcardRegexp(r.Value)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+			r.re = re
+			rs.linear = append(rs.linear, i)
+		case "regex":
+			re, err := regexp.Compile("(?i)" + r.Value)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+			r.re = re
+			rs.linear = append(rs.linear, i)
+		case "keyword":
+			rs.linear = append(rs.linear, i)
+		case "cidr":
+			_, ipnet, err := net.ParseCIDR(r.Value)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+			r.ipnet = ipnet
+			rs.linear = append(rs.linear, i)
+		case "geoip":
+			r.Value = strings.ToUpper(r.Value)
+			if len(r.Value) != 2 {
+				return nil, fmt.Errorf("rule %d: invalid country code: %s", i, r.Value)
+			}
+			rs.geoip = true
+			rs.linear = append(rs.linear, i)
+		default:
+			return nil, fmt.Errorf("rule %d: unknown type: %s", i, r.Type)
+		}
+	}
+	return rs, nil
+}
+
+// match 返回命中的最小规则序号，-1 表示未命中
+func (rs *ruleSet) match(host string) int {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip := net.ParseIP(host)
+
+	best := -1
+	if idx, ok := rs.domains[host]; ok {
+		best = idx
+	}
+	country, looked := "", false
+	if ip == nil {
+		best = minIndex(best, rs.suffix.match(host))
+	}
+	for _, i := range rs.linear {
+		if best >= 0 && i > best {
+			break
+		}
+		r := &rs.rules[i]
+		var hit bool
+		switch r.Type {
+		case "keyword":
+			hit = strings.Contains(host, r.Value)
+		case "wildcard", "regex":
+			hit = r.re.MatchString(host)
+		case "cidr":
+			hit = ip != nil && r.ipnet.Contains(ip)
+		case "geoip":
+			if ip != nil && !looked {
+				country, looked = lookupCountry(ip), true
+			}
+			hit = country != "" && country == r.Value
+			if hit {
+				atomic.AddUint64(&statGeoIPMatches, 1)
+			}
+		}
+		if hit {
+			return i
+		}
+	}
+	return best
+}
+
+// rulesMu 保护运行中配置的 Rules/subRules/ruleSet (UpdateRules 和订阅会整体替换)
+var rulesMu sync.RWMutex
+
+// currentRules 返回当前生效的规则集
+func currentRules(config *Config) *ruleSet {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return config.ruleSet
+}
+
+// matchRule 按顺序匹配规则，返回动作；未命中返回默认动作
+func matchRule(config *Config, host string) string {
+	if rs := currentRules(config); rs != nil {
+		if idx := rs.match(host); idx >= 0 {
+			atomic.AddUint64(&rs.hits[idx], 1)
+			return rs.rules[idx].Action
+		}
+	}
+	return config.DefaultAction
+}
+
+// ruleHit 规则命中统计
+type ruleHit struct {
+	Index  int    `json:"index"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Action string `json:"action"`
+	Hits   uint64 `json:"hits"`
+}
+
+// topRules 返回命中次数最多的前 n 条规则
+func topRules(config *Config, n int) []ruleHit {
+	rs := currentRules(config)
+	if rs == nil {
+		return nil
+	}
+	var list []ruleHit
+	for i := range rs.rules {
+		if hits := atomic.LoadUint64(&rs.hits[i]); hits > 0 {
+			r := &rs.rules[i]
+			list = append(list, ruleHit{Index: i, Type: r.Type, Value: r.Value, Action: r.Action, Hits: hits})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hits > list[j].Hits })
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+var (
+	statRuleRejects uint64 // reject 规则拦截的连接数
+	errRuleRejected = errors.New("rejected by rule")
+)
+
+// checkTarget 识别出目标后按规则处理，reject 时返回 errRuleRejected
+func checkTarget(config *Config, target string) error {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	if matchRule(config, host) == actionReject {
+		atomic.AddUint64(&statRuleRejects, 1)
+		return errRuleRejected
+	}
+	return nil
+}
+
+// MatchRule 用配置中的规则匹配 host (不需要启动代理，GeoIP 规则仅在代理运行时生效)
+// 返回 JSON: {"action": "...", "index": 命中的规则序号 (-1 表示使用默认动作), "error": "..."}
+func MatchRule(configJson string, host string) string {
+	result := struct {
+		Action string `json:"action,omitempty"`
+		Index  int    `json:"index"`
+		Error  string `json:"error,omitempty"`
+	}{Index: -1}
+
+	config, err := parseConfig(configJson)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		result.Action = config.DefaultAction
+		if idx := config.ruleSet.match(host); idx >= 0 {
+			result.Index, result.Action = idx, config.ruleSet.rules[idx].Action
+		}
+	}
+	b, _ := json.Marshal(result)
+	return string(b)
+}
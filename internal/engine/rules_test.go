@@ -0,0 +1,153 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRuleSetMatch(t *testing.T) {
+	rs, err := compileRules([]Rule{
+		{Type: "domain", Value: "Exact.example.com", Action: actionDirect},
+		{Type: "wildcard", Value: "*.ads.example.com", Action: actionReject},
+		{Type: "suffix", Value: ".example.com", Action: actionProxy},
+		{Type: "keyword", Value: "tracker", Action: actionReject},
+		{Type: "regex", Value: `^cdn\d+\.net$`, Action: actionDirect},
+		{Type: "wildcard", Value: "img?.*.org", Action: actionDirect},
+		{Type: "cidr", Value: "10.0.0.0/8", Action: actionDirect},
+		{Type: "suffix", Value: "ads.example.com", Action: actionDirect}, // 被前面的规则覆盖
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host string
+		want int
+	}{
+		{"exact.example.com", 0},
+		{"EXACT.example.com.", 0},
+		{"x.ads.example.com", 1},
+		{"a.b.ads.example.com", 1},
+		{"ads.example.com", 2}, // *.xxx 只匹配子域名
+		{"example.com", 2},
+		{"www.example.com", 2},
+		{"badexample.com", -1},
+		{"tracker.example.com", 2}, // 序号更小的后缀规则优先
+		{"tracker.io", 3},
+		{"CDN42.net", 4},
+		{"cdn.net", -1},
+		{"img1.static.org", 5},
+		{"img12.static.org", -1},
+		{"10.1.2.3", 6},
+		{"11.1.2.3", -1},
+		{"com", -1},
+		{"", -1},
+	} {
+		if got := rs.match(c.host); got != c.want {
+			t.Errorf("match(%q) = %d, want %d", c.host, got, c.want)
+		}
+	}
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	for _, rules := range [][]Rule{
+		{{Type: "domain", Value: " ", Action: actionProxy}},
+		{{Type: "domain", Value: "a.com", Action: "drop"}},
+		{{Type: "prefix", Value: "a.com", Action: actionProxy}},
+		{{Type: "regex", Value: "(", Action: actionProxy}},
+		{{Type: "cidr", Value: "10.0.0.0/33", Action: actionProxy}},
+		{{Type: "geoip", Value: "USA", Action: actionProxy}},
+		{{Type: "domain", Value: "a.com", Action: actionProxy, Resolve: "both"}},
+	} {
+		if _, err := compileRules(rules); err == nil {
+			t.Errorf("compileRules(%+v) succeeded", rules[0])
+		}
+	}
+}
+
+// benchRules 社区规则列表规模的规则集: 大量完整域名和后缀，少量正则和关键字
+func benchRules(n int) []Rule {
+	rules := make([]Rule, 0, n+4)
+	for i := 0; i < n; i++ {
+		typ := "suffix"
+		switch i % 3 {
+		case 0:
+			typ = "domain"
+		case 1:
+			rules = append(rules, Rule{Type: "wildcard", Value: fmt.Sprintf("*.w%d.example%d.com", i, i%97), Action: actionDirect})
+			continue
+		}
+		rules = append(rules, Rule{Type: typ, Value: fmt.Sprintf("d%d.example%d.com", i, i%97), Action: actionProxy})
+	}
+	rules = append(rules,
+		Rule{Type: "keyword", Value: "doubleclick", Action: actionReject},
+		Rule{Type: "regex", Value: `^ad[0-9]+\.`, Action: actionReject},
+		Rule{Type: "wildcard", Value: "*track*", Action: actionReject},
+		Rule{Type: "cidr", Value: "192.168.0.0/16", Action: actionDirect},
+	)
+	return rules
+}
+
+func BenchmarkRuleSet(b *testing.B) {
+	for _, n := range []int{1000, 50000} {
+		rs, err := compileRules(benchRules(n))
+		if err != nil {
+			b.Fatal(err)
+		}
+		last := n/3*3 - 3 // 最后一条 domain 规则，其后第二条为 suffix
+		for _, host := range []string{
+			fmt.Sprintf("d%d.example%d.com", last, last%97),           // 完整域名
+			fmt.Sprintf("a.b.d%d.example%d.com", last+2, (last+2)%97), // 后缀
+			fmt.Sprintf("x.w%d.example%d.com", last+1, (last+1)%97),   // *.xxx 通配符
+			"www.unlisted-domain.org",                                 // 未命中，遍历所有线性规则
+			"192.168.1.1",
+		} {
+			if hit := rs.match(host) >= 0; hit != (host != "www.unlisted-domain.org") {
+				b.Fatalf("match(%q) hit = %v", host, hit)
+			}
+			b.Run(fmt.Sprintf("%d/%s", n, host), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					rs.match(host)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkRuleSetLinear 不使用 trie 时逐条匹配的开销，作为对照
+func BenchmarkRuleSetLinear(b *testing.B) {
+	rules := benchRules(50000)
+	for i := range rules {
+		if rules[i].Type == "domain" || rules[i].Type == "suffix" {
+			rules[i].Type = "keyword"
+		}
+	}
+	rs, err := compileRules(rules)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		rs.match("www.unlisted-domain.org")
+	}
+}
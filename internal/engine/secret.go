@@ -0,0 +1,203 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"crypto/sha1"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xtaci/qpp"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// 密钥隔离与清零: 预共享密钥在启动时派生为加密密钥和签名密钥，保存在
+// 锁定内存 (平台支持时) 的独立缓冲区中，原始 Key 随即从配置中清除。
+// 每个配置 (包括地址簿中的每个服务器) 持有各自的缓冲区，互不共享。
+// StopProxy 和 ClearSecrets 会将缓冲区清零。
+// 注意: 调用方传入的 JSON 字符串由 Go 运行时管理，无法清零。
+
+var errSecretWiped = errors.New("secret has been wiped")
+
+// 密钥审计计数
+var (
+	secretsMu      sync.Mutex
+	liveSecrets    = make(map[*secretBuf]struct{})
+	secretsCreated uint64
+	secretsWiped   uint64
+	secretsLocked  uint64 // 成功锁定内存的缓冲区数
+)
+
+// secretBuf 可清零的密钥缓冲区
+type secretBuf struct {
+	mu     sync.Mutex
+	b      []byte
+	locked bool
+}
+
+// newSecret 接管 b 的所有权 (调用方不应再使用 b)
+func newSecret(b []byte) *secretBuf {
+	s := &secretBuf{b: b}
+	if len(b) > 0 && lockMemory(b) == nil {
+		s.locked = true
+		atomic.AddUint64(&secretsLocked, 1)
+	}
+	atomic.AddUint64(&secretsCreated, 1)
+
+	secretsMu.Lock()
+	liveSecrets[s] = struct{}{}
+	secretsMu.Unlock()
+	return s
+}
+
+// use 在持有锁的情况下访问密钥，fn 不得保留 b
+func (s *secretBuf) use(fn func(b []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.b == nil {
+		return errSecretWiped
+	}
+	return fn(s.b)
+}
+
+// wipe 清零并释放缓冲区，可重复调用
+func (s *secretBuf) wipe() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.b != nil {
+		zero(s.b)
+		if s.locked {
+			unlockMemory(s.b)
+		}
+		s.b = nil
+		atomic.AddUint64(&secretsWiped, 1)
+	}
+	s.mu.Unlock()
+
+	secretsMu.Lock()
+	delete(liveSecrets, s)
+	secretsMu.Unlock()
+}
+
+// zero 清零字节切片
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// configSecrets 一个配置派生出的全部密钥
+type configSecrets struct {
+	block *secretBuf // KCP 加密密钥 (pbkdf2，与 kcptun 一致)
+	ctrl  *secretBuf // 控制流签名密钥
+
+	// QPP 置换表和 PRNG 种子 (仅 qpp 开启时，种子为原始 Key)
+	// 置换表由 qpp 库持有，无法清零
+	qpp     *qpp.QuantumPermutationPad
+	qppSeed *secretBuf
+}
+
+// deriveSecrets 由预共享密钥派生加密/签名密钥，并清除配置中的原始 Key
+func deriveSecrets(config *Config) {
+	if config.secrets != nil {
+		return
+	}
+	key := []byte(config.Key)
+	config.secrets = &configSecrets{
+		block: newSecret(pbkdf2.Key(key, []byte(SALT), 4096, 32, sha1.New)),
+		ctrl:  newSecret(pbkdf2.Key(key, []byte(ctrlHMACContext), 4096, 32, sha1.New)),
+	}
+	if config.QPP {
+		config.secrets.qpp = qpp.NewQPP(key, uint16(config.QPPCount))
+		config.secrets.qppSeed = newSecret(append([]byte(nil), key...))
+	}
+	zero(key)
+	config.Key = ""
+}
+
+// wipeSecrets 清零配置持有的密钥
+func wipeSecrets(config *Config) {
+	if config == nil || config.secrets == nil {
+		return
+	}
+	config.secrets.block.wipe()
+	config.secrets.ctrl.wipe()
+	config.secrets.qppSeed.wipe()
+}
+
+// secretStats 密钥审计统计
+type secretStats struct {
+	Live    int    `json:"live"`    // 当前未清零的缓冲区数
+	Created uint64 `json:"created"` // 累计创建数
+	Wiped   uint64 `json:"wiped"`   // 累计清零数
+	Locked  uint64 `json:"locked"`  // 累计锁定内存成功数
+}
+
+// snapshotSecrets 返回密钥审计统计
+func snapshotSecrets() secretStats {
+	secretsMu.Lock()
+	live := len(liveSecrets)
+	secretsMu.Unlock()
+
+	return secretStats{
+		Live:    live,
+		Created: atomic.LoadUint64(&secretsCreated),
+		Wiped:   atomic.LoadUint64(&secretsWiped),
+		Locked:  atomic.LoadUint64(&secretsLocked),
+	}
+}
+
+// ClearSecrets 清零所有密钥缓冲区，并丢弃保存的基础配置和地址簿
+// 代理运行中时返回错误 (运行中的会话重连需要密钥)
+// 返回空字符串表示成功，否则返回错误信息
+func ClearSecrets() string {
+	proxyMu.Lock()
+	running := proxyRunning()
+	proxyMu.Unlock()
+	if running {
+		return "Proxy running"
+	}
+
+	addrMu.Lock()
+	baseConfig = ""
+	addrBook = nil
+	addrMu.Unlock()
+
+	secretsMu.Lock()
+	live := make([]*secretBuf, 0, len(liveSecrets))
+	for s := range liveSecrets {
+		live = append(live, s)
+	}
+	secretsMu.Unlock()
+
+	for _, s := range live {
+		s.wipe()
+	}
+	return ""
+}
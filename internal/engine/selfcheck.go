@@ -0,0 +1,194 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// 启动自检: 逐项检查启动前提，返回机器可读结果
+// 每项带稳定的 code 和 params，App 可据此显示本地化的提示，message 仅供日志
+
+const selfCheckTimeout = 3 * time.Second
+
+// minClockYear 系统时间早于该年份视为时钟未同步
+const minClockYear = 2024
+
+// checkResult 单项检查结果
+type checkResult struct {
+	Name    string                 `json:"name"`   // config, localport, egress, dns, clock, memory
+	Status  string                 `json:"status"` // pass, fail, skip
+	Code    string                 `json:"code,omitempty"`
+	Message string                 `json:"message,omitempty"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+}
+
+func checkPass(name string, params map[string]interface{}) checkResult {
+	return checkResult{Name: name, Status: "pass", Params: params}
+}
+
+func checkFail(name, code string, err error, params map[string]interface{}) checkResult {
+	return checkResult{Name: name, Status: "fail", Code: code, Message: err.Error(), Params: params}
+}
+
+func checkSkip(name, code string) checkResult {
+	return checkResult{Name: name, Status: "skip", Code: code}
+}
+
+// SelfCheck 检查启动前提: 配置、本地端口、出站连通 (UDP/TCP)、remoteaddr 解析、系统时钟、可用内存
+// 返回 JSON: {"ok": bool, "checks": [{"name", "status", "code", "message", "params"}]}
+// 配置无效时后续依赖配置的检查标记为 skip
+func SelfCheck(configJson string) string {
+	result := struct {
+		OK     bool          `json:"ok"`
+		Checks []checkResult `json:"checks"`
+	}{OK: true}
+
+	config, err := parseConfig(configJson)
+	if err != nil {
+		result.Checks = append(result.Checks,
+			checkFail("config", "config_invalid", err, nil),
+			checkSkip("localport", "config_invalid"),
+			checkSkip("egress", "config_invalid"),
+			checkSkip("dns", "config_invalid"),
+		)
+	} else {
+		result.Checks = append(result.Checks,
+			checkPass("config", nil),
+			checkLocalPort(config),
+		)
+		host, port, _ := net.SplitHostPort(config.RemoteAddr)
+		dns, ip := checkDNS(host)
+		result.Checks = append(result.Checks, checkEgress(config, ip, port), dns)
+	}
+	result.Checks = append(result.Checks, checkClock(), checkMemory(config))
+
+	for _, c := range result.Checks {
+		if c.Status == "fail" {
+			result.OK = false
+		}
+	}
+	b, _ := json.Marshal(result)
+	return string(b)
+}
+
+// checkLocalPort 本地监听地址是否可用 (本代理正在使用时视为通过)
+func checkLocalPort(config *Config) checkResult {
+	params := map[string]interface{}{"addr": config.LocalAddr}
+
+	proxyMu.Lock()
+	running := proxyRunning() && proxyListener != nil && proxyListener.Addr().String() == config.LocalAddr
+	proxyMu.Unlock()
+	if running {
+		return checkPass("localport", params)
+	}
+	if config.Hotspot {
+		return checkSkip("localport", "hotspot")
+	}
+
+	l, err := net.Listen("tcp", config.LocalAddr)
+	if err != nil {
+		return checkFail("localport", "port_unavailable", err, params)
+	}
+	l.Close()
+	return checkPass("localport", params)
+}
+
+// checkDNS 解析 remoteaddr 的主机名，返回结果和第一个地址
+func checkDNS(host string) (checkResult, net.IP) {
+	params := map[string]interface{}{"host": host}
+	if ip := net.ParseIP(host); ip != nil {
+		return checkPass("dns", params), ip
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return checkFail("dns", "dns_failed", err, params), nil
+	}
+	params["ip"] = ips[0].IP.String()
+	return checkPass("dns", params), ips[0].IP
+}
+
+// checkEgress 出站连通: KCP 传输检查 UDP 路由，TLS 传输检查 TCP 连接
+func checkEgress(config *Config, ip net.IP, port string) checkResult {
+	if ip == nil {
+		return checkSkip("egress", "dns_failed")
+	}
+	addr := net.JoinHostPort(ip.String(), port)
+	params := map[string]interface{}{"addr": addr, "transport": config.Transport}
+
+	if useTLS(config) {
+		conn, err := net.DialTimeout("tcp", addr, selfCheckTimeout)
+		if err != nil {
+			return checkFail("egress", "tcp_unreachable", err, params)
+		}
+		conn.Close()
+		return checkPass("egress", params)
+	}
+
+	// UDP connect 不发送数据，只验证存在到目标的路由
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return checkFail("egress", "udp_no_route", err, params)
+	}
+	conn.Close()
+	return checkPass("egress", params)
+}
+
+// checkClock 系统时间是否合理 (未同步的时钟会导致 TLS 证书校验失败)
+func checkClock() checkResult {
+	now := time.Now()
+	params := map[string]interface{}{"time": now.Unix()}
+	if now.Year() < minClockYear {
+		return checkResult{Name: "clock", Status: "fail", Code: "clock_invalid",
+			Message: "system clock is not set: " + now.UTC().Format(time.RFC3339), Params: params}
+	}
+	return checkPass("clock", params)
+}
+
+// checkMemory 可用内存是否足够容纳会话池的缓冲区
+func checkMemory(config *Config) checkResult {
+	avail, err := availableMemory()
+	if err != nil {
+		return checkSkip("memory", "unsupported")
+	}
+	params := map[string]interface{}{"available": avail}
+	if config == nil {
+		return checkPass("memory", params)
+	}
+
+	need := uint64(config.Conn) * uint64(config.SmuxBuf+2*config.SockBuf)
+	params["required"] = need
+	if avail < need {
+		return checkResult{Name: "memory", Status: "fail", Code: "low_memory",
+			Message: "available memory is below the session pool buffers", Params: params}
+	}
+	return checkPass("memory", params)
+}
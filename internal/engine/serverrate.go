@@ -0,0 +1,121 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+)
+
+// 服务端带宽上限: 开启 acceptserverrate 后客户端在能力协商中声明 "rate"，
+// 服务端在 caps 回复中通告对本客户端的限速 (字节/秒，上下行相同)。
+// 客户端据此限制各会话的发送速率，并把窗口限制在上限对应的 BDP 附近，
+// 避免超出服务端整形速率的数据被丢弃后反复重传
+
+const (
+	capRate = "rate"
+
+	serverRateWndGain = 2  // 窗口上限为上限速率 BDP 的倍数，留出抖动余量
+	serverRateMinWnd  = 32 // 窗口下限 (包)
+)
+
+// serverRate 服务端通告的带宽上限字节/秒 (0 表示未通告)
+func serverRate() int64 {
+	ctrlMu.Lock()
+	defer ctrlMu.Unlock()
+	return ctrlState.ServerRate
+}
+
+// sessionRateCap 按存活会话数平分服务端上限，得到每个会话的速率上限 (0 表示不限制)
+func sessionRateCap() float64 {
+	rate := serverRate()
+	if rate <= 0 {
+		return 0
+	}
+	alive := 0
+	proxyMu.Lock()
+	for _, s := range proxySessions {
+		if s.alive() {
+			alive++
+		}
+	}
+	proxyMu.Unlock()
+	if alive == 0 {
+		alive = 1
+	}
+	return float64(rate) / float64(alive)
+}
+
+// handleServerRate 记录 caps 回复中的带宽上限并立即应用
+func handleServerRate(config *Config, msg *ctrlMessage) {
+	if !config.AcceptServerRate || msg.Rate <= 0 {
+		return
+	}
+	ctrlMu.Lock()
+	changed := ctrlState.ServerRate != msg.Rate
+	ctrlState.ServerRate = msg.Rate
+	ctrlMu.Unlock()
+	if !changed {
+		return
+	}
+	log.Printf("Server rate cap: %d B/s", msg.Rate)
+	emitEvent("server-rate", map[string]interface{}{"rate": msg.Rate})
+	sampleServerRate(config)
+}
+
+// sampleServerRate 按服务端上限调整各会话的窗口和发送速率
+// 平滑发送开启且未配置 ratelimit 时速率由 samplePacing 负责 (同样不超过上限)
+func sampleServerRate(config *Config) {
+	limit := sessionRateCap()
+	if limit <= 0 {
+		return
+	}
+	p := effectiveParams(config)
+	mtu := currentMTU(config)
+	setRate := !pacingOn(config) || config.RateLimit > 0
+	rate := limit
+	if config.RateLimit > 0 && float64(config.RateLimit) < rate {
+		rate = float64(config.RateLimit)
+	}
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	for _, s := range proxySessions {
+		if !s.alive() || s.conn == nil {
+			continue
+		}
+		if setRate {
+			s.conn.SetRateLimit(uint32(rate))
+		}
+		srtt := s.srtt()
+		if srtt <= 0 {
+			continue
+		}
+		wnd := int(limit*float64(srtt)/1000/float64(mtu)) * serverRateWndGain
+		if wnd < serverRateMinWnd {
+			wnd = serverRateMinWnd
+		}
+		s.conn.SetWindowSize(minInt(p.SndWnd, wnd), minInt(p.RcvWnd, wnd))
+	}
+}
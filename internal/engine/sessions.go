@@ -0,0 +1,492 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// 会话 RTT 超过该值视为质量下降
+const degradedRTT = 1000 * time.Millisecond
+
+// poolSession 会话池中的一个 KCP + SMUX 会话
+type poolSession struct {
+	*smux.Session
+	conn       *kcp.UDPSession // KCP 传输时的连接 (TLS 传输时为 nil)
+	link       net.Conn        // 底层传输连接
+	handshake  time.Duration   // TLS 握手耗时 (作为 RTT 估计)
+	created    time.Time
+	shutdown   int32         // 非 0 表示因代理停止而关闭
+	blamed     int32         // 非 0 表示已计入服务器 IP 黑名单
+	gate       *priorityGate // 握手加速的交互优先门 (未开启 boosthandshakes 时为 nil)
+	tracked    *trackedConn  // 合并心跳时 SMUX 使用的连接 (未启用时为 nil)
+	batch      *batchConn    // 写入合并 (未开启 writebatch 时为 nil)
+	queued     int64         // 已交给流、尚未写入传输层的字节数
+	mark       *queueMark    // 发送队列水位 (未配置 queuehigh 时为 nil)
+	balance    balanceState  // 按吞吐加权选择 (由 proxyMu 保护)
+	ttfbMisses int32         // 连续首字节超时的流数
+	suspect    int32         // 非 0 表示疑似僵尸会话，正在重建
+	predicted  int32         // 非 0 表示已预测将要失效，正在替换
+
+	features  *sessionFeatures // 建立时协商的功能
+	admission admissionState   // 打开流错峰 (未配置 openspacing 时不使用)
+
+	buffers *streamBuffers // 各流接收数据统计 (未配置 streamcap 时为 nil)
+
+	warmMu sync.Mutex
+	warm   *smux.Stream // 预热流 (未开启 warmstream 时为 nil)
+	warmAt time.Time
+
+	bytesUp   uint64
+	bytesDown uint64
+}
+
+// alive 会话是否可用
+func (s *poolSession) alive() bool {
+	return s != nil && !s.IsClosed()
+}
+
+// state 会话状态: healthy, degraded, suspect, reconnecting, hibernating
+// 已断开的槽位会在下一次分配连接时重连
+func (s *poolSession) state() string {
+	if !s.alive() {
+		if isHibernating() {
+			return "hibernating"
+		}
+		return "reconnecting"
+	}
+	if atomic.LoadInt32(&s.suspect) != 0 {
+		return "suspect"
+	}
+	if time.Duration(s.srtt())*time.Millisecond > degradedRTT {
+		return "degraded"
+	}
+	return "healthy"
+}
+
+// srtt 平滑 RTT 毫秒 (TLS 传输时为握手耗时)
+func (s *poolSession) srtt() int32 {
+	if s.conn == nil {
+		return int32(s.handshake.Milliseconds())
+	}
+	return s.conn.GetSRTT()
+}
+
+// conv KCP 会话 ID (与 kcptun 服务端日志对应，TLS 传输时为 0)
+func (s *poolSession) conv() uint32 {
+	if s.conn == nil {
+		return 0
+	}
+	return s.conn.GetConv()
+}
+
+// rto 重传超时毫秒 (TLS 传输时由 TCP 负责，为 0)
+func (s *poolSession) rto() uint32 {
+	if s.conn == nil {
+		return 0
+	}
+	return s.conn.GetRTO()
+}
+
+// GetSessions 返回会话池中每个会话的 JSON 快照
+func GetSessions() string {
+	type sessionJSON struct {
+		Index     int     `json:"index"`
+		State     string  `json:"state"`
+		Conv      uint32  `json:"conv,omitempty"` // KCP 会话 ID
+		Local     string  `json:"local,omitempty"`
+		Remote    string  `json:"remote,omitempty"`
+		Age       int64   `json:"age"` // 秒
+		Streams   int     `json:"streams"`
+		BytesUp   uint64  `json:"bytesup"`
+		BytesDown uint64  `json:"bytesdown"`
+		RTT       int32   `json:"rtt"` // 平滑 RTT 毫秒
+		RTO       uint32  `json:"rto"` // 重传超时毫秒
+		Retrans   float64 `json:"retrans"`
+		Queued    int64   `json:"queued"`           // 待写出字节数
+		InPPS     float64 `json:"inpps"`            // 收包速率
+		OutPPS    float64 `json:"outpps"`           // 发包速率
+		Goodput   float64 `json:"goodput"`          // 平滑吞吐 字节/秒
+		Weight    float64 `json:"weight"`           // 分配新连接的权重
+		Pinned    bool    `json:"pinned,omitempty"` // pinnedports 专用会话
+
+		Features *sessionFeatures `json:"features,omitempty"` // 建立时协商的功能
+	}
+
+	// kcp-go 只提供进程级的重传计数，各会话共用同一个重传率
+	snmp := kcp.DefaultSnmp.Copy()
+	var retrans float64
+	if snmp.OutSegs > 0 {
+		retrans = float64(snmp.RetransSegs) / float64(snmp.OutSegs)
+	}
+
+	proxyMu.Lock()
+	reserved := reservedSlotLocked()
+	list := make([]sessionJSON, 0, len(proxySessions))
+	for i, s := range proxySessions {
+		item := sessionJSON{Index: i, State: s.state(), Retrans: retrans, Pinned: i == reserved}
+		if s != nil {
+			item.Local = s.link.LocalAddr().String()
+			item.Remote = s.link.RemoteAddr().String()
+			item.Conv = s.conv()
+			item.Age = int64(clk.Since(s.created).Seconds())
+			item.Streams = s.NumStreams()
+			item.BytesUp = atomic.LoadUint64(&s.bytesUp)
+			item.BytesDown = atomic.LoadUint64(&s.bytesDown)
+			item.RTT = s.srtt()
+			item.RTO = s.rto()
+			item.Queued = s.queuedBytes()
+			item.Goodput = s.balance.goodput
+			item.Weight = s.balanceWeight()
+			item.Features = s.features
+			if w := s.wire(); w != nil {
+				w.mu.Lock()
+				item.InPPS, item.OutPPS = w.inPPS, w.outPPS
+				w.mu.Unlock()
+			}
+		}
+		list = append(list, item)
+	}
+	proxyMu.Unlock()
+
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
+// sessionIdentity 会话标识，用于与服务端日志关联
+type sessionIdentity struct {
+	Index  int    `json:"index"`
+	Conv   uint32 `json:"conv,omitempty"` // KCP 会话 ID
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+// sessionIdentities 存活会话的标识 (调用方持有 proxyMu)
+func sessionIdentities() []sessionIdentity {
+	var list []sessionIdentity
+	for i, s := range proxySessions {
+		if s.alive() {
+			list = append(list, sessionIdentity{
+				Index:  i,
+				Conv:   s.conv(),
+				Local:  s.link.LocalAddr().String(),
+				Remote: s.link.RemoteAddr().String(),
+			})
+		}
+	}
+	return list
+}
+
+// RecycleSession 强制重建指定序号的会话
+// 先建立新会话再关闭旧会话 (建立期间不持有锁)，旧会话上的连接会被中断
+// 返回空字符串表示成功，否则返回错误信息
+func RecycleSession(idx int) string {
+	proxyMu.Lock()
+	if !proxyRunning() {
+		proxyMu.Unlock()
+		return "Proxy not running"
+	}
+	if idx < 0 || idx >= len(proxySessions) {
+		proxyMu.Unlock()
+		return fmt.Sprintf("Invalid session index: %d", idx)
+	}
+	config, stop := proxyConfig, stopChan
+	proxyMu.Unlock()
+
+	if err := replaceSession(idx, config, stop, 0); err != nil {
+		return "Session Error: " + err.Error()
+	}
+	log.Printf("Session %d recycled", idx)
+	return ""
+}
+
+// 旧会话在替换后等待现有连接结束的最长时间
+const drainTimeout = 30 * time.Second
+
+var reconnectAllBusy int32
+
+// ReconnectAll 逐个替换会话池中的所有会话 (先建后拆)
+// 用于用户点击"重连"或认证强制门户之后；新会话建立后才替换旧会话，
+// 旧会话上的现有连接可在 drainTimeout 内继续完成
+// 每个槽位的结果通过 "reconnect" 事件异步返回，全部完成后发送 "reconnect-done"
+// 返回空字符串表示已开始，否则返回错误信息
+func ReconnectAll() string {
+	proxyMu.Lock()
+	if !proxyRunning() {
+		proxyMu.Unlock()
+		return "Proxy not running"
+	}
+	config, stop, n := proxyConfig, stopChan, len(proxySessions)
+	proxyMu.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&reconnectAllBusy, 0, 1) {
+		return "Reconnect already in progress"
+	}
+	wakeUp()
+
+	go func() {
+		defer atomic.StoreInt32(&reconnectAllBusy, 0)
+
+		ok := 0
+		for i := 0; i < n; i++ {
+			err := replaceSession(i, config, stop, drainTimeout)
+			data := map[string]interface{}{"index": i, "ok": err == nil}
+			if err != nil {
+				data["error"] = err.Error()
+			} else {
+				ok++
+			}
+			emitEvent("reconnect", data)
+		}
+		emitEvent("reconnect-done", map[string]interface{}{"total": n, "ok": ok})
+		log.Printf("Reconnect all: %d/%d sessions replaced", ok, n)
+	}()
+	return ""
+}
+
+// RestartSessions 以当前配置重建 KCP/SMUX 层，本地监听 socket 保持打开
+// 比 StopProxy/StartProxy 快: 本地客户端只有正在转发的连接会断开，重建期间的新连接
+// 留在监听 backlog 中，会话池就绪后立即被接受
+// 成功时发送 "sessions-restarted" 事件；重建失败时代理停止
+// 返回空字符串表示成功，否则返回错误信息
+func RestartSessions() string {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	if !proxyRunning() {
+		return "Proxy not running"
+	}
+	listener, err := dupListener(proxyListener)
+	if err != nil {
+		return "Listen Error: " + err.Error()
+	}
+
+	config := proxyConfig
+	start := clk.Now()
+	for _, s := range detachLocked() {
+		if s != nil {
+			closeSessionForShutdown(s)
+		}
+	}
+	handoffMu.Lock()
+	importListener = listener
+	handoffMu.Unlock()
+
+	err = startLocked(config)
+
+	// 启动失败时 startLocked 已关闭接管的监听，这里只清理未被接管的部分
+	handoffMu.Lock()
+	if importListener != nil {
+		importListener.Close()
+		importListener = nil
+	}
+	handoffMu.Unlock()
+
+	if err != nil {
+		wipeSecrets(config)
+		logError("Session restart failed, proxy stopped:", err)
+		emitEvent("sessions-restarted", map[string]interface{}{"ok": false, "error": err.Error()})
+		return err.Error()
+	}
+	elapsed := clk.Since(start)
+	log.Printf("Sessions restarted in %v", elapsed)
+	emitEvent("sessions-restarted", map[string]interface{}{"ok": true, "ms": elapsed.Milliseconds()})
+	return ""
+}
+
+// replaceSession 在不持有锁的情况下建立新会话，然后替换槽位 idx
+// 旧会话上的现有连接最多再保留 drain
+func replaceSession(idx int, config *Config, stop chan struct{}, drain time.Duration) error {
+	session, err := createSession(config)
+	if err != nil {
+		return err
+	}
+
+	proxyMu.Lock()
+	select {
+	case <-stop:
+		// 建立期间代理已停止或重启
+		proxyMu.Unlock()
+		session.Close()
+		return fmt.Errorf("proxy stopped")
+	default:
+	}
+	old := proxySessions[idx]
+	proxySessions[idx] = session
+	proxyMu.Unlock()
+	atomic.AddUint64(&statReconnects, 1)
+	metricCount("kcp_reconnects_total", "", 1)
+
+	if old != nil {
+		go drainAndClose(old, drain, stop)
+	}
+	return nil
+}
+
+// dialResult 并发建立会话的结果
+type dialResult struct {
+	idx     int
+	session *poolSession
+	err     error
+}
+
+// dialSessions 并发建立 config.Conn 个会话，minready 个建立成功即返回，不必等待最慢的会话
+// 之后完成的会话在实例仍在运行时放入对应槽位，失败的槽位保持为 nil 由监管协程重连；
+// 成功数已不可能达到 minready 或 sessionDialTimeout 超时时返回错误
+func dialSessions(config *Config, stop chan struct{}) ([]*poolSession, error) {
+	n := config.Conn
+	if config.onDemand {
+		log.Printf("Session pool: on demand, up to %d sessions", n)
+		return make([]*poolSession, n), nil
+	}
+	results := make(chan dialResult, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			s, err := createSession(config)
+			results <- dialResult{i, s, err}
+		}(i)
+	}
+
+	sessions := make([]*poolSession, n)
+	abort := func(pending int, err error) ([]*poolSession, error) {
+		for _, s := range sessions {
+			if s != nil {
+				s.Close()
+			}
+		}
+		// stop 随启动失败关闭，之后完成的会话会被关闭
+		go adoptSessions(results, pending, stop)
+		return nil, err
+	}
+
+	limit := config.start.remaining(sessionDialTimeout)
+	timeout := clk.After(limit)
+	ready, failed := 0, 0
+	for pending := n; pending > 0; {
+		select {
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				failed++
+				if n-failed < config.MinReady {
+					return abort(pending, r.err)
+				}
+				logError("Session error:", r.err)
+				continue
+			}
+			sessions[r.idx] = r.session
+			ready++
+			if ready >= config.MinReady {
+				if ready < n {
+					log.Printf("Session pool: %d/%d sessions up, serving while the rest connect", ready, n)
+					go adoptSessions(results, pending, stop)
+				}
+				return sessions, nil
+			}
+		case <-timeout:
+			return abort(pending, fmt.Errorf("%d/%d sessions established within %s", ready, config.MinReady, limit))
+		}
+	}
+	return sessions, nil
+}
+
+// adoptSessions 将启动后才建立完成的会话放入空槽位，实例已停止或槽位已被占用时关闭
+func adoptSessions(results <-chan dialResult, pending int, stop chan struct{}) {
+	for ; pending > 0; pending-- {
+		r := <-results
+		if r.err != nil {
+			logError("Session error:", r.err)
+			continue
+		}
+
+		// startLocked 返回前 proxyMu 一直被持有，此时实例状态已确定；
+		// UpdateConfig 预建的会话在新实例接管 stop 之前完成时关闭，空槽位由监管协程重连
+		proxyMu.Lock()
+		adopted := false
+		select {
+		case <-stop:
+		default:
+			if stopChan == stop && r.idx < len(proxySessions) && !proxySessions[r.idx].alive() {
+				proxySessions[r.idx] = r.session
+				adopted = true
+			}
+		}
+		proxyMu.Unlock()
+		if !adopted {
+			r.session.Close()
+			continue
+		}
+		reportPoolProgress()
+	}
+}
+
+// reportPoolProgress 会话池未满时有会话建立后发送 "pool-progress" 事件
+func reportPoolProgress() {
+	proxyMu.Lock()
+	ready, total := 0, len(proxySessions)
+	for _, s := range proxySessions {
+		if s.alive() {
+			ready++
+		}
+	}
+	proxyMu.Unlock()
+	emitEvent("pool-progress", map[string]interface{}{"ready": ready, "total": total})
+}
+
+// drainAndClose 等待会话上的流全部结束 (或超时、代理停止) 后关闭会话
+func drainAndClose(s *poolSession, timeout time.Duration, stop chan struct{}) {
+	defer s.Close()
+
+	deadline := clk.Now().Add(timeout)
+	for s.alive() && s.NumStreams() > 0 && clk.Now().Before(deadline) {
+		select {
+		case <-stop:
+			return
+		case <-clk.After(time.Second):
+		}
+	}
+}
+
+// pickAliveSession 返回会话池中第一个存活的会话
+func pickAliveSession() *poolSession {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	for _, s := range proxySessions {
+		if s.alive() {
+			return s
+		}
+	}
+	return nil
+}
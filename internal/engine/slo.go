@@ -0,0 +1,119 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 流质量 SLO 统计: OpenStream 耗时/失败率，以及首字节时间 (TTFB，流打开到收到第一个下行字节)
+// 按固定阈值统计 TTFB 达标比例，便于量化线上隧道质量
+
+// sloThresholds TTFB 达标阈值 (毫秒)
+var sloThresholds = [...]int64{100, 250, 500, 1000, 2000}
+
+var (
+	statStreamsOpened uint64 // OpenStream 成功数
+	statOpenFailures  uint64 // OpenStream 失败数
+	statOpenNanos     uint64 // OpenStream 累计耗时
+	statTTFBSamples   uint64 // 收到首字节的流数
+	statTTFBNanos     uint64 // 累计 TTFB
+	statTTFBBelow     [len(sloThresholds)]uint64
+)
+
+// recordOpen 记录一次 OpenStream
+func recordOpen(d time.Duration, err error) {
+	if err != nil {
+		atomic.AddUint64(&statOpenFailures, 1)
+		metricCount("kcp_stream_open_failures_total", "", 1)
+		return
+	}
+	metricObserve("kcp_stream_open_ms", "", float64(d)/float64(time.Millisecond))
+	atomic.AddUint64(&statStreamsOpened, 1)
+	atomic.AddUint64(&statOpenNanos, uint64(d))
+}
+
+// recordTTFB 记录一条流的首字节时间
+func recordTTFB(d time.Duration) {
+	atomic.AddUint64(&statTTFBSamples, 1)
+	metricObserve("kcp_ttfb_ms", "", float64(d)/float64(time.Millisecond))
+	atomic.AddUint64(&statTTFBNanos, uint64(d))
+	ms := d.Milliseconds()
+	for i, t := range sloThresholds {
+		if ms < t {
+			atomic.AddUint64(&statTTFBBelow[i], 1)
+		}
+	}
+}
+
+// resetSLO 清零 SLO 统计
+func resetSLO() {
+	for _, c := range []*uint64{&statStreamsOpened, &statOpenFailures, &statOpenNanos, &statTTFBSamples, &statTTFBNanos} {
+		atomic.StoreUint64(c, 0)
+	}
+	for i := range statTTFBBelow {
+		atomic.StoreUint64(&statTTFBBelow[i], 0)
+	}
+}
+
+// sloStats 流质量统计
+type sloStats struct {
+	Opened      uint64             `json:"opened"`      // OpenStream 成功数
+	OpenFailed  uint64             `json:"openfailed"`  // OpenStream 失败数
+	FailRate    float64            `json:"failrate"`    // 失败比例
+	OpenAvg     float64            `json:"openavg"`     // 平均 OpenStream 耗时毫秒
+	TTFBSamples uint64             `json:"ttfbsamples"` // 收到首字节的流数
+	TTFBAvg     float64            `json:"ttfbavg"`     // 平均 TTFB 毫秒
+	TTFBBelow   map[string]float64 `json:"ttfbbelow"`   // 阈值毫秒 -> TTFB 低于该值的流百分比
+}
+
+// snapshotSLO 返回流质量统计
+func snapshotSLO() sloStats {
+	s := sloStats{
+		Opened:      atomic.LoadUint64(&statStreamsOpened),
+		OpenFailed:  atomic.LoadUint64(&statOpenFailures),
+		TTFBSamples: atomic.LoadUint64(&statTTFBSamples),
+		TTFBBelow:   make(map[string]float64, len(sloThresholds)),
+	}
+	if total := s.Opened + s.OpenFailed; total > 0 {
+		s.FailRate = float64(s.OpenFailed) / float64(total)
+	}
+	if s.Opened > 0 {
+		s.OpenAvg = float64(atomic.LoadUint64(&statOpenNanos)) / float64(s.Opened) / 1e6
+	}
+	for i, t := range sloThresholds {
+		var pct float64
+		if s.TTFBSamples > 0 {
+			pct = float64(atomic.LoadUint64(&statTTFBBelow[i])) * 100 / float64(s.TTFBSamples)
+		}
+		s.TTFBBelow[strconv.FormatInt(t, 10)] = pct
+	}
+	if s.TTFBSamples > 0 {
+		s.TTFBAvg = float64(atomic.LoadUint64(&statTTFBNanos)) / float64(s.TTFBSamples) / 1e6
+	}
+	return s
+}
@@ -0,0 +1,195 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 目标识别: 本地客户端通过隧道与服务端的代理 (SOCKS5/SOCKS4/HTTP) 握手，
+// 从上行的前几个报文中被动解析目标地址，只读取不修改
+
+const sniffLimit = 1024 // 最多缓存的上行字节数，超过仍无法识别则放弃
+
+// targetSniffer 累积上行数据并尝试解析目标
+type targetSniffer struct {
+	buf   []byte
+	done  bool
+	sni   bool // 目标为 IP 时继续识别 ClientHello 中的 SNI (sniffsni)
+	host  bool // 目标为 IP 时继续识别 HTTP 请求的 Host 头 (sniffhost)
+	hello bool // 正在识别域名
+}
+
+// feed 追加上行数据，识别出目标时返回 host:port，识别出 SNI/Host 时返回 domain；done 为 true 后不再处理
+func (t *targetSniffer) feed(p []byte) (target, domain string) {
+	if t.done {
+		return "", ""
+	}
+	t.buf = append(t.buf, p...)
+
+	if t.hello {
+		domain, ok := parseDomain(t.sni, t.host, t.buf)
+		if ok || len(t.buf) >= sniffHelloLimit {
+			t.done = true
+			t.buf = nil
+		}
+		return "", domain
+	}
+
+	target, ok := parseProxyTarget(t.buf)
+	if ok || len(t.buf) >= sniffLimit {
+		t.done = true
+		t.buf = nil
+		// 客户端收到代理应答后才发送 ClientHello/请求，从下一段上行数据开始识别
+		if (t.sni || t.host) && isIPTarget(target) {
+			t.done, t.hello = false, true
+		}
+	}
+	return target, ""
+}
+
+// parseProxyTarget 解析代理握手中的目标地址
+// ok 为 false 表示数据还不完整；ok 为 true 且 target 为空表示无法识别
+func parseProxyTarget(b []byte) (target string, ok bool) {
+	if len(b) == 0 {
+		return "", false
+	}
+	switch b[0] {
+	case 5:
+		return parseSOCKS5(b)
+	case 4:
+		return parseSOCKS4(b)
+	}
+	return parseHTTPProxy(b)
+}
+
+// parseSOCKS5 问候 [5, n, methods...] + 可选用户名密码认证 [1, ulen, user, plen, pass] + 请求 [5, cmd, 0, atyp, addr, port]
+func parseSOCKS5(b []byte) (string, bool) {
+	if len(b) < 2 || len(b) < 2+int(b[1]) {
+		return "", false
+	}
+	b = b[2+int(b[1]):]
+
+	if len(b) > 0 && b[0] == 1 {
+		if len(b) < 2 || len(b) < 3+int(b[1]) {
+			return "", false
+		}
+		plen := int(b[2+int(b[1])])
+		if len(b) < 3+int(b[1])+plen {
+			return "", false
+		}
+		b = b[3+int(b[1])+plen:]
+	}
+
+	if len(b) < 5 {
+		return "", false
+	}
+	if b[0] != 5 {
+		return "", true
+	}
+	var host string
+	var rest []byte
+	switch b[3] {
+	case 1: // IPv4
+		if len(b) < 4+4+2 {
+			return "", false
+		}
+		host, rest = net.IP(b[4:8]).String(), b[8:]
+	case 3: // 域名
+		n := int(b[4])
+		if len(b) < 5+n+2 {
+			return "", false
+		}
+		host, rest = string(b[5:5+n]), b[5+n:]
+	case 4: // IPv6
+		if len(b) < 4+16+2 {
+			return "", false
+		}
+		host, rest = net.IP(b[4:20]).String(), b[20:]
+	default:
+		return "", true
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(rest)))), true
+}
+
+// parseSOCKS4 [4, cmd, port, ip, userid, 0] (+ SOCKS4a: host, 0)
+func parseSOCKS4(b []byte) (string, bool) {
+	if len(b) < 9 {
+		return "", false
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(b[2:4])))
+	ip := net.IP(b[4:8])
+	end := bytes.IndexByte(b[8:], 0)
+	if end < 0 {
+		return "", false
+	}
+	// SOCKS4a: 0.0.0.x 表示后面跟域名
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		rest := b[8+end+1:]
+		n := bytes.IndexByte(rest, 0)
+		if n < 0 {
+			return "", false
+		}
+		return net.JoinHostPort(string(rest[:n]), port), true
+	}
+	return net.JoinHostPort(ip.String(), port), true
+}
+
+// parseHTTPProxy "CONNECT host:port HTTP/1.1" 或 "GET http://host[:port]/path HTTP/1.1"
+func parseHTTPProxy(b []byte) (string, bool) {
+	end := bytes.Index(b, []byte("\r\n"))
+	if end < 0 {
+		return "", false
+	}
+	fields := strings.Fields(string(b[:end]))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return "", true
+	}
+	if fields[0] == "CONNECT" {
+		return fields[1], true
+	}
+
+	uri := fields[1]
+	i := strings.Index(uri, "://")
+	if i < 0 {
+		return "", true
+	}
+	scheme, hostport := uri[:i], uri[i+3:]
+	if j := strings.IndexAny(hostport, "/?#"); j >= 0 {
+		hostport = hostport[:j]
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		port := "80"
+		if strings.EqualFold(scheme, "https") {
+			port = "443"
+		}
+		hostport = net.JoinHostPort(hostport, port)
+	}
+	return hostport, true
+}
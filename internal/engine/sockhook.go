@@ -0,0 +1,95 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// socket 选项回调: 库没有建模的平台相关选项 (如 Linux 策略路由的 SO_MARK、iOS 的 IP_BOUND_IF)
+// 由 App 实现 RawSocketOptionHook 自行设置。KCP 使用的 UDP socket 创建后、发送数据前
+// (指定 network 时在 NetworkProtector 之后) 收到 fd；引擎交接时复用的旧 socket 不再回调
+
+// RawSocketOptionHook socket 选项回调接口 (由 App 实现)
+type RawSocketOptionHook interface {
+	// OnSocket 设置 fd 的 socket 选项，network 为 "udp4" 或 "udp6"；返回 false 时放弃该 socket，本次建连失败
+	OnSocket(fd int, network string) bool
+}
+
+var (
+	socketHookMu sync.Mutex
+	socketHook   RawSocketOptionHook
+)
+
+var errSocketHook = errors.New("socket option hook rejected socket")
+
+// SetRawSocketOptionHook 设置 socket 选项回调，传入 nil 取消
+func SetRawSocketOptionHook(h RawSocketOptionHook) {
+	socketHookMu.Lock()
+	socketHook = h
+	socketHookMu.Unlock()
+}
+
+// currentSocketHook 返回当前的回调 (未设置时为 nil)
+func currentSocketHook() RawSocketOptionHook {
+	socketHookMu.Lock()
+	defer socketHookMu.Unlock()
+	return socketHook
+}
+
+// withSocketHook 在 control (可为 nil) 之后调用 socket 选项回调
+func withSocketHook(control func(string, string, syscall.RawConn) error) func(string, string, syscall.RawConn) error {
+	h := currentSocketHook()
+	if h == nil {
+		return control
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		ok := false
+		if err := c.Control(func(fd uintptr) {
+			ok = h.OnSocket(int(fd), network)
+		}); err != nil {
+			return err
+		}
+		if !ok {
+			return errSocketHook
+		}
+		return nil
+	}
+}
+
+// listenUDP 创建 KCP 使用的 UDP socket，依次调用 control 和 socket 选项回调
+func listenUDP(control func(string, string, syscall.RawConn) error) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: withSocketHook(control)}
+	return lc.ListenPacket(context.Background(), "udp", "")
+}
@@ -0,0 +1,95 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// SOCKS5 域名目标的解析方:
+// remote 把域名经隧道交给服务端解析 (不在本机产生 DNS 查询，CDN 按服务端位置调度)；
+// local 在本机解析后只向服务端发送 IP (CDN 按本机网络调度，cidr/geoip 规则按解析结果匹配)；
+// rules 按命中规则的 resolve 字段选择，未指定时为 remote
+
+const socksResolveTimeout = 5 * time.Second // 本机解析的最长时间
+
+// resolvesLocally 目标 host 的 SOCKS5 域名请求是否在本机解析
+func resolvesLocally(config *Config, host string) bool {
+	switch config.SocksResolve {
+	case socksResolveLocal:
+		return true
+	case socksResolveRules:
+		if rs := currentRules(config); rs != nil {
+			if idx := rs.match(host); idx >= 0 {
+				return rs.rules[idx].Resolve == socksResolveLocal
+			}
+		}
+	}
+	return false
+}
+
+// resolveSOCKS5 需要时在本机解析 SOCKS5 域名目标，并把重放的请求改写为 IP 地址类型
+// 解析后 hs.domain 保留原域名，用于连接日志和目的地统计；返回解析出的 IP (未解析时为空)
+func resolveSOCKS5(config *Config, hs *proxyHandshake) (string, error) {
+	if hs.proto != 5 || hs.cmd != socksCmdConnect || hs.target == "" || isIPTarget(hs.target) {
+		return "", nil
+	}
+	host, port, err := net.SplitHostPort(hs.target)
+	if err != nil || !resolvesLocally(config, host) {
+		return "", nil
+	}
+
+	resolver := net.DefaultResolver
+	if d := directDialer(config); d.Resolver != nil {
+		resolver = d.Resolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), socksResolveTimeout)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		metricCount("kcp_socks_resolve_total", "result=error", 1)
+		return "", err
+	}
+	ip := addrs[0].IP
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			ip = a.IP
+			break
+		}
+	}
+
+	req, err := socks5Connect(net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return "", err
+	}
+	metricCount("kcp_socks_resolve_total", "result=ok", 1)
+	hs.head, hs.target = req.head, req.target
+	if hs.domain == "" {
+		hs.domain = host
+	}
+	return ip.String(), nil
+}
@@ -0,0 +1,119 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SMUX 窗口阻塞统计: 单次写入阻塞超过 stallThreshold 视为一次阻塞
+//   - 上行 (写入 SMUX 流) 阻塞: 流的发送窗口耗尽 (smuxver 2 按流控制) 或会话发送队列积压
+//   - 下行 (写入本地客户端) 阻塞: 客户端读取过慢，数据堆积在会话的接收缓冲区 (smuxbuf)，
+//     缓冲区占满后整个会话停止读取，同一会话上的其他流也被拖慢
+// 记录最近发生阻塞的流 ID，便于判断 smuxbuf/streambuf 是否需要调整
+
+const (
+	stallThreshold = 200 * time.Millisecond
+	recentStallLen = 16 // 保留的最近阻塞记录数
+)
+
+var (
+	statSendStalls uint64 // 上行写入阻塞次数
+	statRecvStalls uint64 // 下行写入阻塞次数
+	statStallNanos uint64 // 累计阻塞时间
+
+	stallMu      sync.Mutex
+	recentStalls []stallRecord
+)
+
+// stallRecord 一次阻塞
+type stallRecord struct {
+	Time     int64  `json:"time"` // 毫秒时间戳
+	ID       uint64 `json:"id"`
+	SID      uint32 `json:"sid"`
+	Dir      string `json:"dir"`      // send: 流发送窗口, recv: 会话接收缓冲区
+	Duration int64  `json:"duration"` // 毫秒
+}
+
+// recordStall 记录一次写入阻塞
+func recordStall(s *streamInfo, dir byte, d time.Duration) {
+	rec := stallRecord{
+		Time:     clk.Now().UnixNano() / int64(time.Millisecond),
+		ID:       s.id,
+		SID:      s.sid,
+		Duration: d.Milliseconds(),
+	}
+	if dir == 'U' {
+		atomic.AddUint64(&statSendStalls, 1)
+		rec.Dir = "send"
+	} else {
+		atomic.AddUint64(&statRecvStalls, 1)
+		rec.Dir = "recv"
+	}
+	atomic.AddUint64(&statStallNanos, uint64(d))
+	metricCount("kcp_stalls_total", "dir="+rec.Dir, 1)
+	atomic.AddUint32(&s.stalls, 1)
+
+	stallMu.Lock()
+	if len(recentStalls) >= recentStallLen {
+		recentStalls = recentStalls[1:]
+	}
+	recentStalls = append(recentStalls, rec)
+	stallMu.Unlock()
+}
+
+// stallStats 窗口阻塞统计
+type stallStats struct {
+	Send   uint64        `json:"send"`
+	Recv   uint64        `json:"recv"`
+	Total  int64         `json:"total"` // 累计阻塞毫秒
+	Recent []stallRecord `json:"recent,omitempty"`
+}
+
+// snapshotStalls 返回阻塞统计
+func snapshotStalls() stallStats {
+	stallMu.Lock()
+	recent := append([]stallRecord(nil), recentStalls...)
+	stallMu.Unlock()
+
+	return stallStats{
+		Send:   atomic.LoadUint64(&statSendStalls),
+		Recv:   atomic.LoadUint64(&statRecvStalls),
+		Total:  time.Duration(atomic.LoadUint64(&statStallNanos)).Milliseconds(),
+		Recent: recent,
+	}
+}
+
+// resetStalls 清零阻塞统计
+func resetStalls() {
+	for _, c := range []*uint64{&statSendStalls, &statRecvStalls, &statStallNanos} {
+		atomic.StoreUint64(c, 0)
+	}
+	stallMu.Lock()
+	recentStalls = nil
+	stallMu.Unlock()
+}
@@ -0,0 +1,176 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+)
+
+// 启动失败的修复建议: StartProxy 仍返回原有的错误文本，同时发送 "start-failed" 事件
+// {"error", "stage", "hints"} 并保存供 GetStartError 查询。每条建议带有机器可读的 code
+// 和可直接合并到配置中的 patch (通过 StartProxyWithOverrides 传入)，App 可据此提供一键修复
+
+// remediation 一条修复建议
+type remediation struct {
+	Code    string                 `json:"code"`            // 如 port-in-use, udp-blocked
+	Message string                 `json:"message"`         // 英文说明
+	Patch   map[string]interface{} `json:"patch,omitempty"` // 建议的配置修改
+}
+
+// startFailure 最近一次启动失败
+type startFailure struct {
+	Error string        `json:"error"`
+	Stage string        `json:"stage"` // validate, bind, dial, hotspot, ...
+	Hints []remediation `json:"hints"`
+}
+
+var (
+	startFailMu   sync.Mutex
+	lastStartFail *startFailure
+)
+
+// startStages 错误前缀对应的启动阶段
+var startStages = map[string]string{
+	"Config Error":   "validate",
+	"Validate Error": "validate",
+	"Listen Error":   "bind",
+	"Session Error":  "dial",
+	"Hotspot Error":  "hotspot",
+	"GeoIP Error":    "geoip",
+	"Comp Error":     "comp",
+	"Log Error":      "log",
+	"DNS Error":      "dns",
+	"Control Error":  "control",
+	"Startup Error":  "timeout",
+	"FEC Error":      "fec",
+}
+
+// diagnoseStart 按错误文本和配置给出修复建议
+func diagnoseStart(config *Config, msg string) *startFailure {
+	f := &startFailure{Error: msg, Stage: "start", Hints: []remediation{}}
+	if i := strings.Index(msg, ":"); i > 0 {
+		if stage, ok := startStages[msg[:i]]; ok {
+			f.Stage = stage
+		}
+	}
+	lower := strings.ToLower(msg)
+	hint := func(code, message string, patch map[string]interface{}) {
+		f.Hints = append(f.Hints, remediation{Code: code, Message: message, Patch: patch})
+	}
+
+	switch f.Stage {
+	case "validate":
+		hint("invalid-config", "fix the reported config field", nil)
+	case "bind":
+		host := "127.0.0.1"
+		if config != nil {
+			if h, _, err := net.SplitHostPort(config.LocalAddr); err == nil && h != "" {
+				host = h
+			}
+		}
+		switch {
+		case strings.Contains(lower, "address already in use"):
+			hint("port-in-use", "try localport 0 to pick a free port", map[string]interface{}{"localaddr": net.JoinHostPort(host, "0")})
+		case strings.Contains(lower, "permission denied"):
+			hint("port-privileged", "ports below 1024 need privileges; try localport 0", map[string]interface{}{"localaddr": net.JoinHostPort(host, "0")})
+		case strings.Contains(lower, "assign requested address"):
+			hint("addr-unavailable", "the listen address is not on this device; try loopback", map[string]interface{}{"localaddr": "127.0.0.1:0"})
+		}
+	case "dial":
+		var capErr bool
+		switch {
+		case strings.Contains(lower, "capability error"):
+			capErr = true
+			hint("raw-socket-denied", "tcp emulation needs root; try plain udp", map[string]interface{}{"tcp": false})
+		case strings.Contains(lower, "no such host"):
+			hint("dns-failed", "remoteaddr could not be resolved; check it or use an IP address", nil)
+		case strings.Contains(lower, "connection refused"):
+			hint("server-refused", "the server refused the connection; check remoteaddr and that the server is running", nil)
+		case strings.Contains(lower, "network is unreachable"):
+			hint("network-unreachable", "no route to the server; check the device network", nil)
+		}
+		if !capErr && (strings.Contains(lower, "timeout") || strings.Contains(lower, "sessions established within")) &&
+			config != nil && !useTLS(config) {
+			hint("udp-blocked", "udp may be blocked on this network; try transport tls", map[string]interface{}{"transport": "tls"})
+		}
+	case "hotspot":
+		hint("hotspot-unavailable", "no hotspot interface found; start the hotspot or disable it", map[string]interface{}{"hotspot": false})
+	case "geoip":
+		hint("geoip-unavailable", "the GeoIP database could not be opened", map[string]interface{}{"geoipdb": ""})
+	case "log":
+		hint("log-unwritable", "the log file could not be opened", map[string]interface{}{"log": ""})
+	case "fec":
+		hint("fec-broken", "reed-solomon failed with these shard counts on this device; try other datashard/parityshard values (must match the server)", nil)
+	case "timeout":
+		hint("startup-slow", "startup did not finish within startuptimeout; check the network or raise it", nil)
+	}
+	switch msg {
+	case "Proxy already running", "Proxy already armed":
+		hint("already-running", "call StopProxy first", nil)
+	}
+	return f
+}
+
+// startFailed 记录启动失败并发送事件
+func startFailed(configJson string, msg string) {
+	// 尽量解析配置以给出针对性的建议，解析失败不影响诊断
+	var config Config
+	if json.Unmarshal([]byte(configJson), &config) == nil {
+		applyDefaults(&config)
+	}
+	reportStartFailure(&config, msg)
+}
+
+// reportStartFailure 保存诊断并发送 "start-failed" 事件
+func reportStartFailure(config *Config, msg string) {
+	f := diagnoseStart(config, msg)
+	startFailMu.Lock()
+	lastStartFail = f
+	startFailMu.Unlock()
+	emitEvent("start-failed", map[string]interface{}{"error": f.Error, "stage": f.Stage, "hints": f.Hints})
+}
+
+// GetStartError 返回最近一次启动失败的诊断 (JSON)，没有失败记录时返回空字符串
+// {"error": "...", "stage": "bind", "hints": [{"code": "port-in-use", "message": "...", "patch": {"localaddr": "127.0.0.1:0"}}]}
+func GetStartError() string {
+	startFailMu.Lock()
+	f := lastStartFail
+	startFailMu.Unlock()
+	if f == nil {
+		return ""
+	}
+	b, _ := json.Marshal(f)
+	return string(b)
+}
+
+// clearStartError 启动成功后清除失败记录
+func clearStartError() {
+	startFailMu.Lock()
+	lastStartFail = nil
+	startFailMu.Unlock()
+}
@@ -0,0 +1,94 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// 启动总时长上限: startuptimeout 秒内 StartProxy 未完成 (自动选择服务器、监听、建立会话池等) 时
+// 直接返回 "Startup Error"，后台的启动流程随后结束并清理已创建的资源，
+// 期间完成的启动也会被撤销，App 不会在超时后意外得到一个运行中的代理
+
+const (
+	startPending int32 = iota
+	startClaimed
+	startAbandoned
+)
+
+// startGuard 一次带时长上限的启动
+type startGuard struct {
+	deadline time.Time
+	state    int32
+}
+
+// startWithTimeout 在后台启动并最多等待 startuptimeout
+func startWithTimeout(config *Config, configJson string) string {
+	timeout := time.Duration(config.StartupTimeout) * time.Second
+	guard := &startGuard{deadline: clk.Now().Add(timeout)}
+	config.start = guard
+
+	done := make(chan string, 1)
+	go func() {
+		done <- startParsed(config, configJson)
+	}()
+	select {
+	case msg := <-done:
+		return msg
+	case <-clk.After(timeout):
+	}
+	if !atomic.CompareAndSwapInt32(&guard.state, startPending, startAbandoned) {
+		// 恰好在超时时完成
+		return <-done
+	}
+	logErrorf("Startup did not finish within %s, abandoning", timeout)
+	return fmt.Sprintf("Startup Error: not ready within %s", timeout)
+}
+
+// abandoned 启动是否已超时放弃
+func (g *startGuard) abandoned() bool {
+	return g != nil && atomic.LoadInt32(&g.state) == startAbandoned
+}
+
+// claim 启动完成时调用，返回 false 表示已超时放弃，调用方需撤销启动
+func (g *startGuard) claim() bool {
+	return g == nil || atomic.CompareAndSwapInt32(&g.state, startPending, startClaimed)
+}
+
+// remaining 距启动截止时间的剩余时长 (未设置上限时返回 max)
+func (g *startGuard) remaining(max time.Duration) time.Duration {
+	if g == nil {
+		return max
+	}
+	if d := g.deadline.Sub(clk.Now()); d < max {
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+	return max
+}
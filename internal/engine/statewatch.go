@@ -0,0 +1,78 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// 状态等待: 不支持回调的绑定 (部分 FFI 调用方) 通过 GetStateBlocking 长轮询状态变化，
+// 每个事件都会唤醒等待方重新计算状态；RTT 变化等没有事件的状态变化由 stateWatchPoll 兜底
+
+const (
+	stateWatchPoll       = time.Second
+	stateWatchMaxTimeout = 5 * time.Minute
+)
+
+var (
+	stateWatchMu sync.Mutex
+	stateWatchCh = make(chan struct{})
+)
+
+// wakeStateWatchers 唤醒所有等待状态变化的调用方
+func wakeStateWatchers() {
+	stateWatchMu.Lock()
+	close(stateWatchCh)
+	stateWatchCh = make(chan struct{})
+	stateWatchMu.Unlock()
+}
+
+// GetStateBlocking 阻塞直到引擎状态与 lastState 不同或超时，返回当前状态
+// 状态与 GetState 相同: idle, starting, ready, degraded, reconnecting, draining, stopping
+// lastState 为空时立即返回；timeoutMs 最长 5 分钟，<= 0 时立即返回当前状态
+func GetStateBlocking(lastState string, timeoutMs int) string {
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout > stateWatchMaxTimeout {
+		timeout = stateWatchMaxTimeout
+	}
+	deadline := clk.After(timeout)
+	for {
+		stateWatchMu.Lock()
+		ch := stateWatchCh
+		stateWatchMu.Unlock()
+
+		state := GetState()
+		if state != lastState || timeout <= 0 {
+			return state
+		}
+		select {
+		case <-ch:
+		case <-clk.After(stateWatchPoll):
+		case <-deadline:
+			return GetState()
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+var (
+	statBytesUp     uint64 // 本地 -> 远程 字节数
+	statBytesDown   uint64 // 远程 -> 本地 字节数
+	statActiveConns int64  // 当前转发中的连接数
+	statTotalConns  uint64 // 累计连接数
+	startTime       time.Time
+)
+
+// stats 统计快照
+type stats struct {
+	APIVersion  int    `json:"apiversion"`
+	Instance    string `json:"instance"` // 实例标签
+	Running     bool   `json:"running"`
+	Uptime      int64  `json:"uptime"`      // 运行秒数
+	Sessions    int    `json:"sessions"`    // 会话池大小
+	Alive       int    `json:"alive"`       // 存活会话数
+	Hibernating bool   `json:"hibernating"` // 会话是否因空闲休眠
+	KillSwitch  bool   `json:"killswitch"`  // 断网保护是否生效
+	ActiveConns int64  `json:"activeconns"` // 当前连接数
+	TotalConns  uint64 `json:"totalconns"`  // 累计连接数
+	BytesUp     uint64 `json:"bytesup"`     // 上行字节数
+	BytesDown   uint64 `json:"bytesdown"`   // 下行字节数
+	Rejected    uint64 `json:"rejected"`    // 来源过滤拒绝数
+	RuleRejects uint64 `json:"rulerejects"` // reject 规则拦截数
+
+	// 上下行滑动速率 (1s/10s/60s 指数平均，字节/秒)
+	Rates *rateStats `json:"rates"`
+
+	// 累计会话质量 (配置 metricsfile 时跨重启保留)
+	Since           int64  `json:"since"`           // 统计起始时间 (Unix 秒)
+	SessionsCreated uint64 `json:"sessionscreated"` // 累计建立的会话数
+	Reconnects      uint64 `json:"reconnects"`      // 累计重连次数
+	AvgRTT          uint64 `json:"avgrtt"`          // 历史平均 RTT 毫秒
+
+	// KCP 全局计数 (来自 kcp-go SNMP)
+	InPkts      uint64 `json:"inpkts"`
+	OutPkts     uint64 `json:"outpkts"`
+	RetransSegs uint64 `json:"retranssegs"`
+	LostSegs    uint64 `json:"lostsegs"`
+
+	ClampedMTU int   `json:"clampedmtu,omitempty"` // 检测到 MTU 黑洞后降低的 MTU
+	IdleTimer  bool  `json:"idletimer,omitempty"`  // 空闲中，KCP interval 已按 timerresolution 放宽
+	KeepAlive  int64 `json:"keepalive,omitempty"`  // 当前心跳间隔毫秒 (合并或自适应心跳时)
+
+	DupPackets uint64 `json:"duppackets,omitempty"` // duplicate 额外发送的小包副本数
+
+	// 自动档位 (仅 profile 为 auto 时)
+	Profile *profileState `json:"profile,omitempty"`
+
+	// 连接质量评分 (未运行或尚未采样时为 -1)
+	QualityScore int           `json:"qualityscore"`
+	Quality      *qualityStats `json:"quality,omitempty"`
+
+	// 会话标识 (KCP 会话 ID 和端点，与服务端日志关联)
+	Identities []sessionIdentity `json:"identities,omitempty"`
+
+	// 各会话收发包数和包速率 (引擎自建 socket 时)
+	Wire []sessionWire `json:"wire,omitempty"`
+
+	// FEC 效果 (仅启用 FEC 时)
+	FEC *fecStats `json:"fec,omitempty"`
+
+	// 发送队列 (FlushAll 等待其排空)
+	Queued      []int64 `json:"queued,omitempty"` // 各会话槽位待写出字节数
+	QueuedBytes int64   `json:"queuedbytes"`      // 待写出字节总数
+
+	// 流质量 SLO
+	SLO          sloStats          `json:"slo"`
+	CloseReasons map[string]uint64 `json:"closereasons"` // 各关闭原因的连接数
+	Stalls       stallStats        `json:"stalls"`       // SMUX 窗口阻塞
+	WriteErrors  writeErrorStats   `json:"writeerrors"`  // UDP 写错误 (瞬时/永久)
+
+	// 各出口 (proxy/direct/reject) 的连接数和流量
+	Outbounds map[string]outboundStats `json:"outbounds"`
+	AutoWins  map[string]uint64        `json:"autowins"` // auto 动作竞速中各出口胜出次数
+
+	// 按 App 连接标签聚合的连接数和流量
+	Tags map[string]tagStats `json:"tags,omitempty"`
+
+	// 密钥审计
+	Secrets secretStats `json:"secrets"`
+
+	// 统一指标 (MetricsSink 内存后端)
+	Metrics metricsSnapshot `json:"metrics"`
+
+	// 命中最多的路由规则
+	TopRules []ruleHit `json:"toprules,omitempty"`
+
+	// GeoIP (仅配置 geoipdb 时)
+	GeoIP *geoipStats `json:"geoip,omitempty"`
+
+	// 服务器 IP 黑名单 (冷却中的 IP)
+	Blacklist []blacklistInfo `json:"blacklist,omitempty"`
+
+	// 压缩 (仅启用压缩时)
+	Comp *compStats `json:"comp,omitempty"`
+
+	// 写入合并 (仅 writebatch 开启时)
+	Batch *batchStats `json:"batch,omitempty"`
+
+	// 预热流 (仅 warmstream 开启时)
+	Warm *warmStats `json:"warm,omitempty"`
+
+	// 热点 DNS 转发 (仅 hotspotdns 开启时)
+	DNS *dnsStats `json:"dns,omitempty"`
+
+	// ICMP 中继 (仅 icmprelay 开启时)
+	ICMP *icmpStats `json:"icmp,omitempty"`
+
+	// 控制流 (仅 controlstream 开启时)
+	Control *ctrlStats `json:"control,omitempty"`
+	OneWay  *owdStats  `json:"oneway,omitempty"` // 上下行单向时延和排队时延 (控制流有样本后)
+
+	// 调试统计 (仅 debug 模式)
+	CopyPaths map[string]uint64 `json:"copypaths,omitempty"` // 各转发路径使用次数
+	CRC       *crcStats         `json:"crc,omitempty"`       // 帧校验 (仅 framecrc 开启时)
+
+	StreamCap *streamCapStats `json:"streamcap,omitempty"` // 单条流缓冲上限 (仅 streamcap 开启时)
+	Replay    *replayStats    `json:"replay,omitempty"`    // 流重放 (仅配置 replayports 时)
+	FECDirs   *fecDirStats    `json:"fecdirs,omitempty"`   // 分方向 FEC (仅 fecup/fecdown 不为 on 时)
+	DNSStub   *dnsStubStats   `json:"dnsstub,omitempty"`   // 本地 DNS 存根 (仅配置 dnsstub 时)
+	Bloat     *bloatStats     `json:"bloat,omitempty"`     // 下行缓冲膨胀 (出现下行负载后)
+	Classes   []classStats    `json:"classes,omitempty"`   // 按类别整形 (仅配置 classshares 时)
+	OpenRetry *openRetryStats `json:"openretry,omitempty"` // 打开流失败后在其余会话上重试 (发生过重试后)
+	Prefetch  []prefetchInfo  `json:"prefetch,omitempty"`  // 服务器域名预解析 (仅配置 dnsprefetch 时)
+	Admission *admissionStats `json:"admission,omitempty"` // 打开流错峰 (仅配置 openspacing 时)
+	Idle      *idleStats      `json:"idle,omitempty"`      // 流空闲回收 (仅配置 streamidle 时)
+	Peer      *peerStats      `json:"peer,omitempty"`      // 点对点隧道 (仅配置 rendezvous 时)
+
+	Boundary *boundaryStats `json:"boundary,omitempty"` // 回调的跨语言边界开销 (仅 debug)
+}
+
+// StatsListener 统计回调接口 (由 App 实现)
+type StatsListener interface {
+	OnStats(statsJson string)
+}
+
+var (
+	statsMu   sync.Mutex
+	statsStop chan struct{}
+)
+
+// GetStats 返回 JSON 格式的统计快照
+func GetStats() string {
+	b, _ := json.Marshal(snapshotStats())
+	return string(b)
+}
+
+// SetStatsListener 按 intervalMs 毫秒间隔推送统计快照
+// l 为 nil 或 intervalMs <= 0 时取消推送; Pause 期间自动暂停
+func SetStatsListener(intervalMs int, l StatsListener) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	if statsStop != nil {
+		close(statsStop)
+		statsStop = nil
+	}
+	if l == nil || intervalMs <= 0 {
+		return
+	}
+
+	statsStop = make(chan struct{})
+	go statsLoop(time.Duration(intervalMs)*time.Millisecond, l, statsStop)
+}
+
+// statsLoop 统计推送循环
+func statsLoop(interval time.Duration, l StatsListener, stop chan struct{}) {
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.Chan():
+		}
+
+		// 暂停期间停止计时器，避免无意义的唤醒
+		if resume := pauseWait(); resume != nil {
+			ticker.Stop()
+			select {
+			case <-stop:
+				return
+			case <-resume:
+			}
+			ticker.Reset(interval)
+		}
+
+		start := clk.Now()
+		js := GetStats()
+		marshaled := clk.Now()
+		observeCallback(&statsMarshals, "statsmarshal", marshaled.Sub(start), 1)
+		l.OnStats(js)
+		observeCallback(&statsCalls, "stats", clk.Since(marshaled), 1)
+	}
+}
+
+// snapshotStats 生成统计快照
+func snapshotStats() *stats {
+	s := &stats{
+		APIVersion:  apiVersion,
+		Instance:    currentLabel(),
+		Hibernating: isHibernating(),
+		KillSwitch:  killSwitchEngaged(),
+		ActiveConns: atomic.LoadInt64(&statActiveConns),
+		TotalConns:  atomic.LoadUint64(&statTotalConns),
+		BytesUp:     atomic.LoadUint64(&statBytesUp),
+		BytesDown:   atomic.LoadUint64(&statBytesDown),
+		Rejected:    atomic.LoadUint64(&statRejected),
+		RuleRejects: atomic.LoadUint64(&statRuleRejects),
+
+		SessionsCreated: atomic.LoadUint64(&statSessionsCreated),
+		Reconnects:      atomic.LoadUint64(&statReconnects),
+		AvgRTT:          avgRTT(),
+		ClampedMTU:      int(atomic.LoadInt32(&clampedMTU)),
+		IdleTimer:       atomic.LoadInt32(&timerCoarse) != 0,
+		KeepAlive:       time.Duration(atomic.LoadInt64(&currentKeepAlive)).Milliseconds(),
+		DupPackets:      atomic.LoadUint64(&statDupPackets),
+
+		SLO:          snapshotSLO(),
+		CloseReasons: closeReasonStats(),
+		Stalls:       snapshotStalls(),
+		WriteErrors:  snapshotWriteErrors(),
+		Outbounds:    outboundStatsSnapshot(),
+		AutoWins:     autoWinStats(),
+		Tags:         snapshotTags(),
+		Secrets:      snapshotSecrets(),
+		Metrics:      memMetrics.snapshot(),
+		Rates:        snapshotRates(),
+	}
+
+	metricsMu.Lock()
+	s.Since = metricsSince
+	metricsMu.Unlock()
+
+	proxyMu.Lock()
+	s.Running = proxyRunning()
+	s.QualityScore = -1
+	if proxyRunning() {
+		if s.Quality = snapshotQuality(); s.Quality != nil {
+			s.QualityScore = s.Quality.Score
+		}
+		s.Uptime = int64(clk.Since(startTime).Seconds())
+		s.Queued, s.QueuedBytes = sessionQueues()
+		s.Blacklist = snapshotBlacklist()
+		s.Identities = sessionIdentities()
+		s.Wire = sessionWires()
+		s.Profile = snapshotProfile()
+		s.FEC = snapshotFEC(proxyConfig)
+		s.StreamCap = snapshotStreamCap(proxyConfig)
+		s.Replay = snapshotReplay(proxyConfig)
+		s.FECDirs = snapshotFECDirs(proxyConfig)
+		s.DNSStub = snapshotDNSStub(proxyConfig)
+		s.Bloat = snapshotBloat()
+		s.Classes = snapshotClasses()
+		s.OpenRetry = snapshotOpenRetry()
+		s.Prefetch = snapshotPrefetch(proxyConfig)
+		s.Admission = snapshotAdmission()
+		s.Idle = snapshotIdle(proxyConfig)
+		s.Peer = snapshotPeer(proxyConfig)
+		if proxyConfig.Debug {
+			s.CopyPaths = copyPathStats()
+			s.Boundary = snapshotBoundary()
+			if proxyConfig.FrameCRC {
+				s.CRC = snapshotCRC()
+			}
+		}
+		s.TopRules = topRules(proxyConfig, 10)
+		if proxyConfig.GeoIPDB != "" {
+			s.GeoIP = snapshotGeoIP()
+		}
+		if proxyConfig.Comp == compZstd {
+			s.Comp = snapshotComp(compZstd)
+		} else if !*proxyConfig.NoComp {
+			s.Comp = snapshotComp(compSnappy)
+		}
+		if proxyConfig.WriteBatch > 0 {
+			s.Batch = snapshotBatch()
+		}
+		if proxyConfig.WarmStream {
+			s.Warm = snapshotWarm()
+		}
+		if proxyConfig.Hotspot && proxyConfig.HotspotDNS > 0 {
+			s.DNS = snapshotDNS()
+		}
+		if proxyConfig.ICMPRelay {
+			s.ICMP = snapshotICMP()
+		}
+		if proxyConfig.ControlStream {
+			ctrl := snapshotCtrl()
+			s.Control = &ctrl
+			s.OneWay = snapshotOneWay()
+		}
+	}
+	s.Sessions = len(proxySessions)
+	for _, session := range proxySessions {
+		if session.alive() {
+			s.Alive++
+		}
+	}
+	proxyMu.Unlock()
+
+	snmp := kcp.DefaultSnmp.Copy()
+	s.InPkts = snmp.InPkts
+	s.OutPkts = snmp.OutPkts
+	s.RetransSegs = snmp.RetransSegs
+	s.LostSegs = snmp.LostSegs
+	return s
+}
+
+// countWriter 统计写入字节数
+type countWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
@@ -0,0 +1,241 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 单条流的接收缓冲上限 (streamcap): 与 SMUX 版本和 maxstreambuffer 无关，
+// 在 SMUX 之下按帧统计每条流收到的数据，减去已写给本地客户端的部分即为积压在 SMUX 中的字节数。
+// 某条流积压超过上限时暂停读取该会话 (服务端随之受 KCP 窗口限制)，
+// 持续超过 streamCapGrace 仍未消化则关闭该流，避免一条读取缓慢的连接占满内存
+// 上行方向受 KCP 发送窗口限制，单条流只占用一个转发缓冲区，不需要额外限制
+
+const (
+	smuxCmdPSH = 2 // SMUX 数据帧
+
+	streamCapPoll  = 20 * time.Millisecond
+	streamCapGrace = 10 * time.Second
+)
+
+var (
+	statStreamCapPauses uint64 // 因单条流超出上限暂停读取的次数
+	statStreamCapKills  uint64 // 超出上限过久被关闭的流数
+)
+
+// streamBuffers 会话内各流收到的数据量
+type streamBuffers struct {
+	limit uint64
+
+	mu      sync.Mutex
+	streams map[uint32]*capEntry
+}
+
+type capEntry struct {
+	info *streamInfo
+	recv uint64
+}
+
+func newStreamBuffers(config *Config) *streamBuffers {
+	if config.StreamCap <= 0 {
+		return nil
+	}
+	return &streamBuffers{limit: uint64(config.StreamCap) * 1024, streams: make(map[uint32]*capEntry)}
+}
+
+// track 开始统计一条流
+func (b *streamBuffers) track(s *streamInfo) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.streams[s.sid] = &capEntry{info: s}
+	b.mu.Unlock()
+}
+
+// untrack 流结束时停止统计
+func (b *streamBuffers) untrack(s *streamInfo) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	if e := b.streams[s.sid]; e != nil && e.info == s {
+		delete(b.streams, s.sid)
+	}
+	b.mu.Unlock()
+}
+
+// received 记录收到的数据帧，返回该流 (未登记时为 nil)
+func (b *streamBuffers) received(sid uint32, n int) *capEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.streams[sid]
+	if e != nil {
+		e.recv += uint64(n)
+	}
+	return e
+}
+
+// buffered 流积压在 SMUX 中、尚未写给本地客户端的字节数 (已结束的流为 0)
+func (b *streamBuffers) buffered(e *capEntry) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.streams[e.info.sid] != e {
+		return 0
+	}
+	if done := atomic.LoadUint64(&e.info.bytesDown); e.recv > done {
+		return e.recv - done
+	}
+	return 0
+}
+
+// bufferedFor 返回流当前积压字节数 (未开启或未登记时为 0)
+func (b *streamBuffers) bufferedFor(s *streamInfo) uint64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	e := b.streams[s.sid]
+	b.mu.Unlock()
+	if e == nil || e.info != s {
+		return 0
+	}
+	return b.buffered(e)
+}
+
+// capConn 按帧统计各流收到的数据，必要时暂停读取
+type capConn struct {
+	net.Conn
+	r   *bufio.Reader
+	buf *streamBuffers
+
+	hdr    [smuxHeaderSize]byte
+	header []byte // 当前帧尚未交给 SMUX 的帧头
+	remain int    // 当前帧尚未交给 SMUX 的数据字节数
+
+	closeOnce sync.Once
+	die       chan struct{}
+}
+
+func newCapConn(conn net.Conn, buf *streamBuffers) *capConn {
+	return &capConn{Conn: conn, r: bufio.NewReaderSize(conn, 64<<10), buf: buf, die: make(chan struct{})}
+}
+
+func (c *capConn) Close() error {
+	c.closeOnce.Do(func() { close(c.die) })
+	return c.Conn.Close()
+}
+
+// Read 逐帧交给 SMUX，数据帧先计入对应的流
+func (c *capConn) Read(b []byte) (int, error) {
+	if len(c.header) == 0 && c.remain == 0 {
+		if _, err := io.ReadFull(c.r, c.hdr[:]); err != nil {
+			return 0, err
+		}
+		c.header = c.hdr[:]
+		c.remain = int(binary.LittleEndian.Uint16(c.hdr[2:4]))
+		if c.hdr[1] == smuxCmdPSH && c.remain > 0 {
+			if e := c.buf.received(binary.LittleEndian.Uint32(c.hdr[4:]), c.remain); e != nil {
+				c.wait(e)
+			}
+		}
+	}
+	if len(c.header) > 0 {
+		n := copy(b, c.header)
+		c.header = c.header[n:]
+		return n, nil
+	}
+	if len(b) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.r.Read(b)
+	c.remain -= n
+	return n, err
+}
+
+// wait 流积压超过上限时暂停读取，直到回落、流结束或超时后关闭该流
+func (c *capConn) wait(e *capEntry) {
+	if c.buf.buffered(e) <= c.buf.limit {
+		return
+	}
+	atomic.AddUint64(&statStreamCapPauses, 1)
+	metricCount("kcp_stream_cap_pauses_total", "", 1)
+
+	deadline := clk.Now().Add(streamCapGrace)
+	for c.buf.buffered(e) > c.buf.limit {
+		if !clk.Now().Before(deadline) {
+			c.kill(e)
+			return
+		}
+		select {
+		case <-clk.After(streamCapPoll):
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// kill 关闭长时间超出上限的流
+func (c *capConn) kill(e *capEntry) {
+	s := e.info
+	buffered := c.buf.buffered(e)
+	atomic.AddUint64(&statStreamCapKills, 1)
+	atomic.StoreInt32(&s.trimmed, 1)
+	if s.kill != nil {
+		s.kill()
+	}
+	log.Printf("Stream %d exceeded streamcap (%d bytes buffered), closed", s.id, buffered)
+	emitEvent("stream-capped", map[string]interface{}{
+		"id":       s.id,
+		"target":   s.getTarget(),
+		"buffered": buffered,
+		"limit":    c.buf.limit,
+	})
+}
+
+// streamCapStats 单条流缓冲上限统计
+type streamCapStats struct {
+	Pauses uint64 `json:"pauses"`
+	Kills  uint64 `json:"kills"`
+}
+
+// snapshotStreamCap 返回单条流缓冲上限统计 (未开启时为 nil)
+func snapshotStreamCap(config *Config) *streamCapStats {
+	if config.StreamCap <= 0 {
+		return nil
+	}
+	return &streamCapStats{
+		Pauses: atomic.LoadUint64(&statStreamCapPauses),
+		Kills:  atomic.LoadUint64(&statStreamCapKills),
+	}
+}
@@ -0,0 +1,248 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// streamInfo 一条正在转发的连接 (本地 TCP 连接 <-> SMUX 流)
+type streamInfo struct {
+	id        uint64
+	sid       uint32 // SMUX 流 ID (仅在所属会话内唯一)
+	conv      uint32 // 所属会话的 KCP 会话 ID
+	link      string // 所属会话的本地端点 (服务端日志中的客户端地址)
+	session   *poolSession
+	local     string
+	start     time.Time
+	bytesUp   uint64
+	bytesDown uint64
+	ttfb      int64  // 首字节时间 (纳秒，0 表示尚未收到)
+	stalls    uint32 // 写入阻塞次数
+	warm      bool   // 使用了预热流
+	tag       string // App 通过 TagNextConnection 设置的标签
+
+	lastActive int64  // 最后一次转发数据的时间 (UnixNano)
+	trimmed    int32  // 非 0 表示因内存压力被关闭
+	reaped     int32  // 非 0 表示因空闲超过 streamidle 被关闭
+	kill       func() // 关闭本地连接和流
+
+	sniff    targetSniffer             // 仅上行写入协程访问
+	onTarget func(target string) error // 识别出目标时调用，返回错误则中止上行
+
+	mu     sync.Mutex
+	mirror *streamMirror
+	target string // 从代理握手中识别的目标 host:port
+	domain string // 目标为 IP 时嗅探出的域名
+}
+
+var (
+	streamsMu     sync.Mutex
+	activeStreams = make(map[uint64]*streamInfo)
+	nextStreamID  uint64
+)
+
+// registerStream 登记新的转发连接
+func registerStream(p1 net.Conn, p2 *smux.Stream, session *poolSession) *streamInfo {
+	s := &streamInfo{
+		id:      atomic.AddUint64(&nextStreamID, 1),
+		sid:     p2.ID(),
+		conv:    session.conv(),
+		link:    session.link.LocalAddr().String(),
+		session: session,
+		local:   p1.RemoteAddr().String(),
+		tag:     takeTag(p1.RemoteAddr()),
+		start:   clk.Now(),
+		kill: func() {
+			p1.Close()
+			p2.Close()
+		},
+	}
+	s.lastActive = s.start.UnixNano()
+	streamsMu.Lock()
+	activeStreams[s.id] = s
+	streamsMu.Unlock()
+	session.buffers.track(s)
+	return s
+}
+
+// unregisterStream 连接结束时移除登记并停止镜像
+func unregisterStream(s *streamInfo) {
+	streamsMu.Lock()
+	delete(activeStreams, s.id)
+	streamsMu.Unlock()
+	s.session.buffers.untrack(s)
+	s.setMirror(nil)
+}
+
+// GetActiveStreams 返回当前转发中的连接列表 (JSON)
+func GetActiveStreams() string {
+	type streamJSON struct {
+		ID        uint64 `json:"id"`
+		SID       uint32 `json:"sid"`
+		Conv      uint32 `json:"conv,omitempty"`
+		Local     string `json:"local"`
+		Age       int64  `json:"age"` // 秒
+		BytesUp   uint64 `json:"bytesup"`
+		BytesDown uint64 `json:"bytesdown"`
+		Target    string `json:"target,omitempty"`
+		Domain    string `json:"domain,omitempty"` // 嗅探出的域名
+		Tag       string `json:"tag,omitempty"`
+		TTFB      int64  `json:"ttfb,omitempty"` // 首字节时间毫秒
+		Stalls    uint32 `json:"stalls,omitempty"`
+		Buffered  uint64 `json:"buffered,omitempty"` // 积压在 SMUX 中的接收字节数 (仅 streamcap 开启时)
+		Mirrored  bool   `json:"mirrored"`
+	}
+
+	streamsMu.Lock()
+	list := make([]streamJSON, 0, len(activeStreams))
+	for _, s := range activeStreams {
+		s.mu.Lock()
+		mirrored, target, domain := s.mirror != nil, s.target, s.domain
+		s.mu.Unlock()
+		list = append(list, streamJSON{
+			ID:        s.id,
+			SID:       s.sid,
+			Conv:      s.conv,
+			Local:     s.local,
+			Target:    target,
+			Domain:    domain,
+			Tag:       s.tag,
+			Age:       int64(clk.Since(s.start).Seconds()),
+			BytesUp:   atomic.LoadUint64(&s.bytesUp),
+			BytesDown: atomic.LoadUint64(&s.bytesDown),
+			TTFB:      time.Duration(atomic.LoadInt64(&s.ttfb)).Milliseconds(),
+			Stalls:    atomic.LoadUint32(&s.stalls),
+			Buffered:  s.session.buffers.bufferedFor(s),
+			Mirrored:  mirrored,
+		})
+	}
+	streamsMu.Unlock()
+
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
+// setMirror 替换镜像输出，关闭旧的镜像
+func (s *streamInfo) setMirror(m *streamMirror) {
+	s.mu.Lock()
+	old := s.mirror
+	s.mirror = m
+	s.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+}
+
+// getTarget 返回识别出的目标 (未识别时为空)
+func (s *streamInfo) getTarget() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.target
+}
+
+// getDomain 返回嗅探出的域名 (未识别时为空)
+func (s *streamInfo) getDomain() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.domain
+}
+
+// destination 用于目的地统计的地址: 嗅探出域名时使用域名，否则为目标
+func (s *streamInfo) destination() string {
+	if domain := s.getDomain(); domain != "" {
+		return domain
+	}
+	return s.getTarget()
+}
+
+// getMirror 返回当前镜像输出
+func (s *streamInfo) getMirror() *streamMirror {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mirror
+}
+
+// streamWriter 统计单条连接的字节数并按需镜像
+type streamWriter struct {
+	w   io.Writer
+	s   *streamInfo
+	dir byte // 'U' 上行, 'D' 下行
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	// 下行只有一个写入协程，首次写入即首字节
+	if sw.dir == 'D' && len(p) > 0 && atomic.LoadInt64(&sw.s.ttfb) == 0 {
+		ttfb := clk.Since(sw.s.start)
+		if ttfb <= 0 {
+			ttfb = 1 // 0 表示尚未收到
+		}
+		atomic.StoreInt64(&sw.s.ttfb, int64(ttfb))
+		recordTTFB(ttfb)
+		recordWarmTTFB(sw.s.warm, ttfb)
+		sw.s.session.ttfbOK()
+	}
+	if sw.dir == 'U' {
+		target, domain := sw.s.sniff.feed(p)
+		if target != "" || domain != "" {
+			sw.s.mu.Lock()
+			if target != "" {
+				sw.s.target = target
+			} else {
+				sw.s.domain = domain
+				target = domain
+			}
+			sw.s.mu.Unlock()
+			if sw.s.onTarget != nil {
+				if err := sw.s.onTarget(target); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	start := clk.Now()
+	n, err := sw.w.Write(p)
+	if d := clk.Since(start); d > stallThreshold {
+		recordStall(sw.s, sw.dir, d)
+	}
+	atomic.StoreInt64(&sw.s.lastActive, start.UnixNano())
+	if sw.dir == 'U' {
+		atomic.AddUint64(&sw.s.bytesUp, uint64(n))
+	} else {
+		atomic.AddUint64(&sw.s.bytesDown, uint64(n))
+	}
+	if m := sw.s.getMirror(); m != nil && n > 0 {
+		m.write(sw.dir, p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,192 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 规则热更新与订阅:
+// UpdateRules 整体替换本地规则；rulesurl 订阅的规则通过隧道定期拉取 (支持 ETag)，
+// 排在本地规则之后。两者更新后都会立即生效，并发送 rules-updated 事件
+
+const (
+	maxRulesSize    = 8 << 20 // 订阅规则最大字节数
+	rulesFetchRetry = 5 * time.Minute
+)
+
+// UpdateRules 替换运行中实例的本地路由规则
+// rulesJson: JSON 规则数组，格式与配置中的 rules 相同
+// 返回空字符串表示成功，否则返回错误信息
+func UpdateRules(rulesJson string) string {
+	var rules []Rule
+	if err := json.Unmarshal([]byte(rulesJson), &rules); err != nil {
+		return "Config Error: " + err.Error()
+	}
+
+	proxyMu.Lock()
+	config := proxyConfig
+	proxyMu.Unlock()
+	if config == nil {
+		return "Proxy not running"
+	}
+
+	if err := replaceRules(config, rules, nil); err != nil {
+		return "Config Error: " + err.Error()
+	}
+	emitEvent("rules-updated", map[string]interface{}{"source": "local", "count": len(rules)})
+	return ""
+}
+
+// replaceRules 重新编译并替换规则，local 或 sub 为 nil 时保留原值
+func replaceRules(config *Config, local, sub []Rule) error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	if local == nil {
+		local = config.Rules
+	}
+	if sub == nil {
+		sub = config.subRules
+	}
+	rs, err := compileRules(append(append([]Rule(nil), local...), sub...))
+	if err != nil {
+		return err
+	}
+	if rs.geoip && config.GeoIPDB == "" {
+		return errors.New("geoip rules require geoipdb")
+	}
+	config.Rules, config.subRules, config.ruleSet = local, sub, rs
+	return nil
+}
+
+// subscriptionLoop 定期拉取订阅规则，失败时按 rulesFetchRetry 重试
+func subscriptionLoop(config *Config, proxyAddr net.Addr, stop chan struct{}) {
+	client, err := tunnelHTTPClient(config, proxyAddr)
+	if err != nil {
+		logError("Rules subscription:", err)
+		return
+	}
+	interval := time.Duration(config.RulesInterval) * time.Second
+
+	etag := ""
+	for {
+		next := interval
+		rules, tag, err := fetchRules(client, config.RulesURL, etag)
+		switch {
+		case err != nil:
+			logError("Rules subscription:", err)
+			next = rulesFetchRetry
+		case rules == nil:
+			// 304 未变化
+		default:
+			if err := replaceRules(config, nil, rules); err != nil {
+				logError("Rules subscription:", err)
+				break
+			}
+			etag = tag
+			log.Printf("Rules subscription: %d rules loaded", len(rules))
+			emitEvent("rules-updated", map[string]interface{}{"source": "subscription", "count": len(rules)})
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-clk.After(next):
+		}
+	}
+}
+
+// tunnelHTTPClient 返回经本地代理端口 (即隧道) 访问的 HTTP 客户端
+// 服务端为 SOCKS5 代理时用 socks5，否则用 HTTP 代理 (与 pactype 一致)
+func tunnelHTTPClient(config *Config, proxyAddr net.Addr) (*http.Client, error) {
+	tcpAddr, ok := proxyAddr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected listener address: %v", proxyAddr)
+	}
+	host := tcpAddr.IP.String()
+	if tcpAddr.IP.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	scheme := "http"
+	switch config.PACType {
+	case "SOCKS5", "SOCKS":
+		scheme = "socks5"
+	}
+	proxyURL := &url.URL{Scheme: scheme, Host: net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port))}
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   time.Minute,
+	}, nil
+}
+
+// fetchRules 拉取订阅规则；内容未变化 (304) 时 rules 为 nil
+func fetchRules(client *http.Client, rawURL, etag string) (rules []Rule, newTag string, err error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRulesSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > maxRulesSize {
+		return nil, "", errors.New("rules too large")
+	}
+	if err := json.Unmarshal(body, &rules); err != nil {
+		return nil, "", err
+	}
+	if rules == nil {
+		rules = []Rule{}
+	}
+	return rules, resp.Header.Get("ETag"), nil
+}
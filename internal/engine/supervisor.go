@@ -0,0 +1,314 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 会话监管: 断开的会话由监管协程在锁外重连，accept 循环不再拨号。
+// 没有可用会话时，新连接暂存在停车场中，会话恢复后立即分发；
+// 超过 parkTimeout 仍未分发或停车场已满的连接会被关闭。
+
+const (
+	parkingLotSize   = 128              // 停车场最多暂存的连接数
+	parkTimeout      = 10 * time.Second // 连接最长暂存时间
+	reconnectBackoff = time.Second      // 重连失败后的重试间隔
+)
+
+// parkedConn 等待可用会话的连接
+type parkedConn struct {
+	conn   net.Conn
+	client *hotspotClient
+	since  time.Time
+}
+
+// sessionSupervisor 一个实例的会话监管
+type sessionSupervisor struct {
+	config *Config
+	stop   chan struct{}
+	wake   chan struct{} // 有会话断开或有连接暂存 (容量 1)
+
+	mu     sync.Mutex
+	parked []parkedConn
+
+	failures int       // 连续重连失败次数 (仅监管协程访问)
+	retryAt  time.Time // 失败后下次允许重连的时间 (仅监管协程访问)
+
+	idleSince time.Time // 开始没有客户端连接的时间 (仅监管协程访问)
+	exitSince time.Time // exitonidle: 全部连接结束的时间 (仅监管协程访问)
+
+	idleSessions map[*poolSession]time.Time // 按需模式: 各会话开始没有流的时间 (仅监管协程访问)
+
+	lastTick time.Time // 上一轮监管的时间，用于发现系统睡眠 (仅监管协程访问)
+}
+
+func newSupervisor(config *Config, stop chan struct{}) *sessionSupervisor {
+	return &sessionSupervisor{config: config, stop: stop, wake: make(chan struct{}, 1)}
+}
+
+// kick 唤醒监管协程
+func (s *sessionSupervisor) kick() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// parkedCount 停车场中等待会话的连接数
+func (s *sessionSupervisor) parkedCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.parked)
+}
+
+// park 暂存没有可用会话的连接，停车场已满时关闭连接
+func (s *sessionSupervisor) park(conn net.Conn, client *hotspotClient) {
+	s.mu.Lock()
+	if len(s.parked) >= parkingLotSize {
+		s.mu.Unlock()
+		logError("Parking lot full, dropping", conn.RemoteAddr())
+		closeParked(parkedConn{conn: conn, client: client}, closeOverload, socksRefused)
+		return
+	}
+	s.parked = append(s.parked, parkedConn{conn: conn, client: client, since: clk.Now()})
+	s.mu.Unlock()
+	wakeUp()
+	s.kick()
+}
+
+// closeParked 关闭一个未分发的连接，code 为回复客户端的 SOCKS5 失败码
+func closeParked(p parkedConn, reason string, code byte) {
+	countClose(reason)
+	logAccess(&accessRecord{Peer: p.conn.RemoteAddr().String(), Reason: reason})
+	go failClient(p.conn, nil, code)
+	if p.client != nil {
+		p.client.release()
+	}
+}
+
+// run 监管循环
+func (s *sessionSupervisor) run() {
+	ticker := clk.NewTicker(reconnectBackoff)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			s.mu.Lock()
+			parked := s.parked
+			s.parked = nil
+			s.mu.Unlock()
+			for _, p := range parked {
+				closeParked(p, closeShutdown, socksRefused)
+			}
+			return
+		case <-s.wake:
+		case <-ticker.Chan():
+		}
+
+		s.checkResume()
+		s.reconnectDead()
+		s.checkKillSwitch()
+		s.dispatchParked()
+		s.checkIdle()
+		s.checkExitOnIdle()
+		s.checkOwner()
+		s.expireSessions()
+		s.predictLoss()
+		s.trimOnDemand()
+	}
+}
+
+// reconnectDead 在锁外重建已断开的会话
+func (s *sessionSupervisor) reconnectDead() {
+	if clk.Now().Before(s.retryAt) || isHibernating() {
+		return
+	}
+
+	s.mu.Lock()
+	parked := len(s.parked)
+	s.mu.Unlock()
+
+	proxyMu.Lock()
+	var dead []int
+	for i, session := range proxySessions {
+		if !session.alive() {
+			dead = append(dead, i)
+			blameSession(s.config, session)
+		}
+	}
+	// 按需模式只补足当前需要的会话
+	if s.config.onDemand {
+		dead = demandSlotsLocked(parked)
+	}
+	proxyMu.Unlock()
+
+	for _, idx := range dead {
+		session, err := createSession(s.config)
+		if err != nil {
+			logError("Reconnect error:", err)
+			s.retryAt = clk.Now().Add(reconnectBackoff)
+			s.failures++
+			if s.config.AutoServer && s.failures >= autoSwitchFailures {
+				s.failures = 0
+				go autoSwitchServer(s.config, s.stop)
+			}
+			return
+		}
+
+		proxyMu.Lock()
+		select {
+		case <-s.stop:
+			proxyMu.Unlock()
+			session.Close()
+			return
+		default:
+		}
+		// 期间槽位可能已被 ReconnectAll 等替换为存活会话
+		if proxySessions[idx].alive() {
+			proxyMu.Unlock()
+			session.Close()
+			continue
+		}
+		proxySessions[idx] = session
+		proxyMu.Unlock()
+
+		s.failures = 0
+		atomic.AddUint64(&statReconnects, 1)
+		metricCount("kcp_reconnects_total", "", 1)
+		reportPoolProgress()
+		s.dispatchParked()
+	}
+}
+
+// expireSessions 替换存活超过 autoexpire 的会话 (与 kcptun 一致)，每次最多一个
+// 旧会话上的连接最多保留 scavengettl 秒
+func (s *sessionSupervisor) expireSessions() {
+	if s.config.AutoExpire <= 0 || isHibernating() || clk.Now().Before(s.retryAt) {
+		return
+	}
+	expire := time.Duration(s.config.AutoExpire) * time.Second
+
+	proxyMu.Lock()
+	idx := -1
+	for i, session := range proxySessions {
+		if session.alive() && clk.Since(session.created) > expire {
+			idx = i
+			break
+		}
+	}
+	proxyMu.Unlock()
+	if idx < 0 {
+		return
+	}
+
+	if err := replaceSession(idx, s.config, s.stop, time.Duration(s.config.ScavengeTTL)*time.Second); err != nil {
+		logError("Session expire error:", err)
+		s.retryAt = clk.Now().Add(reconnectBackoff)
+		return
+	}
+	log.Printf("Session %d expired and replaced", idx)
+}
+
+// dispatchParked 将暂存的连接分发到存活会话，并关闭超时的连接
+func (s *sessionSupervisor) dispatchParked() {
+	s.mu.Lock()
+	parked := s.parked
+	s.parked = nil
+	s.mu.Unlock()
+	if len(parked) == 0 {
+		return
+	}
+
+	var keep []parkedConn
+	rr := 0
+	for _, p := range parked {
+		proxyMu.Lock()
+		session, _ := pickSessionLocked(&rr)
+		proxyMu.Unlock()
+
+		switch {
+		case session != nil:
+			atomic.AddUint64(&acceptCount, 1)
+			go handleClient(s.config, p.conn, session, p.client)
+		case clk.Since(p.since) > parkTimeout:
+			logError("No session available, dropping", p.conn.RemoteAddr())
+			// 重连持续失败说明服务端不可达，否则只是等待超时
+			code := socksTTLExpired
+			if s.failures > 0 {
+				code = socksHostUnreachable
+			}
+			closeParked(p, closeSessionLost, code)
+		default:
+			keep = append(keep, p)
+		}
+	}
+
+	if len(keep) > 0 {
+		s.mu.Lock()
+		s.parked = append(keep, s.parked...)
+		s.mu.Unlock()
+	}
+}
+
+// pickSessionLocked 从 *rr 开始按吞吐权重做平滑加权轮询，选择一个存活会话 (调用方需持有 proxyMu)
+// 配置了 pinnedports 时跳过专用会话，其余会话全部断开时才使用它
+// dead 表示遇到了已断开的会话
+func pickSessionLocked(rr *int) (session *poolSession, dead bool) {
+	n := len(proxySessions)
+	reserved := reservedSlotLocked()
+	var total float64
+	for i := 0; i < n; i++ {
+		idx := (*rr + i) % n
+		s := proxySessions[idx]
+		if !s.alive() {
+			dead = true
+			continue
+		}
+		if idx == reserved {
+			continue
+		}
+		w := s.balanceWeight()
+		s.balance.credit += w
+		total += w
+		if session == nil || s.balance.credit > session.balance.credit {
+			session = s
+		}
+	}
+	if session != nil {
+		session.balance.credit -= total
+		*rr++
+		return session, dead
+	}
+	if reserved >= 0 && proxySessions[reserved].alive() {
+		return proxySessions[reserved], dead
+	}
+	return nil, dead
+}
@@ -0,0 +1,190 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// useManualClock 在测试期间以手动时钟替换 clk
+func useManualClock(t *testing.T) *manualClock {
+	c := newManualClock(time.Unix(1700000000, 0))
+	old := clk
+	clk = c
+	t.Cleanup(func() { clk = old })
+	return c
+}
+
+// usePool 在测试期间替换会话池
+func usePool(t *testing.T, sessions []*poolSession) {
+	proxyMu.Lock()
+	old := proxySessions
+	proxySessions = sessions
+	proxyMu.Unlock()
+	t.Cleanup(func() {
+		proxyMu.Lock()
+		proxySessions = old
+		proxyMu.Unlock()
+	})
+}
+
+// unreachableConfig 建立会话必然失败的配置 (加密方式无效，不会真正发包)
+func unreachableConfig() *Config {
+	return &Config{RemoteAddr: "127.0.0.1:1", Crypt: "invalid", Key: "test"}
+}
+
+// pipeSession 基于内存管道的存活会话
+func pipeSession(t *testing.T, created time.Time) *poolSession {
+	a, b := net.Pipe()
+	client, err := smux.Client(a, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := smux.Server(b, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &poolSession{Session: client, link: a, created: created}
+}
+
+func TestManualClockTimers(t *testing.T) {
+	c := newManualClock(time.Unix(0, 0))
+	after := c.After(2 * time.Second)
+	ticker := c.NewTicker(time.Second)
+	fired := 0
+	c.AfterFunc(3*time.Second, func() { fired++ })
+
+	c.Advance(time.Second)
+	select {
+	case <-after:
+		t.Fatal("After fired early")
+	default:
+	}
+	<-ticker.Chan()
+
+	c.Advance(2 * time.Second)
+	<-after
+	if fired != 1 {
+		t.Fatalf("AfterFunc fired %d times", fired)
+	}
+	if got := c.Since(time.Unix(0, 0)); got != 3*time.Second {
+		t.Fatalf("Since = %v", got)
+	}
+
+	ticker.Stop()
+	c.Advance(time.Minute)
+	select {
+	case <-ticker.Chan():
+		// 停止前最后一次到期的值可能仍在缓冲中
+	default:
+	}
+	select {
+	case <-ticker.Chan():
+		t.Fatal("ticker fired after Stop")
+	default:
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	c := useManualClock(t)
+	usePool(t, []*poolSession{nil})
+	s := newSupervisor(unreachableConfig(), make(chan struct{}))
+
+	s.reconnectDead()
+	if s.failures != 1 || !s.retryAt.Equal(c.Now().Add(reconnectBackoff)) {
+		t.Fatalf("after first failure: failures %d retryAt %v", s.failures, s.retryAt)
+	}
+
+	// 退避期间不重试
+	c.Advance(reconnectBackoff / 2)
+	s.reconnectDead()
+	if s.failures != 1 {
+		t.Fatalf("retried during backoff: failures %d", s.failures)
+	}
+
+	c.Advance(reconnectBackoff / 2)
+	s.reconnectDead()
+	if s.failures != 2 || !s.retryAt.Equal(c.Now().Add(reconnectBackoff)) {
+		t.Fatalf("after backoff: failures %d retryAt %v", s.failures, s.retryAt)
+	}
+}
+
+func TestExpireSessions(t *testing.T) {
+	c := useManualClock(t)
+	config := unreachableConfig()
+	config.AutoExpire = 60
+	config.ScavengeTTL = 1
+	session := pipeSession(t, c.Now())
+	usePool(t, []*poolSession{session})
+	s := newSupervisor(config, make(chan struct{}))
+
+	// 未超过 autoexpire 时不替换
+	c.Advance(time.Duration(config.AutoExpire) * time.Second)
+	s.expireSessions()
+	if !s.retryAt.IsZero() {
+		t.Fatalf("expired at exactly autoexpire")
+	}
+
+	// 超过后尝试替换，建立失败时保留旧会话并退避
+	c.Advance(time.Second)
+	s.expireSessions()
+	retryAt := c.Now().Add(reconnectBackoff)
+	if !s.retryAt.Equal(retryAt) {
+		t.Fatalf("retryAt %v, want %v", s.retryAt, retryAt)
+	}
+	if proxySessions[0] != session || !session.alive() {
+		t.Fatal("old session replaced or closed after failed expiry")
+	}
+
+	c.Advance(reconnectBackoff / 2)
+	s.expireSessions()
+	if !s.retryAt.Equal(retryAt) {
+		t.Fatal("expiry retried during backoff")
+	}
+
+	c.Advance(reconnectBackoff / 2)
+	s.expireSessions()
+	if !s.retryAt.Equal(c.Now().Add(reconnectBackoff)) {
+		t.Fatal("expiry not retried after backoff")
+	}
+}
+
+func TestExpireSessionsDisabled(t *testing.T) {
+	c := useManualClock(t)
+	usePool(t, []*poolSession{pipeSession(t, c.Now())})
+	s := newSupervisor(unreachableConfig(), make(chan struct{}))
+
+	c.Advance(365 * 24 * time.Hour)
+	s.expireSessions()
+	if !s.retryAt.IsZero() {
+		t.Fatal("session expired with autoexpire 0")
+	}
+}
@@ -0,0 +1,156 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// 连接标签: App 在发起连接前为本地源端口登记标签，
+// 该端口的下一个连接的流统计、连接日志和按标签聚合的流量都带上该标签
+
+const (
+	tagTTL      = 10 * time.Second // 登记后未被连接使用的标签的有效期
+	maxTagLen   = 64
+	maxTags     = 64 // 按标签聚合的条目上限，超出的标签计入 "other"
+	tagOverflow = "other"
+)
+
+// pendingTag 等待连接的标签
+type pendingTag struct {
+	tag string
+	at  time.Time
+}
+
+// tagStats 一个标签的累计统计
+type tagStats struct {
+	Conns     uint64 `json:"conns"`
+	BytesUp   uint64 `json:"bytesup"`
+	BytesDown uint64 `json:"bytesdown"`
+}
+
+var (
+	tagMu       sync.Mutex
+	pendingTags = make(map[int]pendingTag) // 本地源端口 -> 标签
+	tagTotals   = make(map[string]*tagStats)
+)
+
+// TagNextConnection 为来自本地源端口 srcPort 的下一个连接设置标签 (如 "video-player")
+// 标签在 10 秒内未被使用则失效；tag 为空时取消登记
+// 返回空字符串表示成功，否则返回错误信息
+func TagNextConnection(srcPort int, tag string) string {
+	if srcPort <= 0 || srcPort > 65535 {
+		return fmt.Sprintf("Invalid port: %d", srcPort)
+	}
+	if len(tag) > maxTagLen {
+		return fmt.Sprintf("Tag too long: %d > %d", len(tag), maxTagLen)
+	}
+
+	tagMu.Lock()
+	defer tagMu.Unlock()
+
+	// 顺带清理过期的登记
+	for port, p := range pendingTags {
+		if clk.Since(p.at) > tagTTL {
+			delete(pendingTags, port)
+		}
+	}
+	if tag == "" {
+		delete(pendingTags, srcPort)
+		return ""
+	}
+	pendingTags[srcPort] = pendingTag{tag: tag, at: clk.Now()}
+	return ""
+}
+
+// takeTag 取出本地连接源端口登记的标签 (没有时返回空字符串)
+func takeTag(peer net.Addr) string {
+	addr, ok := peer.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+
+	tagMu.Lock()
+	defer tagMu.Unlock()
+
+	p, ok := pendingTags[addr.Port]
+	if !ok {
+		return ""
+	}
+	delete(pendingTags, addr.Port)
+	if clk.Since(p.at) > tagTTL {
+		return ""
+	}
+	return p.tag
+}
+
+// recordTag 连接结束时累加到标签
+func recordTag(tag string, up, down uint64) {
+	if tag == "" {
+		return
+	}
+
+	tagMu.Lock()
+	defer tagMu.Unlock()
+
+	t := tagTotals[tag]
+	if t == nil {
+		if len(tagTotals) >= maxTags {
+			tag = tagOverflow
+		}
+		if t = tagTotals[tag]; t == nil {
+			t = &tagStats{}
+			tagTotals[tag] = t
+		}
+	}
+	t.Conns++
+	t.BytesUp += up
+	t.BytesDown += down
+}
+
+// snapshotTags 各标签的累计统计
+func snapshotTags() map[string]tagStats {
+	tagMu.Lock()
+	defer tagMu.Unlock()
+
+	if len(tagTotals) == 0 {
+		return nil
+	}
+	m := make(map[string]tagStats, len(tagTotals))
+	for tag, t := range tagTotals {
+		m[tag] = *t
+	}
+	return m
+}
+
+// resetTags 清零按标签聚合的统计
+func resetTags() {
+	tagMu.Lock()
+	tagTotals = make(map[string]*tagStats)
+	tagMu.Unlock()
+}
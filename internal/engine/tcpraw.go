@@ -0,0 +1,84 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// TCP 模拟: 与 kcptun 的 --tcp 一致，KCP 数据包封装在伪造的 TCP 报文中 (tcpraw)，
+// 用于连接以 --tcp true 启动的服务端。原始套接字需要 root 或 CAP_NET_RAW，
+// 普通 Android App 和 iOS 上通常不可用:
+// 此时 tcpfallback 开启则回退到 UDP (服务端需同时监听 UDP)，否则返回能力错误
+
+// capabilityError 当前平台或权限不支持某项功能
+type capabilityError struct {
+	feature string
+	err     error
+}
+
+func (e *capabilityError) Error() string {
+	return "Capability Error: " + e.feature + ": " + e.err.Error()
+}
+
+func (e *capabilityError) Unwrap() error { return e.err }
+
+var errNoRawSocket = errors.New("raw sockets require root or CAP_NET_RAW")
+
+// dialKCPOverTCP 通过 TCP 模拟建立 KCP 连接
+func dialKCPOverTCP(config *Config, block kcp.BlockCrypt, dataShard, parityShard int) (*kcp.UDPSession, net.Conn, error) {
+	pconn, err := dialRawTCP(config.RemoteAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	wire := newWireCounter(pconn)
+	sess, err := kcp.NewConn(config.RemoteAddr, block, dataShard, parityShard, dropParity(config, block, duplicateSmall(config, wire)))
+	if err != nil {
+		pconn.Close()
+		return nil, nil, err
+	}
+	return sess, &boundConn{UDPSession: sess, pconn: pconn, wire: wire}, nil
+}
+
+// tcpFallback 处理 TCP 模拟失败: 能力错误且允许回退时返回 true
+func tcpFallback(config *Config, err error) bool {
+	var capErr *capabilityError
+	if !errors.As(err, &capErr) {
+		return false
+	}
+	emitEvent("capability", map[string]interface{}{
+		"feature":  capErr.feature,
+		"error":    capErr.err.Error(),
+		"fallback": config.TCPFallback,
+	})
+	if config.TCPFallback {
+		log.Println("TCP emulation unavailable, falling back to UDP:", capErr.err)
+	}
+	return config.TCPFallback
+}
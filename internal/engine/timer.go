@@ -0,0 +1,102 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 空闲定时器粒度: kcp-go 按每个会话的 interval (10ms 起) 唤醒执行 update/flush，
+// 没有数据时也持续唤醒，是手机空闲耗电的主要来源之一。kcp-go 的全局调度器没有公开可调参数，
+// 这里通过 timerresolution 在没有连接时把各会话的 interval 放宽 (仍保留心跳)，
+// 有新连接时立即恢复模式设定的 interval
+
+const (
+	timerCheckInterval = time.Second
+	timerIdleDelay     = 5 * time.Second // 连续空闲多久后放宽
+)
+
+var timerCoarse int32 // 非 0 表示已放宽 interval
+
+// kcpInterval 当前应使用的 KCP interval
+func kcpInterval(config *Config, p kcpParams) int {
+	if config.TimerResolution > p.Interval && atomic.LoadInt32(&timerCoarse) != 0 {
+		return config.TimerResolution
+	}
+	return p.Interval
+}
+
+// applyInterval 按当前状态设置所有存活会话的 interval
+func applyInterval(config *Config) {
+	p := effectiveParams(config)
+	interval := kcpInterval(config, p)
+
+	proxyMu.Lock()
+	for _, s := range proxySessions {
+		if s.alive() && s.conn != nil {
+			s.conn.SetNoDelay(p.NoDelay, interval, p.Resend, p.NoCongestion)
+		}
+	}
+	proxyMu.Unlock()
+}
+
+// timerActive 有新连接时恢复精细的 interval
+func timerActive(config *Config) {
+	if atomic.CompareAndSwapInt32(&timerCoarse, 1, 0) {
+		applyInterval(config)
+		log.Println("Traffic resumed, KCP interval restored")
+	}
+}
+
+// timerLoop 空闲检测循环
+func timerLoop(config *Config, stop chan struct{}) {
+	ticker := clk.NewTicker(timerCheckInterval)
+	defer ticker.Stop()
+	defer atomic.StoreInt32(&timerCoarse, 0)
+
+	var idleSince time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.Chan():
+		}
+
+		if atomic.LoadInt64(&statActiveConns) > 0 {
+			idleSince = time.Time{}
+			continue
+		}
+		if idleSince.IsZero() {
+			idleSince = clk.Now()
+			continue
+		}
+		if clk.Since(idleSince) >= timerIdleDelay && atomic.CompareAndSwapInt32(&timerCoarse, 0, 1) {
+			applyInterval(config)
+			log.Printf("Idle, KCP interval relaxed to %dms", config.TimerResolution)
+		}
+	}
+}
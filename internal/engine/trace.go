@@ -0,0 +1,186 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// 网络轨迹录制与重放 (调试): 用户设备上配置 tracefile，每秒记录一行会话 RTT 和重传率，
+// 以及会话断开/重建；开发机上配置 tracereplay 指向该文件，KCP 的 UDP 收发经过模拟损伤层，
+// 按录制的时间线加入延迟和丢包，所有会话都断开的时段内丢弃全部报文，复现用户遇到的网络状况。
+// 轨迹为文本，每行 "<毫秒> <类型> <字段...>":
+//
+//	0 r 0          会话 0 建立
+//	1000 s 85 0.02 平均 RTT 85ms，重传率 2%
+//	4200 l 0       会话 0 断开
+//
+// 损伤层只作用于 UDP 传输 (不含 TCP 模拟和 TLS)，施加在本机到服务端的真实网络之上
+
+const (
+	traceHeader   = "# kcptrace v1"
+	traceInterval = time.Second
+)
+
+// 重放时间线的起点 (UnixNano)，每次启动重置
+var traceStart int64
+
+// resetTrace 重放时间线从本次启动开始
+func resetTrace() {
+	atomic.StoreInt64(&traceStart, clk.Now().UnixNano())
+}
+
+// at 返回时间线上 d 时刻的 RTT、单向丢包率和是否全部断开 (超出轨迹末尾时保持最后一个采样)
+func (t *netTrace) at(d time.Duration) (time.Duration, float64, bool) {
+	for _, o := range t.outages {
+		if d >= o[0] && d < o[1] {
+			return 0, 1, true
+		}
+	}
+	i := sort.Search(len(t.samples), func(i int) bool { return t.samples[i].at > d })
+	if i > 0 {
+		i--
+	}
+	s := t.samples[i]
+	return s.rtt, s.loss, false
+}
+
+// impairConn 按轨迹模拟延迟和丢包的 PacketConn
+// 发送方向延迟整个 RTT，两个方向各按单向丢包率丢弃
+type impairConn struct {
+	net.PacketConn
+	trace *netTrace
+}
+
+// impairTrace 配置了 tracereplay 时为 conn 加上模拟损伤层
+func impairTrace(config *Config, conn net.PacketConn) net.PacketConn {
+	if config.trace == nil {
+		return conn
+	}
+	return &impairConn{PacketConn: conn, trace: config.trace}
+}
+
+// now 当前时刻在重放时间线上的状态
+func (c *impairConn) now() (time.Duration, float64, bool) {
+	return c.trace.at(clk.Now().Sub(time.Unix(0, atomic.LoadInt64(&traceStart))))
+}
+
+func (c *impairConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	rtt, loss, down := c.now()
+	if down || rand.Float64() < loss {
+		return len(b), nil
+	}
+	if rtt <= 0 {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	p := append([]byte(nil), b...)
+	clk.AfterFunc(rtt, func() { c.PacketConn.WriteTo(p, addr) })
+	return len(b), nil
+}
+
+func (c *impairConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if _, loss, down := c.now(); !down && rand.Float64() >= loss {
+			return n, addr, nil
+		}
+	}
+}
+
+// traceLoop 每秒向 tracefile 写入一行采样，并记录会话的断开和重建
+func traceLoop(config *Config, stop chan struct{}) {
+	f, err := os.OpenFile(config.TraceFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		logError("Trace file:", err)
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+	fmt.Fprintln(w, traceHeader)
+
+	start := clk.Now()
+	last := kcp.DefaultSnmp.Copy()
+	known := make(map[int]*poolSession) // 各槽位上一次看到的存活会话
+	ticker := clk.NewTicker(traceInterval)
+	defer ticker.Stop()
+	for {
+		ms := clk.Since(start).Milliseconds()
+		proxyMu.Lock()
+		sessions := append([]*poolSession(nil), proxySessions...)
+		proxyMu.Unlock()
+
+		var rttSum int64
+		alive := 0
+		for i, s := range sessions {
+			if s.alive() {
+				alive++
+				rttSum += int64(s.srtt())
+				if known[i] != s {
+					known[i] = s
+					fmt.Fprintf(w, "%d r %d\n", ms, i)
+				}
+			} else if known[i] != nil {
+				known[i] = nil
+				fmt.Fprintf(w, "%d l %d\n", ms, i)
+			}
+		}
+
+		snmp := kcp.DefaultSnmp.Copy()
+		var loss float64
+		if out := snmp.OutSegs - last.OutSegs; out > 0 {
+			loss = math.Min(1, float64(snmp.RetransSegs-last.RetransSegs)/float64(out))
+		}
+		last = snmp
+		var rtt int64
+		if alive > 0 {
+			rtt = rttSum / int64(alive)
+		}
+		fmt.Fprintf(w, "%d s %d %.4f\n", ms, rtt, loss)
+		if err := w.Flush(); err != nil {
+			logError("Trace file:", err)
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.Chan():
+		}
+	}
+}
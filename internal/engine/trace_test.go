@@ -0,0 +1,211 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTrace 写入临时轨迹文件
+func writeTrace(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "trace")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTrace(t *testing.T) {
+	tr, err := loadTrace(writeTrace(t,
+		traceHeader,
+		"0 r 0",
+		"0 r 1",
+		"0 s 80 0.19",
+		"1000 l 0",
+		"1000 s 120 0",
+		"2000 l 1", // 全部断开
+		"",
+		"3000 r 1",
+		"3000 s 60 1",
+		"5000 l 1",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.samples) != 3 {
+		t.Fatalf("%d samples", len(tr.samples))
+	}
+	if len(tr.outages) != 2 || tr.outages[0] != [2]time.Duration{2 * time.Second, 3 * time.Second} ||
+		tr.outages[1][0] != 5*time.Second || tr.outages[1][1] != math.MaxInt64 {
+		t.Fatalf("outages %v", tr.outages)
+	}
+
+	for _, c := range []struct {
+		at   time.Duration
+		rtt  time.Duration
+		loss float64
+		down bool
+	}{
+		{0, 80 * time.Millisecond, 0.1, false}, // 往返 19% 重传 = 单向 10% 丢包
+		{999 * time.Millisecond, 80 * time.Millisecond, 0.1, false},
+		{time.Second, 120 * time.Millisecond, 0, false},
+		{2500 * time.Millisecond, 0, 1, true},
+		{3 * time.Second, 60 * time.Millisecond, 1, false},
+		{time.Hour, 0, 1, true},
+	} {
+		rtt, loss, down := tr.at(c.at)
+		if rtt != c.rtt || math.Abs(loss-c.loss) > 1e-9 || down != c.down {
+			t.Errorf("at(%v) = %v %v %v, want %v %v %v", c.at, rtt, loss, down, c.rtt, c.loss, c.down)
+		}
+	}
+}
+
+func TestLoadTraceErrors(t *testing.T) {
+	for _, lines := range [][]string{
+		{traceHeader},        // 没有采样
+		{"0 r 0"},            // 没有采样
+		{"0 s 80 1.5"},       // 丢包率超出范围
+		{"0 s 80 -0.1"},      // 丢包率超出范围
+		{"0 s 80"},           // 缺少字段
+		{"0 x 1", "0 s 1 0"}, // 未知类型
+		{"abc s 1 0"},
+		{"0 l zero", "0 s 1 0"},
+	} {
+		if _, err := loadTrace(writeTrace(t, lines...)); err == nil {
+			t.Errorf("loadTrace(%q) succeeded", lines)
+		}
+	}
+	if _, err := loadTrace(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loadTrace of missing file succeeded")
+	}
+}
+
+// TestTraceRecordReplay 录制会话断开/重建后重放: 断开时段内丢弃报文，其余时段按 RTT 延迟发送
+func TestTraceRecordReplay(t *testing.T) {
+	c := useManualClock(t)
+	session := pipeSession(t, c.Now())
+	session.handshake = 40 * time.Millisecond
+	usePool(t, []*poolSession{session})
+
+	path := filepath.Join(t.TempDir(), "trace")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		traceLoop(&Config{TraceFile: path}, stop)
+		close(done)
+	}()
+	waitTraceLines(t, path, 3)
+
+	setSlot := func(s *poolSession) {
+		proxyMu.Lock()
+		proxySessions[0] = s
+		proxyMu.Unlock()
+	}
+	setSlot(nil)
+	c.Advance(traceInterval)
+	waitTraceLines(t, path, 5)
+	setSlot(pipeSession(t, c.Now()))
+	c.Advance(traceInterval)
+	waitTraceLines(t, path, 7)
+	close(stop)
+	<-done
+
+	tr, err := loadTrace(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.outages) != 1 || tr.outages[0] != [2]time.Duration{traceInterval, 2 * traceInterval} {
+		t.Fatalf("outages %v", tr.outages)
+	}
+	if rtt, _, _ := tr.at(0); rtt != session.handshake {
+		t.Fatalf("recorded rtt %v", rtt)
+	}
+
+	// 重放
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := impairTrace(&Config{trace: tr}, raw)
+	defer conn.Close()
+	resetTrace()
+
+	// 正常时段: 按录制的 RTT 延迟发送
+	conn.WriteTo([]byte("a"), server.LocalAddr())
+	if got := readPacket(server, 50*time.Millisecond); got != "" {
+		t.Fatalf("packet %q delivered before rtt", got)
+	}
+	c.Advance(session.handshake)
+	if got := readPacket(server, time.Second); got != "a" {
+		t.Fatalf("delayed packet %q", got)
+	}
+
+	// 断开时段: 两个方向都丢弃
+	c.Advance(traceInterval)
+	conn.WriteTo([]byte("b"), server.LocalAddr())
+	c.Advance(session.handshake)
+	if got := readPacket(server, 50*time.Millisecond); got != "" {
+		t.Fatalf("packet %q sent during outage", got)
+	}
+	server.WriteTo([]byte("c"), raw.LocalAddr())
+	if got := readPacket(conn, 50*time.Millisecond); got != "" {
+		t.Fatalf("packet %q received during outage", got)
+	}
+}
+
+// waitTraceLines 等待 traceLoop 写出至少 n 行
+func waitTraceLines(t *testing.T, path string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(path)
+		if strings.Count(string(b), "\n") >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("trace has %d lines, want %d:\n%s", strings.Count(string(b), "\n"), n, b)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readPacket 在 timeout 内读取一个报文，超时返回空串
+func readPacket(conn net.PacketConn, timeout time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 64)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
@@ -0,0 +1,240 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// 传输层: 默认 KCP over UDP (与 kcptun 一致)；
+// transport 为 tls 时改用 TCP + TLS 1.3 承载 SMUX，使隧道在中间设备看来与普通 HTTPS 一致。
+// TLS 模式需要服务端在 TLS 终结后直接接入 SMUX (kcptun 服务端不支持)，
+// 此时 crypt/key/FEC/KCP 参数均不生效，由 TLS 负责加密和可靠传输。
+// 默认用标准库 crypto/tls 握手，ClientHello 是 Go 的指纹；tlsfingerprint 选择浏览器时
+// 由 utls 模拟该浏览器的 ClientHello，避免被识别 Go TLS 指纹的中间设备区分出来。
+
+const tlsDialTimeout = 10 * time.Second
+
+// tlsServerName 返回握手使用的 SNI (未配置时使用 remoteaddr 的主机名)
+func tlsServerName(config *Config) string {
+	if config.TLSSNI != "" {
+		return config.TLSSNI
+	}
+	host, _, _ := net.SplitHostPort(config.RemoteAddr)
+	return host
+}
+
+// loadCAPool 加载自定义 CA (cafile 路径和/或 capem 内联 PEM)，都未配置时返回 nil 使用系统 CA
+func loadCAPool(config *Config) (*x509.CertPool, error) {
+	if config.CAFile == "" && config.CAPEM == "" {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in cafile: %s", config.CAFile)
+		}
+	}
+	if config.CAPEM != "" && !pool.AppendCertsFromPEM([]byte(config.CAPEM)) {
+		return nil, errors.New("no certificates in capem")
+	}
+	return pool, nil
+}
+
+// verifyPins 校验证书链中是否有公钥匹配固定指纹，失败时上报 pin-failure 事件
+func verifyPins(config *Config, pins [][]byte, serverName string, certs []*x509.Certificate) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+				return nil
+			}
+		}
+	}
+
+	var got string
+	if len(certs) > 0 {
+		sum := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+		got = base64.StdEncoding.EncodeToString(sum[:])
+	}
+	logErrorf("TLS pin mismatch for %s (got %s)", config.RemoteAddr, got)
+	emitEvent("pin-failure", map[string]interface{}{
+		"remoteaddr": config.RemoteAddr,
+		"sni":        serverName,
+		"got":        got,
+	})
+	return errPinMismatch
+}
+
+var errPinMismatch = errors.New("tls: certificate does not match pinsha256")
+
+// tlsHelloIDs tlsfingerprint 对应的 utls ClientHello (go 使用 crypto/tls，不在表中)
+var tlsHelloIDs = map[string]utls.ClientHelloID{
+	"chrome":             utls.HelloChrome_Auto,
+	"firefox":            utls.HelloFirefox_Auto,
+	"safari":             utls.HelloSafari_Auto,
+	"ios":                utls.HelloIOS_Auto,
+	"edge":               utls.HelloEdge_Auto,
+	tlsFingerprintRandom: randomHelloID(),
+}
+
+// randomHelloID 每次握手随机生成的 ClientHello，总是提供 TLS 1.3 和 ALPN；
+// 提供 X25519MLKEM768 时总是附带其 key share，否则服务端选择该组会触发 utls 不支持的 HelloRetryRequest
+func randomHelloID() utls.ClientHelloID {
+	weights := utls.DefaultWeights
+	weights.TLSVersMax_Set_VersionTLS13 = 1
+	weights.CurveIDs_Append_X25519 = 1
+	weights.KeyShare_Append_RandomGroups = 1
+	id := utls.HelloRandomizedALPN
+	id.Weights = &weights
+	return id
+}
+
+// dialTLS 建立 TLS 1.3 连接，返回连接和握手耗时 (作为 RTT 估计)
+// 配置 pinsha256 时要求证书链中有公钥匹配，不匹配直接失败 (不回退)
+func dialTLS(config *Config) (net.Conn, time.Duration, error) {
+	roots, err := loadCAPool(config)
+	if err != nil {
+		return nil, 0, err
+	}
+	pins, err := parsePins(config.PinSHA256)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsDialTimeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	if config.Network != 0 {
+		if dialer, err = networkDialer(config.Network); err != nil {
+			return nil, 0, err
+		}
+	}
+	start := clk.Now()
+	raw, err := dialer.DialContext(ctx, "tcp", prefetchedAddr(config, config.RemoteAddr))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var conn net.Conn
+	if config.TLSFingerprint == tlsFingerprintGo {
+		conn, err = goHandshake(ctx, raw, config, roots, pins)
+	} else {
+		conn, err = utlsHandshake(ctx, raw, config, roots, pins)
+	}
+	if err != nil {
+		raw.Close()
+		return nil, 0, err
+	}
+	return conn, clk.Since(start), nil
+}
+
+// goHandshake 用 crypto/tls 完成握手
+func goHandshake(ctx context.Context, raw net.Conn, config *Config, roots *x509.CertPool, pins [][]byte) (*tls.Conn, error) {
+	tlsConfig := &tls.Config{
+		ServerName: tlsServerName(config),
+		NextProtos: tlsALPN(config.TLSALPN),
+		MinVersion: tls.VersionTLS13,
+		RootCAs:    roots,
+	}
+	if len(pins) > 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(config, pins, cs.ServerName, cs.PeerCertificates)
+		}
+	}
+	conn := tls.Client(raw, tlsConfig)
+	return conn, conn.HandshakeContext(ctx)
+}
+
+// utlsHandshake 用 utls 模拟 tlsfingerprint 所选浏览器的 ClientHello 完成握手
+// 浏览器指纹的 ALPN 换成 tlsalpn；指纹同时提供 TLS 1.2，因此在握手后检查协商结果为 TLS 1.3
+func utlsHandshake(ctx context.Context, raw net.Conn, config *Config, roots *x509.CertPool, pins [][]byte) (*utls.UConn, error) {
+	tlsConfig := &utls.Config{
+		ServerName: tlsServerName(config),
+		NextProtos: tlsALPN(config.TLSALPN),
+		RootCAs:    roots,
+		VerifyConnection: func(cs utls.ConnectionState) error {
+			if cs.Version != utls.VersionTLS13 {
+				return fmt.Errorf("tls: server negotiated %s, want TLS 1.3", utls.VersionName(cs.Version))
+			}
+			if len(pins) > 0 {
+				return verifyPins(config, pins, cs.ServerName, cs.PeerCertificates)
+			}
+			return nil
+		},
+	}
+
+	id := tlsHelloIDs[config.TLSFingerprint]
+	if config.TLSFingerprint == tlsFingerprintRandom {
+		// 随机指纹直接使用 tlsConfig.NextProtos
+		conn := utls.UClient(raw, tlsConfig, id)
+		return conn, conn.HandshakeContext(ctx)
+	}
+
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = tlsConfig.NextProtos
+		}
+	}
+	conn := utls.UClient(raw, tlsConfig, utls.HelloCustom)
+	if err := conn.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	return conn, conn.HandshakeContext(ctx)
+}
+
+// tlsConnState 返回 TLS 传输协商的版本和 ALPN (crypto/tls 或 utls 连接)
+func tlsConnState(link net.Conn) (version uint16, alpn string, ok bool) {
+	switch c := link.(type) {
+	case *tls.Conn:
+		state := c.ConnectionState()
+		return state.Version, state.NegotiatedProtocol, true
+	case *utls.UConn:
+		state := c.ConnectionState()
+		return state.Version, state.NegotiatedProtocol, true
+	}
+	return 0, "", false
+}
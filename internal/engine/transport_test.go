@@ -0,0 +1,154 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigTLSFingerprint(t *testing.T) {
+	config, err := parseConfig(`{"remoteaddr": "203.0.113.1:443", "transport": "tls"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TLSFingerprint != tlsFingerprintGo {
+		t.Errorf("default tlsfingerprint %q", config.TLSFingerprint)
+	}
+	for configJson, ok := range map[string]bool{
+		`{"remoteaddr": "203.0.113.1:443", "transport": "tls", "tlsfingerprint": "chrome"}`: true,
+		`{"remoteaddr": "203.0.113.1:443", "transport": "tls", "tlsfingerprint": "random"}`: true,
+		`{"remoteaddr": "203.0.113.1:443", "transport": "tls", "tlsfingerprint": "opera"}`:  false,
+		`{"remoteaddr": "203.0.113.1:443", "tlsfingerprint": "chrome"}`:                     false,
+		`{"remoteaddr": "203.0.113.1:443", "tlsfingerprint": "go"}`:                         true,
+	} {
+		if _, err := parseConfig(configJson); (err == nil) != ok {
+			t.Errorf("parseConfig(%s): %v", configJson, err)
+		}
+	}
+}
+
+// isGREASE RFC 8701 的 GREASE 取值 (浏览器会发送，crypto/tls 不会)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func TestDialTLSFingerprint(t *testing.T) {
+	s := newTestTunnel(t)
+	s.down()
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	s.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	s.tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		hellos <- hello
+		return nil, nil
+	}
+	s.up()
+
+	dial := func(extra map[string]interface{}) (*tls.ClientHelloInfo, error) {
+		t.Helper()
+		config, err := parseConfig(s.config("127.0.0.1:0", extra))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, _, err := dialTLS(config)
+		hello := <-hellos
+		if err != nil {
+			return hello, err
+		}
+		defer conn.Close()
+		version, alpn, ok := tlsConnState(conn)
+		if !ok || version != tls.VersionTLS13 || alpn != "h2" {
+			t.Errorf("%v: negotiated %s %q", extra, tls.VersionName(version), alpn)
+		}
+		return hello, nil
+	}
+
+	goHello, err := dial(map[string]interface{}{"tlsalpn": "h2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, suite := range goHello.CipherSuites {
+		if isGREASE(suite) {
+			t.Errorf("go fingerprint sent GREASE %#04x", suite)
+		}
+	}
+	for fp := range tlsFingerprints {
+		if fp == tlsFingerprintGo {
+			continue
+		}
+		// 随机指纹每次不同，多试几次
+		tries := 1
+		if fp == tlsFingerprintRandom {
+			tries = 50
+		}
+		for i := 0; i < tries; i++ {
+			hello, err := dial(map[string]interface{}{"tlsalpn": "h2", "tlsfingerprint": fp})
+			if err != nil {
+				t.Errorf("%s: %v", fp, err)
+				break
+			}
+			if !reflect.DeepEqual(hello.SupportedProtos, []string{"h2"}) {
+				t.Errorf("%s: ALPN %q, want tlsalpn", fp, hello.SupportedProtos)
+			}
+			if fp != tlsFingerprintRandom && reflect.DeepEqual(hello.CipherSuites, goHello.CipherSuites) {
+				t.Errorf("%s: ClientHello cipher suites match crypto/tls", fp)
+			}
+		}
+	}
+
+	chrome, err := dial(map[string]interface{}{"tlsalpn": "h2", "tlsfingerprint": "chrome"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chrome.CipherSuites) == 0 || !isGREASE(chrome.CipherSuites[0]) {
+		t.Errorf("chrome fingerprint without GREASE: %#04x", chrome.CipherSuites)
+	}
+
+	// 固定证书指纹对 utls 同样生效
+	cert, err := x509.ParseCertificate(s.tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	if _, err := dial(map[string]interface{}{"tlsalpn": "h2", "tlsfingerprint": "firefox", "pinsha256": pin}); err != nil {
+		t.Errorf("matching pin: %v", err)
+	}
+	wrong := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	if _, err := dial(map[string]interface{}{"tlsalpn": "h2", "tlsfingerprint": "firefox", "pinsha256": wrong}); !errors.Is(err, errPinMismatch) {
+		t.Errorf("wrong pin: %v", err)
+	}
+
+	// 浏览器指纹同时提供 TLS 1.2，服务端只支持 TLS 1.2 时必须拒绝
+	s.down()
+	s.tlsConfig.MaxVersion = tls.VersionTLS12
+	s.up()
+	if _, err := dial(map[string]interface{}{"tlsfingerprint": "chrome"}); err == nil {
+		t.Error("chrome fingerprint accepted TLS 1.2")
+	}
+}
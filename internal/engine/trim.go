@@ -0,0 +1,148 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 内存压力下的流回收: App 收到 onTrimMemory/didReceiveMemoryWarning 时调用 TrimMemory，
+// 或配置 memorybudget 后由内存监控在堆占用超出预算时触发；
+// 按 trimpolicy 选出受害流并关闭，每条发送 "stream-trimmed" 事件，避免系统直接杀掉整个进程
+//   - bulk: 累计流量最大的流优先 (批量下载占用的缓冲区最多)
+//   - idle: 空闲最久的流优先
+//   - oldest: 建立最早的流优先
+
+const (
+	memoryCheckInterval = 10 * time.Second
+	memoryTrimCooldown  = 30 * time.Second // 两次预算触发的回收之间的最短间隔
+)
+
+// Android ComponentCallbacks2 的 TRIM_MEMORY_* 级别
+const (
+	trimRunningLow      = 10
+	trimRunningCritical = 15
+)
+
+var trimPolicies = map[string]func(a, b *streamInfo) bool{
+	"bulk": func(a, b *streamInfo) bool {
+		return atomic.LoadUint64(&a.bytesUp)+atomic.LoadUint64(&a.bytesDown) >
+			atomic.LoadUint64(&b.bytesUp)+atomic.LoadUint64(&b.bytesDown)
+	},
+	"idle": func(a, b *streamInfo) bool {
+		return atomic.LoadInt64(&a.lastActive) < atomic.LoadInt64(&b.lastActive)
+	},
+	"oldest": func(a, b *streamInfo) bool {
+		return a.start.Before(b.start)
+	},
+}
+
+// TrimMemory 按内存压力级别回收流 (level 使用 Android 的 TRIM_MEMORY_* 值，iOS 内存警告可传 15)
+// RUNNING_LOW (10) 关闭约 1/4 的流，RUNNING_CRITICAL (15) 及以上关闭约一半；
+// 任何级别都会把空闲内存归还给系统
+// 返回空字符串表示成功，否则返回错误信息
+func TrimMemory(level int) string {
+	proxyMu.Lock()
+	config := proxyConfig
+	running := proxyRunning()
+	proxyMu.Unlock()
+
+	if running {
+		switch {
+		case level >= trimRunningCritical:
+			trimStreams(config, 2, fmt.Sprintf("trim-level-%d", level))
+		case level >= trimRunningLow:
+			trimStreams(config, 4, fmt.Sprintf("trim-level-%d", level))
+		}
+	}
+	debug.FreeOSMemory()
+	return ""
+}
+
+// trimStreams 按策略关闭约 1/div 的活动流，返回关闭的数量
+func trimStreams(config *Config, div int, cause string) int {
+	streamsMu.Lock()
+	list := make([]*streamInfo, 0, len(activeStreams))
+	for _, s := range activeStreams {
+		if s.kill != nil {
+			list = append(list, s)
+		}
+	}
+	streamsMu.Unlock()
+	if len(list) == 0 {
+		return 0
+	}
+
+	sort.Slice(list, func(i, j int) bool { return trimPolicies[config.TrimPolicy](list[i], list[j]) })
+	n := (len(list) + div - 1) / div
+	for _, s := range list[:n] {
+		atomic.StoreInt32(&s.trimmed, 1)
+		s.kill()
+		emitEvent("stream-trimmed", map[string]interface{}{
+			"id":        s.id,
+			"target":    s.getTarget(),
+			"bytesup":   atomic.LoadUint64(&s.bytesUp),
+			"bytesdown": atomic.LoadUint64(&s.bytesDown),
+			"policy":    config.TrimPolicy,
+			"cause":     cause,
+		})
+	}
+	log.Printf("Memory trim (%s): closed %d/%d streams by %s", cause, n, len(list), config.TrimPolicy)
+	return n
+}
+
+// memoryLoop 堆占用超出 memorybudget 时回收流
+func memoryLoop(config *Config, stop chan struct{}) {
+	budget := uint64(config.MemoryBudget) << 20
+	ticker := clk.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+
+	var lastTrim time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.Chan():
+		}
+
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		used := ms.HeapInuse + ms.StackInuse
+		if used <= budget || clk.Since(lastTrim) < memoryTrimCooldown {
+			continue
+		}
+		lastTrim = clk.Now()
+
+		emitEvent("memory-pressure", map[string]interface{}{"used": used, "budget": budget})
+		trimStreams(config, 4, "budget")
+		debug.FreeOSMemory()
+	}
+}
@@ -0,0 +1,158 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// 大流量调优:
+//   - bdpbuffers: 按窗口可支撑的最大 BDP (rcvwnd×mtu) 设置未配置的 sockbuf/smuxbuf/streambuf
+//   - autostreambuf: 新建会话时把流窗口 (streambuf) 放大到测得的 BDP (峰值吞吐×RTT) 的两倍，不超过 smuxbuf
+//   - autofec: 按测得的重传率给出建议的 FEC 分片 (FEC 参数需与服务端一致，只建议不自动修改)，
+//     建议变化时发送 "fec-advice" 事件
+
+const (
+	bdpDecay    = 0.9 // 峰值 BDP 每个采样周期的衰减
+	fecLossEWMA = 0.2 // 重传率平滑系数
+)
+
+var measuredBDP uint64 // 峰值 BDP 字节 (按 bdpDecay 衰减)
+
+// sampleBDP 以各会话的平滑吞吐×RTT 更新峰值 BDP
+func sampleBDP() {
+	var peak float64
+	proxyMu.Lock()
+	for _, s := range proxySessions {
+		if s.alive() {
+			peak = math.Max(peak, s.balance.goodput*float64(s.srtt())/1000)
+		}
+	}
+	proxyMu.Unlock()
+
+	old := float64(atomic.LoadUint64(&measuredBDP)) * bdpDecay
+	atomic.StoreUint64(&measuredBDP, uint64(math.Max(old, peak)))
+}
+
+// streamBufFor 新建会话使用的流窗口
+func streamBufFor(config *Config) int {
+	if !config.AutoStreamBuf {
+		return config.StreamBuf
+	}
+	want := int(2 * atomic.LoadUint64(&measuredBDP))
+	return minInt(maxInt(config.StreamBuf, want), config.SmuxBuf)
+}
+
+// fecAdvice 按重传率建议的 FEC 分片
+type fecAdvice struct {
+	Loss        float64 `json:"loss"` // 平滑后的重传率
+	DataShard   int     `json:"datashard"`
+	ParityShard int     `json:"parityshard"`
+}
+
+var (
+	fecMu     sync.Mutex
+	fecLoss   float64
+	fecLossOK bool
+	fecLast   fecAdvice
+)
+
+// recommendFEC 重传率对应的分片: 丢包很少时关闭 FEC，越高校验分片越多
+func recommendFEC(loss float64) (data, parity int) {
+	switch {
+	case loss < 0.005:
+		return 0, 0
+	case loss < 0.02:
+		return 10, 1
+	case loss < 0.05:
+		return 10, 2
+	case loss < 0.10:
+		return 10, 3
+	default:
+		return 10, 5
+	}
+}
+
+// sampleFEC 按最近一次质量采样的重传率更新建议
+func sampleFEC(config *Config) {
+	if !config.AutoFEC {
+		return
+	}
+	quality.mu.Lock()
+	loss, ok := quality.loss, quality.valid
+	quality.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	fecMu.Lock()
+	if !fecLossOK {
+		fecLoss, fecLossOK = loss, true
+	} else {
+		fecLoss += fecLossEWMA * (loss - fecLoss)
+	}
+	data, parity := recommendFEC(fecLoss)
+	advice := fecAdvice{Loss: fecLoss, DataShard: data, ParityShard: parity}
+	changed := data != fecLast.DataShard || parity != fecLast.ParityShard
+	fecLast = advice
+	fecMu.Unlock()
+
+	p := effectiveParams(config)
+	if !changed || (data == p.DataShard && parity == p.ParityShard) || (parity == 0 && p.ParityShard == 0) {
+		return
+	}
+	log.Printf("FEC advice: loss %.2f%%, suggest datashard %d parityshard %d", fecLoss*100, data, parity)
+	emitEvent("fec-advice", map[string]interface{}{
+		"loss":        fecLoss,
+		"datashard":   data,
+		"parityshard": parity,
+		"current":     map[string]int{"datashard": p.DataShard, "parityshard": p.ParityShard},
+	})
+}
+
+// currentFECAdvice 最近的建议 (未开启或尚未采样时为 nil)
+func currentFECAdvice(config *Config) *fecAdvice {
+	if !config.AutoFEC {
+		return nil
+	}
+	fecMu.Lock()
+	defer fecMu.Unlock()
+	if !fecLossOK {
+		return nil
+	}
+	a := fecLast
+	return &a
+}
+
+// resetTuning 启动时清空测量值
+func resetTuning() {
+	atomic.StoreUint64(&measuredBDP, 0)
+	fecMu.Lock()
+	fecLoss, fecLossOK, fecLast = 0, false, fecAdvice{}
+	fecMu.Unlock()
+}
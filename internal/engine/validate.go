@@ -0,0 +1,539 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 各功能的配置校验。本文件与 configparse.go 等配置代码不引用网络代码，
+// 网页端 (js/wasm) 只编译这部分，运行时代码以 //go:build !js 排除
+
+// 配置项的取值
+const (
+	// transport
+	transportKCP = "kcp"
+	transportTLS = "tls"
+
+	// tlsfingerprint (见 transport.go)
+	tlsFingerprintGo     = "go"
+	tlsFingerprintRandom = "random"
+
+	// serverselect
+	serverSelectRank     = "rank"
+	serverSelectWeighted = "weighted"
+
+	// fecup/fecdown
+	fecDirOn   = "on"
+	fecDirOff  = "off"
+	fecDirAuto = "auto"
+
+	// comp
+	compSnappy = "snappy"
+	compZstd   = "zstd"
+
+	// socksresolve (见 socksresolve.go)
+	socksResolveRemote = "remote"
+	socksResolveLocal  = "local"
+	socksResolveRules  = "rules"
+
+	// 按需模式 (见 ondemand.go)
+	onDemandMaxConn = 4 // 未配置 maxconn 时的槽位数
+
+	// bdpbuffers (见 tuning.go)
+	bdpBufMin = 1 << 20 // bdpbuffers 的最小缓冲区
+)
+
+// blockCrypts 支持的 crypt (与 kcptun 客户端一致，加密器由 newBlockCrypt 创建)
+var blockCrypts = map[string]bool{
+	"null": true, "none": true, "sm4": true, "tea": true, "xor": true,
+	"aes": true, "aes-128": true, "aes-192": true, "blowfish": true, "twofish": true,
+	"cast5": true, "3des": true, "xtea": true, "salsa20": true,
+}
+
+// tlsFingerprints 支持的 tlsfingerprint (go 以外由 utls 模拟，见 transport.go 的 tlsHelloIDs)
+var tlsFingerprints = map[string]bool{
+	tlsFingerprintGo: true, "chrome": true, "firefox": true, "safari": true, "ios": true, "edge": true,
+	tlsFingerprintRandom: true,
+}
+
+// useTLS 是否使用 TLS 传输
+func useTLS(config *Config) bool {
+	return config.Transport == transportTLS
+}
+
+// validateTLS 校验 TLS 相关配置 (cafile 在连接时读取)
+func validateTLS(config *Config) error {
+	if !tlsFingerprints[config.TLSFingerprint] {
+		return fmt.Errorf("unknown tlsfingerprint: %s", config.TLSFingerprint)
+	}
+	if config.TLSFingerprint != tlsFingerprintGo && !useTLS(config) {
+		return fmt.Errorf("tlsfingerprint requires tls transport")
+	}
+	if _, err := parsePins(config.PinSHA256); err != nil {
+		return err
+	}
+	if config.CAPEM != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(config.CAPEM)) {
+		return errors.New("no certificates in capem")
+	}
+	return nil
+}
+
+// parsePins 解析逗号分隔的证书公钥 SHA-256 指纹 (base64 或 hex)
+func parsePins(pins string) ([][]byte, error) {
+	var out [][]byte
+	for _, p := range strings.Split(pins, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(sum) != sha256.Size {
+			sum, err = hex.DecodeString(strings.ReplaceAll(p, ":", ""))
+		}
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid pinsha256: %s", p)
+		}
+		out = append(out, sum)
+	}
+	return out, nil
+}
+
+// tlsALPN 解析逗号分隔的 ALPN 列表
+func tlsALPN(alpn string) []string {
+	var protos []string
+	for _, p := range strings.Split(alpn, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			protos = append(protos, p)
+		}
+	}
+	return protos
+}
+
+// validateTrace 校验录制/重放配置并加载重放的轨迹
+func validateTrace(config *Config) error {
+	if config.TraceFile == "" && config.TraceReplay == "" {
+		return nil
+	}
+	if !config.Debug {
+		return fmt.Errorf("tracefile and tracereplay require debug")
+	}
+	if config.TraceReplay == "" {
+		return nil
+	}
+	if config.Transport == transportTLS {
+		return fmt.Errorf("tracereplay requires kcp transport")
+	}
+	t, err := loadTrace(config.TraceReplay)
+	if err != nil {
+		return fmt.Errorf("tracereplay: %v", err)
+	}
+	config.trace = t
+	return nil
+}
+
+var errBadTrace = errors.New("invalid trace file")
+
+// traceSample 轨迹中的一个采样点
+type traceSample struct {
+	at   time.Duration
+	rtt  time.Duration
+	loss float64 // 单向丢包率 (由往返重传率换算)
+}
+
+// netTrace 解析后的轨迹
+type netTrace struct {
+	samples []traceSample
+	outages [][2]time.Duration // 全部会话断开的时段
+}
+
+// loadTrace 读取轨迹文件
+func loadTrace(path string) (*netTrace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &netTrace{}
+	up := make(map[int]bool)
+	var downSince time.Duration = -1
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var ms int64
+		var kind string
+		if _, err := fmt.Sscan(line, &ms, &kind); err != nil {
+			return nil, errBadTrace
+		}
+		at := time.Duration(ms) * time.Millisecond
+		switch kind {
+		case "s":
+			var rtt int64
+			var loss float64
+			if _, err := fmt.Sscanf(line, "%d s %d %g", &ms, &rtt, &loss); err != nil || loss < 0 || loss > 1 {
+				return nil, errBadTrace
+			}
+			t.samples = append(t.samples, traceSample{at: at, rtt: time.Duration(rtt) * time.Millisecond, loss: 1 - math.Sqrt(1-loss)})
+		case "r", "l":
+			var idx int
+			if _, err := fmt.Sscanf(line, "%d "+kind+" %d", &ms, &idx); err != nil {
+				return nil, errBadTrace
+			}
+			up[idx] = kind == "r"
+			down := true
+			for _, ok := range up {
+				down = down && !ok
+			}
+			switch {
+			case down && downSince < 0:
+				downSince = at
+			case !down && downSince >= 0:
+				t.outages = append(t.outages, [2]time.Duration{downSince, at})
+				downSince = -1
+			}
+		default:
+			return nil, errBadTrace
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if downSince >= 0 {
+		t.outages = append(t.outages, [2]time.Duration{downSince, math.MaxInt64})
+	}
+	if len(t.samples) == 0 {
+		return nil, errBadTrace
+	}
+	return t, nil
+}
+
+// alpnPassthrough localtlsalpn 取此值时按客户端提供的协议顺序协商 (选择客户端首选的协议)
+const alpnPassthrough = "passthrough"
+
+// localTLSConfig 构建本地监听的 TLS 配置，未配置证书时返回 nil
+func localTLSConfig(config *Config) (*tls.Config, error) {
+	if config.LocalTLSCert == "" && config.LocalTLSKey == "" {
+		return nil, nil
+	}
+	if config.LocalTLSCert == "" || config.LocalTLSKey == "" {
+		return nil, errors.New("localtlscert and localtlskey must be set together")
+	}
+	cert, err := tls.X509KeyPair([]byte(config.LocalTLSCert), []byte(config.LocalTLSKey))
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.LocalTLSALPN == alpnPassthrough {
+		// 服务端按自身列表顺序匹配，使用客户端的列表即选中客户端首选的协议
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c := tlsConfig.Clone()
+			c.GetConfigForClient = nil
+			c.NextProtos = hello.SupportedProtos
+			return c, nil
+		}
+	} else {
+		tlsConfig.NextProtos = tlsALPN(config.LocalTLSALPN)
+	}
+	return tlsConfig, nil
+}
+
+// validateServerSelect 校验 serverselect
+func validateServerSelect(config *Config) error {
+	switch config.ServerSelect {
+	case serverSelectRank:
+	case serverSelectWeighted:
+		if config.ClientID == "" {
+			return fmt.Errorf("serverselect weighted requires clientid")
+		}
+	default:
+		return fmt.Errorf("unknown serverselect: %s", config.ServerSelect)
+	}
+	return nil
+}
+
+// validateDNSStub 校验 dnsstub 地址
+func validateDNSStub(config *Config) error {
+	if config.DNSStub == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(config.DNSStub); err != nil {
+		return fmt.Errorf("invalid dnsstub: %v", err)
+	}
+	return nil
+}
+
+// validateFECDirs 校验 fecup/fecdown
+func validateFECDirs(config *Config) error {
+	for name, v := range map[string]string{"fecup": config.FECUp, "fecdown": config.FECDown} {
+		switch v {
+		case fecDirOn, fecDirOff, fecDirAuto:
+		default:
+			return fmt.Errorf("invalid %s: %s", name, v)
+		}
+	}
+	return nil
+}
+
+// validateClasses 校验 classshares 和 classports
+func validateClasses(config *Config) error {
+	for class, share := range config.ClassShares {
+		if !labelPattern.MatchString(class) {
+			return fmt.Errorf("invalid class name: %q", class)
+		}
+		if share <= 0 || share > 100 {
+			return fmt.Errorf("classshares %s must be between 1 and 100", class)
+		}
+	}
+	for class, ports := range config.ClassPorts {
+		if !labelPattern.MatchString(class) {
+			return fmt.Errorf("invalid class name: %q", class)
+		}
+		for _, p := range ports {
+			if p <= 0 || p > 65535 {
+				return fmt.Errorf("invalid class port: %d", p)
+			}
+		}
+	}
+	return nil
+}
+
+// onDemandSlots 按需模式的槽位数
+func onDemandSlots(config *Config) int {
+	if config.MaxConn > 0 {
+		return config.MaxConn
+	}
+	return onDemandMaxConn
+}
+
+// validateOnDemand 校验按需模式的配置组合
+func validateOnDemand(config *Config) error {
+	if !config.onDemand {
+		return nil
+	}
+	if len(config.PinnedPorts) > 0 {
+		return fmt.Errorf("pinnedports is not supported with conn 0")
+	}
+	return nil
+}
+
+// validateListenExtra 校验 localaddr 数组中的附加地址
+func validateListenExtra(config *Config) error {
+	for _, addr := range config.listenExtra {
+		if path, ok := unixListenPath(addr); ok {
+			if path == "" {
+				return fmt.Errorf("invalid localaddr: %q has no socket path", addr)
+			}
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid localaddr: %v", err)
+		}
+	}
+	return nil
+}
+
+const unixAddrPrefix = "unix:"
+
+// unixListenPath 解析 "unix:/path" 形式的地址
+func unixListenPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixAddrPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixAddrPrefix), true
+}
+
+// validatePeer 校验点对点配置
+func validatePeer(config *Config) error {
+	if config.Rendezvous == "" {
+		if config.PeerDial != "" || config.PeerServe != "" {
+			return fmt.Errorf("peerdial and peerserve require rendezvous")
+		}
+		return nil
+	}
+	switch {
+	case config.PeerID == "":
+		return fmt.Errorf("rendezvous requires peerid")
+	case (config.PeerDial == "") == (config.PeerServe == ""):
+		return fmt.Errorf("rendezvous requires exactly one of peerdial and peerserve")
+	case useTLS(config) || config.TCP:
+		return fmt.Errorf("rendezvous requires kcp over udp")
+	case config.Comp == compZstd || config.QPP || config.FrameCRC:
+		return fmt.Errorf("rendezvous does not support zstd, qpp or framecrc")
+	case config.PeerDial != "" && config.ControlStream:
+		return fmt.Errorf("peerdial cannot be combined with controlstream")
+	}
+	if _, _, err := net.SplitHostPort(config.Rendezvous); err != nil {
+		return fmt.Errorf("invalid rendezvous: %v", err)
+	}
+	if config.PeerServe != "" {
+		if _, _, err := net.SplitHostPort(config.PeerServe); err != nil {
+			return fmt.Errorf("invalid peerserve: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateMapping 校验 kcplocalport 和 mappedaddr
+func validateMapping(config *Config) error {
+	if config.MappedAddr == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(config.MappedAddr)
+	if err != nil || net.ParseIP(host) == nil || port == "0" {
+		return fmt.Errorf("invalid mappedaddr: %s", config.MappedAddr)
+	}
+	switch {
+	case config.LocalPort == 0:
+		return fmt.Errorf("mappedaddr requires kcplocalport")
+	case !config.ControlStream:
+		return fmt.Errorf("mappedaddr requires controlstream")
+	case useTLS(config) || config.TCP:
+		return fmt.Errorf("mappedaddr requires kcp over udp")
+	}
+	return nil
+}
+
+// validateIdleExempt 校验空闲豁免的端口和域名
+func validateIdleExempt(config *Config) error {
+	for _, p := range config.IdleExemptPorts {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid idle exempt port: %d", p)
+		}
+	}
+	for i, d := range config.IdleExemptDomains {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "."))
+		if d == "" {
+			return fmt.Errorf("invalid idle exempt domain: %q", config.IdleExemptDomains[i])
+		}
+		config.IdleExemptDomains[i] = d
+	}
+	return nil
+}
+
+// validateReplayPorts 校验 replayports
+func validateReplayPorts(config *Config) error {
+	for _, p := range config.ReplayPorts {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid replay port: %d", p)
+		}
+	}
+	return nil
+}
+
+// validatePinnedPorts 校验 pinnedports
+func validatePinnedPorts(config *Config) error {
+	if len(config.PinnedPorts) == 0 {
+		return nil
+	}
+	if config.Conn < 2 {
+		return fmt.Errorf("pinnedports requires conn >= 2")
+	}
+	for _, p := range config.PinnedPorts {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid pinned port: %d", p)
+		}
+	}
+	return nil
+}
+
+// parseSources 解析来源白名单，支持 CIDR 和单个 IP
+func parseSources(sources []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(sources))
+	for _, src := range sources {
+		src = strings.TrimSpace(src)
+		if !strings.Contains(src, "/") {
+			ip := net.ParseIP(src)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source: %s", src)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(src)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source: %s", src)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+const defaultLabel = "default"
+
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// validateLabel 检查实例标签 (未配置时为 "default")
+func validateLabel(label string) error {
+	if !labelPattern.MatchString(label) {
+		return fmt.Errorf("invalid label %q (1-32 chars of letters, digits, '_', '.', '-')", label)
+	}
+	return nil
+}
+
+// applyBDPBuffers 按窗口设置未配置的缓冲区 (在其他默认值之前调用)
+func applyBDPBuffers(config *Config) {
+	if !config.BDPBuffers {
+		return
+	}
+	rcv, mtu := config.RcvWnd, config.MTU
+	if rcv <= 0 {
+		rcv = 512
+	}
+	if mtu <= 0 {
+		mtu = 1350
+	}
+	bdp := minInt(maxInt(rcv*mtu, bdpBufMin), maxBufSize/2)
+	if config.SockBuf <= 0 {
+		config.SockBuf = 2 * bdp
+	}
+	if config.SmuxBuf <= 0 {
+		config.SmuxBuf = 2 * bdp
+	}
+	if config.StreamBuf <= 0 {
+		config.StreamBuf = bdp
+	}
+}
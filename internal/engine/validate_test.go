@@ -0,0 +1,80 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestOptionLists 配置校验使用的取值列表与运行时代码一致
+func TestOptionLists(t *testing.T) {
+	for crypt := range blockCrypts {
+		if _, err := newBlockCrypt(crypt, make([]byte, 32)); err != nil {
+			t.Errorf("crypt %s passes validation but newBlockCrypt fails: %v", crypt, err)
+		}
+	}
+	for policy := range trimPolicies {
+		configJson := fmt.Sprintf(`{"remoteaddr": "203.0.113.1:4000", "trimpolicy": %q}`, policy)
+		if _, err := parseConfig(configJson); err != nil {
+			t.Errorf("trimpolicy %s: %v", policy, err)
+		}
+	}
+	for fp := range tlsFingerprints {
+		if _, ok := tlsHelloIDs[fp]; !ok && fp != tlsFingerprintGo {
+			t.Errorf("tlsfingerprint %s passes validation but has no ClientHello", fp)
+		}
+	}
+	for fp := range tlsHelloIDs {
+		if !tlsFingerprints[fp] {
+			t.Errorf("tlsfingerprint %s is rejected by validation", fp)
+		}
+	}
+	if _, err := parseConfig(`{"remoteaddr": "203.0.113.1:4000", "crypt": "rot13"}`); err == nil {
+		t.Error("unknown crypt accepted")
+	}
+}
+
+// TestWasmDeps 网页端 (js/wasm) 构建不链接网络相关的依赖
+func TestWasmDeps(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go list")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not found")
+	}
+	cmd := exec.Command(gobin, "list", "-deps", "../../wasm")
+	cmd.Env = append(cmd.Environ(), "GOOS=js", "GOARCH=wasm")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go list: %v\n%s", err, out)
+	}
+	for _, pkg := range strings.Fields(string(out)) {
+		if strings.Contains(pkg, ".") && !strings.HasPrefix(pkg, "vendor/") {
+			t.Errorf("wasm depends on %s", pkg)
+		}
+	}
+}
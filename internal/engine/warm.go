@@ -0,0 +1,168 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// 预热流: 每个会话预先打开一条空闲流，服务端收到后即连接转发目标，
+// 用户的下一个连接直接接管这条流，省去服务端拨号目标和首个往返，使用后立即补充。
+// 空闲过久的预热流可能已被目标关闭，定期替换
+
+const (
+	warmCheckInterval = 10 * time.Second
+	warmStreamTTL     = 60 * time.Second // 预热流最长空闲时间
+)
+
+var (
+	statWarmHits    uint64 // 使用了预热流的连接数
+	statWarmMisses  uint64 // 没有可用预热流的连接数
+	statWarmTTFB    uint64 // 使用预热流的连接累计 TTFB (纳秒)
+	statWarmSamples uint64
+	statColdTTFB    uint64 // 未使用预热流的连接累计 TTFB (纳秒)
+	statColdSamples uint64
+)
+
+// warmStats 预热流统计
+type warmStats struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	WarmTTFB int64  `json:"warmttfb"` // 使用预热流的平均 TTFB 毫秒
+	ColdTTFB int64  `json:"coldttfb"` // 未使用预热流的平均 TTFB 毫秒
+	Saved    int64  `json:"saved"`    // 平均节省的 TTFB 毫秒
+}
+
+func snapshotWarm() *warmStats {
+	avg := func(sum, n *uint64) int64 {
+		if n := atomic.LoadUint64(n); n > 0 {
+			return time.Duration(atomic.LoadUint64(sum) / n).Milliseconds()
+		}
+		return 0
+	}
+	w := &warmStats{
+		Hits:     atomic.LoadUint64(&statWarmHits),
+		Misses:   atomic.LoadUint64(&statWarmMisses),
+		WarmTTFB: avg(&statWarmTTFB, &statWarmSamples),
+		ColdTTFB: avg(&statColdTTFB, &statColdSamples),
+	}
+	if w.WarmTTFB > 0 && w.ColdTTFB > 0 {
+		w.Saved = w.ColdTTFB - w.WarmTTFB
+	}
+	return w
+}
+
+// resetWarm 清零预热流统计
+func resetWarm() {
+	for _, c := range []*uint64{&statWarmHits, &statWarmMisses, &statWarmTTFB, &statWarmSamples, &statColdTTFB, &statColdSamples} {
+		atomic.StoreUint64(c, 0)
+	}
+}
+
+// recordWarmTTFB 按是否使用预热流分别记录 TTFB
+func recordWarmTTFB(warm bool, d time.Duration) {
+	if warm {
+		atomic.AddUint64(&statWarmTTFB, uint64(d))
+		atomic.AddUint64(&statWarmSamples, 1)
+	} else {
+		atomic.AddUint64(&statColdTTFB, uint64(d))
+		atomic.AddUint64(&statColdSamples, 1)
+	}
+}
+
+// streamDead 流是否已关闭
+func streamDead(st *smux.Stream) bool {
+	select {
+	case <-st.GetDieCh():
+		return true
+	default:
+		return false
+	}
+}
+
+// refreshWarm 补充预热流，已有的预热流关闭或超过 warmStreamTTL 时替换
+func (s *poolSession) refreshWarm() {
+	if !s.alive() {
+		return
+	}
+
+	s.warmMu.Lock()
+	defer s.warmMu.Unlock()
+	if s.warm != nil {
+		if !streamDead(s.warm) && clk.Since(s.warmAt) < warmStreamTTL {
+			return
+		}
+		s.warm.Close()
+		s.warm = nil
+	}
+	st, err := s.OpenStream()
+	if err != nil {
+		return
+	}
+	s.warm, s.warmAt = st, clk.Now()
+}
+
+// takeWarm 取出预热流 (没有可用的返回 nil)，并在后台补充
+func (s *poolSession) takeWarm() *smux.Stream {
+	s.warmMu.Lock()
+	st, at := s.warm, s.warmAt
+	s.warm = nil
+	s.warmMu.Unlock()
+	go s.refreshWarm()
+
+	if st == nil || streamDead(st) || clk.Since(at) >= warmStreamTTL {
+		if st != nil {
+			st.Close()
+		}
+		atomic.AddUint64(&statWarmMisses, 1)
+		return nil
+	}
+	atomic.AddUint64(&statWarmHits, 1)
+	return st
+}
+
+// warmLoop 定期替换失效的预热流
+func warmLoop(stop chan struct{}) {
+	ticker := clk.NewTicker(warmCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.Chan():
+		}
+
+		proxyMu.Lock()
+		sessions := append([]*poolSession(nil), proxySessions...)
+		proxyMu.Unlock()
+		for _, s := range sessions {
+			s.refreshWarm()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	acceptBusySince  int64  // acceptLoop 开始处理当前连接的时间 (UnixNano)，0 表示空闲
+	acceptCount      uint64 // 已分发的连接数
+	watchdogRestarts uint64 // 看门狗触发的重启次数
+)
+
+// watchdogLoop 看门狗循环
+// 监控 accept 循环和会话池，卡死超过阈值时自动重启实例；
+// 服务端不可达 (新会话建立失败) 时不重启，实例继续运行并由监管协程重连
+func watchdogLoop(config *Config, sup *sessionSupervisor, stop chan struct{}) {
+	threshold := time.Duration(config.Watchdog) * time.Second
+	ticker := clk.NewTicker(threshold / 3)
+	defer ticker.Stop()
+
+	var deadSince time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.Chan():
+		}
+
+		// accept 循环在处理某个连接时卡住 (例如锁被长时间占用)
+		if busy := atomic.LoadInt64(&acceptBusySince); busy != 0 {
+			if stalled := clk.Since(time.Unix(0, busy)); stalled > threshold {
+				if watchdogRestart("accept-wedged", stalled, config, stop) {
+					return
+				}
+			}
+		}
+
+		// 所有会话都已断开 (休眠除外；按需模式没有等待会话的连接时，空闲关闭全部会话是正常状态)
+		alive, ok := aliveSessions()
+		if !ok {
+			continue
+		}
+		if alive > 0 || isHibernating() || (config.onDemand && sup.parkedCount() == 0) {
+			deadSince = time.Time{}
+			continue
+		}
+		if deadSince.IsZero() {
+			deadSince = clk.Now()
+		} else if stalled := clk.Since(deadSince); stalled > threshold {
+			if watchdogRestart("sessions-dead", stalled, config, stop) {
+				return
+			}
+			deadSince = time.Time{}
+		}
+	}
+}
+
+// aliveSessions 返回存活的会话数，锁被占用时 ok 为 false
+func aliveSessions() (alive int, ok bool) {
+	if !proxyMu.TryLock() {
+		return 0, false
+	}
+	defer proxyMu.Unlock()
+
+	for _, session := range proxySessions {
+		if session.alive() {
+			alive++
+		}
+	}
+	return alive, true
+}
+
+// watchdogRestart 发送诊断事件并重启实例，返回 false 表示没有重启，实例继续由本看门狗监控
+// 先在锁外建立新会话，再沿用当前监听切换 (与 UpdateConfig 相同)，重启失败时实例不会停止
+func watchdogRestart(reason string, stalled time.Duration, config *Config, stop chan struct{}) bool {
+	restarts := atomic.AddUint64(&watchdogRestarts, 1)
+	diag := map[string]interface{}{
+		"reason":     reason,
+		"stalled":    stalled.Seconds(),
+		"goroutines": runtime.NumGoroutine(),
+		"accepted":   atomic.LoadUint64(&acceptCount),
+		"sessions":   config.Conn,
+		"restarts":   restarts,
+	}
+	log.Printf("Watchdog: %s for %v, restarting", reason, stalled)
+	emitEvent("watchdog", diag)
+
+	sessions, staged, err := stageSessions(config, sessionDialTimeout)
+	if err != nil {
+		logError("Watchdog: restart skipped, sessions unavailable:", err)
+		emitEvent("watchdog", map[string]interface{}{
+			"reason": "restart-skipped",
+			"error":  err.Error(),
+		})
+		return false
+	}
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	// 实例已被停止或重启，不再处理
+	select {
+	case <-stop:
+		closeStaged(sessions, staged)
+		return true
+	default:
+	}
+
+	_, old, err := swapLocked(config, sessions, staged)
+	if err != nil {
+		logError("Watchdog restart error:", err)
+		emitEvent("watchdog", map[string]interface{}{
+			"reason": "restart-failed",
+			"error":  err.Error(),
+		})
+		// 复制监听失败时实例未受影响，继续监控；否则已恢复运行 (由新实例的看门狗监控) 或已停止
+		return !err.(*restartError).listen
+	}
+	atomic.StoreInt64(&acceptBusySince, 0)
+	for _, s := range old {
+		if s != nil {
+			closeSessionForShutdown(s)
+		}
+	}
+	return true
+}
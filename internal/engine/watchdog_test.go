@@ -0,0 +1,111 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseConfigWatchdog(t *testing.T) {
+	for configJson, want := range map[string]int{
+		`{"remoteaddr": "203.0.113.1:4000"}`:                          30,
+		`{"remoteaddr": "203.0.113.1:4000", "watchdog": 5}`:           5,
+		`{"remoteaddr": "203.0.113.1:4000", "watchdog": -5}`:          -1,
+		`{"remoteaddr": "203.0.113.1:4000", "watchdog": 3600}`:        3600,
+		`{"remoteaddr": "203.0.113.1:4000", "watchdog": 3601}`:        0,
+		`{"remoteaddr": "203.0.113.1:4000", "watchdog": 10000000000}`: 0, // 换算成 Duration 会溢出
+	} {
+		config, err := parseConfig(configJson)
+		if want == 0 {
+			if err == nil {
+				t.Errorf("parseConfig(%s) accepted watchdog %d", configJson, config.Watchdog)
+			}
+			continue
+		}
+		if err != nil || config.Watchdog != want {
+			t.Errorf("parseConfig(%s) = %v, want watchdog %d", configJson, err, want)
+		}
+	}
+}
+
+// TestWatchdogServerDown 服务端中断超过看门狗阈值: 新会话无法建立时不重启，
+// 实例继续运行，服务端恢复后由监管协程重连
+func TestWatchdogServerDown(t *testing.T) {
+	if isolated(t) {
+		return
+	}
+	c := useManualClock(t)
+	srv := newTestTunnel(t)
+	localAddr := freeLocalAddr(t)
+	if err := StartProxy(srv.config(localAddr, map[string]interface{}{"conn": 1, "watchdog": 3})); err != "" {
+		t.Fatal(err)
+	}
+	t.Cleanup(StopProxy)
+
+	// smux 在读错误后要等 keepalive 超时才关闭会话，这里直接关闭
+	srv.down()
+	proxyMu.Lock()
+	for _, s := range proxySessions {
+		s.Close()
+	}
+	proxyMu.Unlock()
+	waitAlive(t, c, func(alive int) bool { return alive == 0 })
+
+	// 看门狗每秒检查一次，连续触发两次说明第一次之后仍在监控
+	base := atomic.LoadUint64(&watchdogRestarts)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&watchdogRestarts) < base+2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("watchdog fired %d times", atomic.LoadUint64(&watchdogRestarts)-base)
+		}
+		c.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !IsRunning() {
+		t.Fatal("proxy stopped after watchdog restart failed")
+	}
+
+	srv.up()
+	waitAlive(t, c, func(alive int) bool { return alive > 0 })
+}
+
+// waitAlive 推进时钟直到存活会话数满足 ok
+func waitAlive(t *testing.T, c *manualClock, ok func(alive int) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		proxyMu.Lock()
+		alive := aliveCount(proxySessions)
+		proxyMu.Unlock()
+		if ok(alive) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions alive", alive)
+		}
+		c.Advance(100 * time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
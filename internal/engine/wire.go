@@ -0,0 +1,193 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// 线路统计: 每个会话的收发包数和包速率 (引擎自建 socket 时统计，外部传入的连接没有)，
+// 以及 FEC 恢复/校验开销，用于判断 datashard/parityshard 是在起作用还是只在消耗流量。
+// kcp-go 的 FEC 计数是进程级的，校验分片发送开销按分片比例估算
+
+const wireSampleInterval = 5 * time.Second
+
+// wireCounter 统计收发包的 PacketConn
+type wireCounter struct {
+	net.PacketConn
+	inPkts, outPkts   uint64
+	inBytes, outBytes uint64
+
+	mu              sync.Mutex
+	lastIn, lastOut uint64
+	lastAt          time.Time
+	inPPS, outPPS   float64
+}
+
+func newWireCounter(conn net.PacketConn) *wireCounter {
+	return &wireCounter{PacketConn: conn, lastAt: clk.Now()}
+}
+
+func (c *wireCounter) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if n > 0 {
+		atomic.AddUint64(&c.inPkts, 1)
+		atomic.AddUint64(&c.inBytes, uint64(n))
+	}
+	return n, addr, err
+}
+
+func (c *wireCounter) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		atomic.AddUint64(&c.outPkts, 1)
+		atomic.AddUint64(&c.outBytes, uint64(n))
+	}
+	return n, err
+}
+
+// sample 按上次采样以来的增量计算包速率
+func (c *wireCounter) sample() {
+	in, out := atomic.LoadUint64(&c.inPkts), atomic.LoadUint64(&c.outPkts)
+	now := clk.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if secs := now.Sub(c.lastAt).Seconds(); secs > 0 {
+		c.inPPS = float64(in-c.lastIn) / secs
+		c.outPPS = float64(out-c.lastOut) / secs
+	}
+	c.lastIn, c.lastOut, c.lastAt = in, out, now
+}
+
+// wire 会话的收发包统计 (没有时为 nil)
+func (s *poolSession) wire() *wireCounter {
+	if bc, ok := s.link.(*boundConn); ok {
+		return bc.wire
+	}
+	return nil
+}
+
+// sampleWire 对所有存活会话的包速率采样
+func sampleWire() {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	for _, s := range proxySessions {
+		if s.alive() {
+			if w := s.wire(); w != nil {
+				w.sample()
+			}
+		}
+	}
+}
+
+// sessionWire 一个会话的线路统计
+type sessionWire struct {
+	Index    int     `json:"index"`
+	InPkts   uint64  `json:"inpkts"`
+	OutPkts  uint64  `json:"outpkts"`
+	InBytes  uint64  `json:"inbytes"`
+	OutBytes uint64  `json:"outbytes"`
+	InPPS    float64 `json:"inpps"`  // 最近采样周期的收包速率
+	OutPPS   float64 `json:"outpps"` // 最近采样周期的发包速率
+}
+
+// sessionWires 存活会话的线路统计 (调用方持有 proxyMu)
+func sessionWires() []sessionWire {
+	var list []sessionWire
+	for i, s := range proxySessions {
+		if !s.alive() {
+			continue
+		}
+		w := s.wire()
+		if w == nil {
+			continue
+		}
+		w.mu.Lock()
+		in, out := w.inPPS, w.outPPS
+		w.mu.Unlock()
+		list = append(list, sessionWire{
+			Index:    i,
+			InPkts:   atomic.LoadUint64(&w.inPkts),
+			OutPkts:  atomic.LoadUint64(&w.outPkts),
+			InBytes:  atomic.LoadUint64(&w.inBytes),
+			OutBytes: atomic.LoadUint64(&w.outBytes),
+			InPPS:    in,
+			OutPPS:   out,
+		})
+	}
+	return list
+}
+
+// fecStats FEC 效果统计
+type fecStats struct {
+	DataShard   int     `json:"datashard"`
+	ParityShard int     `json:"parityshard"`
+	Recovered   uint64  `json:"recovered"`   // 通过 FEC 恢复的段 (进程级)
+	Errors      uint64  `json:"errors"`      // FEC 解码错误
+	ParityIn    uint64  `json:"parityin"`    // 收到的校验分片
+	ShortShards uint64  `json:"shortshards"` // 分片不足无法恢复的次数
+	Overhead    float64 `json:"overhead"`    // 发送中校验分片的比例 parity/(data+parity)
+	ParityOut   uint64  `json:"parityout"`   // 估算的已发送校验分片字节数
+	Usefulness  float64 `json:"usefulness"`  // 每个收到的校验分片恢复的段数
+
+	Advice *fecAdvice `json:"advice,omitempty"` // 按重传率建议的分片 (仅 autofec)
+}
+
+// snapshotFEC FEC 统计 (调用方持有 proxyMu，未启用 FEC 时返回 nil)
+func snapshotFEC(config *Config) *fecStats {
+	p := effectiveParams(config)
+	if p.ParityShard <= 0 {
+		return nil
+	}
+	snmp := kcp.DefaultSnmp.Copy()
+	f := &fecStats{
+		DataShard:   p.DataShard,
+		ParityShard: p.ParityShard,
+		Recovered:   snmp.FECRecovered,
+		Errors:      snmp.FECErrs,
+		ParityIn:    snmp.FECParityShards,
+		ShortShards: snmp.FECShortShards,
+		Overhead:    float64(p.ParityShard) / float64(p.DataShard+p.ParityShard),
+	}
+	var out uint64
+	for _, s := range proxySessions {
+		if w := s.wire(); s.alive() && w != nil {
+			out += atomic.LoadUint64(&w.outBytes)
+		}
+	}
+	f.ParityOut = uint64(float64(out) * f.Overhead)
+	if f.ParityIn > 0 {
+		f.Usefulness = float64(f.Recovered) / float64(f.ParityIn)
+	}
+	f.Advice = currentFECAdvice(config)
+	return f
+}
@@ -0,0 +1,200 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 切换网络 (WiFi <-> 蜂窝) 的瞬间 UDP 写入会短暂返回 ENETUNREACH 等错误，
+// kcp-go 遇到写错误会直接关闭会话。writeGuard 把这类瞬时错误吞掉并缓存数据包，
+// 在宽限期内定时重发；宽限期内恢复则会话不受影响，超时才把错误交给 kcp-go。
+// 注意: 包装后 kcp-go 无法使用 Linux 的批量发送 (sendmmsg)
+
+const (
+	writeRetryInterval = 100 * time.Millisecond
+	writePendingLimit  = 128 // 缓存的数据包上限，超出丢弃最旧的 (KCP 会重传)
+)
+
+var (
+	statWriteTransient uint64 // 瞬时写错误次数
+	statWritePermanent uint64 // 永久写错误次数
+	statWriteRecovered uint64 // 宽限期内恢复的次数
+	statWriteDropped   uint64 // 因缓存满或超时丢弃的数据包数
+)
+
+// writeErrorStats 写错误统计
+type writeErrorStats struct {
+	Transient uint64 `json:"transient"`
+	Permanent uint64 `json:"permanent"`
+	Recovered uint64 `json:"recovered"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+func snapshotWriteErrors() writeErrorStats {
+	return writeErrorStats{
+		Transient: atomic.LoadUint64(&statWriteTransient),
+		Permanent: atomic.LoadUint64(&statWritePermanent),
+		Recovered: atomic.LoadUint64(&statWriteRecovered),
+		Dropped:   atomic.LoadUint64(&statWriteDropped),
+	}
+}
+
+// resetWriteErrors 清零写错误统计
+func resetWriteErrors() {
+	for _, c := range []*uint64{&statWriteTransient, &statWritePermanent, &statWriteRecovered, &statWriteDropped} {
+		atomic.StoreUint64(c, 0)
+	}
+}
+
+// transientWriteError 判断写错误是否可能随网络恢复而消失
+func transientWriteError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.ENETUNREACH, syscall.EHOSTUNREACH, syscall.ENETDOWN, syscall.EADDRNOTAVAIL, syscall.ENOBUFS:
+		return true
+	}
+	return false
+}
+
+type pendingPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// writeGuard 拦截瞬时写错误的 PacketConn
+type writeGuard struct {
+	net.PacketConn
+	grace time.Duration
+
+	mu      sync.Mutex
+	failing time.Time // 本轮瞬时错误开始的时间，零值表示正常
+	lastErr error
+	expired bool // 宽限期已过，之后的写入都返回 lastErr
+	pending []pendingPacket
+}
+
+// guardWrites 按配置包装 PacketConn
+func guardWrites(config *Config, conn net.PacketConn) net.PacketConn {
+	if config.WriteGrace < 0 {
+		return conn
+	}
+	return &writeGuard{PacketConn: conn, grace: time.Duration(config.WriteGrace) * time.Millisecond}
+}
+
+func (g *writeGuard) WriteTo(b []byte, addr net.Addr) (int, error) {
+	g.mu.Lock()
+	if g.expired {
+		err := g.lastErr
+		g.mu.Unlock()
+		return 0, err
+	}
+	if !g.failing.IsZero() {
+		// 正在重试，保持顺序排队
+		g.enqueue(b, addr)
+		g.mu.Unlock()
+		return len(b), nil
+	}
+	g.mu.Unlock()
+
+	n, err := g.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		return n, nil
+	}
+	if !transientWriteError(err) {
+		atomic.AddUint64(&statWritePermanent, 1)
+		metricCount("kcp_write_errors_total", "class=permanent", 1)
+		return n, err
+	}
+
+	atomic.AddUint64(&statWriteTransient, 1)
+	metricCount("kcp_write_errors_total", "class=transient", 1)
+	g.mu.Lock()
+	g.enqueue(b, addr)
+	if g.failing.IsZero() {
+		g.failing = clk.Now()
+		g.lastErr = err
+		logError("UDP write error, retrying:", err)
+		go g.retryLoop()
+	}
+	g.mu.Unlock()
+	return len(b), nil
+}
+
+// enqueue 缓存数据包的副本 (调用方持有 g.mu)
+func (g *writeGuard) enqueue(b []byte, addr net.Addr) {
+	if len(g.pending) >= writePendingLimit {
+		g.pending = g.pending[1:]
+		atomic.AddUint64(&statWriteDropped, 1)
+	}
+	g.pending = append(g.pending, pendingPacket{append([]byte(nil), b...), addr})
+}
+
+// retryLoop 定时重发缓存的数据包，直到全部发出或宽限期结束
+func (g *writeGuard) retryLoop() {
+	ticker := clk.NewTicker(writeRetryInterval)
+	defer ticker.Stop()
+
+	for range ticker.Chan() {
+		g.mu.Lock()
+		for len(g.pending) > 0 {
+			p := g.pending[0]
+			if _, err := g.PacketConn.WriteTo(p.b, p.addr); err != nil {
+				g.lastErr = err
+				break
+			}
+			g.pending = g.pending[1:]
+		}
+
+		switch {
+		case len(g.pending) == 0:
+			log.Printf("UDP writes recovered after %v", clk.Since(g.failing).Round(time.Millisecond))
+			atomic.AddUint64(&statWriteRecovered, 1)
+			metricCount("kcp_write_recovered_total", "", 1)
+			g.failing = time.Time{}
+			g.pending = nil
+			g.mu.Unlock()
+			return
+		case !transientWriteError(g.lastErr) || clk.Since(g.failing) > g.grace:
+			// 连接已关闭、变成永久错误或宽限期已过: 交给 kcp-go 关闭会话
+			logError("UDP write error, giving up:", g.lastErr)
+			atomic.AddUint64(&statWriteDropped, uint64(len(g.pending)))
+			g.expired = true
+			g.pending = nil
+			g.mu.Unlock()
+			return
+		}
+		g.mu.Unlock()
+	}
+}
@@ -0,0 +1,87 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+package engine
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 僵尸会话检测: NAT 映射半失效时 OpenStream 仍能成功 (SYN 帧只需发出)，但服务端的数据再也回不来。
+// 已发送上行数据的流超过 zombiettfb 秒仍未收到首字节记为一次超时，
+// 同一会话连续 zombiecount 次超时 (中间没有任何流收到首字节) 即标记为可疑并先建后拆地重建
+
+// watchTTFB 启动首字节超时检查，返回的定时器在流结束时停止 (未开启检测时返回 nil)
+func watchTTFB(config *Config, info *streamInfo, session *poolSession) clockTimer {
+	if config.ZombieTTFB <= 0 {
+		return nil
+	}
+	return clk.AfterFunc(time.Duration(config.ZombieTTFB)*time.Second, func() {
+		// 客户端还没发数据时服务端可能本就不会回复 (如等待请求)，不计入
+		if atomic.LoadInt64(&info.ttfb) != 0 || atomic.LoadUint64(&info.bytesUp) == 0 {
+			return
+		}
+		session.ttfbTimeout(config)
+	})
+}
+
+// ttfbTimeout 记录一次首字节超时，达到阈值时重建会话
+func (s *poolSession) ttfbTimeout(config *Config) {
+	metricCount("kcp_ttfb_timeouts_total", "", 1)
+	n := atomic.AddInt32(&s.ttfbMisses, 1)
+	if int(n) < config.ZombieCount || !s.alive() {
+		return
+	}
+	// 已不在会话池中 (已被替换或代理已停止) 的会话无从重建，不标记为可疑
+	idx := sessionIndex(s)
+	if idx < 0 || !atomic.CompareAndSwapInt32(&s.suspect, 0, 1) {
+		return
+	}
+
+	proxyMu.Lock()
+	stop := stopChan
+	proxyMu.Unlock()
+
+	log.Printf("Session %d suspect: %d streams without first byte, recycling", idx, n)
+	metricCount("kcp_zombie_sessions_total", "", 1)
+	emitEvent("session-suspect", map[string]interface{}{"index": idx, "timeouts": n})
+	go func() {
+		// 现有流已收不到数据，无需等待它们结束
+		if err := replaceSession(idx, config, stop, 0); err != nil {
+			logErrorf("Session %d recycle: %v", idx, err)
+			// 重建失败时保留旧会话，之后的超时可再次触发
+			atomic.StoreInt32(&s.suspect, 0)
+			atomic.StoreInt32(&s.ttfbMisses, 0)
+		}
+	}()
+}
+
+// ttfbOK 流收到首字节，清零所属会话的连续超时计数
+func (s *poolSession) ttfbOK() {
+	if s != nil && atomic.LoadInt32(&s.ttfbMisses) != 0 {
+		atomic.StoreInt32(&s.ttfbMisses, 0)
+	}
+}
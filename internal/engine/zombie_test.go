@@ -0,0 +1,58 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package engine
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTTFBTimeoutDetached(t *testing.T) {
+	config := unreachableConfig()
+	config.ZombieCount = 2
+	s := pipeSession(t, time.Now())
+
+	// 不在会话池中的会话达到阈值也不能停留在 suspect
+	usePool(t, []*poolSession{pipeSession(t, time.Now())})
+	for i := 0; i < config.ZombieCount+1; i++ {
+		s.ttfbTimeout(config)
+	}
+	if state := s.state(); state == "suspect" {
+		t.Fatalf("detached session state %s", state)
+	}
+
+	// 在会话池中时标记为可疑，重建失败后恢复，之后的超时可再次触发
+	usePool(t, []*poolSession{s})
+	atomic.StoreInt32(&s.ttfbMisses, 0)
+	for i := 0; i < config.ZombieCount; i++ {
+		s.ttfbTimeout(config)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&s.suspect) != 0 || atomic.LoadInt32(&s.ttfbMisses) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("suspect %d, misses %d after failed recycle", atomic.LoadInt32(&s.suspect), atomic.LoadInt32(&s.ttfbMisses))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,297 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// interop 与真实 kcptun 服务端的互通测试: 对加密方式、FEC、SMUX 版本、压缩和 QPP 的组合矩阵，
+// 逐一启动 kcptun 服务端和本库的代理，经隧道向本地回显服务发送随机数据并校验，
+// 用于在新增加密、压缩、QPP 等功能时发现线路格式不兼容。
+//
+// 运行 (找不到 kcptun 服务端时跳过并以 0 退出):
+//
+//	go install github.com/xtaci/kcptun/server@latest
+//	go run ./interop -server $(go env GOPATH)/bin/server
+//
+// 也可以通过环境变量 KCPTUN_SERVER 指定服务端路径
+//
+// -trace 指定设备上以 tracefile 录制的网络轨迹时，代理按轨迹模拟延迟、丢包和断网 (tracereplay)，
+// 在开发机上复现用户报告的网络状况:
+//
+//	go run ./interop -quick -trace user.trace
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"mobilekcp"
+)
+
+const (
+	payloadSize  = 256 * 1024
+	caseTimeout  = 15 * time.Second
+	serverWarmup = 300 * time.Millisecond
+	testKey      = "interop-test-key"
+)
+
+// interopCase 矩阵中的一组参数
+type interopCase struct {
+	Crypt       string
+	DataShard   int
+	ParityShard int
+	SmuxVer     int
+	NoComp      bool
+	QPP         bool
+}
+
+func (c interopCase) String() string {
+	return fmt.Sprintf("crypt=%s fec=%d/%d smuxver=%d nocomp=%v qpp=%v",
+		c.Crypt, c.DataShard, c.ParityShard, c.SmuxVer, c.NoComp, c.QPP)
+}
+
+// matrix 生成测试矩阵，quick 时只测试每个维度各自变化的组合
+func matrix(quick bool) []interopCase {
+	crypts := []string{"aes", "aes-128", "salsa20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor", "sm4", "none"}
+	fecs := [][2]int{{10, 3}, {0, 0}}
+	smuxVers := []int{1, 2}
+	bools := []bool{false, true}
+
+	base := interopCase{Crypt: "aes", DataShard: 10, ParityShard: 3, SmuxVer: 1, NoComp: true}
+	if quick {
+		cases := []interopCase{}
+		for _, crypt := range crypts {
+			c := base
+			c.Crypt = crypt
+			cases = append(cases, c)
+		}
+		c := base
+		c.DataShard, c.ParityShard = 0, 0
+		cases = append(cases, c)
+		c = base
+		c.SmuxVer = 2
+		cases = append(cases, c)
+		c = base
+		c.NoComp = false
+		cases = append(cases, c)
+		c = base
+		c.QPP = true
+		cases = append(cases, c)
+		return cases
+	}
+
+	var cases []interopCase
+	for _, crypt := range crypts {
+		for _, fec := range fecs {
+			for _, v := range smuxVers {
+				for _, noComp := range bools {
+					for _, qpp := range bools {
+						cases = append(cases, interopCase{crypt, fec[0], fec[1], v, noComp, qpp})
+					}
+				}
+			}
+		}
+	}
+	return cases
+}
+
+// freePort 返回一个当前空闲的本地端口
+func freePort(network string) int {
+	if network == "udp" {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer c.Close()
+		return c.LocalAddr().(*net.UDPAddr).Port
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startEcho 启动 TCP 回显服务
+func startEcho() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l, nil
+}
+
+// runCase 运行一组参数，返回 nil 表示互通正常
+func runCase(server string, echo net.Addr, c interopCase, verbose bool, trace string) error {
+	serverPort := freePort("udp")
+	localAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort("tcp")))
+
+	args := []string{
+		"-t", echo.String(),
+		"-l", net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+		"--key", testKey,
+		"--crypt", c.Crypt,
+		"--mode", "fast",
+		"--datashard", strconv.Itoa(c.DataShard),
+		"--parityshard", strconv.Itoa(c.ParityShard),
+		"--smuxver", strconv.Itoa(c.SmuxVer),
+	}
+	if c.NoComp {
+		args = append(args, "--nocomp")
+	}
+	if c.QPP {
+		args = append(args, "--QPP")
+	}
+	cmd := exec.Command(server, args...)
+	if verbose {
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start server: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	time.Sleep(serverWarmup)
+
+	fields := map[string]interface{}{
+		"apiversion":  mobilekcp.GetAPIVersion(),
+		"label":       "interop",
+		"localaddr":   localAddr,
+		"remoteaddr":  net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort)),
+		"key":         testKey,
+		"crypt":       c.Crypt,
+		"mode":        "fast",
+		"datashard":   c.DataShard,
+		"parityshard": c.ParityShard,
+		"smuxver":     c.SmuxVer,
+		"nocomp":      c.NoComp,
+		"qpp":         c.QPP,
+	}
+	if trace != "" {
+		fields["debug"] = true
+		fields["tracereplay"] = trace
+	}
+	config, _ := json.Marshal(fields)
+	if msg := mobilekcp.StartProxy(string(config)); msg != "" {
+		return fmt.Errorf("start proxy: %s", msg)
+	}
+	defer mobilekcp.StopProxy()
+
+	return roundTrip(localAddr)
+}
+
+// roundTrip 经隧道发送随机数据并校验回显
+func roundTrip(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, caseTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(caseTimeout))
+
+	payload := make([]byte, payloadSize)
+	rand.Read(payload)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		errc <- err
+	}()
+
+	got := make([]byte, payloadSize)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("read echo: %v", err)
+	}
+	if err := <-errc; err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		return fmt.Errorf("echo mismatch")
+	}
+	return nil
+}
+
+func main() {
+	server := flag.String("server", os.Getenv("KCPTUN_SERVER"), "kcptun server binary (default $KCPTUN_SERVER)")
+	quick := flag.Bool("quick", false, "vary one dimension at a time instead of the full matrix")
+	verbose := flag.Bool("v", false, "show server and proxy logs")
+	trace := flag.String("trace", "", "replay a recorded network trace through the simulated impairment layer")
+	flag.Parse()
+
+	if *server == "" {
+		*server = "server"
+	}
+	path, err := exec.LookPath(*server)
+	if err != nil {
+		fmt.Println("kcptun server not found, skipping interop tests:", err)
+		return
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	echo, err := startEcho()
+	if err != nil {
+		fmt.Println("echo server:", err)
+		os.Exit(1)
+	}
+	defer echo.Close()
+
+	cases := matrix(*quick)
+	failed := 0
+	for i, c := range cases {
+		start := time.Now()
+		err := runCase(path, echo.Addr(), c, *verbose, *trace)
+		status := "ok"
+		if err != nil {
+			status = "FAIL: " + err.Error()
+			failed++
+		}
+		fmt.Printf("[%d/%d] %-60s %6dms %s\n", i+1, len(cases), c, time.Since(start).Milliseconds(), status)
+	}
+
+	fmt.Printf("%d/%d passed\n", len(cases)-failed, len(cases))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,448 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !js
+
+// Package mobilekcp 是引擎的 gomobile 门面: 只做参数转发，实现位于 internal/engine，
+// gomobile、ffi (C ABI) 和 wasm 共用同一份实现 (wasm 只编译 config.go 中的配置接口)
+package mobilekcp
+
+import "mobilekcp/internal/engine"
+
+// EventListener 事件回调接口 (由 App 实现)
+// eventJson 格式: {"apiversion": 2, "instance": "标签", "type": "...", "time": 毫秒时间戳, "data": {...}}
+type EventListener interface {
+	OnEvent(eventJson string)
+}
+
+// StatsListener 统计回调接口 (由 App 实现)
+type StatsListener interface {
+	OnStats(statsJson string)
+}
+
+// NetworkProtector socket 绑定回调接口 (由 App 实现)
+type NetworkProtector interface {
+	// Protect 将 fd 绑定到 network (Network.getNetworkHandle() 的值)，成功返回 true
+	Protect(fd int, network int64) bool
+}
+
+// RawSocketOptionHook socket 选项回调接口 (由 App 实现)
+type RawSocketOptionHook interface {
+	// OnSocket 设置 fd 的 socket 选项，network 为 "udp4" 或 "udp6"；返回 false 时放弃该 socket，本次建连失败
+	OnSocket(fd int, network string) bool
+}
+
+// MetricsSink 指标后端接口 (可由 App 实现)
+// labels 为逗号分隔的 key=value (如 "reason=timeout")，没有标签时为空
+type MetricsSink interface {
+	Counter(name string, labels string, delta int64)
+	Gauge(name string, labels string, value float64)
+	Histogram(name string, labels string, value float64)
+}
+
+// SetAddrBook 设置地址簿
+// profilesJson: JSON 数组，每项包含 name 和任意配置字段 (至少 remoteaddr)，
+// 如 [{"name": "hk", "remoteaddr": "1.2.3.4:4000", "crypt": "aes"}]
+// 返回空字符串表示成功，否则返回错误信息
+func SetAddrBook(profilesJson string) string {
+	return engine.SetAddrBook(profilesJson)
+}
+
+// GetAddrBook 返回地址簿及最近一次排序结果 (JSON)
+func GetAddrBook() string {
+	return engine.GetAddrBook()
+}
+
+// RankServers 并发探测地址簿中的所有服务器，按丢包和 RTT 排序
+// 返回排序后的地址簿 (JSON)；耗时最多约 rankProbes * rankProbeTimeout
+func RankServers() string {
+	return engine.RankServers()
+}
+
+// NotifyNetworkChanged 报告设备网络状态变化
+// connected: 是否有可用网络；待命中且网络恢复时自动启动代理
+func NotifyNetworkChanged(connected bool) {
+	engine.NotifyNetworkChanged(connected)
+}
+
+// IsArmed 是否处于待命状态 (已配置，等待网络恢复)
+func IsArmed() bool {
+	return engine.IsArmed()
+}
+
+// CheckConnectivity 检测当前网络状态
+// 先直连 (不经过隧道) 请求 url，再通过新建的 KCP 会话探测服务器可达性
+// 返回 JSON: {"result": "open|captive-portal|tunnel-blocked|offline", "direct": {...}, "tunnel": {...}}
+// url 为空时使用默认的 generate_204 地址；代理未运行时只做直连检测
+func CheckConnectivity(url string) string {
+	return engine.CheckConnectivity(url)
+}
+
+// GetTopDestinations 返回按总流量排序的前 n 个目标主机 (JSON)，n <= 0 返回全部
+// 目标从代理握手 (SOCKS5/SOCKS4/HTTP) 中识别，无法识别的连接不计入
+func GetTopDestinations(n int) string {
+	return engine.GetTopDestinations(n)
+}
+
+// DumpState 返回一份完整的运行状态 JSON，便于附在用户的问题反馈中
+// 包括生效配置 (密钥已隐去)、统计、会话列表、最近事件、goroutine 数量和内存统计
+func DumpState() string {
+	return engine.DumpState()
+}
+
+// SetEventListener 设置事件回调，传入 nil 取消
+// 回调在独立 goroutine 中按顺序调用，不会阻塞代理
+func SetEventListener(l EventListener) {
+	engine.SetEventListener(l)
+}
+
+// GetHotspotClients 返回热点模式下各局域网客户端的 JSON 统计
+func GetHotspotClients() string {
+	return engine.GetHotspotClients()
+}
+
+// StartProxy 启动代理服务
+// configJson: JSON 格式的配置字符串
+// 返回空字符串表示成功，否则返回错误信息
+func StartProxy(configJson string) string {
+	return engine.StartProxy(configJson)
+}
+
+// StopProxy 停止代理服务 (待命中时取消待命)
+func StopProxy() {
+	engine.StopProxy()
+}
+
+// UpdateConfig 以新配置替换运行中的实例，不中断现有连接
+// 先用新配置建好会话池再切换，旧会话上的现有连接在 scavengettl 内继续完成；
+// 建立新会话失败时继续使用旧配置；localaddr 或 hotspot 变化时在新地址重新监听，
+// 旧地址上已接受的连接不受影响
+// 返回空字符串表示成功，否则返回错误信息
+func UpdateConfig(configJson string) string {
+	return engine.UpdateConfig(configJson)
+}
+
+// IsRunning 返回代理是否正在运行
+func IsRunning() bool {
+	return engine.IsRunning()
+}
+
+// Pause 通知引擎 App 已进入后台，暂停统计推送等非必要的周期任务
+// 代理本身继续运行
+func Pause() {
+	engine.Pause()
+}
+
+// Resume 通知引擎 App 已回到前台，恢复周期任务
+func Resume() {
+	engine.Resume()
+}
+
+// SetAdvertise 运行时开启或关闭 mDNS 广播
+// 返回空字符串表示成功，否则返回错误信息
+func SetAdvertise(enable bool) string {
+	return engine.SetAdvertise(enable)
+}
+
+// ResetCounters 清零累计统计 (包括持久化文件中的数据)
+func ResetCounters() {
+	engine.ResetCounters()
+}
+
+// MirrorStream 将 GetActiveStreams 中指定 id 的连接镜像 durationMs 毫秒
+// target: "file:/path/to/file" 或 "tcp:host:port"
+// 仅在配置开启 debug 时可用; 返回空字符串表示成功，否则返回错误信息
+func MirrorStream(id int64, target string, durationMs int) string {
+	return engine.MirrorStream(id, target, durationMs)
+}
+
+// SetNetworkProtector 设置 socket 绑定回调，传入 nil 取消
+func SetNetworkProtector(p NetworkProtector) {
+	engine.SetNetworkProtector(p)
+}
+
+// SetRawSocketOptionHook 设置 socket 选项回调，传入 nil 取消
+// KCP 使用的 UDP socket 创建后、发送数据前调用，用于设置 SO_MARK、IP_BOUND_IF 等库未提供的选项
+func SetRawSocketOptionHook(h RawSocketOptionHook) {
+	engine.SetRawSocketOptionHook(h)
+}
+
+// StartProxyWithOverrides 以 configJson 为基础配置，深度合并 overridesJson 后启动代理
+// 适用于 App 保存一份基础配置，每次启动时临时调整个别字段 (如调试日志、端口)
+// 合并顺序: 基础配置 < 环境变量 < overridesJson
+// 返回空字符串表示成功，否则返回错误信息
+func StartProxyWithOverrides(configJson string, overridesJson string) string {
+	return engine.StartProxyWithOverrides(configJson, overridesJson)
+}
+
+// SetPerformanceProfile 设置性能档位
+// profile: "efficiency", "balanced" 或 "performance"
+// 调整 GOMAXPROCS (同时限制调度器自旋线程数) 和会话池锁被占用时的等待方式
+// 返回空字符串表示成功，否则返回错误信息
+func SetPerformanceProfile(profile string) string {
+	return engine.SetPerformanceProfile(profile)
+}
+
+// ClearSecrets 清零所有密钥缓冲区，并丢弃保存的基础配置和地址簿
+// 代理运行中时返回错误 (运行中的会话重连需要密钥)
+// 返回空字符串表示成功，否则返回错误信息
+func ClearSecrets() string {
+	return engine.ClearSecrets()
+}
+
+// SelfCheck 检查启动前提: 配置、本地端口、出站连通 (UDP/TCP)、remoteaddr 解析、系统时钟、可用内存
+// 返回 JSON: {"ok": bool, "checks": [{"name", "status", "code", "message", "params"}]}
+// 配置无效时后续依赖配置的检查标记为 skip
+func SelfCheck(configJson string) string {
+	return engine.SelfCheck(configJson)
+}
+
+// GetSessions 返回会话池中每个会话的 JSON 快照
+func GetSessions() string {
+	return engine.GetSessions()
+}
+
+// GetQualityScore 返回 0~100 的连接质量评分，未运行或尚未采样时返回 -1
+func GetQualityScore() int {
+	return engine.GetQualityScore()
+}
+
+// RunBenchmarks 运行名称包含 filter 的基准 (filter 为空时全部运行，阻塞调用)
+// 仅在使用 bench 构建标签时可用，默认构建返回 {"version", "error"}
+// 返回 JSON: {"version", "goos", "goarch", "cpus", "results": [{"name", "n", "nsop", "mbps", "allocs", "bytesop", "error"}]}
+func RunBenchmarks(filter string) string {
+	return engine.RunBenchmarks(filter)
+}
+
+// RunIntegrityTest 经隧道向服务端回送端发送 sizeMB MB 伪随机数据并逐字节校验 (阻塞调用)
+// 返回 JSON: {"ok", "bytes", "corrupted", "ranges": [{"offset", "length"}], "ms", "mbps", "seed", "burst", "error"}
+// sizeMB 取值 1~1024，需要服务端支持回送
+func RunIntegrityTest(sizeMB int) string {
+	return engine.RunIntegrityTest(sizeMB)
+}
+
+// Drain 停止接受新连接，等待已有连接结束 (阻塞调用，最长 timeoutMs 毫秒)
+// 全部连接在超时前结束时返回空字符串，否则返回错误信息；超时后仍保持排空状态，
+// 直到 CancelDrain、StopProxy 或 UpdateConfig 完成切换
+func Drain(timeoutMs int) string {
+	return engine.Drain(timeoutMs)
+}
+
+// CancelDrain 取消排空，恢复接受新连接
+func CancelDrain() {
+	engine.CancelDrain()
+}
+
+// OwnerHeartbeat 宿主存活心跳，配置 ownertimeout 时需在超时前定期调用
+func OwnerHeartbeat() {
+	engine.OwnerHeartbeat()
+}
+
+// GetStartError 返回最近一次启动失败的诊断 (JSON)，没有失败记录时返回空字符串
+// {"error": "...", "stage": "bind", "hints": [{"code": "port-in-use", "message": "...", "patch": {"localaddr": "127.0.0.1:0"}}]}
+// patch 可直接作为 StartProxyWithOverrides 的 overridesJson 使用
+func GetStartError() string {
+	return engine.GetStartError()
+}
+
+// GetState 返回引擎状态: idle, starting, ready, degraded, reconnecting, draining, stopping
+// 启动和停止期间不等待引擎锁，立即返回
+func GetState() string {
+	return engine.GetState()
+}
+
+// GetStateBlocking 阻塞直到引擎状态与 lastState 不同或超时，返回当前状态
+// 状态与 GetState 相同: idle, starting, ready, degraded, reconnecting, draining, stopping
+// lastState 为空时立即返回；timeoutMs 最长 5 分钟，<= 0 时立即返回当前状态
+func GetStateBlocking(lastState string, timeoutMs int) string {
+	return engine.GetStateBlocking(lastState, timeoutMs)
+}
+
+// GetNotificationStats 返回用于通知栏的摘要，适合每秒轮询:
+// "connected · ↑ 12.0 KB/s ↓ 1.5 MB/s · 320.4 MB · 1:02:03"
+// 依次为状态、上/下行速度、累计总流量和本次运行时长；未运行时只返回状态
+func GetNotificationStats() string {
+	return engine.GetNotificationStats()
+}
+
+// LockProfile 锁定 auto 模式下的档位: "gaming", "download" 或 "balanced"，空字符串解除锁定恢复自动切换
+// 返回空字符串表示成功，否则返回错误信息
+func LockProfile(name string) string {
+	return engine.LockProfile(name)
+}
+
+// RecycleSession 强制重建指定序号的会话
+// 先建立新会话再关闭旧会话，旧会话上的连接会被中断
+// 返回空字符串表示成功，否则返回错误信息
+func RecycleSession(idx int) string {
+	return engine.RecycleSession(idx)
+}
+
+// FlushAll 等待所有会话的发送队列排空，最多等待 timeoutMs 毫秒
+// 用于主动切换网络或 Pause 之前，避免丢失尾部数据
+// kcp-go 不导出发送队列长度，队列排空后再等待两个平滑 RTT 让最后的段得到确认
+// 返回空字符串表示已排空，否则返回错误信息
+func FlushAll(timeoutMs int) string {
+	return engine.FlushAll(timeoutMs)
+}
+
+// ReconnectAll 逐个替换会话池中的所有会话 (先建后拆)
+// 用于用户点击"重连"或认证强制门户之后；新会话建立后才替换旧会话，
+// 旧会话上的现有连接可在 drainTimeout 内继续完成
+// 每个槽位的结果通过 "reconnect" 事件异步返回，全部完成后发送 "reconnect-done"
+// 返回空字符串表示已开始，否则返回错误信息
+func ReconnectAll() string {
+	return engine.ReconnectAll()
+}
+
+// RestartSessions 以当前配置重建 KCP/SMUX 层，本地监听 socket 保持打开
+// 比 StopProxy/StartProxy 快: 本地客户端只有正在转发的连接会断开，重建期间的新连接
+// 留在监听 backlog 中，会话池就绪后立即被接受
+// 成功时发送 "sessions-restarted" 事件；重建失败时代理停止
+// 返回空字符串表示成功，否则返回错误信息
+func RestartSessions() string {
+	return engine.RestartSessions()
+}
+
+// GetStats 返回 JSON 格式的统计快照
+func GetStats() string {
+	return engine.GetStats()
+}
+
+// SetEventBatching 设置事件合并间隔毫秒数
+// flushMs > 0 时第一个事件到达后最多等待 flushMs，把期间的事件 (最多 64 个) 合并为一次回调，
+// OnEvent 收到的是事件的 JSON 数组 "[{...}, {...}]"；flushMs <= 0 恢复逐条回调 (默认)
+func SetEventBatching(flushMs int) {
+	engine.SetEventBatching(flushMs)
+}
+
+// SetStatsListener 按 intervalMs 毫秒间隔推送统计快照
+// l 为 nil 或 intervalMs <= 0 时取消推送; Pause 期间自动暂停
+func SetStatsListener(intervalMs int, l StatsListener) {
+	engine.SetStatsListener(intervalMs, l)
+}
+
+// GetActiveStreams 返回当前转发中的连接列表 (JSON)
+func GetActiveStreams() string {
+	return engine.GetActiveStreams()
+}
+
+// TagNextConnection 为来自本地源端口 srcPort 的下一个连接设置标签 (如 "video-player")
+// 标签在 10 秒内未被使用则失效；tag 为空时取消登记
+// 返回空字符串表示成功，否则返回错误信息
+func TagNextConnection(srcPort int, tag string) string {
+	return engine.TagNextConnection(srcPort, tag)
+}
+
+// RelayEcho 经隧道中继一个 ICMP echo 请求
+// packet 为 TUN 读到的完整 IPv4/IPv6 报文 (ICMP/ICMPv6 echo request)，
+// 返回应写回 TUN 的 echo reply 报文；超时、目标不可达或未启用 icmprelay 时返回 nil (等同丢包)
+// 调用会阻塞到收到回复或 timeoutMs 超时，App 应在独立线程中调用
+func RelayEcho(packet []byte, timeoutMs int) []byte {
+	return engine.RelayEcho(packet, timeoutMs)
+}
+
+// UpdateRules 替换运行中实例的本地路由规则
+// rulesJson: JSON 规则数组，格式与配置中的 rules 相同
+// 返回空字符串表示成功，否则返回错误信息
+func UpdateRules(rulesJson string) string {
+	return engine.UpdateRules(rulesJson)
+}
+
+// TrimMemory 按内存压力级别回收流 (level 使用 Android 的 TRIM_MEMORY_* 值，iOS 内存警告可传 15)
+// RUNNING_LOW (10) 关闭约 1/4 的流，RUNNING_CRITICAL (15) 及以上关闭约一半；
+// 任何级别都会把空闲内存归还给系统
+// 返回空字符串表示成功，否则返回错误信息
+func TrimMemory(level int) string {
+	return engine.TrimMemory(level)
+}
+
+// SetMetricsSink 设置 App 的指标回调后端，传入 nil 取消
+// 回调在记录指标的 goroutine 中同步调用，实现应当快速返回
+func SetMetricsSink(s MetricsSink) {
+	engine.SetMetricsSink(s)
+}
+
+// ExportEngineState 导出监听和会话描述并停止引擎 (不关闭导出的 socket)
+// 返回 JSON: {"apiversion": 2, "version": "...", "listener": fd, "sessions": [{"fd": fd, ...}]}，
+// 失败时返回 {"error": "..."}
+func ExportEngineState() string {
+	return engine.ExportEngineState()
+}
+
+// ImportEngineState 使用旧引擎导出的状态启动代理
+// configJson 与 StartProxy 相同 (导出的状态不包含配置和密钥)
+// 返回空字符串表示成功，否则返回错误信息；无法复用的 fd 会被关闭
+func ImportEngineState(configJson string, stateJson string) string {
+	return engine.ImportEngineState(configJson, stateJson)
+}
+
+// ListInstances 返回所有实例的标签和摘要 (JSON 数组)，没有运行或待命中的实例时返回 []
+func ListInstances() string {
+	return engine.ListInstances()
+}
+
+// Stream App 打开的命名流
+type Stream struct {
+	s *engine.Stream
+}
+
+// OpenNamedStream 在一个存活的会话上打开名为 name 的流 (名称为 1-32 个字母、数字、'_'、'.'、'-')
+// 未运行、名称无效或打开失败时返回 nil。流随会话断开而关闭，之后需重新打开
+func OpenNamedStream(name string) *Stream {
+	s := engine.OpenNamedStream(name)
+	if s == nil {
+		return nil
+	}
+	return &Stream{s: s}
+}
+
+// ID SMUX 流 ID (仅在所属会话内唯一)
+func (s *Stream) ID() int64 {
+	return s.s.ID()
+}
+
+// Name 流名称
+func (s *Stream) Name() string {
+	return s.s.Name()
+}
+
+// Write 发送数据，成功返回空字符串，否则返回错误信息
+func (s *Stream) Write(data []byte) string {
+	return s.s.Write(data)
+}
+
+// Read 读取已到达的数据 (阻塞到有数据或 timeoutMs 超时，最长 5 分钟)
+// 超时返回空数组，流已关闭返回 nil (可用 IsClosed 区分)
+func (s *Stream) Read(timeoutMs int) []byte {
+	return s.s.Read(timeoutMs)
+}
+
+// IsClosed 流是否已关闭 (本地关闭、对端关闭或会话断开)
+func (s *Stream) IsClosed() bool {
+	return s.s.IsClosed()
+}
+
+// Close 关闭流
+func (s *Stream) Close() {
+	s.s.Close()
+}
@@ -0,0 +1,100 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// rendezvous 是点对点隧道 (rendezvous/peerid/peerdial/peerserve 配置) 使用的会合中介的最小实现，
+// 记录每个 ID 最近一次登记时的公网地址和候选地址，双方都登记后向两边各发送一条配对消息。
+// 中介只转发地址，不经过任何隧道数据，可以部署在任意有公网 UDP 端口的机器上:
+//
+//	go run ./rendezvous -listen :3478
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"time"
+)
+
+// peerMessage 与引擎的中介消息对应
+type peerMessage struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Peer       string   `json:"peer,omitempty"`
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+// registration 某个 ID 最近一次登记
+type registration struct {
+	addr       *net.UDPAddr
+	candidates []string
+	seen       time.Time
+}
+
+// expire 登记的有效期 (peerserve 每 15 秒重新登记)
+const expire = time.Minute
+
+func main() {
+	listen := flag.String("listen", ":3478", "UDP address to listen on")
+	flag.Parse()
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("rendezvous listening on", conn.LocalAddr())
+
+	peers := make(map[string]*registration)
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var msg peerMessage
+		if json.Unmarshal(buf[:n], &msg) != nil || msg.Type != "register" || msg.ID == "" {
+			continue
+		}
+		from := addr.(*net.UDPAddr)
+		peers[msg.ID] = &registration{addr: from, candidates: msg.Candidates, seen: time.Now()}
+		if msg.Peer == "" {
+			continue
+		}
+
+		other, ok := peers[msg.Peer]
+		if !ok || time.Since(other.seen) > expire {
+			log.Printf("%s (%s) asked for %s: not registered", msg.ID, from, msg.Peer)
+			continue
+		}
+		// 公网地址放在最前面，其后是对方上报的本地地址 (同一局域网时可直连)
+		send(conn, from, &peerMessage{Type: "peer", ID: msg.Peer, Candidates: append([]string{other.addr.String()}, other.candidates...)})
+		send(conn, other.addr, &peerMessage{Type: "peer", ID: msg.ID, Candidates: append([]string{from.String()}, msg.Candidates...)})
+		log.Printf("paired %s (%s) with %s (%s)", msg.ID, from, msg.Peer, other.addr)
+	}
+}
+
+func send(conn net.PacketConn, addr net.Addr, msg *peerMessage) {
+	b, _ := json.Marshal(msg)
+	if _, err := conn.WriteTo(b, addr); err != nil {
+		log.Println(err)
+	}
+}
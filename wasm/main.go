@@ -0,0 +1,71 @@
+// The MIT License (MIT)
+//
+// # Copyright (c) 2016 xtaci
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build js && wasm
+
+// wasm 将配置校验和规则匹配编译为 WebAssembly，
+// 供网页配置生成器使用与客户端完全相同的校验逻辑；
+// 引擎的网络代码以 //go:build !js 排除，不链接 kcp-go、smux 等依赖
+//
+// 构建:
+//
+//	GOOS=js GOARCH=wasm go build -o mobilekcp.wasm ./wasm
+//
+// 加载后在 globalThis.mobilekcp 上提供:
+//   - validate(configJson) -> ValidateConfigJSON 的结果 JSON
+//   - matchRule(configJson, host) -> MatchRule 的结果 JSON
+//   - exportURI(configJson) -> ExportConfigURI 的结果 JSON
+//   - importURI(uri) -> ImportConfigURI 的结果 JSON
+//   - apiVersion() -> 支持的 JSON API 版本
+//   - version() -> 库版本号
+package main
+
+import (
+	"syscall/js"
+
+	"mobilekcp"
+)
+
+// stringFunc 包装接收字符串参数、返回字符串的函数，缺少参数时按空字符串处理
+func stringFunc(fn func(args []string) string) js.Func {
+	return js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		strs := make([]string, 2)
+		for i := 0; i < len(args) && i < len(strs); i++ {
+			strs[i] = args[i].String()
+		}
+		return fn(strs)
+	})
+}
+
+func main() {
+	api := js.Global().Get("Object").New()
+	api.Set("validate", stringFunc(func(a []string) string { return mobilekcp.ValidateConfigJSON(a[0]) }))
+	api.Set("matchRule", stringFunc(func(a []string) string { return mobilekcp.MatchRule(a[0], a[1]) }))
+	api.Set("exportURI", stringFunc(func(a []string) string { return mobilekcp.ExportConfigURI(a[0]) }))
+	api.Set("importURI", stringFunc(func(a []string) string { return mobilekcp.ImportConfigURI(a[0]) }))
+	api.Set("apiVersion", js.FuncOf(func(js.Value, []js.Value) interface{} { return mobilekcp.GetAPIVersion() }))
+	api.Set("version", js.FuncOf(func(js.Value, []js.Value) interface{} { return mobilekcp.GetVersion() }))
+	js.Global().Set("mobilekcp", api)
+
+	// 保持运行，供 JS 持续调用
+	select {}
+}